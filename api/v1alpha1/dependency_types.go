@@ -34,6 +34,28 @@ type DependencySpec struct {
 	// +kubebuilder:validation:MinLength=1
 	// +kubebuilder:validation:MaxLength=63
 	PolicyName string `json:"policyName"`
+
+	// How the policy is placed among the OpaEngines, overriding the strategy
+	// of the namespace and of the operator
+	// +kubebuilder:validation:Optional
+	Placement *PlacementSpec `json:"placement,omitempty"`
+}
+
+// PlacementSpec selects the OpaEngine receiving the policy of a Dependency
+type PlacementSpec struct {
+	// The placement strategy: FirstFit uses the first engine with room for the
+	// policy, LeastLoaded the engine with the lowest load, BinPacking the engine
+	// with the least estimated memory left and Affinity an engine already
+	// serving the same ServiceName
+	// +kubebuilder:validation:Enum=FirstFit;LeastLoaded;BinPacking;Affinity
+	// +kubebuilder:validation:Optional
+	Strategy string `json:"strategy,omitempty"`
+
+	// The load minimized by LeastLoaded and Affinity: the number of policies
+	// of the engine or the size of their code
+	// +kubebuilder:validation:Enum=Policies;RegoSize
+	// +kubebuilder:validation:Optional
+	LoadMetric string `json:"loadMetric,omitempty"`
 }
 
 // DependencyStatus defines the observed state of Dependency
@@ -41,7 +63,7 @@ type DependencyStatus struct {
 	// +operator-sdk:csv:customresourcedefinitions:type=status
 	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,1,rep,name=conditions"`
 
-	// If the dependency is deployed in EngineName
+	// If the policy and its dependencies are loaded by every engine in EngineName
 	// +kubebuilder:validation:Optional
 	// +kubebuilder:default=false
 	Deployed bool `json:"deployed,omitempty"`
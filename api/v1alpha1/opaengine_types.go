@@ -18,6 +18,7 @@ package v1alpha1
 
 import (
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -46,22 +47,180 @@ type OpaEngineSpec struct {
 	// +kubebuilder:default:={}
 	// +kubebuilder:validation:Optional
 	Policies []string `json:"policies"`
+
+	// The keys signing the bundles served to the OPA engine, the bundles are
+	// not signed if empty
+	// +kubebuilder:validation:Optional
+	Signing *BundleSigning `json:"signing,omitempty"`
+
+	// The capacity of the OPA engine, the limits not set are taken from the
+	// defaults of the operator
+	// +kubebuilder:validation:Optional
+	Capacity *EngineCapacity `json:"capacity,omitempty"`
+
+	// The external authorization mode of the OPA engine, answering the
+	// authorization requests of Envoy through the envoy_ext_authz_grpc
+	// plugin. It requires an opa-envoy image.
+	// +kubebuilder:validation:Optional
+	ExtAuthz *ExtAuthzSpec `json:"extAuthz,omitempty"`
+
+	// The TLS and the authentication of the REST API of the OPA engine,
+	// served over plain HTTP without authentication if not set
+	// +kubebuilder:validation:Optional
+	API *EngineAPISpec `json:"api,omitempty"`
+}
+
+// EngineAPISpec secures the REST API of an OPA engine. The operator uses the
+// same settings to reach the engine.
+type EngineAPISpec struct {
+	// Name of the Secret, in the namespace of the engine, with the certificate
+	// served by OPA in tls.crt and tls.key and the CA that issued it in
+	// ca.crt. The certificate must be valid for the Service of the engine,
+	// <name>.<namespace>.svc. The API is served over plain HTTP if not set.
+	// +kubebuilder:validation:Optional
+	TLSSecretName string `json:"tlsSecretName,omitempty"`
+
+	// The bearer token required by OPA on every request but the health
+	// checks, in a Secret of the namespace of the engine. The API does not
+	// require authentication if not set.
+	// +kubebuilder:validation:Optional
+	TokenSecretRef *corev1.SecretKeySelector `json:"tokenSecretRef,omitempty"`
+}
+
+// ExtAuthzSpec configures the Envoy external authorization plugin of an OPA engine
+type ExtAuthzSpec struct {
+	// The port of the gRPC server of the plugin, exposed by the Service of the engine
+	// +kubebuilder:default:=9191
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=65535
+	// +kubebuilder:validation:Optional
+	Port int32 `json:"port,omitempty"`
+
+	// The path of the decision queried for each request, e.g. envoy/authz/allow
+	// +kubebuilder:default:="envoy/authz/allow"
+	// +kubebuilder:validation:Optional
+	Path string `json:"path,omitempty"`
+
+	// If set, every request is allowed and the decisions are only logged
+	// +kubebuilder:validation:Optional
+	DryRun bool `json:"dryRun,omitempty"`
+}
+
+// EngineCapacity bounds the policies scheduled in an OPA engine. When a
+// policy does not fit in any engine, it is loaded in a new shard of an engine,
+// named after the engine followed by an ordinal.
+type EngineCapacity struct {
+	// The maximum number of policies, including the dependencies
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Optional
+	MaxPolicies *int32 `json:"maxPolicies,omitempty"`
+
+	// The maximum total size of the rego modules of the policies, e.g. "1Mi"
+	// +kubebuilder:validation:Optional
+	MaxRegoBytes *resource.Quantity `json:"maxRegoBytes,omitempty"`
+
+	// The maximum total size of the PolicyData documents of the policies
+	// +kubebuilder:validation:Optional
+	MaxDataBytes *resource.Quantity `json:"maxDataBytes,omitempty"`
+}
+
+// BundleSigning defines the keys signing the bundles served to an OPA engine
+type BundleSigning struct {
+	// Name of the Secret, in the namespace of the engine, holding the keys.
+	// Each key is stored as "<id>.pem", a PEM RSA or EC P-256 private key
+	// signing with RS256 or ES256, or as "<id>.hmac", a secret shared with
+	// OPA signing with HS256. Every key signs a variant of the bundles.
+	// +kubebuilder:validation:MinLength=1
+	SecretName string `json:"secretName"`
+
+	// The id of the key trusted by the OPA engine, required if the Secret
+	// holds more than one key. A new key is rotated in by adding it to the
+	// Secret and making it active, which restarts the engine; the old key can
+	// be removed once the rollout has completed.
+	// +kubebuilder:validation:Optional
+	ActiveKey string `json:"activeKey,omitempty"`
 }
 
 // OpaEngineStatus defines the observed state of OpaEngine
 type OpaEngineStatus struct {
 	// Represent the observations of a OpaEngine's current state
-	// OpaEngine.status.conditions.type are : "Available", "Progressing", "Degraded"
+	// OpaEngine.status.conditions.type are : "Available", "Progressing", "Degraded", "PolicyDrift"
 	// OpaEngine.status.conditions.status are : "True", "False", "Unknown"
 
 	// The expected lists of policies loaded in the OPA engine
 	// +kubebuilder:default:={}
 	Policies []string `json:"policies"`
 
+	// The hash of the code of each loaded policy, used to push again the
+	// policies modified after they were loaded
+	// +kubebuilder:validation:Optional
+	PolicyHashes map[string]string `json:"policyHashes,omitempty"`
+
+	// The state of the policies in each replica of the OPA engine
+	// +kubebuilder:validation:Optional
+	Pods []PodPolicyStatus `json:"pods,omitempty"`
+
+	// The state of the PolicyData documents of the expected policies
+	// +kubebuilder:validation:Optional
+	Data []DataDocumentStatus `json:"data,omitempty"`
+
 	// +operator-sdk:csv:customresourcedefinitions:type=status
 	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type" protobuf:"bytes,1,rep,name=conditions"`
 }
 
+// DataDocumentStatus defines the state of a PolicyData document in the replicas of the OPA engine
+type DataDocumentStatus struct {
+	// Name of the PolicyData
+	Name string `json:"name"`
+
+	// The path of the document under /v1/data
+	Path string `json:"path"`
+
+	// The hash of the value of the document
+	// +kubebuilder:validation:Optional
+	Hash string `json:"hash,omitempty"`
+
+	// If every running replica has loaded the value of the document
+	Synced bool `json:"synced"`
+
+	// The last time the document has been loaded in every running replica
+	// +kubebuilder:validation:Optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// A human readable message describing the last synchronization error
+	// +kubebuilder:validation:Optional
+	Message string `json:"message,omitempty"`
+}
+
+// PodPolicyStatus defines the state of the policies in a replica of the OPA engine
+type PodPolicyStatus struct {
+	// Name of the pod
+	Name string `json:"name"`
+
+	// IP of the pod the policies are pushed to
+	// +kubebuilder:validation:Optional
+	IP string `json:"ip,omitempty"`
+
+	// The policies with every module loaded in the pod
+	// +kubebuilder:validation:Optional
+	Policies []string `json:"policies,omitempty"`
+
+	// The hash of the whole set of modules last loaded in the pod
+	// +kubebuilder:validation:Optional
+	Revision string `json:"revision,omitempty"`
+
+	// If the pod has loaded every expected policy
+	Synced bool `json:"synced"`
+
+	// The last time the policies of the pod have been checked
+	// +kubebuilder:validation:Optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+
+	// A human readable message describing the last synchronization error
+	// +kubebuilder:validation:Optional
+	Message string `json:"message,omitempty"`
+}
+
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
 
@@ -0,0 +1,154 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// OpaEngineSetSpec defines the desired state of OpaEngineSet
+type OpaEngineSetSpec struct {
+	// The template of the OpaEngines of the set
+	// +kubebuilder:validation:Optional
+	Template OpaEngineTemplate `json:"template,omitempty"`
+
+	// The policies loaded by the set. Each policy is loaded with its
+	// dependencies in one of the OpaEngines, and stays there while the set grows.
+	// +kubebuilder:validation:Optional
+	Policies []string `json:"policies,omitempty"`
+
+	// The minimum number of OpaEngines of the set, kept even when empty
+	// +kubebuilder:default:=1
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Optional
+	MinShards *int32 `json:"minShards,omitempty"`
+
+	// The maximum number of OpaEngines of the set, the policies that do not
+	// fit in them are not loaded. Unlimited if not set.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Optional
+	MaxShards *int32 `json:"maxShards,omitempty"`
+}
+
+// OpaEngineTemplate defines the OpaEngines created by an OpaEngineSet
+type OpaEngineTemplate struct {
+	// Image to use for the OPA engines
+	// +kubebuilder:default:value="openpolicyagent/opa:latest-envoy"
+	Image string `json:"image,omitempty"`
+
+	// Number of replicas of each OPA engine
+	// +kubebuilder:default:value=1
+	// +kubebuilder:validation:Minimum=1
+	Replicas int32 `json:"replicas,omitempty"`
+
+	// Resources of each OPA engine
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// The capacity of each OPA engine
+	// +kubebuilder:validation:Optional
+	Capacity *EngineCapacity `json:"capacity,omitempty"`
+
+	// The keys signing the bundles served to the OPA engines
+	// +kubebuilder:validation:Optional
+	Signing *BundleSigning `json:"signing,omitempty"`
+
+	// The external authorization mode of the OPA engines
+	// +kubebuilder:validation:Optional
+	ExtAuthz *ExtAuthzSpec `json:"extAuthz,omitempty"`
+
+	// The TLS and the authentication of the REST API of the OPA engines
+	// +kubebuilder:validation:Optional
+	API *EngineAPISpec `json:"api,omitempty"`
+}
+
+// OpaEngineSetStatus defines the observed state of OpaEngineSet
+type OpaEngineSetStatus struct {
+	// The list of observed conditions
+	// OpaEngineSet.status.conditions.type are : "Ready", "Degraded"
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// The generation of the set last processed by the controller
+	// +kubebuilder:validation:Optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// The number of OpaEngines of the set
+	Shards int32 `json:"shards"`
+
+	// The number of OpaEngines of the set that are available
+	ReadyShards int32 `json:"readyShards"`
+
+	// The number of policies expected in the OpaEngines, with their dependencies
+	Policies int32 `json:"policies"`
+
+	// The number of policies loaded in every replica of their OpaEngine
+	LoadedPolicies int32 `json:"loadedPolicies"`
+
+	// The policies of the set that are not loaded in any OpaEngine
+	// +kubebuilder:validation:Optional
+	UnscheduledPolicies []string `json:"unscheduledPolicies,omitempty"`
+
+	// The state of each OpaEngine of the set
+	// +kubebuilder:validation:Optional
+	Engines []EngineShardStatus `json:"engines,omitempty"`
+}
+
+// EngineShardStatus defines the state of an OpaEngine of an OpaEngineSet
+type EngineShardStatus struct {
+	// Name of the OpaEngine
+	Name string `json:"name"`
+
+	// The ordinal of the OpaEngine in the set
+	Ordinal int32 `json:"ordinal"`
+
+	// The policies expected in the OpaEngine
+	// +kubebuilder:validation:Optional
+	Policies []string `json:"policies,omitempty"`
+
+	// If the OpaEngine is available
+	Ready bool `json:"ready"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Shards",type=integer,JSONPath=`.status.shards`
+// +kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=`.status.readyShards`
+// +kubebuilder:printcolumn:name="Policies",type=integer,JSONPath=`.status.policies`
+// +kubebuilder:printcolumn:name="Loaded",type=integer,JSONPath=`.status.loadedPolicies`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// OpaEngineSet is the Schema for the opaenginesets API
+type OpaEngineSet struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   OpaEngineSetSpec   `json:"spec,omitempty"`
+	Status OpaEngineSetStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// OpaEngineSetList contains a list of OpaEngineSet
+type OpaEngineSetList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []OpaEngineSet `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&OpaEngineSet{}, &OpaEngineSetList{})
+}
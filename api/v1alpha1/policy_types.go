@@ -17,6 +17,7 @@ limitations under the License.
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
@@ -30,22 +31,88 @@ type PolicySpec struct {
 	// +kubebuilder:validation:Optional
 	Rego string `json:"rego,omitzero"`
 
-	// An image url representing an OCI image containing the rego code
+	// An image url representing an OCI image containing the rego code.
+	// The image can be pinned to a digest with the repository@sha256:<digest> form
 	// +kubebuilder:validation:Optional
 	Image string `json:"image,omitzero"`
 
-	// List of policies that dependen on this
-	Dependencies string `json:"dependencies,omitempty"`
+	// Secrets of type kubernetes.io/dockerconfigjson used to pull the image
+	// +kubebuilder:validation:Optional
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+
+	// Policies whose modules are imported by this policy. They are loaded
+	// together with the policy, with their own dependencies, in the same OpaEngine
+	// +kubebuilder:validation:Optional
+	// +listType=map
+	// +listMapKey=name
+	Dependencies []PolicyReference `json:"dependencies,omitempty"`
+}
+
+// PolicyReference identifies a Policy in the same namespace
+type PolicyReference struct {
+	// The name of the Policy
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=63
+	Name string `json:"name"`
 }
 
 // PolicyStatus defines the observed state of Policy
 type PolicyStatus struct {
 	// The list of observer conditions
+	// Policy.status.conditions.type are : "Compiled", "Ready", "ImportsResolved"
 	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// The generation of the policy last processed by the controller
+	// +kubebuilder:validation:Optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// The OpaEngines that currently have the policy loaded
+	// +kubebuilder:validation:Optional
+	Engines []string `json:"engines,omitempty"`
+
+	// The size in bytes of the rego modules of the policy
+	// +kubebuilder:validation:Optional
+	Size int64 `json:"size,omitempty"`
+
+	// The packages defined by the modules of the policy, e.g. data.lib.authz
+	// +kubebuilder:validation:Optional
+	Packages []string `json:"packages,omitempty"`
+
+	// The data documents imported by the modules of the policy
+	// +kubebuilder:validation:Optional
+	Imports []string `json:"imports,omitempty"`
+
+	// The edges of the resolved dependency graph of the policy, including the
+	// ones of its transitive dependencies
+	// +kubebuilder:validation:Optional
+	Dependencies []PolicyDependencyStatus `json:"dependencies,omitempty"`
+}
+
+// PolicyDependencyStatus is an edge of the dependency graph of a policy
+type PolicyDependencyStatus struct {
+	// The policy depending on Name, either this policy or one of its dependencies
+	Policy string `json:"policy"`
+
+	// The policy depended on
+	Name string `json:"name"`
+
+	// If the dependency has been inferred from the imports instead of being
+	// listed in the spec of Policy
+	// +kubebuilder:validation:Optional
+	Inferred bool `json:"inferred,omitempty"`
+
+	// The imports of Policy resolved to the packages of Name
+	// +kubebuilder:validation:Optional
+	Imports []string `json:"imports,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Compiled",type=string,JSONPath=`.status.conditions[?(@.type=="Compiled")].status`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Engines",type=string,JSONPath=`.status.engines`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // Policy is the Schema for the policies API
 type Policy struct {
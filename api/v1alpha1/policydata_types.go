@@ -0,0 +1,119 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PolicyDataSpec defines the desired state of PolicyData
+// +kubebuilder:validation:XValidation:rule="[has(self.value), has(self.configMapRef), has(self.secretRef)].filter(x, x).size() == 1",message="spec must contain exactly one of value, configMapRef or secretRef"
+type PolicyDataSpec struct {
+	// The Policy reading the document, which is loaded in every OpaEngine
+	// loading the policy
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=63
+	PolicyName string `json:"policyName"`
+
+	// The slash separated path of the document under /v1/data, e.g. "roles/admins".
+	// It must not overlap the packages of the policies nor the path of another document.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Pattern=`^[^/]+(/[^/]+)*$`
+	Path string `json:"path"`
+
+	// The document, written as JSON or YAML
+	// +kubebuilder:validation:Optional
+	// +kubebuilder:validation:Schemaless
+	// +kubebuilder:pruning:PreserveUnknownFields
+	Value *apiextensionsv1.JSON `json:"value,omitempty"`
+
+	// A key of a ConfigMap holding the document as JSON or YAML
+	// +kubebuilder:validation:Optional
+	ConfigMapRef *DataSourceRef `json:"configMapRef,omitempty"`
+
+	// A key of a Secret holding the document as JSON or YAML. The document is
+	// not included in the bundles of the injected sidecars.
+	// +kubebuilder:validation:Optional
+	SecretRef *DataSourceRef `json:"secretRef,omitempty"`
+}
+
+// DataSourceRef selects a key of a ConfigMap or a Secret in the namespace of the PolicyData
+type DataSourceRef struct {
+	// Name of the ConfigMap or Secret
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+
+	// The key holding the document
+	// +kubebuilder:validation:MinLength=1
+	Key string `json:"key"`
+}
+
+// PolicyDataStatus defines the observed state of PolicyData
+type PolicyDataStatus struct {
+	// The list of observed conditions
+	// PolicyData.status.conditions.type are : "Resolved", "Ready"
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// The generation of the document last processed by the controller
+	// +kubebuilder:validation:Optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// The hash of the current value of the document
+	// +kubebuilder:validation:Optional
+	Hash string `json:"hash,omitempty"`
+
+	// The size in bytes of the current value of the document
+	// +kubebuilder:validation:Optional
+	Size int64 `json:"size,omitempty"`
+
+	// The OpaEngines that currently have the current value of the document loaded
+	// +kubebuilder:validation:Optional
+	Engines []string `json:"engines,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Policy",type=string,JSONPath=`.spec.policyName`
+// +kubebuilder:printcolumn:name="Path",type=string,JSONPath=`.spec.path`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Engines",type=string,JSONPath=`.status.engines`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// PolicyData is the Schema for the policydata API
+type PolicyData struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	// +kubebuilder:validation:Required
+	Spec   PolicyDataSpec   `json:"spec,omitempty"`
+	Status PolicyDataStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// PolicyDataList contains a list of PolicyData
+type PolicyDataList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PolicyData `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PolicyData{}, &PolicyDataList{})
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"os"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+
+	"github.com/bramba2000/opa-scaler/internal/gateway"
+)
+
+// gatewayCommand is the subcommand running the decision-routing gateway
+const gatewayCommand = "gateway"
+
+// runGateway serves the Data API of OPA in front of the OpaEngines of a
+// namespace, forwarding each query to the engine loading its package
+func runGateway(args []string) {
+	var addr string
+	var namespace string
+	var probeAddr string
+	fs := flag.NewFlagSet(gatewayCommand, flag.ExitOnError)
+	fs.StringVar(&addr, "bind-address", ":8181", "The address the gateway serves the OPA Data API on.")
+	fs.StringVar(&namespace, "namespace", os.Getenv("POD_NAMESPACE"),
+		"The namespace of the OpaEngines behind the gateway, the namespace of the pod by default.")
+	fs.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	opts := zap.Options{
+		Development: true,
+	}
+	opts.BindFlags(fs)
+	_ = fs.Parse(args)
+
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	if namespace == "" {
+		setupLog.Error(nil, "the namespace of the gateway is required")
+		os.Exit(1)
+	}
+
+	// The gateway only reads the Policies, the OpaEngines and the Secrets of
+	// their API in its namespace
+	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+		Scheme:                 scheme,
+		Metrics:                metricsserver.Options{BindAddress: "0"},
+		HealthProbeBindAddress: probeAddr,
+		Cache: cache.Options{
+			DefaultNamespaces: map[string]cache.Config{namespace: {}},
+		},
+	})
+	if err != nil {
+		setupLog.Error(err, "unable to start manager")
+		os.Exit(1)
+	}
+	if err := mgr.Add(gateway.New(addr, namespace, mgr.GetClient())); err != nil {
+		setupLog.Error(err, "unable to set up gateway")
+		os.Exit(1)
+	}
+	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
+		setupLog.Error(err, "unable to set up health check")
+		os.Exit(1)
+	}
+	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
+		setupLog.Error(err, "unable to set up ready check")
+		os.Exit(1)
+	}
+
+	setupLog.Info("starting gateway")
+	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+		setupLog.Error(err, "problem running gateway")
+		os.Exit(1)
+	}
+}
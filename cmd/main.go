@@ -19,16 +19,23 @@ package main
 import (
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
@@ -36,7 +43,12 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
 	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	"github.com/bramba2000/opa-scaler/internal/bundle"
 	"github.com/bramba2000/opa-scaler/internal/controller"
+	"github.com/bramba2000/opa-scaler/internal/oci"
+	"github.com/bramba2000/opa-scaler/internal/scheduler"
+	webhookv1 "github.com/bramba2000/opa-scaler/internal/webhook/v1"
+	webhookv1alpha1 "github.com/bramba2000/opa-scaler/internal/webhook/v1alpha1"
 	// +kubebuilder:scaffold:imports
 )
 
@@ -53,11 +65,26 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == gatewayCommand {
+		runGateway(os.Args[2:])
+		return
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var bundleAddr string
+	var bundleServiceURL string
+	var bundleCertPath string
+	var placement opaspolimiitv1alpha1.PlacementSpec
+	var maxPolicies int
+	var maxRegoBytes, maxDataBytes string
+	var rebalanceInterval time.Duration
+	var rebalanceDryRun bool
+	var sidecarImage string
+	var missingPolicy string
 	var tlsOpts []func(*tls.Config)
 	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to. "+
 		"Use :8443 for HTTPS or :8080 for HTTP, or leave as 0 to disable the metrics service.")
@@ -69,6 +96,30 @@ func main() {
 		"If set, the metrics endpoint is served securely via HTTPS. Use --metrics-secure=false to use HTTP instead.")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.StringVar(&bundleAddr, "bundle-bind-address", ":8082", "The address the bundle server binds to.")
+	flag.StringVar(&bundleServiceURL, "bundle-service-url", "http://opa-scaler-bundle-server.opa-scaler-system.svc:8082",
+		"The url at which the OPA engines download their bundles from the bundle server.")
+	flag.StringVar(&bundleCertPath, "bundle-cert-path", "",
+		"The directory with the tls.crt, tls.key and ca.crt of the bundle server. "+
+			"Leave empty to serve the bundles over plain HTTP.")
+	flag.StringVar(&placement.Strategy, "placement-strategy", scheduler.FirstFit,
+		"The default placement strategy of the Dependencies: FirstFit, LeastLoaded, BinPacking or Affinity.")
+	flag.StringVar(&placement.LoadMetric, "placement-load-metric", scheduler.PolicyCount,
+		"The load minimized by the LeastLoaded and Affinity placement strategies: Policies or RegoSize.")
+	flag.IntVar(&maxPolicies, "engine-max-policies", 7,
+		"The default maximum number of policies of an OpaEngine, 0 for no limit.")
+	flag.StringVar(&maxRegoBytes, "engine-max-rego-bytes", "",
+		"The default maximum size of the rego modules of an OpaEngine, e.g. 1Mi. Empty for no limit.")
+	flag.StringVar(&maxDataBytes, "engine-max-data-bytes", "",
+		"The default maximum size of the PolicyData documents of an OpaEngine, e.g. 16Mi. Empty for no limit.")
+	flag.DurationVar(&rebalanceInterval, "rebalance-interval", 5*time.Minute,
+		"The period between two consolidations of the OpaEngines of a namespace, 0 to disable the rebalancer.")
+	flag.BoolVar(&rebalanceDryRun, "rebalance-dry-run", false,
+		"If set, the rebalancer only reports the planned moves as events of the Dependencies.")
+	flag.StringVar(&sidecarImage, "sidecar-image", "openpolicyagent/opa:latest",
+		"The image of the OPA sidecars injected in the pods annotated with a ServiceName.")
+	flag.StringVar(&missingPolicy, "dependency-missing-policy", webhookv1alpha1.MissingPolicyWarn,
+		"How the webhook admits the Dependencies naming a Policy that does not exist: Warn or Deny.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -77,6 +128,20 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	if _, err := scheduler.New(placement.Strategy, placement.LoadMetric); err != nil {
+		setupLog.Error(err, "invalid default placement")
+		os.Exit(1)
+	}
+	if missingPolicy != webhookv1alpha1.MissingPolicyWarn && missingPolicy != webhookv1alpha1.MissingPolicyDeny {
+		setupLog.Error(fmt.Errorf("unknown value %q", missingPolicy), "invalid dependency-missing-policy")
+		os.Exit(1)
+	}
+	capacity, err := engineCapacity(maxPolicies, maxRegoBytes, maxDataBytes)
+	if err != nil {
+		setupLog.Error(err, "invalid default engine capacity")
+		os.Exit(1)
+	}
+
 	// if the enable-http2 flag is false (the default), http/2 should be disabled
 	// due to its vulnerabilities. More specifically, disabling http/2 will
 	// prevent from being vulnerable to the HTTP/2 Stream Cancellation and
@@ -127,6 +192,11 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "2a6ee251.polimi.it",
+		// The controllers only watch the metadata of the Secrets, so their data
+		// is read from the API server instead of caching every Secret
+		Client: client.Options{
+			Cache: &client.CacheOptions{DisableFor: []client.Object{&corev1.Secret{}}},
+		},
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -144,20 +214,135 @@ func main() {
 		os.Exit(1)
 	}
 
+	puller := oci.NewPuller()
+	bundles := bundle.NewServer(bundleAddr)
+	bundles.CertDir = bundleCertPath
+	bundles.TLSOpts = tlsOpts
+	bundles.ReviewToken = bundle.ServiceAccountReviewer(mgr.GetClient())
+	if err := mgr.Add(bundles); err != nil {
+		setupLog.Error(err, "unable to set up bundle server")
+		os.Exit(1)
+	}
+	var bundleCAFile string
+	if bundleCertPath != "" {
+		bundleCAFile = filepath.Join(bundleCertPath, bundle.CAKey)
+	}
+	// The bundle Service is routed to the pod of the leader, set through the
+	// downward API
+	if podName, podNamespace := os.Getenv("POD_NAME"), os.Getenv("POD_NAMESPACE"); podName != "" && podNamespace != "" {
+		if err := mgr.Add(&bundle.LeaderLabeler{
+			Client:    mgr.GetClient(),
+			Namespace: podNamespace,
+			Name:      podName,
+			Elected:   mgr.Elected(),
+		}); err != nil {
+			setupLog.Error(err, "unable to set up bundle server")
+			os.Exit(1)
+		}
+	} else {
+		setupLog.Info("POD_NAME or POD_NAMESPACE not set, the bundle Service is not routed to the leader")
+	}
 	if err = (&controller.OpaEngineReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
+		Client:           mgr.GetClient(),
+		Scheme:           mgr.GetScheme(),
+		Puller:           puller,
+		Bundles:          bundles,
+		BundleServiceURL: bundleServiceURL,
+		BundleCAFile:     bundleCAFile,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "OpaEngine")
 		os.Exit(1)
 	}
 	if err = (&controller.DependencyReconciler{
+		Client:           mgr.GetClient(),
+		Scheme:           mgr.GetScheme(),
+		DefaultPlacement: placement,
+		DefaultCapacity:  capacity,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Dependency")
+		os.Exit(1)
+	}
+	if err = (&controller.PolicyReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
+		Puller: puller,
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "Dependency")
+		setupLog.Error(err, "unable to create controller", "controller", "Policy")
 		os.Exit(1)
 	}
+	if err = (&controller.PolicyDataReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "PolicyData")
+		os.Exit(1)
+	}
+	if err = (&controller.OpaEngineSetReconciler{
+		Client:          mgr.GetClient(),
+		Scheme:          mgr.GetScheme(),
+		DefaultCapacity: capacity,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "OpaEngineSet")
+		os.Exit(1)
+	}
+	if rebalanceInterval > 0 {
+		if err = (&controller.RebalanceReconciler{
+			Client:          mgr.GetClient(),
+			Scheme:          mgr.GetScheme(),
+			Recorder:        mgr.GetEventRecorderFor("opa-scaler-rebalancer"),
+			Interval:        rebalanceInterval,
+			DryRun:          rebalanceDryRun,
+			DefaultCapacity: capacity,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Rebalance")
+			os.Exit(1)
+		}
+	}
+	if err = (&controller.RouteReconciler{
+		Client: mgr.GetClient(),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Route")
+		os.Exit(1)
+	}
+	if err = (&controller.ServiceBundleReconciler{
+		Client:       mgr.GetClient(),
+		Scheme:       mgr.GetScheme(),
+		Puller:       puller,
+		Bundles:      bundles,
+		BundleCAFile: bundleCAFile,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "ServiceBundle")
+		os.Exit(1)
+	}
+	// nolint:goconst
+	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
+		if err = webhookv1.SetupPodWebhookWithManager(mgr, &webhookv1.PodCustomDefaulter{
+			Image:            sidecarImage,
+			BundleServiceURL: bundleServiceURL,
+			BundleCA:         bundleCAFile != "",
+		}); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Pod")
+			os.Exit(1)
+		}
+		if err = webhookv1alpha1.SetupPolicyWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Policy")
+			os.Exit(1)
+		}
+		// The Policies are read from the API server, so that a Dependency
+		// created right after its Policy is not rejected by a stale cache
+		if err = webhookv1alpha1.SetupDependencyWebhookWithManager(mgr, &webhookv1alpha1.DependencyCustomValidator{
+			Reader:        mgr.GetAPIReader(),
+			MissingPolicy: missingPolicy,
+		}); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Dependency")
+			os.Exit(1)
+		}
+		if err = webhookv1alpha1.SetupOpaEngineWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "OpaEngine")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -175,3 +360,25 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// engineCapacity returns the default capacity of the OpaEngines from the flags
+func engineCapacity(maxPolicies int, maxRegoBytes, maxDataBytes string) (opaspolimiitv1alpha1.EngineCapacity, error) {
+	capacity := opaspolimiitv1alpha1.EngineCapacity{}
+	if maxPolicies > 0 {
+		capacity.MaxPolicies = ptr.To(int32(maxPolicies))
+	}
+	for _, limit := range []struct {
+		value string
+		field **resource.Quantity
+	}{{maxRegoBytes, &capacity.MaxRegoBytes}, {maxDataBytes, &capacity.MaxDataBytes}} {
+		if limit.value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(limit.value)
+		if err != nil {
+			return capacity, err
+		}
+		*limit.field = &quantity
+	}
+	return capacity, nil
+}
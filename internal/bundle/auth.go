@@ -0,0 +1,95 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bundle
+
+import (
+	"context"
+	"crypto/sha256"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ServiceAccountTokenPath is the token of the service account mounted in the
+// pods, with which OPA downloads the bundles without a token
+const ServiceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// reviewTTL is how long the result of a TokenReview is trusted, as OPA
+// downloads its bundle every few seconds with the same token
+const reviewTTL = time.Minute
+
+// TokenReviewer returns the namespace of the service account authenticated
+// by the token, empty if the token is not the one of a service account
+type TokenReviewer func(ctx context.Context, token string) (string, error)
+
+type review struct {
+	namespace string
+	expiry    time.Time
+}
+
+// +kubebuilder:rbac:groups=authentication.k8s.io,resources=tokenreviews,verbs=create
+
+// ServiceAccountReviewer returns a TokenReviewer asking the API server to
+// review the tokens
+func ServiceAccountReviewer(c client.Client) TokenReviewer {
+	var mu sync.Mutex
+	reviews := map[[sha256.Size]byte]review{}
+	return func(ctx context.Context, token string) (string, error) {
+		key := sha256.Sum256([]byte(token))
+		now := time.Now()
+		mu.Lock()
+		cached, ok := reviews[key]
+		mu.Unlock()
+		if ok && now.Before(cached.expiry) {
+			return cached.namespace, nil
+		}
+
+		tr := &authenticationv1.TokenReview{
+			Spec: authenticationv1.TokenReviewSpec{Token: token},
+		}
+		if err := c.Create(ctx, tr); err != nil {
+			return "", err
+		}
+		namespace := ""
+		if tr.Status.Authenticated {
+			namespace = serviceAccountNamespace(tr.Status.User.Username)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		for k, r := range reviews {
+			if !now.Before(r.expiry) {
+				delete(reviews, k)
+			}
+		}
+		reviews[key] = review{namespace: namespace, expiry: now.Add(reviewTTL)}
+		return namespace, nil
+	}
+}
+
+// serviceAccountNamespace returns the namespace in the name of the user of a
+// service account, system:serviceaccount:<namespace>:<name>
+func serviceAccountNamespace(username string) string {
+	parts := strings.Split(username, ":")
+	if len(parts) != 4 || parts[0] != "system" || parts[1] != "serviceaccount" {
+		return ""
+	}
+	return parts[2]
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bundle
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+var _ = Describe("service account reviewer", func() {
+	It("should return the namespace of the service accounts and remember it", func() {
+		reviews := 0
+		c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithInterceptorFuncs(interceptor.Funcs{
+			Create: func(_ context.Context, _ client.WithWatch, obj client.Object, _ ...client.CreateOption) error {
+				tr := obj.(*authenticationv1.TokenReview)
+				reviews++
+				switch tr.Spec.Token {
+				case "orders-sa":
+					tr.Status.Authenticated = true
+					tr.Status.User.Username = "system:serviceaccount:default:orders"
+				case "user":
+					tr.Status.Authenticated = true
+					tr.Status.User.Username = "alice"
+				}
+				return nil
+			},
+		}).Build()
+		review := ServiceAccountReviewer(c)
+
+		for _, token := range []string{"orders-sa", "orders-sa"} {
+			namespace, err := review(context.Background(), token)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(namespace).To(Equal("default"))
+		}
+		Expect(reviews).To(Equal(1))
+
+		for _, token := range []string{"user", "invalid"} {
+			namespace, err := review(context.Background(), token)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(namespace).To(BeEmpty())
+		}
+	})
+})
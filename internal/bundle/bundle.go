@@ -0,0 +1,212 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package bundle builds the OPA bundles of the engines and serves them over
+// HTTP, so that every OPA replica downloads its policies on its own.
+package bundle
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+	opabundle "github.com/open-policy-agent/opa/bundle"
+	"github.com/open-policy-agent/opa/format"
+
+	opamanager "github.com/bramba2000/opa-scaler/internal/opa"
+)
+
+// EmptyRoot is the root owned by a bundle without modules nor data
+const EmptyRoot = "opa_scaler/empty"
+
+// Bundle is the content loaded by the replicas of an engine
+type Bundle struct {
+	// Revision identifies the content, it is written in the manifest and used as ETag
+	Revision string
+	// Modules maps the id of each Rego module to its source
+	Modules map[string]string
+	// Data is the base document loaded with the modules
+	Data map[string]any
+	// Keys sign the bundle, a variant is served for each key so that OPA
+	// instances trusting different keys can coexist. The bundle is not
+	// signed if empty.
+	Keys []*Key
+	// Token is the bearer token required to download the bundle. Without a
+	// token, the bundle is served to the service accounts of its namespace.
+	Token string
+}
+
+// Build returns the bundle as a gzipped tarball. The manifest records the
+// revision, the Rego version of every module and the roots owned by the
+// bundle, which are the packages of the modules and the top level keys of
+// the data, so that the rest of the data can still be written through the
+// REST API. The bundle is signed with the key, if not nil.
+func Build(b *Bundle, key *Key) ([]byte, error) {
+	parsed, err := parseModules(b.Modules)
+	if err != nil {
+		return nil, err
+	}
+
+	data := b.Data
+	if data == nil {
+		data = map[string]any{}
+	}
+	roots := Roots(parsed, data)
+	if len(roots) == 0 {
+		// OPA refuses a manifest without roots, claim a path nobody uses
+		roots = []string{EmptyRoot}
+	}
+	modules, versions, err := moduleFiles(b.Modules, parsed)
+	if err != nil {
+		return nil, err
+	}
+	manifest := opabundle.Manifest{
+		Revision:         b.Revision,
+		Roots:            &roots,
+		FileRegoVersions: versions,
+	}
+
+	built := opabundle.Bundle{
+		Manifest: manifest,
+		Data:     data,
+		Modules:  modules,
+	}
+	if key != nil {
+		signing := opabundle.NewSigningConfig(string(key.Private), key.Algorithm, "")
+		if err := built.GenerateSignature(signing, key.ID, false); err != nil {
+			return nil, fmt.Errorf("unable to sign the bundle with key %s: %w", key.ID, err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := opabundle.NewWriter(&buf).Write(built); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ActivatedModules returns the source of the modules as loaded by OPA once the
+// bundle with the given name is activated, indexed by their id in OPA
+func ActivatedModules(name string, modules map[string]string) (map[string]string, error) {
+	parsed, err := parseModules(modules)
+	if err != nil {
+		return nil, err
+	}
+	files, _, err := moduleFiles(modules, parsed)
+	if err != nil {
+		return nil, err
+	}
+	activated := make(map[string]string, len(files))
+	for _, file := range files {
+		activated[name+file.Path] = string(file.Raw)
+	}
+	return activated, nil
+}
+
+// parseModules parses the modules, failing with the errors of the invalid ones
+func parseModules(modules map[string]string) (map[string]*ast.Module, error) {
+	parsed, regoErrors := opamanager.ParseModules(modules)
+	if len(regoErrors) > 0 {
+		messages := make([]string, 0, len(regoErrors))
+		for _, e := range regoErrors {
+			messages = append(messages, e.String())
+		}
+		return nil, fmt.Errorf("invalid modules: %s", strings.Join(messages, "; "))
+	}
+	return parsed, nil
+}
+
+// moduleFiles returns the files of the modules in the bundle, along with the
+// Rego version of the files written with the v0 syntax
+func moduleFiles(modules map[string]string, parsed map[string]*ast.Module) ([]opabundle.ModuleFile, map[string]int, error) {
+	files := make([]opabundle.ModuleFile, 0, len(parsed))
+	versions := map[string]int{}
+	for _, id := range sortedKeys(modules) {
+		path := ModulePath(id)
+		raw := []byte(modules[id])
+		if parsed[id].RegoVersion() == ast.RegoV1 {
+			// OPA 0.x parses again the active modules with the v0 syntax when
+			// a new revision is activated, ignoring the manifest. The v1
+			// modules are rewritten to be valid with both syntaxes.
+			formatted, err := format.AstWithOpts(parsed[id], format.Opts{RegoVersion: ast.RegoV0CompatV1})
+			if err != nil {
+				return nil, nil, fmt.Errorf("module %s: %w", id, err)
+			}
+			raw = formatted
+		} else {
+			versions[path] = ast.RegoV0.Int()
+		}
+		files = append(files, opabundle.ModuleFile{
+			URL:  path,
+			Path: path,
+			Raw:  raw,
+		})
+	}
+	return files, versions, nil
+}
+
+// ModulePath returns the path of the module with the given id inside the bundle
+func ModulePath(id string) string {
+	path := "/" + strings.TrimPrefix(id, "/")
+	if !strings.HasSuffix(path, ".rego") {
+		path += ".rego"
+	}
+	return path
+}
+
+// Roots returns the smallest set of paths covering the packages of the
+// modules and the top level keys of the data
+func Roots(modules map[string]*ast.Module, data map[string]any) []string {
+	paths := make([]string, 0, len(modules)+len(data))
+	for _, module := range modules {
+		segments := []string{}
+		for _, term := range module.Package.Path[1:] {
+			s, ok := term.Value.(ast.String)
+			if !ok {
+				break
+			}
+			segments = append(segments, string(s))
+		}
+		paths = append(paths, strings.Join(segments, "/"))
+	}
+	for key := range data {
+		paths = append(paths, key)
+	}
+	slices.Sort(paths)
+
+	// Sorting puts the prefixes of a path before it
+	roots := []string{}
+	for _, path := range paths {
+		covered := slices.ContainsFunc(roots, func(root string) bool {
+			return path == root || strings.HasPrefix(path, root+"/")
+		})
+		if !covered {
+			roots = append(roots, path)
+		}
+	}
+	return roots
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bundle
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/open-policy-agent/opa/ast"
+	opabundle "github.com/open-policy-agent/opa/bundle"
+)
+
+var _ = Describe("bundle", func() {
+	It("should build a bundle readable by OPA", func() {
+		tarball, err := Build(&Bundle{
+			Revision: "sha256:abc",
+			Modules: map[string]string{
+				"authz":          "package authz\n\nallow if input.admin\n",
+				"legacy/a.rego":  "package legacy.a\n\nallow { input.admin }\n",
+				"legacy/b.rego":  "package legacy.a.b\n\ndeny := true\n",
+				"other/ab.rego":  "package legacyab\n\nx := 1\n",
+				"nested/x.rego":  "package authz.nested\n\ny := 2\n",
+				"quoted/q.rego":  "package data_with_dash[\"a-b\"]\n\nz := 3\n",
+				"inline-policy2": "package p2\n\nw := 4\n",
+			},
+			Data: map[string]any{"users": map[string]any{"alice": true}},
+		}, nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		b, err := opabundle.NewReader(bytes.NewReader(tarball)).Read()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(b.Manifest.Revision).To(Equal("sha256:abc"))
+		Expect(*b.Manifest.Roots).To(Equal([]string{"authz", "data_with_dash/a-b", "legacy/a", "legacyab", "p2", "users"}))
+		Expect(b.Data).To(HaveKey("users"))
+		Expect(b.Modules).To(HaveLen(7))
+
+		versions := map[string]ast.RegoVersion{}
+		for _, m := range b.Modules {
+			versions[m.Path] = m.Parsed.RegoVersion()
+		}
+		Expect(versions).To(HaveKeyWithValue("/authz.rego", ast.RegoV0CompatV1))
+		Expect(versions).To(HaveKeyWithValue("/legacy/a.rego", ast.RegoV0))
+	})
+
+	It("should return the modules as loaded by OPA", func() {
+		modules, err := ActivatedModules("engine", map[string]string{
+			"authz":         "package authz\n\nallow if input.admin\n",
+			"legacy/a.rego": "package legacy.a\n\nallow { input.admin }\n",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(modules).To(HaveLen(2))
+		Expect(modules).To(HaveKeyWithValue("engine/authz.rego", ContainSubstring("import rego.v1")))
+		Expect(modules).To(HaveKeyWithValue("engine/legacy/a.rego", "package legacy.a\n\nallow { input.admin }\n"))
+	})
+
+	It("should reject invalid modules", func() {
+		_, err := Build(&Bundle{Revision: "r", Modules: map[string]string{"broken": "package"}}, nil)
+		Expect(err).To(MatchError(ContainSubstring("broken")))
+	})
+
+	It("should own a placeholder root when empty", func() {
+		tarball, err := Build(&Bundle{Revision: "r"}, nil)
+		Expect(err).NotTo(HaveOccurred())
+		b, err := opabundle.NewReader(bytes.NewReader(tarball)).Read()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(*b.Manifest.Roots).To(Equal([]string{EmptyRoot}))
+	})
+})
@@ -0,0 +1,97 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bundle
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// LeaderLabel marks the manager pod serving the bundles. The Service of the
+// bundles selects it, so that OPA only downloads from the leader.
+const LeaderLabel = "opas.polimi.it/bundle-server"
+
+// LeaderLabeler sets the LeaderLabel on the pod of the manager once it is
+// elected leader, and removes it when the manager stops
+type LeaderLabeler struct {
+	Client client.Client
+
+	// Namespace and Name identify the pod of the manager
+	Namespace string
+	Name      string
+
+	// Elected is closed when the manager is elected leader
+	Elected <-chan struct{}
+}
+
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=patch
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, as the label
+// of a previous leader must be removed before the election
+func (l *LeaderLabeler) NeedLeaderElection() bool {
+	return false
+}
+
+// Start labels the pod while the manager is the leader, it implements
+// manager.Runnable
+func (l *LeaderLabeler) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("bundle-server")
+
+	// A restarted container keeps the label set when it was the leader
+	if err := l.label(ctx, nil); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-l.Elected:
+	}
+	if err := l.label(ctx, ptr.To("true")); err != nil {
+		return err
+	}
+	logger.Info("Routing the bundle Service to the leader", "Pod", l.Name)
+
+	<-ctx.Done()
+	unlabelCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := l.label(unlabelCtx, nil); err != nil {
+		logger.Error(err, "unable to remove the label of the leader", "Pod", l.Name)
+	}
+	return nil
+}
+
+// label sets the LeaderLabel of the pod to the value, or removes it if nil
+func (l *LeaderLabeler) label(ctx context.Context, value *string) error {
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{
+			"labels": map[string]*string{LeaderLabel: value},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: l.Namespace, Name: l.Name}}
+	return l.Client.Patch(ctx, pod, client.RawPatch(types.MergePatchType, patch))
+}
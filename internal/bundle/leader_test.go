@@ -0,0 +1,65 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bundle
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("leader labeler", func() {
+	It("should only label the pod of the manager while it is the leader", func() {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Namespace: "system",
+			Name:      "manager",
+			Labels:    map[string]string{"control-plane": "controller-manager", LeaderLabel: "true"},
+		}}
+		c := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(pod).Build()
+		elected := make(chan struct{})
+		labeler := &LeaderLabeler{Client: c, Namespace: "system", Name: "manager", Elected: elected}
+
+		labels := func() map[string]string {
+			found := &corev1.Pod{}
+			Expect(c.Get(context.Background(), client.ObjectKeyFromObject(pod), found)).To(Succeed())
+			return found.Labels
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- labeler.Start(ctx) }()
+
+		By("removing the label left by a previous leader")
+		Eventually(labels).ShouldNot(HaveKey(LeaderLabel))
+		Expect(labels()).To(HaveKeyWithValue("control-plane", "controller-manager"))
+
+		By("labeling the pod once elected")
+		close(elected)
+		Eventually(labels).Should(HaveKeyWithValue(LeaderLabel, "true"))
+
+		By("removing the label when the manager stops")
+		cancel()
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(labels()).NotTo(HaveKey(LeaderLabel))
+	})
+})
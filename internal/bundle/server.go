@@ -0,0 +1,345 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bundle
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// PathPrefix is the path under which the bundles of the engines are served
+const PathPrefix = "/bundles/"
+
+// ServicePathPrefix is the path under which the bundles of the services are
+// served, apart from the ones of the engines so that their paths never collide
+const ServicePathPrefix = "/services/"
+
+// CAConfigMap is the ConfigMap with the CA of the bundle server, in the
+// namespaces of the services, that is mounted in their OPA sidecars
+const CAConfigMap = "opa-scaler-bundle-ca"
+
+// CAKey is the key of the CA in the CAConfigMap
+const CAKey = "ca.crt"
+
+// Path returns the path of the bundle of the engine signed with the key,
+// relative to the server url. An empty keyID is the unsigned bundle.
+func Path(namespace, name, keyID string) string {
+	return bundlePath(PathPrefix, namespace, name, keyID)
+}
+
+// ServicePath returns the path of the bundle with the policies of a service
+// signed with the key, relative to the server url. An empty keyID is the
+// unsigned bundle.
+func ServicePath(namespace, service, keyID string) string {
+	return bundlePath(ServicePathPrefix, namespace, service, keyID)
+}
+
+func bundlePath(prefix, namespace, name, keyID string) string {
+	if keyID == "" {
+		return prefix + namespace + "/" + name + ".tar.gz"
+	}
+	return prefix + namespace + "/" + name + "/" + keyID + ".tar.gz"
+}
+
+// Server keeps the last bundle built for each engine and each service and
+// serves it to the OPA instances. The ETag combines the revision with the
+// signing key, so that OPA downloads a bundle only when its content or its
+// signature changed.
+//
+// The bundles are built by the reconcilers of the leader, so the server only
+// runs on the leader, where the Service of the bundles is routed by the
+// LeaderLabeler.
+type Server struct {
+	// Addr is the address the server listens on
+	Addr string
+
+	// CertDir contains the tls.crt and tls.key the bundles are served with.
+	// The bundles are served over plain HTTP if empty.
+	CertDir string
+
+	// TLSOpts customize the TLS configuration of the server
+	TLSOpts []func(*tls.Config)
+
+	// ReviewToken authenticates the requests for the bundles without a
+	// token, which are only served to the service accounts of their
+	// namespace. They are served to anyone if nil.
+	ReviewToken TokenReviewer
+
+	mu sync.RWMutex
+	// bundles are the tarballs indexed by path
+	bundles map[string]*entry
+	// engines are the bundles published for each engine or service, by the
+	// path of their unsigned bundle
+	engines map[string]*published
+}
+
+type entry struct {
+	etag    string
+	tarball []byte
+	// namespace of the engine or service
+	namespace string
+	// token required to download the bundle
+	token string
+}
+
+type published struct {
+	revision string
+	// etag identifies the revision and the set of keys
+	etag  string
+	token string
+	paths []string
+}
+
+// NewServer returns an empty server listening on addr
+func NewServer(addr string) *Server {
+	return &Server{
+		Addr:    addr,
+		bundles: map[string]*entry{},
+		engines: map[string]*published{},
+	}
+}
+
+// etagOf returns the ETag of the bundle signed with the key, without quotes
+func etagOf(revision string, key *Key) string {
+	if key == nil {
+		return revision
+	}
+	return revision + "." + key.ID + "." + key.Fingerprint()
+}
+
+// Set builds and publishes the bundle of the engine, once for each key. The
+// bundle is built again only if its revision or its keys changed.
+func (s *Server) Set(namespace, name string, b *Bundle) error {
+	return s.set(namespace, func(keyID string) string { return Path(namespace, name, keyID) }, b)
+}
+
+// SetService builds and publishes the bundle of the service, like Set
+func (s *Server) SetService(namespace, service string, b *Bundle) error {
+	return s.set(namespace, func(keyID string) string { return ServicePath(namespace, service, keyID) }, b)
+}
+
+// set publishes the bundle at the paths returned for each key
+func (s *Server) set(namespace string, pathOf func(keyID string) string, b *Bundle) error {
+	engine := pathOf("")
+	etag := b.Revision
+	for _, key := range b.Keys {
+		etag += "," + etagOf("", key)
+	}
+	s.mu.RLock()
+	current, ok := s.engines[engine]
+	s.mu.RUnlock()
+	if ok && current.etag == etag && current.token == b.Token {
+		return nil
+	}
+
+	keys := b.Keys
+	if len(keys) == 0 {
+		keys = []*Key{nil}
+	}
+	entries := make(map[string]*entry, len(keys))
+	paths := make([]string, 0, len(keys))
+	for _, key := range keys {
+		tarball, err := Build(b, key)
+		if err != nil {
+			return err
+		}
+		path := pathOf("")
+		if key != nil {
+			path = pathOf(key.ID)
+		}
+		entries[path] = &entry{etag: etagOf(b.Revision, key), tarball: tarball, namespace: namespace, token: b.Token}
+		paths = append(paths, path)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(engine)
+	for path, e := range entries {
+		s.bundles[path] = e
+	}
+	s.engines[engine] = &published{revision: b.Revision, etag: etag, token: b.Token, paths: paths}
+	return nil
+}
+
+// Delete stops serving the bundles of the engine
+func (s *Server) Delete(namespace, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(Path(namespace, name, ""))
+}
+
+// DeleteService stops serving the bundles of the service
+func (s *Server) DeleteService(namespace, service string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.remove(ServicePath(namespace, service, ""))
+}
+
+func (s *Server) remove(engine string) {
+	if current, ok := s.engines[engine]; ok {
+		for _, path := range current.paths {
+			delete(s.bundles, path)
+		}
+		delete(s.engines, engine)
+	}
+}
+
+// Revision returns the revision of the bundle served for the engine
+func (s *Server) Revision(namespace, name string) (string, bool) {
+	return s.revision(Path(namespace, name, ""))
+}
+
+// ServiceRevision returns the revision of the bundle served for the service
+func (s *Server) ServiceRevision(namespace, service string) (string, bool) {
+	return s.revision(ServicePath(namespace, service, ""))
+}
+
+func (s *Server) revision(engine string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	current, ok := s.engines[engine]
+	if !ok {
+		return "", false
+	}
+	return current.revision, true
+}
+
+// ServeHTTP answers the bundle download requests of OPA
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	s.mu.RLock()
+	current, ok := s.bundles[req.URL.Path]
+	s.mu.RUnlock()
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if authorized, err := s.authorized(req, current); err != nil {
+		log.FromContext(req.Context()).WithName("bundle-server").Error(err, "unable to review the token", "Path", req.URL.Path)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	} else if !authorized {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	etag := `"` + current.etag + `"`
+	w.Header().Set("ETag", etag)
+	if match := req.Header.Get("If-None-Match"); match == etag || strings.Trim(match, `"`) == current.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/gzip")
+	w.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		_, _ = w.Write(current.tarball)
+	}
+}
+
+// authorized tells whether the request carries the token of the bundle or,
+// for a bundle without a token, the one of a service account of its namespace
+func (s *Server) authorized(req *http.Request, e *entry) (bool, error) {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if e.token != "" {
+		return ok && subtle.ConstantTimeCompare([]byte(token), []byte(e.token)) == 1, nil
+	}
+	if s.ReviewToken == nil {
+		return true, nil
+	}
+	if !ok || token == "" {
+		return false, nil
+	}
+	namespace, err := s.ReviewToken(req.Context(), token)
+	if err != nil {
+		return false, err
+	}
+	return namespace == e.namespace, nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, as only the
+// leader builds the bundles
+func (s *Server) NeedLeaderElection() bool {
+	return true
+}
+
+// Start serves the bundles until the context is done, it implements
+// manager.Runnable
+func (s *Server) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("bundle-server")
+
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	if s.CertDir != "" {
+		// The certificate is reloaded when it is renewed
+		watcher, err := certwatcher.New(filepath.Join(s.CertDir, "tls.crt"), filepath.Join(s.CertDir, "tls.key"))
+		if err != nil {
+			_ = listener.Close()
+			return err
+		}
+		go func() {
+			if err := watcher.Start(ctx); err != nil {
+				logger.Error(err, "unable to watch the certificate of the bundle server")
+			}
+		}()
+		config := &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: watcher.GetCertificate,
+		}
+		for _, opt := range s.TLSOpts {
+			opt(config)
+		}
+		listener = tls.NewListener(listener, config)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(PathPrefix, s)
+	mux.Handle(ServicePathPrefix, s)
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Error(err, "unable to shut down the bundle server")
+		}
+	}()
+
+	logger.Info("Serving bundles", "Addr", listener.Addr().String(), "TLS", s.CertDir != "")
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
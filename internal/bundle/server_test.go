@@ -0,0 +1,154 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bundle
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("bundle server", func() {
+	var server *Server
+	var ts *httptest.Server
+
+	BeforeEach(func() {
+		server = NewServer("")
+		ts = httptest.NewServer(server)
+	})
+
+	AfterEach(func() {
+		ts.Close()
+	})
+
+	getWithToken := func(path, token string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		Expect(err).NotTo(HaveOccurred())
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Body.Close()).To(Succeed())
+		return resp
+	}
+
+	get := func(path, etag string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		Expect(err).NotTo(HaveOccurred())
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Body.Close()).To(Succeed())
+		return resp
+	}
+
+	It("should serve the bundle of each engine", func() {
+		Expect(server.Set("default", "engine", &Bundle{Revision: "r1", Modules: map[string]string{"p": "package p"}})).To(Succeed())
+
+		resp := get(Path("default", "engine", ""), "")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("ETag")).To(Equal(`"r1"`))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/gzip"))
+
+		Expect(get(Path("default", "other", ""), "").StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("should answer not modified while the revision does not change", func() {
+		Expect(server.Set("default", "engine", &Bundle{Revision: "r1"})).To(Succeed())
+		Expect(get(Path("default", "engine", ""), `"r1"`).StatusCode).To(Equal(http.StatusNotModified))
+
+		Expect(server.Set("default", "engine", &Bundle{Revision: "r2"})).To(Succeed())
+		resp := get(Path("default", "engine", ""), `"r1"`)
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("ETag")).To(Equal(`"r2"`))
+	})
+
+	It("should stop serving deleted bundles", func() {
+		Expect(server.Set("default", "engine", &Bundle{Revision: "r1"})).To(Succeed())
+		server.Delete("default", "engine")
+		Expect(get(Path("default", "engine", ""), "").StatusCode).To(Equal(http.StatusNotFound))
+		_, ok := server.Revision("default", "engine")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should serve the bundles of the services apart from the ones of the engines", func() {
+		keys, err := KeysFromSecret(signingSecret(map[string][]byte{"orders.hmac": []byte(hmacSecret)}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(server.Set("default", "services", &Bundle{Revision: "engine", Keys: keys})).To(Succeed())
+		Expect(server.SetService("default", "orders", &Bundle{Revision: "service"})).To(Succeed())
+
+		Expect(get(Path("default", "services", "orders"), "").Header.Get("ETag")).To(HavePrefix(`"engine.`))
+		Expect(get(ServicePath("default", "orders", ""), "").Header.Get("ETag")).To(Equal(`"service"`))
+
+		server.DeleteService("default", "orders")
+		Expect(get(ServicePath("default", "orders", ""), "").StatusCode).To(Equal(http.StatusNotFound))
+		_, ok := server.ServiceRevision("default", "orders")
+		Expect(ok).To(BeFalse())
+		Expect(get(Path("default", "services", "orders"), "").StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should serve a variant of the bundle signed with each key", func() {
+		keys, err := KeysFromSecret(signingSecret(map[string][]byte{"old.pem": ecKey(), "new.hmac": []byte(hmacSecret)}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(server.Set("default", "engine", &Bundle{Revision: "r1", Keys: keys})).To(Succeed())
+
+		Expect(get(Path("default", "engine", "old"), "").StatusCode).To(Equal(http.StatusOK))
+		Expect(get(Path("default", "engine", "new"), "").StatusCode).To(Equal(http.StatusOK))
+		Expect(get(Path("default", "engine", ""), "").StatusCode).To(Equal(http.StatusNotFound))
+
+		Expect(server.Set("default", "engine", &Bundle{Revision: "r1", Keys: keys[1:]})).To(Succeed())
+		Expect(get(Path("default", "engine", "new"), "").StatusCode).To(Equal(http.StatusNotFound))
+		revision, ok := server.Revision("default", "engine")
+		Expect(ok).To(BeTrue())
+		Expect(revision).To(Equal("r1"))
+	})
+
+	It("should only serve the bundles with a token to the requests carrying it", func() {
+		Expect(server.Set("default", "engine", &Bundle{Revision: "r1", Token: "secret"})).To(Succeed())
+
+		Expect(getWithToken(Path("default", "engine", ""), "").StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(getWithToken(Path("default", "engine", ""), "other").StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(getWithToken(Path("default", "engine", ""), "secret").StatusCode).To(Equal(http.StatusOK))
+
+		By("replacing the token of an unchanged bundle")
+		Expect(server.Set("default", "engine", &Bundle{Revision: "r1", Token: "rotated"})).To(Succeed())
+		Expect(getWithToken(Path("default", "engine", ""), "secret").StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(getWithToken(Path("default", "engine", ""), "rotated").StatusCode).To(Equal(http.StatusOK))
+	})
+
+	It("should only serve the bundles without a token to the service accounts of their namespace", func() {
+		server.ReviewToken = func(_ context.Context, token string) (string, error) {
+			return map[string]string{"orders-sa": "default", "billing-sa": "billing"}[token], nil
+		}
+		Expect(server.SetService("default", "orders", &Bundle{Revision: "r1"})).To(Succeed())
+		Expect(server.Set("default", "engine", &Bundle{Revision: "r1", Token: "secret"})).To(Succeed())
+
+		Expect(getWithToken(ServicePath("default", "orders", ""), "").StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(getWithToken(ServicePath("default", "orders", ""), "unknown").StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(getWithToken(ServicePath("default", "orders", ""), "billing-sa").StatusCode).To(Equal(http.StatusUnauthorized))
+		Expect(getWithToken(ServicePath("default", "orders", ""), "orders-sa").StatusCode).To(Equal(http.StatusOK))
+
+		// The token of the engine is required even from its namespace
+		Expect(getWithToken(Path("default", "engine", ""), "orders-sa").StatusCode).To(Equal(http.StatusUnauthorized))
+	})
+})
@@ -0,0 +1,166 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bundle
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Algorithms signing the bundles
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	HS256 = "HS256"
+)
+
+// Suffixes of the Secret entries holding the signing keys
+const (
+	// PEMKeySuffix marks a PEM RSA or EC private key
+	PEMKeySuffix = ".pem"
+	// HMACKeySuffix marks a secret shared with OPA
+	HMACKeySuffix = ".hmac"
+)
+
+// Key signs the bundles of an engine
+type Key struct {
+	// ID names the key in the signatures and in the OPA configuration
+	ID string
+	// Algorithm is one of RS256, ES256 and HS256
+	Algorithm string
+	// Private signs the bundles, a PEM private key or the HMAC secret
+	Private []byte
+	// Public verifies the signatures, a PEM public key or the HMAC secret
+	Public []byte
+}
+
+// IsHMAC reports if the key is a secret shared with OPA
+func (k *Key) IsHMAC() bool {
+	return k.Algorithm == HS256
+}
+
+// Fingerprint returns a short hash of the key, which changes when the key is replaced
+func (k *Key) Fingerprint() string {
+	sum := sha256.Sum256(k.Public)
+	return hex.EncodeToString(sum[:8])
+}
+
+// KeysFromSecret returns the signing keys stored in the Secret, sorted by id.
+// Entries without a known suffix are ignored.
+func KeysFromSecret(secret *corev1.Secret) ([]*Key, error) {
+	keys := []*Key{}
+	for name, data := range secret.Data {
+		var key *Key
+		var err error
+		switch {
+		case strings.HasSuffix(name, PEMKeySuffix):
+			key, err = parsePrivateKey(strings.TrimSuffix(name, PEMKeySuffix), data)
+		case strings.HasSuffix(name, HMACKeySuffix):
+			key = &Key{ID: strings.TrimSuffix(name, HMACKeySuffix), Algorithm: HS256, Private: data, Public: data}
+			if len(data) < 32 {
+				err = fmt.Errorf("key %s: HMAC secret shorter than 32 bytes", key.ID)
+			}
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(keys, func(k *Key) bool { return k.ID == key.ID }) {
+			return nil, fmt.Errorf("key %s: stored both as PEM and HMAC", key.ID)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("secret %s does not contain any signing key", secret.Name)
+	}
+	slices.SortFunc(keys, func(a, b *Key) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return keys, nil
+}
+
+// ActiveKey returns the key with the given id, or the only key if id is empty
+func ActiveKey(keys []*Key, id string) (*Key, error) {
+	if id == "" {
+		if len(keys) != 1 {
+			return nil, errors.New("the active key must be chosen among many keys")
+		}
+		return keys[0], nil
+	}
+	i := slices.IndexFunc(keys, func(k *Key) bool { return k.ID == id })
+	if i < 0 {
+		return nil, fmt.Errorf("key %s not found", id)
+	}
+	return keys[i], nil
+}
+
+// parsePrivateKey reads a PKCS#1, SEC 1 or PKCS#8 PEM private key
+func parsePrivateKey(id string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("key %s: no PEM block found", id)
+	}
+	var private any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		private, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		private, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		private, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", id, err)
+	}
+
+	key := &Key{ID: id, Private: data}
+	var public any
+	switch private := private.(type) {
+	case *rsa.PrivateKey:
+		key.Algorithm = RS256
+		public = &private.PublicKey
+	case *ecdsa.PrivateKey:
+		if private.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("key %s: ES256 requires a P-256 key", id)
+		}
+		key.Algorithm = ES256
+		public = &private.PublicKey
+	default:
+		return nil, fmt.Errorf("key %s: unsupported key type %T", id, private)
+	}
+	der, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %w", id, err)
+	}
+	key.Public = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	return key, nil
+}
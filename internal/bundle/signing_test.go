@@ -0,0 +1,124 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bundle
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	opabundle "github.com/open-policy-agent/opa/bundle"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const hmacSecret = "0123456789abcdef0123456789abcdef"
+
+func ecKey() []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).NotTo(HaveOccurred())
+	der, err := x509.MarshalECPrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func rsaKey() []byte {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).NotTo(HaveOccurred())
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	Expect(err).NotTo(HaveOccurred())
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func signingSecret(data map[string][]byte) *corev1.Secret {
+	return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "keys"}, Data: data}
+}
+
+var _ = Describe("bundle signing", func() {
+	It("should load the keys of a secret", func() {
+		keys, err := KeysFromSecret(signingSecret(map[string][]byte{
+			"ec.pem":      ecKey(),
+			"rsa.pem":     rsaKey(),
+			"shared.hmac": []byte(hmacSecret),
+			"README":      []byte("ignored"),
+		}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys).To(HaveLen(3))
+		Expect(keys[0].ID).To(Equal("ec"))
+		Expect(keys[0].Algorithm).To(Equal(ES256))
+		Expect(keys[1].ID).To(Equal("rsa"))
+		Expect(keys[1].Algorithm).To(Equal(RS256))
+		Expect(string(keys[1].Public)).To(HavePrefix("-----BEGIN PUBLIC KEY-----"))
+		Expect(keys[2].ID).To(Equal("shared"))
+		Expect(keys[2].IsHMAC()).To(BeTrue())
+	})
+
+	It("should reject invalid keys", func() {
+		_, err := KeysFromSecret(signingSecret(map[string][]byte{"short.hmac": []byte("secret")}))
+		Expect(err).To(MatchError(ContainSubstring("short")))
+
+		_, err = KeysFromSecret(signingSecret(map[string][]byte{"k.pem": ecKey(), "k.hmac": []byte(hmacSecret)}))
+		Expect(err).To(MatchError(ContainSubstring("both")))
+
+		_, err = KeysFromSecret(signingSecret(map[string][]byte{"broken.pem": []byte("not a key")}))
+		Expect(err).To(MatchError(ContainSubstring("broken")))
+
+		_, err = KeysFromSecret(signingSecret(nil))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should choose the active key", func() {
+		keys, err := KeysFromSecret(signingSecret(map[string][]byte{"old.pem": ecKey(), "new.hmac": []byte(hmacSecret)}))
+		Expect(err).NotTo(HaveOccurred())
+
+		active, err := ActiveKey(keys, "old")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(active.ID).To(Equal("old"))
+
+		_, err = ActiveKey(keys, "")
+		Expect(err).To(HaveOccurred())
+		_, err = ActiveKey(keys, "missing")
+		Expect(err).To(HaveOccurred())
+
+		active, err = ActiveKey(keys[:1], "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(active).To(Equal(keys[0]))
+	})
+
+	It("should sign bundles verifiable by OPA", func() {
+		keys, err := KeysFromSecret(signingSecret(map[string][]byte{"ec.pem": ecKey(), "shared.hmac": []byte(hmacSecret)}))
+		Expect(err).NotTo(HaveOccurred())
+
+		for _, key := range keys {
+			tarball, err := Build(&Bundle{Revision: "r1", Modules: map[string]string{"p": "package p\n\nx := 1\n"}}, key)
+			Expect(err).NotTo(HaveOccurred())
+
+			verification := opabundle.NewVerificationConfig(map[string]*opabundle.KeyConfig{
+				key.ID: {Key: string(key.Public), Algorithm: key.Algorithm},
+			}, key.ID, "", nil)
+			b, err := opabundle.NewReader(bytes.NewReader(tarball)).WithBundleVerificationConfig(verification).Read()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b.Manifest.Revision).To(Equal("r1"))
+		}
+	})
+})
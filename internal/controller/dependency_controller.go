@@ -17,34 +17,68 @@ limitations under the License.
 package controller
 
 import (
+	"cmp"
 	"context"
 	"fmt"
+	"slices"
 	"time"
 
-	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/util/retry"
+	"k8s.io/client-go/util/workqueue"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	"github.com/bramba2000/opa-scaler/internal/scheduler"
+)
+
+// DependencyFinalizer unschedules the policies of a Dependency before it is deleted
+const DependencyFinalizer = "opa-scaler.polimi.it/dependency-finalizer"
+
+const (
+	// policyNameField indexes the Dependencies by the name of their policy
+	policyNameField = "spec.policyName"
+	// engineNameField indexes the Dependencies by the engines they are scheduled in
+	engineNameField = "status.engineName"
+
+	// dependencyBackoffBase and dependencyBackoffMax bound the delay before a
+	// failed reconciliation of a Dependency is retried
+	dependencyBackoffBase = 1 * time.Second
+	dependencyBackoffMax  = 5 * time.Minute
 )
 
 // DependencyReconciler reconciles a Dependency object
 type DependencyReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// DefaultPlacement is the placement of the Dependencies that do not set
+	// it, unless their namespace is annotated with another one
+	DefaultPlacement opaspolimiitv1alpha1.PlacementSpec
+
+	// DefaultCapacity bounds the policies of the OpaEngines that do not set
+	// their own capacity
+	DefaultCapacity opaspolimiitv1alpha1.EngineCapacity
 }
 
 // +kubebuilder:rbac:groups=opas.polimi.it,resources=dependencies,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=opas.polimi.it,resources=dependencies/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=opas.polimi.it,resources=dependencies/finalizers,verbs=update
 // +kubebuilder:rbac:groups=opas.polimi.it,resources=policies,verbs=get;list;watch
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=policydata,verbs=get;list;watch
 // +kubebuilder:rbac:groups=opas.polimi.it,resources=opaengine,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
 
 func (r *DependencyReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
@@ -56,6 +90,43 @@ func (r *DependencyReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	// Process deletion
+	// - if no deletion timestamp, add finalizer
+	// - if deletion timestamp, unschedule the policies and remove finalizer
+	if depCR.DeletionTimestamp.IsZero() {
+		if !controllerutil.ContainsFinalizer(depCR, DependencyFinalizer) {
+			logger.Info("Adding finalizer to Dependency")
+			if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+				if err := r.Get(ctx, req.NamespacedName, depCR); err != nil {
+					return err
+				}
+				controllerutil.AddFinalizer(depCR, DependencyFinalizer)
+				return r.Update(ctx, depCR)
+			}); err != nil {
+				logger.Error(err, "unable to add finalizer to Dependency")
+				return ctrl.Result{}, err
+			}
+		}
+	} else {
+		if controllerutil.ContainsFinalizer(depCR, DependencyFinalizer) {
+			if err := r.unschedule(ctx, depCR); err != nil {
+				logger.Error(err, "unable to unschedule the policies of Dependency")
+				return ctrl.Result{}, err
+			}
+			if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+				if err := r.Get(ctx, req.NamespacedName, depCR); err != nil {
+					return err
+				}
+				controllerutil.RemoveFinalizer(depCR, DependencyFinalizer)
+				return r.Update(ctx, depCR)
+			}); err != nil {
+				logger.Error(err, "unable to remove finalizer from Dependency")
+				return ctrl.Result{}, client.IgnoreNotFound(err)
+			}
+		}
+		return ctrl.Result{}, nil
+	}
+
 	// if no conditions are set, set the default ones
 	if len(depCR.Status.Conditions) == 0 {
 		if err := r.addCondition(ctx, req, metav1.Condition{
@@ -65,17 +136,11 @@ func (r *DependencyReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 			Message: "Dependency is not ready",
 		}); err != nil {
 			logger.Error(err, "unable to set default conditions")
-			return ctrl.Result{RequeueAfter: 1 * time.Second}, err
+			return ctrl.Result{}, err
 		}
 		logger.Info("Default conditions set")
 	}
 
-	// Check if the dependency is already deployed
-	if depCR.Status.Deployed {
-		logger.Info("Dependency already deployed")
-		return ctrl.Result{}, nil
-	}
-
 	// Fetch the policy instance
 	policyCR := &opaspolimiitv1alpha1.Policy{}
 	if err := r.Get(ctx, client.ObjectKey{
@@ -91,64 +156,137 @@ func (r *DependencyReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 				Message: "Policy not found",
 			})
 			logger.Error(nil, "Policy "+depCR.Spec.PolicyName+"not found")
-			return ctrl.Result{RequeueAfter: 10 * time.Second}, nil
+			// The Policy is watched, the Dependency is reconciled once it is created
+			return ctrl.Result{}, nil
 		} else {
 			logger.Error(err, "unable to fetch Policy")
-			return ctrl.Result{RequeueAfter: 1 * time.Second}, err
+			return ctrl.Result{}, err
 		}
 	}
 
-	// If name is present, check scheduled engine
+	// The policy is scheduled together with its transitive dependencies
+	policies, err := resolvePolicyNames(ctx, r.Client, req.Namespace, []string{policyCR.Name})
+	if reason := dependencyErrorReason(err); reason != "" {
+		r.addCondition(ctx, req, metav1.Condition{
+			Type:    "Available",
+			Status:  metav1.ConditionFalse,
+			Reason:  reason,
+			Message: truncate(err.Error(), maxConditionMessage),
+		})
+		logger.Error(err, "unable to resolve the dependencies of Policy", "Policy", policyCR.Name)
+		return ctrl.Result{}, nil
+	} else if err != nil {
+		logger.Error(err, "unable to fetch the dependencies of Policy")
+		return ctrl.Result{}, err
+	}
+
+	// If name is present, check the scheduled engines: the Dependency is
+	// deployed once every one of them has loaded the policy and its dependencies
 	logger.Info("Checking if scheduled engine is already deployed", "EngineName", depCR.Status.EngineName)
 	if len(depCR.Status.EngineName) > 0 {
-		logger.Info("Checking if scheduled policy is already deployed")
-		// Check if the policy is already scheduled
+		scheduled := []string{}
+		loaded := true
 		for _, engineName := range depCR.Status.EngineName {
 			engine := &opaspolimiitv1alpha1.OpaEngine{}
 			if err := r.Get(ctx, client.ObjectKey{
 				Namespace: req.Namespace,
 				Name:      engineName,
 			}, engine); err != nil {
+				if client.IgnoreNotFound(err) == nil {
+					logger.Info("Scheduled OpaEngine not found", "EngineName", engineName)
+					continue
+				}
 				logger.Error(err, "unable to fetch OpaEngine")
-				return ctrl.Result{RequeueAfter: 1 * time.Second}, err
+				return ctrl.Result{}, err
+			}
+			if !slices.Contains(engine.Spec.Policies, depCR.Spec.PolicyName) { // Spec to check desired state
+				logger.Info("Policy no longer scheduled in OpaEngine", "EngineName", engineName)
+				continue
 			}
 
-			// Check if the policy is already scheduled
-			for _, policy := range engine.Spec.Policies { // Changed from Status to Spec to check desired state
-				if policy == depCR.Spec.PolicyName {
-					logger.Info("Policy already deployed")
-					// Set the condition
-					if err := r.addCondition(ctx, req, metav1.Condition{
-						Type:    "Available",
-						Status:  metav1.ConditionTrue,
-						Reason:  "PolicyDeployed",
-						Message: "Policy already scheduled",
-					}); err != nil {
-						logger.Error(err, "unable to set condition")
-						return ctrl.Result{RequeueAfter: 1 * time.Second}, err
-					}
-					// Update the status
-					if err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
-						if err := r.Get(ctx, req.NamespacedName, depCR); err != nil {
-							return err
-						}
-						depCR.Status.Deployed = true
-						return r.Status().Update(ctx, depCR)
-					}); err != nil {
-						logger.Error(err, "unable to update status")
-						return ctrl.Result{RequeueAfter: 1 * time.Second}, err
-					}
-					return ctrl.Result{}, nil
+			// Dependencies may have been added to the policy after it was
+			// scheduled, the policy moves to a new shard when they do not fit
+			target := engineName
+			if missing := missingPolicies(engine.Spec.Policies, policies); len(missing) > 0 {
+				logger.Info("Adding the missing dependencies to engine", "Policies", missing)
+				state, err := placementState(ctx, r.Client, req.Namespace, []opaspolimiitv1alpha1.OpaEngine{*engine}, r.DefaultCapacity)
+				if err != nil {
+					logger.Error(err, "unable to compute the placement state")
+					return ctrl.Result{}, err
 				}
+				if target, err = r.schedulePolicies(ctx, policies, engine, state); err != nil {
+					logger.Error(err, "unable to add policies to engine")
+					return ctrl.Result{}, err
+				}
+			}
+			scheduled = append(scheduled, target)
+			// Status.Policies holds the policies loaded by every pod of the engine
+			if target != engineName || len(missingPolicies(engine.Status.Policies, policies)) > 0 {
+				loaded = false
 			}
 		}
-		return ctrl.Result{RequeueAfter: 1 * time.Second}, nil
+
+		condition := metav1.Condition{
+			Type:    "Available",
+			Status:  metav1.ConditionTrue,
+			Reason:  "PolicyDeployed",
+			Message: fmt.Sprintf("Policy loaded in engines %v", scheduled),
+		}
+		switch {
+		case len(scheduled) == 0:
+			// Every engine lost the policy, it is scheduled again below
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = "PolicyLost"
+			condition.Message = fmt.Sprintf("Policy no longer scheduled in engines %v", depCR.Status.EngineName)
+		case !loaded:
+			condition.Status = metav1.ConditionFalse
+			condition.Reason = "PolicyNotLoaded"
+			condition.Message = fmt.Sprintf("Policy scheduled in engines %v, waiting for them to load it", scheduled)
+		}
+		if err := r.addCondition(ctx, req, condition); err != nil {
+			logger.Error(err, "unable to set condition")
+			return ctrl.Result{}, err
+		}
+		// Update the status, unless the engines have been changed meanwhile,
+		// e.g. by a migration, as the scheduled ones are computed from them
+		observed := slices.Clone(depCR.Status.EngineName)
+		changed := false
+		if err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+			if err := r.Get(ctx, req.NamespacedName, depCR); err != nil {
+				return err
+			}
+			if changed = !slices.Equal(depCR.Status.EngineName, observed); changed {
+				return nil
+			}
+			depCR.Status.Deployed = len(scheduled) > 0 && loaded
+			depCR.Status.EngineName = scheduled
+			return r.Status().Update(ctx, depCR)
+		}); err != nil {
+			logger.Error(err, "unable to update status")
+			return ctrl.Result{}, err
+		}
+		if changed {
+			logger.Info("Scheduled engines changed meanwhile, checking them again", "EngineName", depCR.Status.EngineName)
+			return ctrl.Result{Requeue: true}, nil
+		}
+		// The OpaEngines are watched, so the Dependency is reconciled again
+		// when they load the policy or lose it
+		if len(scheduled) > 0 {
+			return ctrl.Result{}, nil
+		}
+		logger.Info("Policy lost by every scheduled engine, scheduling it again")
 	}
 
 	// Check if there is a policy engine
 	logger.Info("Policy not scheduled, checking for policy engine")
 	engines := new(opaspolimiitv1alpha1.OpaEngineList)
-	if err := r.List(ctx, engines, client.InNamespace(req.Namespace)); err != nil {
+	err = r.List(ctx, engines, client.InNamespace(req.Namespace))
+	// The policies of the engines of an OpaEngineSet are managed by the set
+	engines.Items = slices.DeleteFunc(engines.Items, func(e opaspolimiitv1alpha1.OpaEngine) bool {
+		_, ok := e.Labels[engineSetLabel]
+		return ok
+	})
+	if err != nil {
 		// If error is not found, create a new engine
 		logger.Error(err, "unable to fetch OpaEngine")
 
@@ -165,14 +303,15 @@ func (r *DependencyReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		}
 		if res, err := controllerutil.CreateOrUpdate(ctx, r.Client, newEngine, func() error {
 			if newEngine.ObjectMeta.CreationTimestamp.IsZero() {
-				newEngine.Spec.Policies = []string{depCR.Spec.PolicyName}
+				newEngine.Labels = map[string]string{scheduledEngineLabel: "true"}
+				newEngine.Spec.Policies = policies
 			} else {
-				newEngine.Spec.Policies = append(newEngine.Spec.Policies, depCR.Spec.PolicyName)
+				newEngine.Spec.Policies = append(newEngine.Spec.Policies, missingPolicies(newEngine.Spec.Policies, policies)...)
 			}
 			return nil
 		}); err != nil {
 			logger.Error(err, "unable to create OpaEngine")
-			return ctrl.Result{RequeueAfter: 1 * time.Second}, err
+			return ctrl.Result{}, err
 		} else if res != controllerutil.OperationResultNone {
 			logger.Info("OpaEngine created")
 			// Set the condition
@@ -183,7 +322,7 @@ func (r *DependencyReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 				Message: "Dependency scheduled in default engine",
 			}); err != nil {
 				logger.Error(err, "unable to set condition")
-				return ctrl.Result{RequeueAfter: 1 * time.Second}, err
+				return ctrl.Result{}, err
 			}
 			// Update the status
 			if err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
@@ -194,36 +333,70 @@ func (r *DependencyReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 				return r.Status().Update(ctx, depCR)
 			}); err != nil {
 				logger.Error(err, "unable to update status")
-				return ctrl.Result{RequeueAfter: 1 * time.Second}, err
+				return ctrl.Result{}, err
 			}
 			logger.Info("Status updated", "EngineName", depCR.Status.EngineName)
 		}
 	} else {
-		// Engine found, add the policy
-		if err := r.addPolicyToEngine(ctx, depCR.Spec.PolicyName, &engines.Items[0]); err != nil {
+		// Engine found, select the one receiving the policy
+		placement, err := r.placement(ctx, depCR)
+		if err != nil {
+			logger.Error(err, "unable to fetch the placement of the Dependency")
+			return ctrl.Result{}, err
+		}
+		strategy, err := scheduler.New(placement.Strategy, placement.LoadMetric)
+		if err != nil {
+			r.addCondition(ctx, req, metav1.Condition{
+				Type:    "Available",
+				Status:  metav1.ConditionFalse,
+				Reason:  "InvalidPlacement",
+				Message: err.Error(),
+			})
+			logger.Error(err, "invalid placement", "Strategy", placement.Strategy, "LoadMetric", placement.LoadMetric)
+			// The placement may come from the namespace, which is not watched
+			return ctrl.Result{Requeue: true}, nil
+		}
+		state, err := placementState(ctx, r.Client, req.Namespace, engines.Items, r.DefaultCapacity)
+		if err != nil {
+			logger.Error(err, "unable to compute the placement state")
+			return ctrl.Result{}, err
+		}
+		// When no engine has room for the policy a new shard of the first one is created
+		engine := &engines.Items[0]
+		if name, ok := scheduler.Place(strategy, scheduler.Request{
+			ServiceName: depCR.Spec.ServiceName,
+			Policies:    policies,
+		}, state); ok {
+			engine = &engines.Items[slices.IndexFunc(engines.Items, func(e opaspolimiitv1alpha1.OpaEngine) bool {
+				return e.Name == name
+			})]
+		}
+		logger.Info("Engine selected", "EngineName", engine.Name, "Strategy", cmp.Or(placement.Strategy, scheduler.FirstFit))
+		engineName, err := r.schedulePolicies(ctx, policies, engine, state)
+		if err != nil {
 			logger.Error(err, "unable to add policy to engine")
-			return ctrl.Result{RequeueAfter: 1 * time.Second}, err
+			return ctrl.Result{}, err
 		}
 		// Set the condition
 		if err := r.addCondition(ctx, req, metav1.Condition{
 			Type:    "Available",
-			Status:  metav1.ConditionTrue,
-			Reason:  "PolicyScheduled",
-			Message: "Policy scheduled in existing engine",
+			Status:  metav1.ConditionFalse,
+			Reason:  "Scheduled",
+			Message: fmt.Sprintf("Policy scheduled in engine %s by %s placement", engineName, cmp.Or(placement.Strategy, scheduler.FirstFit)),
 		}); err != nil {
 			logger.Error(err, "unable to set condition")
-			return ctrl.Result{RequeueAfter: 1 * time.Second}, err
+			return ctrl.Result{}, err
 		}
 		// Update the status
 		if err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
 			if err := r.Get(ctx, req.NamespacedName, depCR); err != nil {
 				return err
 			}
-			depCR.Status.EngineName = append(depCR.Status.EngineName, engines.Items[0].Name)
+			depCR.Status.EngineName = append(depCR.Status.EngineName, engineName)
 			return r.Status().Update(ctx, depCR)
 		}); err != nil {
 			logger.Error(err, "unable to update status")
-			return ctrl.Result{RequeueAfter: 1 * time.Second}, err
+			return ctrl.Result{}, err
 		}
 		logger.Info("Status updated", "EngineName", depCR.Status.EngineName)
 	}
@@ -233,11 +406,92 @@ func (r *DependencyReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *DependencyReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	ctx := context.Background()
+	if err := mgr.GetFieldIndexer().IndexField(ctx, &opaspolimiitv1alpha1.Dependency{}, policyNameField, func(obj client.Object) []string {
+		return []string{obj.(*opaspolimiitv1alpha1.Dependency).Spec.PolicyName}
+	}); err != nil {
+		return err
+	}
+	if err := mgr.GetFieldIndexer().IndexField(ctx, &opaspolimiitv1alpha1.Dependency{}, engineNameField, func(obj client.Object) []string {
+		return obj.(*opaspolimiitv1alpha1.Dependency).Status.EngineName
+	}); err != nil {
+		return err
+	}
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&opaspolimiitv1alpha1.Dependency{}).
+		Watches(
+			&opaspolimiitv1alpha1.Policy{},
+			handler.EnqueueRequestsFromMapFunc(r.dependenciesOfPolicy),
+			builder.WithPredicates(policyGraphChanged),
+		).
+		Watches(
+			&opaspolimiitv1alpha1.OpaEngine{},
+			handler.EnqueueRequestsFromMapFunc(r.dependenciesOfEngine),
+			builder.WithPredicates(engineDependenciesChanged),
+		).
+		WithOptions(controller.Options{
+			// Failed reconciliations are retried with an exponential backoff
+			RateLimiter: workqueue.NewTypedItemExponentialFailureRateLimiter[reconcile.Request](
+				dependencyBackoffBase, dependencyBackoffMax),
+		}).
 		Complete(r)
 }
 
+// engineDependenciesChanged passes the events of the engines whose spec,
+// labels or loaded policies changed, ignoring the other status updates
+var engineDependenciesChanged = predicate.Or[client.Object](
+	predicate.GenerationChangedPredicate{},
+	predicate.LabelChangedPredicate{},
+	predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldEngine, ok := e.ObjectOld.(*opaspolimiitv1alpha1.OpaEngine)
+			if !ok {
+				return false
+			}
+			newEngine, ok := e.ObjectNew.(*opaspolimiitv1alpha1.OpaEngine)
+			if !ok {
+				return false
+			}
+			return !slices.Equal(oldEngine.Status.Policies, newEngine.Status.Policies)
+		},
+	},
+)
+
+// dependenciesOfPolicy maps a Policy to the Dependencies on it or on a policy
+// depending on it
+func (r *DependencyReconciler) dependenciesOfPolicy(ctx context.Context, obj client.Object) []reconcile.Request {
+	names := []string{obj.GetName()}
+	for _, dependent := range policiesDependingOn(ctx, r.Client, obj) {
+		names = append(names, dependent.Name)
+	}
+	requests := []reconcile.Request{}
+	for _, name := range names {
+		requests = append(requests, r.dependenciesMatching(ctx, obj.GetNamespace(), policyNameField, name)...)
+	}
+	return requests
+}
+
+// dependenciesOfEngine maps an OpaEngine to the Dependencies scheduled in it
+func (r *DependencyReconciler) dependenciesOfEngine(ctx context.Context, obj client.Object) []reconcile.Request {
+	return r.dependenciesMatching(ctx, obj.GetNamespace(), engineNameField, obj.GetName())
+}
+
+// dependenciesMatching returns the Dependencies of the namespace whose indexed
+// field has the value
+func (r *DependencyReconciler) dependenciesMatching(ctx context.Context, namespace, field, value string) []reconcile.Request {
+	dependencies := &opaspolimiitv1alpha1.DependencyList{}
+	if err := r.List(ctx, dependencies, client.InNamespace(namespace), client.MatchingFields{field: value}); err != nil {
+		log.FromContext(ctx).Error(err, "unable to list Dependencies", "Field", field, "Value", value)
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, dep := range dependencies.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&dep)})
+	}
+	return requests
+}
+
 func (r *DependencyReconciler) addCondition(ctx context.Context, req ctrl.Request, newCondition metav1.Condition) error {
 	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
 		depCR := new(opaspolimiitv1alpha1.Dependency)
@@ -252,92 +506,114 @@ func (r *DependencyReconciler) addCondition(ctx context.Context, req ctrl.Reques
 	})
 }
 
-func (r *DependencyReconciler) addPolicyToEngine(ctx context.Context, policyName string, engine *opaspolimiitv1alpha1.OpaEngine) error {
-	logger := log.FromContext(ctx).WithValues("engine", client.ObjectKeyFromObject(engine))
-
-	originalPolicies := engine.Spec.Policies
-	updatedPolicies := append(originalPolicies, policyName)
-
-	if len(updatedPolicies) > 7 {
-		// Split policies into a new engine
-		numToMove := 5
-		if len(updatedPolicies) < numToMove {
-			numToMove = len(updatedPolicies)
+// addPoliciesToEngine adds the policies to the engine
+func addPoliciesToEngine(ctx context.Context, c client.Client, policies []string, engine *opaspolimiitv1alpha1.OpaEngine) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		if err := c.Get(ctx, client.ObjectKeyFromObject(engine), engine); err != nil {
+			return err
 		}
-		policiesToMove := updatedPolicies[len(updatedPolicies)-numToMove:]
-		remainingPolicies := updatedPolicies[:len(updatedPolicies)-numToMove]
+		engine.Spec.Policies = append(engine.Spec.Policies, missingPolicies(engine.Spec.Policies, policies)...)
+		return c.Update(ctx, engine)
+	})
+}
 
-		newEngineName := fmt.Sprintf("%s-part2", engine.Name)
-		newEngine := &opaspolimiitv1alpha1.OpaEngine{
-			ObjectMeta: metav1.ObjectMeta{
-				Name:      newEngineName,
-				Namespace: engine.Namespace,
-			},
-			Spec: opaspolimiitv1alpha1.OpaEngineSpec{
-				InstanceName: newEngineName,
-				Policies:     policiesToMove,
-			},
+// unschedule removes the policies of the Dependency from the engines it is
+// scheduled in, or migrating to, unless another Dependency needs them
+func (r *DependencyReconciler) unschedule(ctx context.Context, dep *opaspolimiitv1alpha1.Dependency) error {
+	policies, err := dependencyPolicies(ctx, r.Client, dep)
+	if err != nil {
+		return err
+	}
+	engines := slices.Clone(dep.Status.EngineName)
+	if target := dep.Annotations[migrateToAnnotation]; target != "" && !slices.Contains(engines, target) {
+		engines = append(engines, target)
+	}
+	for _, engine := range engines {
+		if err := unloadPolicies(ctx, r.Client, dep.Namespace, engine, policies); err != nil {
+			return err
 		}
+		log.FromContext(ctx).Info("Policies of Dependency released", "OpaEngine", engine, "Policies", policies)
+	}
+	return nil
+}
 
-		// Create the new engine
-		err := r.Create(ctx, newEngine)
+// unloadPolicies removes the policies from the engine, except the ones still
+// needed by the Dependencies scheduled in it. A policy stays in the engine
+// while at least one Dependency that is not being deleted needs it, and the
+// engine is deleted once empty if the operator created it.
+func unloadPolicies(ctx context.Context, c client.Client, namespace, name string, policies []string) error {
+	dependencies := &opaspolimiitv1alpha1.DependencyList{}
+	if err := c.List(ctx, dependencies, client.InNamespace(namespace)); err != nil {
+		return err
+	}
+	needed := []string{}
+	for _, dep := range dependencies.Items {
+		if !dep.DeletionTimestamp.IsZero() || !slices.Contains(dep.Status.EngineName, name) {
+			continue
+		}
+		closure, err := dependencyPolicies(ctx, c, &dep)
 		if err != nil {
-			if !errors.IsAlreadyExists(err) {
-				logger.Error(err, "unable to create new OpaEngine for splitting")
-				return err
-			}
-			logger.Info("New OpaEngine already exists, likely due to concurrent request", "NewEngine", newEngineName)
-			// If it already exists, we need to update the original engine's policies
-			return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
-				if err := r.Get(ctx, client.ObjectKeyFromObject(engine), engine); err != nil {
-					return err
-				}
-				// Remove the policies that were intended to be moved
-				currentPolicies := engine.Spec.Policies
-				newRemainingPolicies := make([]string, 0, len(currentPolicies))
-				policiesToKeep := make(map[string]bool)
-				for _, p := range remainingPolicies {
-					policiesToKeep[p] = true
-				}
-				for _, p := range currentPolicies {
-					if policiesToKeep[p] {
-						newRemainingPolicies = append(newRemainingPolicies, p)
-					}
-				}
-				engine.Spec.Policies = newRemainingPolicies
-				return r.Update(ctx, engine)
-			})
+			return err
 		}
-		logger.Info("Created new OpaEngine for splitting", "NewEngine", newEngineName, "Policies", policiesToMove)
+		needed = append(needed, closure...)
+	}
 
-		// Update the original engine's policies
-		return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
-			if err := r.Get(ctx, client.ObjectKeyFromObject(engine), engine); err != nil {
-				return err
-			}
-			// Remove the policies that were moved
-			currentPolicies := engine.Spec.Policies
-			newRemainingPolicies := make([]string, 0, len(currentPolicies))
-			policiesToRemove := make(map[string]bool)
-			for _, p := range policiesToMove {
-				policiesToRemove[p] = true
-			}
-			for _, p := range currentPolicies {
-				if !policiesToRemove[p] {
-					newRemainingPolicies = append(newRemainingPolicies, p)
-				}
-			}
-			engine.Spec.Policies = newRemainingPolicies
-			return r.Update(ctx, engine)
-		})
-	} else {
-		// Add the policy to the engine if the limit is not exceeded
-		return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
-			if err := r.Get(ctx, client.ObjectKeyFromObject(engine), engine); err != nil {
-				return err
-			}
-			engine.Spec.Policies = updatedPolicies
-			return r.Update(ctx, engine)
+	engine := &opaspolimiitv1alpha1.OpaEngine{}
+	if err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, engine); err != nil {
+			return err
+		}
+		remaining := slices.DeleteFunc(slices.Clone(engine.Spec.Policies), func(p string) bool {
+			return slices.Contains(policies, p) && !slices.Contains(needed, p)
 		})
+		if len(remaining) == len(engine.Spec.Policies) {
+			return nil
+		}
+		engine.Spec.Policies = remaining
+		return c.Update(ctx, engine)
+	}); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+
+	if len(engine.Spec.Policies) == 0 && len(needed) == 0 && reclaimable(engine) {
+		log.FromContext(ctx).Info("Deleting empty OpaEngine", "OpaEngine", name)
+		return client.IgnoreNotFound(c.Delete(ctx, engine))
+	}
+	return nil
+}
+
+// dependencyPolicies returns the policy of the Dependency with its transitive
+// dependencies. When they cannot be resolved, e.g. because the policy has been
+// deleted, only the policy itself is returned.
+func dependencyPolicies(ctx context.Context, c client.Client, dep *opaspolimiitv1alpha1.Dependency) ([]string, error) {
+	policies, err := resolvePolicyNames(ctx, c, dep.Namespace, []string{dep.Spec.PolicyName})
+	if dependencyErrorReason(err) != "" {
+		return []string{dep.Spec.PolicyName}, nil
+	}
+	return policies, err
+}
+
+// schedulePolicies adds the policies to the engine when they fit its
+// capacity, otherwise they are loaded in a new shard of the engine. It
+// returns the name of the engine that received the policies.
+func (r *DependencyReconciler) schedulePolicies(ctx context.Context, policies []string, engine *opaspolimiitv1alpha1.OpaEngine, state scheduler.State) (string, error) {
+	if state.Within(engineLimits(engine, r.DefaultCapacity), append(slices.Clone(engine.Spec.Policies), missingPolicies(engine.Spec.Policies, policies)...)) {
+		return engine.Name, addPoliciesToEngine(ctx, r.Client, policies, engine)
+	}
+	shard, err := r.createShard(ctx, engine, policies)
+	if err != nil {
+		return "", err
+	}
+	return shard.Name, nil
+}
+
+// missingPolicies returns the policies that are not in the current ones
+func missingPolicies(current, policies []string) []string {
+	missing := []string{}
+	for _, p := range policies {
+		if !slices.Contains(current, p) {
+			missing = append(missing, p)
+		}
 	}
+	return missing
 }
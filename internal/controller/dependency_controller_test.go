@@ -22,8 +22,11 @@ import (
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -64,10 +67,19 @@ var _ = Describe("Dependency Controller", Focus, func() {
 		AfterEach(func() {
 			resource := &opaspolimiitv1alpha1.Dependency{}
 			err := k8sClient.Get(ctx, typeNamespacedName, resource)
+			if errors.IsNotFound(err) {
+				Skip("Resource already deleted")
+			}
 			Expect(err).NotTo(HaveOccurred())
 
 			By("Cleanup the specific resource instance Dependency")
 			Expect(k8sClient.Delete(ctx, resource)).To(Succeed())
+			By("Releasing the policies of the deleted Dependency")
+			_, err = (&DependencyReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}).Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
 
 			By("Deleting all opaengines")
 			Expect(client.IgnoreNotFound(k8sClient.DeleteAllOf(ctx, &opaspolimiitv1alpha1.OpaEngine{}))).To(Succeed())
@@ -80,10 +92,12 @@ var _ = Describe("Dependency Controller", Focus, func() {
 				Scheme: k8sClient.Scheme(),
 			}
 
-			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+			result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
 				NamespacedName: typeNamespacedName,
 			})
 			Expect(err).NotTo(HaveOccurred())
+			// The Dependency waits for the Policy through the watches, without polling
+			Expect(result.IsZero()).To(BeTrue())
 
 			dependency := new(opaspolimiitv1alpha1.Dependency)
 			Expect(k8sClient.Get(ctx, typeNamespacedName, dependency)).To(Succeed())
@@ -136,6 +150,9 @@ var _ = Describe("Dependency Controller", Focus, func() {
 				dependency := new(opaspolimiitv1alpha1.Dependency)
 				Expect(k8sClient.Get(ctx, typeNamespacedName, dependency)).To(Succeed())
 				Expect(dependency.Status.EngineName).To(ContainElement("default"))
+				engine := new(opaspolimiitv1alpha1.OpaEngine)
+				Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "default", Namespace: "default"}, engine)).To(Succeed())
+				Expect(reclaimable(engine)).To(BeTrue())
 				Expect(dependency.Status.Conditions).To(HaveLen(1))
 				Expect(dependency.Status.Conditions[0].Type).To(Equal("Available"))
 				Expect(dependency.Status.Conditions[0].Status).To(Equal(metav1.ConditionFalse))
@@ -183,6 +200,301 @@ var _ = Describe("Dependency Controller", Focus, func() {
 				Expect(engine.Spec.Policies).To(ContainElement(policy.Name))
 			})
 
+			It("should follow the policies loaded by the engine", func() {
+				controllerReconciler := &DependencyReconciler{
+					Client: k8sClient,
+					Scheme: k8sClient.Scheme(),
+				}
+				reconcileAndGet := func() *metav1.Condition {
+					_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+					Expect(err).NotTo(HaveOccurred())
+					Expect(k8sClient.Get(ctx, typeNamespacedName, dependency)).To(Succeed())
+					return meta.FindStatusCondition(dependency.Status.Conditions, "Available")
+				}
+				key := types.NamespacedName{Name: "default", Namespace: "default"}
+				engine := new(opaspolimiitv1alpha1.OpaEngine)
+
+				By("Scheduling the policy without loading it")
+				reconcileAndGet()
+				available := reconcileAndGet()
+				Expect(available.Reason).To(Equal("PolicyNotLoaded"))
+				Expect(dependency.Status.Deployed).To(BeFalse())
+
+				By("Loading the policy in the engine")
+				Expect(k8sClient.Get(ctx, key, engine)).To(Succeed())
+				engine.Status.Policies = []string{policy.Name}
+				Expect(k8sClient.Status().Update(ctx, engine)).To(Succeed())
+				available = reconcileAndGet()
+				Expect(available.Status).To(Equal(metav1.ConditionTrue))
+				Expect(dependency.Status.Deployed).To(BeTrue())
+
+				By("Unloading the policy from the engine")
+				Expect(k8sClient.Get(ctx, key, engine)).To(Succeed())
+				engine.Status.Policies = nil
+				Expect(k8sClient.Status().Update(ctx, engine)).To(Succeed())
+				available = reconcileAndGet()
+				Expect(available.Status).To(Equal(metav1.ConditionFalse))
+				Expect(available.Reason).To(Equal("PolicyNotLoaded"))
+				Expect(dependency.Status.Deployed).To(BeFalse())
+
+				By("Deleting the engine")
+				Expect(k8sClient.Delete(ctx, engine)).To(Succeed())
+				available = reconcileAndGet()
+				Expect(available.Status).To(Equal(metav1.ConditionFalse))
+				Expect(available.Reason).To(Equal("Scheduled"))
+				Expect(dependency.Status.EngineName).To(Equal([]string{"default"}))
+				Expect(k8sClient.Get(ctx, key, engine)).To(Succeed())
+				Expect(engine.Spec.Policies).To(Equal([]string{policy.Name}))
+			})
+
+			It("should schedule the dependencies of the policy in the same engine", func() {
+				By("Adding a library to the dependencies of the policy")
+				lib := &opaspolimiitv1alpha1.Policy{
+					ObjectMeta: metav1.ObjectMeta{Name: "test-lib", Namespace: "default"},
+					Spec:       opaspolimiitv1alpha1.PolicySpec{Rego: "package lib\n\nadmins := {\"alice\"}\n"},
+				}
+				Expect(k8sClient.Create(ctx, lib)).To(Succeed())
+				defer func() {
+					Expect(k8sClient.Delete(ctx, lib)).To(Succeed())
+				}()
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(policy), policy)).To(Succeed())
+				policy.Spec.Dependencies = []opaspolimiitv1alpha1.PolicyReference{{Name: lib.Name}}
+				Expect(k8sClient.Update(ctx, policy)).To(Succeed())
+
+				controllerReconciler := &DependencyReconciler{
+					Client: k8sClient,
+					Scheme: k8sClient.Scheme(),
+				}
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+					NamespacedName: typeNamespacedName,
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				engine := new(opaspolimiitv1alpha1.OpaEngine)
+				Expect(k8sClient.Get(ctx, types.NamespacedName{
+					Name:      "default",
+					Namespace: typeNamespacedName.Namespace,
+				}, engine)).To(Succeed())
+				Expect(engine.Spec.Policies).To(Equal([]string{lib.Name, policy.Name}))
+			})
+
+			It("should reject a policy with a missing dependency", func() {
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(policy), policy)).To(Succeed())
+				policy.Spec.Dependencies = []opaspolimiitv1alpha1.PolicyReference{{Name: "missing-lib"}}
+				Expect(k8sClient.Update(ctx, policy)).To(Succeed())
+
+				controllerReconciler := &DependencyReconciler{
+					Client: k8sClient,
+					Scheme: k8sClient.Scheme(),
+				}
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+					NamespacedName: typeNamespacedName,
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				dependency := new(opaspolimiitv1alpha1.Dependency)
+				Expect(k8sClient.Get(ctx, typeNamespacedName, dependency)).To(Succeed())
+				available := meta.FindStatusCondition(dependency.Status.Conditions, "Available")
+				Expect(available).NotTo(BeNil())
+				Expect(available.Status).To(Equal(metav1.ConditionFalse))
+				Expect(available.Reason).To(Equal("MissingDependency"))
+				Expect(available.Message).To(ContainSubstring("missing-lib"))
+				Expect(dependency.Status.EngineName).To(BeEmpty())
+			})
+
+			It("should unschedule the policy once no Dependency needs it", func() {
+				controllerReconciler := &DependencyReconciler{
+					Client: k8sClient,
+					Scheme: k8sClient.Scheme(),
+				}
+				By("Scheduling two Dependencies on the same policy")
+				other := &opaspolimiitv1alpha1.Dependency{
+					ObjectMeta: metav1.ObjectMeta{Name: "other-dependency", Namespace: "default"},
+					Spec:       opaspolimiitv1alpha1.DependencySpec{ServiceName: "other-service", PolicyName: policy.Name},
+				}
+				Expect(k8sClient.Create(ctx, other)).To(Succeed())
+				for _, key := range []types.NamespacedName{typeNamespacedName, client.ObjectKeyFromObject(other)} {
+					_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+					Expect(err).NotTo(HaveOccurred())
+				}
+				Expect(k8sClient.Get(ctx, typeNamespacedName, dependency)).To(Succeed())
+				Expect(dependency.Finalizers).To(ContainElement(DependencyFinalizer))
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(other), other)).To(Succeed())
+				Expect(other.Status.EngineName).To(Equal([]string{"default"}))
+
+				By("Deleting the first Dependency")
+				Expect(k8sClient.Delete(ctx, other)).To(Succeed())
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(other)})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(errors.IsNotFound(k8sClient.Get(ctx, client.ObjectKeyFromObject(other), other))).To(BeTrue())
+				engine := new(opaspolimiitv1alpha1.OpaEngine)
+				Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "default", Namespace: "default"}, engine)).To(Succeed())
+				Expect(engine.Spec.Policies).To(Equal([]string{policy.Name}))
+
+				By("Deleting the last Dependency")
+				Expect(k8sClient.Delete(ctx, dependency)).To(Succeed())
+				_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				err = k8sClient.Get(ctx, types.NamespacedName{Name: "default", Namespace: "default"}, engine)
+				Expect(client.IgnoreNotFound(err)).To(Succeed())
+				if err == nil {
+					Expect(engine.DeletionTimestamp).NotTo(BeNil())
+				}
+			})
+
+			It("should keep the empty engines not created by the operator", func() {
+				controllerReconciler := &DependencyReconciler{
+					Client: k8sClient,
+					Scheme: k8sClient.Scheme(),
+				}
+				By("Scheduling the Dependency in an engine created by the user")
+				engine := &opaspolimiitv1alpha1.OpaEngine{
+					ObjectMeta: metav1.ObjectMeta{Name: "user-engine", Namespace: "default"},
+					Spec:       opaspolimiitv1alpha1.OpaEngineSpec{InstanceName: "user-engine"},
+				}
+				Expect(k8sClient.Create(ctx, engine)).To(Succeed())
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(k8sClient.Get(ctx, typeNamespacedName, dependency)).To(Succeed())
+				Expect(dependency.Status.EngineName).To(Equal([]string{"user-engine"}))
+
+				By("Deleting the Dependency")
+				Expect(k8sClient.Delete(ctx, dependency)).To(Succeed())
+				_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(engine), engine)).To(Succeed())
+				Expect(engine.DeletionTimestamp).To(BeNil())
+				Expect(engine.Spec.Policies).To(BeEmpty())
+			})
+
+			It("should place the policy in the least loaded engine", func() {
+				By("Creating a busy and an idle engine")
+				for name, policies := range map[string][]string{"busy": {"policy-a", "policy-b"}, "idle": {}} {
+					Expect(k8sClient.Create(ctx, &opaspolimiitv1alpha1.OpaEngine{
+						ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+						Spec:       opaspolimiitv1alpha1.OpaEngineSpec{InstanceName: name, Policies: policies},
+					})).To(Succeed())
+				}
+				Expect(k8sClient.Get(ctx, typeNamespacedName, dependency)).To(Succeed())
+				dependency.Spec.Placement = &opaspolimiitv1alpha1.PlacementSpec{Strategy: "LeastLoaded"}
+				Expect(k8sClient.Update(ctx, dependency)).To(Succeed())
+
+				controllerReconciler := &DependencyReconciler{
+					Client: k8sClient,
+					Scheme: k8sClient.Scheme(),
+				}
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+					NamespacedName: typeNamespacedName,
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				engine := new(opaspolimiitv1alpha1.OpaEngine)
+				Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "idle", Namespace: "default"}, engine)).To(Succeed())
+				Expect(engine.Spec.Policies).To(Equal([]string{policy.Name}))
+
+				Expect(k8sClient.Get(ctx, typeNamespacedName, dependency)).To(Succeed())
+				Expect(dependency.Status.EngineName).To(Equal([]string{"idle"}))
+				available := meta.FindStatusCondition(dependency.Status.Conditions, "Available")
+				Expect(available).NotTo(BeNil())
+				Expect(available.Status).To(Equal(metav1.ConditionFalse))
+				Expect(available.Reason).To(Equal("Scheduled"))
+				Expect(available.Message).To(ContainSubstring("LeastLoaded"))
+			})
+
+			It("should load the policy in a new shard when the engines are full", func() {
+				By("Creating a full engine and its first shard")
+				full := []*opaspolimiitv1alpha1.OpaEngine{{
+					ObjectMeta: metav1.ObjectMeta{Name: "full", Namespace: "default"},
+					Spec:       opaspolimiitv1alpha1.OpaEngineSpec{InstanceName: "full", Policies: []string{"policy-a", "policy-b"}},
+				}, {
+					ObjectMeta: metav1.ObjectMeta{Name: "full-1", Namespace: "default", Labels: map[string]string{
+						shardOfLabel:      "full",
+						shardOrdinalLabel: "1",
+					}},
+					Spec: opaspolimiitv1alpha1.OpaEngineSpec{InstanceName: "full-1", Policies: []string{"policy-c", "policy-d"}},
+				}}
+				for _, engine := range full {
+					engine.Spec.Capacity = &opaspolimiitv1alpha1.EngineCapacity{MaxPolicies: ptr.To[int32](2)}
+					Expect(k8sClient.Create(ctx, engine)).To(Succeed())
+				}
+
+				controllerReconciler := &DependencyReconciler{
+					Client:          k8sClient,
+					Scheme:          k8sClient.Scheme(),
+					DefaultCapacity: opaspolimiitv1alpha1.EngineCapacity{MaxPolicies: ptr.To[int32](7)},
+				}
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+					NamespacedName: typeNamespacedName,
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				By("Checking that the policies already loaded are not moved")
+				engine := new(opaspolimiitv1alpha1.OpaEngine)
+				for _, expected := range full {
+					Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(expected), engine)).To(Succeed())
+					Expect(engine.Spec.Policies).To(Equal(expected.Spec.Policies))
+				}
+				Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "full-2", Namespace: "default"}, engine)).To(Succeed())
+				Expect(engine.Spec.Policies).To(Equal([]string{policy.Name}))
+				Expect(engine.Labels).To(HaveKeyWithValue(shardOfLabel, "full"))
+				Expect(engine.Labels).To(HaveKeyWithValue(shardOrdinalLabel, "2"))
+				Expect(engine.Spec.Capacity.MaxPolicies).To(HaveValue(BeEquivalentTo(2)))
+
+				Expect(k8sClient.Get(ctx, typeNamespacedName, dependency)).To(Succeed())
+				Expect(dependency.Status.EngineName).To(Equal([]string{"full-2"}))
+			})
+
+			It("should place the policy with the other policies of its service", func() {
+				By("Creating an idle engine and one serving the same service")
+				for name, policies := range map[string][]string{"alpha": {}, "beta": {"policy-a"}} {
+					Expect(k8sClient.Create(ctx, &opaspolimiitv1alpha1.OpaEngine{
+						ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+						Spec:       opaspolimiitv1alpha1.OpaEngineSpec{InstanceName: name, Policies: policies},
+					})).To(Succeed())
+				}
+				other := &opaspolimiitv1alpha1.Dependency{
+					ObjectMeta: metav1.ObjectMeta{Name: "other-dependency", Namespace: "default"},
+					Spec:       opaspolimiitv1alpha1.DependencySpec{ServiceName: "test-service", PolicyName: "policy-a"},
+				}
+				Expect(k8sClient.Create(ctx, other)).To(Succeed())
+				other.Status.EngineName = []string{"beta"}
+				Expect(k8sClient.Status().Update(ctx, other)).To(Succeed())
+
+				By("Reconciling with the affinity placement as default")
+				controllerReconciler := &DependencyReconciler{
+					Client:           k8sClient,
+					Scheme:           k8sClient.Scheme(),
+					DefaultPlacement: opaspolimiitv1alpha1.PlacementSpec{Strategy: "Affinity"},
+				}
+				_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+					NamespacedName: typeNamespacedName,
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				engine := new(opaspolimiitv1alpha1.OpaEngine)
+				Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "beta", Namespace: "default"}, engine)).To(Succeed())
+				Expect(engine.Spec.Policies).To(Equal([]string{"policy-a", policy.Name}))
+			})
+
 		})
 	})
+
+	It("should only requeue the Dependencies on the changes of the engines they follow", func() {
+		engine := &opaspolimiitv1alpha1.OpaEngine{
+			ObjectMeta: metav1.ObjectMeta{Name: "engine", Namespace: "default", Generation: 1},
+			Spec:       opaspolimiitv1alpha1.OpaEngineSpec{Policies: []string{"policy-a"}},
+		}
+		update := func(mutate func(*opaspolimiitv1alpha1.OpaEngine)) bool {
+			updated := engine.DeepCopy()
+			mutate(updated)
+			return engineDependenciesChanged.Update(event.UpdateEvent{ObjectOld: engine, ObjectNew: updated})
+		}
+
+		Expect(update(func(e *opaspolimiitv1alpha1.OpaEngine) {
+			meta.SetStatusCondition(&e.Status.Conditions, metav1.Condition{Type: "Available", Status: metav1.ConditionTrue})
+		})).To(BeFalse())
+		Expect(update(func(e *opaspolimiitv1alpha1.OpaEngine) { e.Status.Policies = []string{"policy-a"} })).To(BeTrue())
+		Expect(update(func(e *opaspolimiitv1alpha1.OpaEngine) { e.Generation = 2 })).To(BeTrue())
+		Expect(update(func(e *opaspolimiitv1alpha1.OpaEngine) { e.Labels = map[string]string{"shard": "0"} })).To(BeTrue())
+	})
 })
@@ -0,0 +1,140 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	"github.com/bramba2000/opa-scaler/internal/scheduler"
+)
+
+// Annotations of a namespace selecting the placement of its Dependencies
+const (
+	placementStrategyAnnotation   = "opas.polimi.it/placement-strategy"
+	placementLoadMetricAnnotation = "opas.polimi.it/placement-load-metric"
+)
+
+// placement returns the placement of the Dependency. Each field is taken from
+// the Dependency, then from the annotations of its namespace and finally from
+// the default of the operator.
+func (r *DependencyReconciler) placement(ctx context.Context, dep *opaspolimiitv1alpha1.Dependency) (opaspolimiitv1alpha1.PlacementSpec, error) {
+	placement := opaspolimiitv1alpha1.PlacementSpec{}
+	if dep.Spec.Placement != nil {
+		placement = *dep.Spec.Placement
+	}
+
+	namespace := &corev1.Namespace{}
+	if err := r.Get(ctx, client.ObjectKey{Name: dep.Namespace}, namespace); client.IgnoreNotFound(err) != nil {
+		return placement, err
+	}
+	placement.Strategy = cmp.Or(placement.Strategy, namespace.Annotations[placementStrategyAnnotation], r.DefaultPlacement.Strategy)
+	placement.LoadMetric = cmp.Or(placement.LoadMetric, namespace.Annotations[placementLoadMetricAnnotation], r.DefaultPlacement.LoadMetric)
+	return placement, nil
+}
+
+// placementState returns the placement state of the engines, with the
+// services of the Dependencies scheduled in them and the size of the policies
+// and of their documents. The engines without a capacity have the default one.
+func placementState(
+	ctx context.Context,
+	c client.Client,
+	namespace string,
+	engines []opaspolimiitv1alpha1.OpaEngine,
+	defaults opaspolimiitv1alpha1.EngineCapacity,
+) (scheduler.State, error) {
+	dependencies := &opaspolimiitv1alpha1.DependencyList{}
+	if err := c.List(ctx, dependencies, client.InNamespace(namespace)); err != nil {
+		return scheduler.State{}, err
+	}
+	policies := &opaspolimiitv1alpha1.PolicyList{}
+	if err := c.List(ctx, policies, client.InNamespace(namespace)); err != nil {
+		return scheduler.State{}, err
+	}
+	documents := &opaspolimiitv1alpha1.PolicyDataList{}
+	if err := c.List(ctx, documents, client.InNamespace(namespace)); err != nil {
+		return scheduler.State{}, err
+	}
+
+	state := scheduler.State{
+		Sizes:     make(map[string]int64, len(policies.Items)),
+		DataSizes: make(map[string]int64, len(documents.Items)),
+	}
+	for _, policy := range policies.Items {
+		state.Sizes[policy.Name] = policy.Status.Size
+	}
+	for _, data := range documents.Items {
+		state.DataSizes[data.Spec.PolicyName] += data.Status.Size
+	}
+	for _, engine := range engines {
+		services := []string{}
+		for _, dep := range dependencies.Items {
+			if slices.Contains(dep.Status.EngineName, engine.Name) && !slices.Contains(services, dep.Spec.ServiceName) {
+				services = append(services, dep.Spec.ServiceName)
+			}
+		}
+		state.Engines = append(state.Engines, scheduler.Engine{
+			Name:     engine.Name,
+			Policies: engine.Spec.Policies,
+			Services: services,
+			Limits:   engineLimits(&engine, defaults),
+		})
+	}
+	slices.SortFunc(state.Engines, func(a, b scheduler.Engine) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return state, nil
+}
+
+// engineLimits returns the limits of the engine. The capacity of the engine
+// takes precedence over the defaults, and its memory is bounded by the memory
+// limit of its containers.
+func engineLimits(engine *opaspolimiitv1alpha1.OpaEngine, defaults opaspolimiitv1alpha1.EngineCapacity) scheduler.Limits {
+	capacity := defaults
+	if engine.Spec.Capacity != nil {
+		if engine.Spec.Capacity.MaxPolicies != nil {
+			capacity.MaxPolicies = engine.Spec.Capacity.MaxPolicies
+		}
+		if engine.Spec.Capacity.MaxRegoBytes != nil {
+			capacity.MaxRegoBytes = engine.Spec.Capacity.MaxRegoBytes
+		}
+		if engine.Spec.Capacity.MaxDataBytes != nil {
+			capacity.MaxDataBytes = engine.Spec.Capacity.MaxDataBytes
+		}
+	}
+
+	limits := scheduler.Limits{}
+	if capacity.MaxPolicies != nil {
+		limits.MaxPolicies = int(*capacity.MaxPolicies)
+	}
+	if capacity.MaxRegoBytes != nil {
+		limits.MaxRegoSize = capacity.MaxRegoBytes.Value()
+	}
+	if capacity.MaxDataBytes != nil {
+		limits.MaxDataSize = capacity.MaxDataBytes.Value()
+	}
+	if memory, ok := engine.Spec.Resources.Limits[corev1.ResourceMemory]; ok {
+		limits.MaxMemory = memory.Value()
+	}
+	return limits
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+)
+
+// Labels of the OpaEngines created as shards of another one
+const (
+	// shardOfLabel is the name of the engine the shard was split from
+	shardOfLabel = "opas.polimi.it/shard-of"
+	// shardOrdinalLabel is the ordinal of the shard, the name of the shard
+	// is the name of the original engine followed by its ordinal
+	shardOrdinalLabel = "opas.polimi.it/shard-ordinal"
+	// scheduledEngineLabel marks the OpaEngines created by the operator to
+	// schedule the Dependencies, which are deleted once empty
+	scheduledEngineLabel = "opas.polimi.it/scheduled-engine"
+)
+
+// maxShardAttempts bounds the names tried for a new shard when they are taken
+const maxShardAttempts = 10
+
+// createShard creates a new shard of the engine loading the policies. The
+// shards of an engine are named after it with increasing ordinals, so the
+// policies already loaded are never moved when the shards grow. A shard of a
+// shard is a shard of the original engine.
+func (r *DependencyReconciler) createShard(ctx context.Context, engine *opaspolimiitv1alpha1.OpaEngine, policies []string) (*opaspolimiitv1alpha1.OpaEngine, error) {
+	logger := log.FromContext(ctx).WithValues("engine", client.ObjectKeyFromObject(engine))
+
+	root := engine.Name
+	if name, ok := engine.Labels[shardOfLabel]; ok {
+		root = name
+	}
+	shards := &opaspolimiitv1alpha1.OpaEngineList{}
+	if err := r.List(ctx, shards, client.InNamespace(engine.Namespace), client.MatchingLabels{shardOfLabel: root}); err != nil {
+		return nil, err
+	}
+	ordinal := 1
+	for _, shard := range shards.Items {
+		if n, err := strconv.Atoi(shard.Labels[shardOrdinalLabel]); err == nil && n >= ordinal {
+			ordinal = n + 1
+		}
+	}
+
+	for attempt := 0; attempt < maxShardAttempts; attempt, ordinal = attempt+1, ordinal+1 {
+		name := fmt.Sprintf("%s-%d", root, ordinal)
+		shard := &opaspolimiitv1alpha1.OpaEngine{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: engine.Namespace,
+				Labels: map[string]string{
+					shardOfLabel:         root,
+					shardOrdinalLabel:    strconv.Itoa(ordinal),
+					scheduledEngineLabel: "true",
+				},
+			},
+			Spec: *engine.Spec.DeepCopy(),
+		}
+		shard.Spec.InstanceName = name
+		shard.Spec.Policies = policies
+
+		if err := r.Create(ctx, shard); errors.IsAlreadyExists(err) {
+			// The name is taken by an engine that is not a shard, or by a
+			// shard created concurrently
+			logger.Info("OpaEngine already exists, trying the next ordinal", "Shard", name)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		logger.Info("Created new shard of OpaEngine", "Shard", name, "Policies", policies)
+		return shard, nil
+	}
+	return nil, fmt.Errorf("unable to find a free name for a shard of %s", root)
+}
+
+// reclaimable reports if the engine has been created by the operator to
+// schedule the Dependencies, so that it can be deleted once empty. The engines
+// of an OpaEngineSet and the ones created by the users are kept.
+func reclaimable(engine *opaspolimiitv1alpha1.OpaEngine) bool {
+	if _, ok := engine.Labels[engineSetLabel]; ok {
+		return false
+	}
+	_, shard := engine.Labels[shardOfLabel]
+	return shard || engine.Labels[scheduledEngineLabel] == "true"
+}
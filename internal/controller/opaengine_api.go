@@ -0,0 +1,195 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	opamanager "github.com/bramba2000/opa-scaler/internal/opa"
+)
+
+const (
+	// apiHashAnnotation is the annotation of the OPA pods with the
+	// fingerprint of the API settings, as OPA reads them only at startup
+	apiHashAnnotation = "opas.polimi.it/api-hash"
+	// apiCertsVolume is the volume with the certificate served by OPA
+	apiCertsVolume = "api-certs"
+	// apiCertsPath is the path at which the certificate is mounted
+	apiCertsPath = "/certs"
+	// apiTokenEnv is the environment variable with the token required by OPA
+	apiTokenEnv = "OPA_API_TOKEN"
+	// caCertKey is the key of the CA in the TLS Secrets
+	caCertKey = "ca.crt"
+	// opaAuthzFile is the key of the ConfigMap with the policy authorizing
+	// the requests to the API
+	opaAuthzFile = "authz.rego"
+)
+
+// opaAuthzPolicy allows the requests with the token of the engine. The
+// health checks are open, as the kubelet probes cannot send the token.
+const opaAuthzPolicy = `package system.authz
+
+import rego.v1
+
+default allow := false
+
+allow if input.path == ["health"]
+
+allow if input.identity == opa.runtime().env.` + apiTokenEnv + `
+`
+
+// engineAPI is the security of the REST API of an engine, with the contents
+// of its Secrets
+type engineAPI struct {
+	// tls verifies the certificate of OPA, nil for plain HTTP
+	tls *tls.Config
+	// token is sent as bearer token, empty without authentication
+	token string
+	// fingerprint changes with the settings requiring a restart of OPA
+	fingerprint string
+}
+
+// engineAPI reads the Secrets securing the REST API of the engine
+func (r *OpaEngineReconciler) engineAPI(ctx context.Context, engine *opaspolimiitv1alpha1.OpaEngine) (*engineAPI, error) {
+	api := &engineAPI{}
+	spec := engine.Spec.API
+	if spec == nil {
+		return api, nil
+	}
+	hash := sha256.New()
+	if spec.TLSSecretName != "" {
+		secret := &corev1.Secret{}
+		if err := r.Get(ctx, client.ObjectKey{Namespace: engine.Namespace, Name: spec.TLSSecretName}, secret); err != nil {
+			return nil, err
+		}
+		// The pods are reached by IP, so the certificate is checked against
+		// the name of the Service
+		config, err := opamanager.NewTLSConfig(opamanager.TLSOptions{
+			CA:         secret.Data[caCertKey],
+			ServerName: fmt.Sprintf("%s.%s.svc", engine.Name, engine.Namespace),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS Secret %s: %w", spec.TLSSecretName, err)
+		}
+		api.tls = config
+		hash.Write([]byte("tls\x00" + spec.TLSSecretName + "\x00"))
+	}
+	if ref := spec.TokenSecretRef; ref != nil {
+		secret := &corev1.Secret{}
+		if err := r.Get(ctx, client.ObjectKey{Namespace: engine.Namespace, Name: ref.Name}, secret); err != nil {
+			return nil, err
+		}
+		token, ok := secret.Data[ref.Key]
+		if !ok || len(token) == 0 {
+			return nil, fmt.Errorf("no token in key %s of Secret %s", ref.Key, ref.Name)
+		}
+		api.token = string(token)
+		// OPA reads the token from its environment only at startup
+		hash.Write([]byte("token\x00"))
+		hash.Write(token)
+	}
+	api.fingerprint = hex.EncodeToString(hash.Sum(nil))
+	return api, nil
+}
+
+// url returns the url of the OPA REST API of the pod
+func (api *engineAPI) url(pod *corev1.Pod) string {
+	scheme := "http"
+	if api.tls != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(opaPort))
+}
+
+// client returns the client of the OPA instance at url
+func (api *engineAPI) client(url string) *opamanager.Client {
+	c := opamanager.NewClient(url)
+	if api.tls != nil {
+		c = c.WithTLS(api.tls)
+	}
+	c.Token = api.token
+	return c
+}
+
+// podClient returns the client of the OPA REST API of the pod
+func (r *OpaEngineReconciler) podClient(api *engineAPI, pod *corev1.Pod) opamanager.API {
+	url := api.url(pod)
+	if r.NewOpaClient != nil {
+		return r.NewOpaClient(url)
+	}
+	return api.client(url)
+}
+
+// withAPI serves the REST API of OPA over HTTPS and requires the token
+// checked by the authorization policy of the ConfigMap. The pods are
+// restarted when the settings of the API change.
+func withAPI(template *corev1.PodTemplateSpec, spec *opaspolimiitv1alpha1.EngineAPISpec, api *engineAPI) {
+	template.Annotations[apiHashAnnotation] = api.fingerprint
+	podSpec := &template.Spec
+	container := &podSpec.Containers[0]
+	if spec.TLSSecretName != "" {
+		podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+			Name: apiCertsVolume,
+			VolumeSource: corev1.VolumeSource{
+				Secret: &corev1.SecretVolumeSource{SecretName: spec.TLSSecretName},
+			},
+		})
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name: apiCertsVolume, MountPath: apiCertsPath, ReadOnly: true,
+		})
+		// The certificate is reloaded when the Secret is renewed
+		container.Args = append(container.Args,
+			"--tls-cert-file", apiCertsPath+"/"+corev1.TLSCertKey,
+			"--tls-private-key-file", apiCertsPath+"/"+corev1.TLSPrivateKeyKey,
+			"--tls-cert-refresh-period", "1m",
+		)
+		for _, probe := range []*corev1.Probe{container.LivenessProbe, container.ReadinessProbe} {
+			if probe.HTTPGet != nil {
+				probe.HTTPGet.Scheme = corev1.URISchemeHTTPS
+			}
+		}
+	}
+	if spec.TokenSecretRef != nil {
+		container.Args = append(container.Args,
+			"--authentication", "token",
+			"--authorization", "basic",
+			opaConfigPath+"/"+opaAuthzFile,
+		)
+		container.Env = append(container.Env, corev1.EnvVar{
+			Name:      apiTokenEnv,
+			ValueFrom: &corev1.EnvVarSource{SecretKeyRef: spec.TokenSecretRef},
+		})
+	}
+}
+
+// apiScheme returns the scheme of the REST API of the engine
+func apiScheme(engine *opaspolimiitv1alpha1.OpaEngine) string {
+	if engine.Spec.API != nil && engine.Spec.API.TLSSecretName != "" {
+		return "https"
+	}
+	return "http"
+}
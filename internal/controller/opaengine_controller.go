@@ -18,12 +18,13 @@ package controller
 
 import (
 	"context"
-	"fmt"
+	"os"
 	"slices"
 	"time"
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -31,11 +32,18 @@ import (
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/yaml"
 
 	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	"github.com/bramba2000/opa-scaler/internal/bundle"
+	"github.com/bramba2000/opa-scaler/internal/oci"
 	opamanager "github.com/bramba2000/opa-scaler/internal/opa"
 )
 
@@ -44,6 +52,25 @@ const (
 	typeAvailableOpaEngine = "Available"
 	// typeDegradedOpaEngine is the type of the condition for an OpaEngine that is degraded
 	typeDegradedOpaEngine = "Degraded"
+	// typePolicyDriftOpaEngine is the type of the condition for an OpaEngine whose loaded
+	// modules diverged from the expected policies
+	typePolicyDriftOpaEngine = "PolicyDrift"
+)
+
+// driftCheckInterval is the period between two checks of the modules loaded in an OpaEngine
+const driftCheckInterval = time.Minute
+
+const (
+	// opaConfigPath is the directory where the OPA configuration is mounted
+	opaConfigPath = "/config"
+	// opaConfigFile is the key of the OPA configuration in the ConfigMap
+	opaConfigFile = "config.yaml"
+	// opaBundleService is the name of the bundle server in the OPA configuration
+	opaBundleService = "opa-scaler"
+	// opaBundleName is the name of the bundle of the engine in the OPA configuration
+	opaBundleName = "opa-scaler"
+	// opaBundleCAFile is the key of the CA of the bundle server in the ConfigMap
+	opaBundleCAFile = "bundle-ca.crt"
 )
 
 const OpaEngineFinalizer = "opa-scaler.polimi.it/oe-finalizer"
@@ -52,14 +79,36 @@ const OpaEngineFinalizer = "opa-scaler.polimi.it/oe-finalizer"
 type OpaEngineReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
+
+	// Puller fetches the policies distributed as OCI images
+	Puller *oci.Puller
+
+	// NewOpaClient returns the client of the OPA instance at url,
+	// opamanager.NewClient if nil
+	NewOpaClient func(url string) opamanager.API
+
+	// Bundles serves the policies of each engine to its OPA replicas
+	Bundles *bundle.Server
+
+	// BundleServiceURL is the url at which the OPA replicas reach the bundle server
+	BundleServiceURL string
+
+	// BundleCAFile is the CA of the certificate of the bundle server, trusted
+	// by the OPA replicas. Empty if the bundles are served over plain HTTP.
+	BundleCAFile string
 }
 
 // +kubebuilder:rbac:groups=opas.polimi.it,resources=opaengines,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=opas.polimi.it,resources=opaengines/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups=opas.polimi.it,resources=opaengines/finalizers,verbs=update
 // +kubebuilder:rbac:groups=opas.polimi.it,resources=policies,verbs=get;list;watch
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=policydata,verbs=get;list;watch
 // +kubebuilder:rbac:groups=apps,resources=deployments,verbs=get;list;watch;create;update;patch;delete;deletecollection
 // +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete;deletecollection
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=pods/status,verbs=get;update;patch
 
 // Reconcile reads that state of the cluster for a OpaEngine object and makes changes based on the state read
 // and what is in the OpaEngine.Spec
@@ -130,6 +179,17 @@ func (r *OpaEngineReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 				logger.Error(err, "unable to delete Service for OpaEngine")
 				return ctrl.Result{}, err
 			}
+			// Engines created before the bundle server have no configuration
+			if err := r.Delete(ctx, &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      configMapName(engine),
+					Namespace: engine.Namespace,
+				},
+			}); client.IgnoreNotFound(err) != nil {
+				logger.Error(err, "unable to delete ConfigMap for OpaEngine")
+				return ctrl.Result{}, err
+			}
+			r.Bundles.Delete(engine.Namespace, engine.Name)
 
 			logger.Info("Removing finalizer from OpaEngine")
 			if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
@@ -180,6 +240,73 @@ func (r *OpaEngineReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 			logger.Error(err, "unable to create Service for OpaEngine", "Service.Namespace", ser.Namespace, "Service.Name", ser.Name)
 			return ctrl.Result{}, err
 		}
+	} else if err != nil {
+		logger.Error(err, "unable to get Service for OpaEngine")
+		return ctrl.Result{}, err
+	} else if ports := servicePortsForOpaEngine(engine); servicePortsChanged(foundService.Spec.Ports, ports) {
+		// The external authorization port is exposed while the mode is enabled
+		logger.Info("Updating the Service ports", "Service.Namespace", foundService.Namespace, "Service.Name", foundService.Name)
+		foundService.Spec.Ports = ports
+		if err := r.Update(ctx, foundService); err != nil {
+			logger.Error(err, "unable to update Service for OpaEngine")
+			return ctrl.Result{}, err
+		}
+	}
+
+	// Load the keys signing the bundles
+	keys, activeKey, err := r.signingKeys(ctx, engine)
+	if err != nil {
+		logger.Error(err, "unable to load the signing keys of OpaEngine")
+		if err := r.addCondition(ctx, req, metav1.Condition{
+			Type:    typeDegradedOpaEngine,
+			Status:  metav1.ConditionTrue,
+			Reason:  "SigningKeyError",
+			Message: truncate(err.Error(), maxConditionMessage),
+		}); err != nil {
+			logger.Error(err, "unable to add condition to OpaEngine")
+		}
+		return ctrl.Result{}, err
+	}
+
+	// Load the Secrets securing the OPA API
+	api, err := r.engineAPI(ctx, engine)
+	if err != nil {
+		logger.Error(err, "unable to load the API Secrets of OpaEngine")
+		if err := r.addCondition(ctx, req, metav1.Condition{
+			Type:    typeDegradedOpaEngine,
+			Status:  metav1.ConditionTrue,
+			Reason:  "APISecretError",
+			Message: truncate(err.Error(), maxConditionMessage),
+		}); err != nil {
+			logger.Error(err, "unable to add condition to OpaEngine")
+		}
+		return ctrl.Result{}, err
+	}
+
+	// Check the OPA configuration, kept in sync with the bundle server url and the keys
+	config, err := r.configMapForOpaEngine(engine, activeKey)
+	if err != nil {
+		logger.Error(err, "unable to create configuration for OpaEngine")
+		return ctrl.Result{}, err
+	}
+	foundConfig := &corev1.ConfigMap{}
+	err = r.Get(ctx, client.ObjectKeyFromObject(config), foundConfig)
+	if err != nil && apierrors.IsNotFound(err) {
+		logger.Info("Creating a new ConfigMap", "ConfigMap.Namespace", config.Namespace, "ConfigMap.Name", config.Name)
+		if err := r.Create(ctx, config); err != nil {
+			logger.Error(err, "unable to create ConfigMap for OpaEngine", "ConfigMap.Namespace", config.Namespace, "ConfigMap.Name", config.Name)
+			return ctrl.Result{}, err
+		}
+	} else if err != nil {
+		logger.Error(err, "unable to get ConfigMap for OpaEngine")
+		return ctrl.Result{}, err
+	} else if !equality.Semantic.DeepEqual(foundConfig.Data, config.Data) {
+		logger.Info("Updating the ConfigMap", "ConfigMap.Namespace", config.Namespace, "ConfigMap.Name", config.Name)
+		foundConfig.Data = config.Data
+		if err := r.Update(ctx, foundConfig); err != nil {
+			logger.Error(err, "unable to update ConfigMap for OpaEngine")
+			return ctrl.Result{}, err
+		}
 	}
 
 	// Check the OpaEngine deployment
@@ -189,7 +316,7 @@ func (r *OpaEngineReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 	// If the deployment doesn't exist, create it
 	if err != nil && apierrors.IsNotFound(err) {
 		// Create the deployment
-		dep, err := r.deploymentForOpaEngine(engine)
+		dep, err := r.deploymentForOpaEngine(engine, config, activeKey, api)
 		if err != nil {
 			// The error has been thrown only if there is another OwnerReference with Controller flag set
 			logger.Error(err, "unable to create deployment for OpaEngine")
@@ -224,6 +351,23 @@ func (r *OpaEngineReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		return ctrl.Result{}, err
 	}
 
+	// Roll out the changes of the engine, and restart the replicas when the
+	// configuration changed, as OPA reads it only at startup
+	dep, err := r.deploymentForOpaEngine(engine, config, activeKey, api)
+	if err != nil {
+		logger.Error(err, "unable to create deployment for OpaEngine")
+		return ctrl.Result{}, err
+	}
+	if deploymentDrifted(foundDeployment, dep) {
+		logger.Info("Updating the Deployment", "Deployment.Namespace", dep.Namespace, "Deployment.Name", dep.Name)
+		foundDeployment.Spec.Replicas = dep.Spec.Replicas
+		foundDeployment.Spec.Template = dep.Spec.Template
+		if err := r.Update(ctx, foundDeployment); err != nil {
+			logger.Error(err, "unable to update Deployment for OpaEngine")
+			return ctrl.Result{}, err
+		}
+	}
+
 	// Check if all conditions are satisfied
 	if foundDeployment.Status.AvailableReplicas == *foundDeployment.Spec.Replicas {
 		r.addCondition(ctx, req, metav1.Condition{
@@ -241,51 +385,10 @@ func (r *OpaEngineReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 		})
 	}
 
-	// If the deployment is available, process policies
-	if foundDeployment.Status.AvailableReplicas == *foundDeployment.Spec.Replicas {
-		toBeAdded, toBeRemoved := opamanager.MergePolicies(engine.Spec.Policies, engine.Status.Policies)
-		url := fmt.Sprintf("http://%s.%s.svc.cluster.local:8181", engine.Name, engine.Namespace)
-		logger.Info("Policy situation", "ToBeAdded", toBeAdded, "ToBeRemoved", toBeRemoved, "Spec", engine.Spec.Policies, "Status", engine.Status.Policies)
-		if len(toBeAdded) > 0 {
-			policies := make(map[string]string)
-			for _, p := range toBeAdded {
-				code, err := r.getPolicyCode(ctx, req, p)
-				if err != nil {
-					logger.Error(err, "unable to fetch policy code")
-					return ctrl.Result{}, err
-				}
-				policies[p] = code
-			}
-			added, err := opamanager.PushPolicies(ctx, url, policies)
-			if err != nil {
-				logger.Error(err, "unable to add policies")
-				return ctrl.Result{}, err
-			}
-			logger.Info("Added policies", "Added", added)
-			engine.Status.Policies = append(engine.Status.Policies, added...)
-			if err := r.Status().Update(ctx, engine); err != nil && !apierrors.IsConflict(err) {
-				logger.Error(err, "unable to update OpaEngine status")
-				return ctrl.Result{}, err
-			}
-		}
-		if len(toBeRemoved) > 0 {
-			removed, err := opamanager.DeletePolicies(ctx, url, toBeRemoved)
-			if err != nil {
-				logger.Error(err, "unable to remove policies")
-				return ctrl.Result{}, err
-			}
-			logger.Info("Removed policies", "Policies", removed)
-			engine.Status.Policies = slices.DeleteFunc(engine.Status.Policies, func(s string) bool {
-				return slices.Contains(removed, s)
-			})
-			if err := r.Status().Update(ctx, engine); err != nil {
-				logger.Error(err, "unable to update OpaEngine status")
-				return ctrl.Result{}, err
-			}
-		}
-	}
-
-	return ctrl.Result{}, nil
+	// Publish the bundle of the expected policies and check that every
+	// running replica activated it. Pods are not required to be ready, as
+	// the readiness gate waits for the policies.
+	return r.syncPolicies(ctx, req, engine, keys, api)
 }
 
 // SetupWithManager sets up the controller with the Manager.
@@ -294,18 +397,108 @@ func (r *OpaEngineReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		For(&opaspolimiitv1alpha1.OpaEngine{}).
 		Owns(&appsv1.Deployment{}).
 		Owns(&corev1.Service{}).
+		Owns(&corev1.ConfigMap{}).
+		// Only the metadata of the Secrets is cached, their data is read when reconciling
+		WatchesMetadata(
+			&corev1.Secret{},
+			handler.EnqueueRequestsFromMapFunc(r.enginesOfSecret),
+			builder.WithPredicates(referencedSecret(r.Client)),
+		).
+		Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.enginesOfDataSource)).
+		Watches(&corev1.Pod{}, handler.EnqueueRequestsFromMapFunc(engineOfPod)).
+		Watches(
+			&opaspolimiitv1alpha1.Policy{},
+			handler.EnqueueRequestsFromMapFunc(r.enginesOfPolicy),
+			builder.WithPredicates(policyGraphChanged),
+		).
+		Watches(
+			&opaspolimiitv1alpha1.PolicyData{},
+			handler.EnqueueRequestsFromMapFunc(r.enginesOfPolicyData),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{}),
+		).
 		Complete(r)
 }
 
-// Generate the deployment for the OpaEngine
-func (r *OpaEngineReconciler) deploymentForOpaEngine(engine *opaspolimiitv1alpha1.OpaEngine) (*appsv1.Deployment, error) {
-	labels := map[string]string{
+// enginesOfPolicy maps a Policy to the OpaEngines that expect or have loaded
+// it, or a policy depending on it
+func (r *OpaEngineReconciler) enginesOfPolicy(ctx context.Context, obj client.Object) []reconcile.Request {
+	logger := log.FromContext(ctx)
+
+	engines := &opaspolimiitv1alpha1.OpaEngineList{}
+	if err := r.List(ctx, engines, client.InNamespace(obj.GetNamespace())); err != nil {
+		logger.Error(err, "unable to list OpaEngines", "Policy", obj.GetName())
+		return nil
+	}
+	names := []string{obj.GetName()}
+	for _, dependent := range policiesDependingOn(ctx, r.Client, obj) {
+		names = append(names, dependent.Name)
+	}
+	requests := []reconcile.Request{}
+	for _, engine := range engines.Items {
+		if slices.ContainsFunc(names, func(name string) bool {
+			return slices.Contains(engine.Spec.Policies, name) || slices.Contains(engine.Status.Policies, name)
+		}) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&engine)})
+		}
+	}
+	return requests
+}
+
+// labelsForOpaEngine returns the labels of the resources owned by the OpaEngine
+func labelsForOpaEngine(engine *opaspolimiitv1alpha1.OpaEngine) map[string]string {
+	return map[string]string{
 		"app.kubernetes.io/name":       engine.Name,
 		"app.kubernetes.io/instance":   engine.Spec.InstanceName,
 		"app.kubernetes.io/component":  "opa-engine",
 		"app.kubernetes.io/part-of":    "opa-scaler",
 		"app.kubernetes.io/managed-by": "opa-scaler-operator",
 	}
+}
+
+// deploymentDrifted reports whether the deployment differs from the desired
+// one in the fields set from the OpaEngine. The rest of the template is
+// defaulted by the API server, so it is not compared.
+func deploymentDrifted(found, desired *appsv1.Deployment) bool {
+	if *found.Spec.Replicas != *desired.Spec.Replicas {
+		return true
+	}
+	for _, annotation := range []string{configHashAnnotation, apiHashAnnotation} {
+		if found.Spec.Template.Annotations[annotation] != desired.Spec.Template.Annotations[annotation] {
+			return true
+		}
+	}
+	if len(found.Spec.Template.Spec.Containers) == 0 {
+		return true
+	}
+	container, want := found.Spec.Template.Spec.Containers[0], desired.Spec.Template.Spec.Containers[0]
+	return container.Image != want.Image ||
+		!equality.Semantic.DeepEqual(container.Resources.Limits, want.Resources.Limits) ||
+		!equality.Semantic.DeepEqual(resourceRequests(container.Resources), resourceRequests(want.Resources))
+}
+
+// resourceRequests returns the requests of the resources, defaulted to the
+// limits as the API server does
+func resourceRequests(resources corev1.ResourceRequirements) corev1.ResourceList {
+	requests := resources.Requests.DeepCopy()
+	for name, limit := range resources.Limits {
+		if _, ok := requests[name]; !ok {
+			if requests == nil {
+				requests = corev1.ResourceList{}
+			}
+			requests[name] = limit
+		}
+	}
+	return requests
+}
+
+// Generate the deployment for the OpaEngine
+func (r *OpaEngineReconciler) deploymentForOpaEngine(
+	engine *opaspolimiitv1alpha1.OpaEngine,
+	config *corev1.ConfigMap,
+	key *bundle.Key,
+	api *engineAPI,
+) (*appsv1.Deployment, error) {
+	labels := labelsForOpaEngine(engine)
 
 	replicas := engine.Spec.Replicas
 	if replicas == 0 {
@@ -326,13 +519,39 @@ func (r *OpaEngineReconciler) deploymentForOpaEngine(engine *opaspolimiitv1alpha
 			Template: corev1.PodTemplateSpec{
 				ObjectMeta: metav1.ObjectMeta{
 					Labels: labels,
+					Annotations: map[string]string{
+						configHashAnnotation: configHash(config, key),
+					},
 				},
 				Spec: corev1.PodSpec{
+					// The pods are ready only once the policies have been pushed
+					ReadinessGates: []corev1.PodReadinessGate{
+						{ConditionType: PoliciesLoadedCondition},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "config",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{Name: configMapName(engine)},
+								},
+							},
+						},
+					},
 					Containers: []corev1.Container{
 						{
 							Name:  "opa",
 							Image: engine.Spec.Image,
-							Args:  []string{"run", "--server", "--addr", ":8181", "--log-level", "debug"},
+							Args: []string{
+								"run", "--server", "--addr", ":8181", "--log-level", "debug",
+								"--config-file", opaConfigPath + "/" + opaConfigFile,
+							},
+							Env: signingKeyEnv(engine, key),
+							// The scheduler packs the policies against the limits of the engine
+							Resources: engine.Spec.Resources,
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "config", MountPath: opaConfigPath, ReadOnly: true},
+							},
 							LivenessProbe: &corev1.Probe{
 								ProbeHandler: corev1.ProbeHandler{
 									HTTPGet: &corev1.HTTPGetAction{
@@ -360,6 +579,13 @@ func (r *OpaEngineReconciler) deploymentForOpaEngine(engine *opaspolimiitv1alpha
 		},
 	}
 
+	if engine.Spec.ExtAuthz != nil {
+		withExtAuthz(&dep.Spec.Template.Spec.Containers[0], engine.Spec.ExtAuthz)
+	}
+	if engine.Spec.API != nil {
+		withAPI(&dep.Spec.Template, engine.Spec.API, api)
+	}
+
 	// Set OpaEngine instance as the owner and controller
 	if err := ctrl.SetControllerReference(engine, dep, r.Scheme); err != nil {
 		return nil, err
@@ -370,13 +596,7 @@ func (r *OpaEngineReconciler) deploymentForOpaEngine(engine *opaspolimiitv1alpha
 
 // Generate the service for the OpaEngine
 func (r *OpaEngineReconciler) serviceForOpaEngine(engine *opaspolimiitv1alpha1.OpaEngine) (*corev1.Service, error) {
-	labels := map[string]string{
-		"app.kubernetes.io/name":       engine.Name,
-		"app.kubernetes.io/instance":   engine.Spec.InstanceName,
-		"app.kubernetes.io/component":  "opa-engine",
-		"app.kubernetes.io/part-of":    "opa-scaler",
-		"app.kubernetes.io/managed-by": "opa-scaler-operator",
-	}
+	labels := labelsForOpaEngine(engine)
 
 	svc := &corev1.Service{
 		ObjectMeta: metav1.ObjectMeta{
@@ -386,12 +606,7 @@ func (r *OpaEngineReconciler) serviceForOpaEngine(engine *opaspolimiitv1alpha1.O
 		},
 		Spec: corev1.ServiceSpec{
 			Selector: labels,
-			Ports: []corev1.ServicePort{
-				{
-					Name: "http",
-					Port: 8181,
-				},
-			},
+			Ports:    servicePortsForOpaEngine(engine),
 		},
 	}
 
@@ -403,6 +618,108 @@ func (r *OpaEngineReconciler) serviceForOpaEngine(engine *opaspolimiitv1alpha1.O
 	return svc, nil
 }
 
+// configMapName returns the name of the ConfigMap holding the OPA configuration of the engine
+func configMapName(engine *opaspolimiitv1alpha1.OpaEngine) string {
+	return engine.Name + "-config"
+}
+
+// opaConfigForEngine returns the OPA configuration downloading the bundle of
+// the engine from the bundle server. The status plugin exposes the active
+// revision of the bundle on /v1/status without reporting it elsewhere. With a
+// signing key, OPA downloads the variant of the bundle signed with it and
+// rejects the bundles without a valid signature.
+func (r *OpaEngineReconciler) opaConfigForEngine(engine *opaspolimiitv1alpha1.OpaEngine, key *bundle.Key) ([]byte, error) {
+	// The bundle is downloaded with the token of the API of the engine, or
+	// with the one of the service account of the pods
+	service := map[string]any{
+		"url": r.BundleServiceURL,
+		"credentials": map[string]any{
+			"bearer": map[string]any{
+				"token_path": bundle.ServiceAccountTokenPath,
+			},
+		},
+	}
+	if engine.Spec.API != nil && engine.Spec.API.TokenSecretRef != nil {
+		// OPA replaces the variable with the token read from its environment
+		service["credentials"] = map[string]any{
+			"bearer": map[string]any{
+				"token": "${" + apiTokenEnv + "}",
+			},
+		}
+	}
+	if r.BundleCAFile != "" {
+		service["tls"] = map[string]any{
+			"ca_cert": opaConfigPath + "/" + opaBundleCAFile,
+		}
+	}
+	source := map[string]any{
+		"service":  opaBundleService,
+		"resource": bundle.Path(engine.Namespace, engine.Name, ""),
+		"polling": map[string]any{
+			"min_delay_seconds": 5,
+			"max_delay_seconds": 15,
+		},
+	}
+	config := map[string]any{
+		"services": map[string]any{
+			opaBundleService: service,
+		},
+		"bundles": map[string]any{
+			opaBundleName: source,
+		},
+		"status": map[string]any{
+			"prometheus": true,
+		},
+	}
+	if engine.Spec.ExtAuthz != nil {
+		opaExtAuthzConfig(config, engine.Spec.ExtAuthz)
+	}
+	if key != nil {
+		config["keys"] = opaKeysConfig(key)
+		source["resource"] = bundle.Path(engine.Namespace, engine.Name, key.ID)
+		source["signing"] = map[string]any{
+			"keyid": key.ID,
+		}
+	}
+	return yaml.Marshal(config)
+}
+
+// Generate the ConfigMap with the OPA configuration of the OpaEngine
+func (r *OpaEngineReconciler) configMapForOpaEngine(engine *opaspolimiitv1alpha1.OpaEngine, key *bundle.Key) (*corev1.ConfigMap, error) {
+	config, err := r.opaConfigForEngine(engine, key)
+	if err != nil {
+		return nil, err
+	}
+
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      configMapName(engine),
+			Namespace: engine.Namespace,
+			Labels:    labelsForOpaEngine(engine),
+		},
+		Data: map[string]string{
+			opaConfigFile: string(config),
+		},
+	}
+	if engine.Spec.API != nil && engine.Spec.API.TokenSecretRef != nil {
+		cm.Data[opaAuthzFile] = opaAuthzPolicy
+	}
+	if r.BundleCAFile != "" {
+		ca, err := os.ReadFile(r.BundleCAFile)
+		if err != nil {
+			return nil, err
+		}
+		cm.Data[opaBundleCAFile] = string(ca)
+	}
+
+	// Set OpaEngine instance as the owner and controller
+	if err := ctrl.SetControllerReference(engine, cm, r.Scheme); err != nil {
+		return nil, err
+	}
+
+	return cm, nil
+}
+
 func (r *OpaEngineReconciler) addCondition(ctx context.Context, req ctrl.Request, condition metav1.Condition) error {
 	logger := log.FromContext(ctx)
 
@@ -418,14 +735,3 @@ func (r *OpaEngineReconciler) addCondition(ctx context.Context, req ctrl.Request
 		return nil
 	})
 }
-
-func (r *OpaEngineReconciler) getPolicyCode(ctx context.Context, req ctrl.Request, name string) (string, error) {
-	logger := log.FromContext(ctx)
-
-	policy := new(opaspolimiitv1alpha1.Policy)
-	if err := r.Get(ctx, client.ObjectKey{Namespace: req.Namespace, Name: name}, policy); err != nil {
-		logger.Error(err, "unable to fetch Policy")
-		return "", err
-	}
-	return policy.Spec.Rego, nil
-}
@@ -18,20 +18,156 @@ package controller
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	"github.com/bramba2000/opa-scaler/internal/bundle"
+	opamanager "github.com/bramba2000/opa-scaler/internal/opa"
 )
 
+// fakeOpaClient stores the modules in memory in place of an OPA instance
+type fakeOpaClient struct {
+	policies map[string]string
+	// revision is the revision of the bundle reported as active
+	revision string
+	// code is the error reported for the activation of the bundle
+	code string
+	// data holds the documents by path
+	data map[string]json.RawMessage
+	// patches counts the documents updated with a JSON Patch
+	patches int
+}
+
+var _ opamanager.API = &fakeOpaClient{}
+
+func newFakeOpaClient() *fakeOpaClient {
+	return &fakeOpaClient{policies: map[string]string{}, data: map[string]json.RawMessage{}}
+}
+
+// activate reports the revision as active, with the modules of its bundle loaded
+func (f *fakeOpaClient) activate(revision string, modules map[string]string) {
+	activated, err := bundle.ActivatedModules(opaBundleName, modules)
+	Expect(err).NotTo(HaveOccurred())
+	f.revision = revision
+	f.policies = activated
+}
+
+func (f *fakeOpaClient) ListPolicies(ctx context.Context) ([]string, error) {
+	ids := []string{}
+	for id := range f.policies {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func (f *fakeOpaClient) GetPolicy(ctx context.Context, id string) (*opamanager.Policy, error) {
+	return &opamanager.Policy{ID: id, Raw: f.policies[id]}, nil
+}
+
+func (f *fakeOpaClient) PutPolicy(ctx context.Context, id, code string) error {
+	f.policies[id] = code
+	return nil
+}
+
+func (f *fakeOpaClient) DeletePolicy(ctx context.Context, id string) error {
+	delete(f.policies, id)
+	return nil
+}
+
+func (f *fakeOpaClient) PushPolicies(ctx context.Context, policies map[string]string) opamanager.Results {
+	results := opamanager.Results{}
+	for id, code := range policies {
+		f.policies[id] = code
+		results = append(results, opamanager.Result{ID: id})
+	}
+	return results
+}
+
+func (f *fakeOpaClient) DeletePolicies(ctx context.Context, ids []string) opamanager.Results {
+	results := opamanager.Results{}
+	for _, id := range ids {
+		delete(f.policies, id)
+		results = append(results, opamanager.Result{ID: id})
+	}
+	return results
+}
+
+func (f *fakeOpaClient) GetData(ctx context.Context, path string) (json.RawMessage, error) {
+	return f.data[path], nil
+}
+
+func (f *fakeOpaClient) PutData(ctx context.Context, path string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	f.data[path] = data
+	return nil
+}
+
+func (f *fakeOpaClient) PatchData(ctx context.Context, path string, ops []opamanager.PatchOperation) error {
+	document := map[string]any{}
+	if err := json.Unmarshal(f.data[path], &document); err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.Op == "remove" {
+			delete(document, op.Path[1:])
+		} else {
+			document[op.Path[1:]] = op.Value
+		}
+	}
+	f.patches++
+	return f.PutData(ctx, path, document)
+}
+
+func (f *fakeOpaClient) DeleteData(ctx context.Context, path string) error {
+	delete(f.data, path)
+	return nil
+}
+
+func (f *fakeOpaClient) Evaluate(ctx context.Context, path string, input any) (json.RawMessage, error) {
+	return nil, nil
+}
+
+func (f *fakeOpaClient) Health(ctx context.Context, opts opamanager.HealthOptions) error {
+	return nil
+}
+
+func (f *fakeOpaClient) Status(ctx context.Context) (*opamanager.Status, error) {
+	status := opamanager.BundleStatus{Name: opaBundleName, ActiveRevision: f.revision}
+	if f.code != "" {
+		status.Code = f.code
+		status.Message = "activation failed"
+	}
+	return &opamanager.Status{Bundles: map[string]opamanager.BundleStatus{opaBundleName: status}}, nil
+}
+
+func (f *fakeOpaClient) Config(ctx context.Context) (map[string]any, error) {
+	return map[string]any{}, nil
+}
+
 var _ = Describe("OpaEngine Controller", func() {
 	Context("When reconciling a resource", func() {
 		const resourceName = "test-resource"
@@ -93,8 +229,9 @@ var _ = Describe("OpaEngine Controller", func() {
 
 			By("Reconciling the OpaEngine")
 			controllerReconciler := &OpaEngineReconciler{
-				Client: k8sClient,
-				Scheme: k8sClient.Scheme(),
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Bundles: bundle.NewServer(""),
 			}
 			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{
 				NamespacedName: typeNamespacedName,
@@ -114,8 +251,9 @@ var _ = Describe("OpaEngine Controller", func() {
 		It("should successfully create owned resources", func() {
 			By("Reconciling the OpaEngine")
 			controllerReconciler := &OpaEngineReconciler{
-				Client: k8sClient,
-				Scheme: k8sClient.Scheme(),
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Bundles: bundle.NewServer(""),
 			}
 			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
 				NamespacedName: typeNamespacedName,
@@ -135,11 +273,197 @@ var _ = Describe("OpaEngine Controller", func() {
 			Expect(service.OwnerReferences).To(HaveLen(1))
 		})
 
+		It("should bound the OPA container with the resources of the engine", func() {
+			bounded := &opaspolimiitv1alpha1.OpaEngine{
+				ObjectMeta: metav1.ObjectMeta{Name: "bounded-engine", Namespace: "default"},
+				Spec: opaspolimiitv1alpha1.OpaEngineSpec{
+					InstanceName: "default",
+					Resources: corev1.ResourceRequirements{
+						Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("256Mi")},
+					},
+				},
+			}
+			Expect(k8sClient.Create(ctx, bounded)).To(Succeed())
+			DeferCleanup(func() {
+				Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(bounded), bounded)).To(Succeed())
+				bounded.SetFinalizers(nil)
+				Expect(k8sClient.Update(ctx, bounded)).To(Succeed())
+				Expect(k8sClient.Delete(ctx, bounded)).To(Succeed())
+			})
+
+			By("Reconciling the OpaEngine")
+			controllerReconciler := &OpaEngineReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Bundles: bundle.NewServer(""),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(bounded)})
+			Expect(err).NotTo(HaveOccurred())
+
+			deployment := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(bounded), deployment)).To(Succeed())
+			limits := deployment.Spec.Template.Spec.Containers[0].Resources.Limits
+			Expect(limits.Memory().String()).To(Equal("256Mi"))
+		})
+
+		It("should roll out the changes of the engine to the deployment", func() {
+			By("Reconciling the OpaEngine")
+			controllerReconciler := &OpaEngineReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Bundles: bundle.NewServer(""),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Changing the replicas, the image and the resources of the engine")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			opaengine.Spec.Replicas = 3
+			opaengine.Spec.Image = "openpolicyagent/opa:1.0.0"
+			opaengine.Spec.Resources = corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("512Mi")},
+			}
+			Expect(k8sClient.Update(ctx, opaengine)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			deployment := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deployment)).To(Succeed())
+			Expect(*deployment.Spec.Replicas).To(Equal(int32(3)))
+			container := deployment.Spec.Template.Spec.Containers[0]
+			Expect(container.Image).To(Equal("openpolicyagent/opa:1.0.0"))
+			Expect(container.Resources.Limits.Memory().String()).To(Equal("512Mi"))
+
+			By("Leaving the deployment alone once it matches the engine")
+			version := deployment.ResourceVersion
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deployment)).To(Succeed())
+			Expect(deployment.ResourceVersion).To(Equal(version))
+		})
+
+		It("should serve the Envoy authorization requests in ext-authz mode", func() {
+			By("Enabling the ext-authz mode")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			opaengine.Spec.ExtAuthz = &opaspolimiitv1alpha1.ExtAuthzSpec{Port: 9292, Path: "authz/allow", DryRun: true}
+			Expect(k8sClient.Update(ctx, opaengine)).To(Succeed())
+			controllerReconciler := &OpaEngineReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Bundles: bundle.NewServer(""),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			config := &corev1.ConfigMap{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: resourceName + "-config", Namespace: "default"}, config)).To(Succeed())
+			Expect(config.Data["config.yaml"]).To(ContainSubstring("envoy_ext_authz_grpc"))
+			Expect(config.Data["config.yaml"]).To(ContainSubstring("addr: :9292"))
+			Expect(config.Data["config.yaml"]).To(ContainSubstring("path: authz/allow"))
+			Expect(config.Data["config.yaml"]).To(ContainSubstring("dry-run: true"))
+
+			deployment := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deployment)).To(Succeed())
+			container := deployment.Spec.Template.Spec.Containers[0]
+			Expect(container.Ports).To(ContainElement(HaveField("ContainerPort", int32(9292))))
+			Expect(container.ReadinessProbe.HTTPGet.Path).To(ContainSubstring("plugins"))
+			Expect(container.LivenessProbe.TCPSocket.Port.IntValue()).To(Equal(9292))
+
+			service := &corev1.Service{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, service)).To(Succeed())
+			Expect(service.Spec.Ports).To(ContainElement(HaveField("Port", int32(9292))))
+
+			By("Disabling the ext-authz mode")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			opaengine.Spec.ExtAuthz = nil
+			Expect(k8sClient.Update(ctx, opaengine)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, service)).To(Succeed())
+			Expect(service.Spec.Ports).To(HaveLen(1))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deployment)).To(Succeed())
+			Expect(deployment.Spec.Template.Spec.Containers[0].Ports).To(BeEmpty())
+		})
+
+		It("should secure the OPA API with the Secrets of the engine", func() {
+			By("Creating the Secrets of the API")
+			tlsSecret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "api-tls", Namespace: "default"},
+				Data:       map[string][]byte{"tls.crt": []byte("cert"), "tls.key": []byte("key")},
+			}
+			tokenSecret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "api-token", Namespace: "default"},
+				Data:       map[string][]byte{"token": []byte("secret")},
+			}
+			Expect(k8sClient.Create(ctx, tlsSecret)).To(Succeed())
+			Expect(k8sClient.Create(ctx, tokenSecret)).To(Succeed())
+			DeferCleanup(func() {
+				Expect(k8sClient.Delete(ctx, tlsSecret)).To(Succeed())
+				Expect(k8sClient.Delete(ctx, tokenSecret)).To(Succeed())
+			})
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			opaengine.Spec.API = &opaspolimiitv1alpha1.EngineAPISpec{
+				TLSSecretName: "api-tls",
+				TokenSecretRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "api-token"},
+					Key:                  "token",
+				},
+			}
+			Expect(k8sClient.Update(ctx, opaengine)).To(Succeed())
+			caFile := filepath.Join(GinkgoT().TempDir(), "ca.crt")
+			Expect(os.WriteFile(caFile, []byte("bundle ca"), 0o600)).To(Succeed())
+			controllerReconciler := &OpaEngineReconciler{
+				Client:           k8sClient,
+				Scheme:           k8sClient.Scheme(),
+				Bundles:          bundle.NewServer(""),
+				BundleServiceURL: "https://bundles:8082",
+				BundleCAFile:     caFile,
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			config := &corev1.ConfigMap{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: resourceName + "-config", Namespace: "default"}, config)).To(Succeed())
+			Expect(config.Data).To(HaveKeyWithValue("authz.rego", ContainSubstring("package system.authz")))
+
+			By("Downloading the bundle over TLS with the token of the API")
+			Expect(config.Data).To(HaveKeyWithValue("bundle-ca.crt", "bundle ca"))
+			Expect(config.Data["config.yaml"]).To(ContainSubstring("token: ${OPA_API_TOKEN}"))
+			Expect(config.Data["config.yaml"]).To(ContainSubstring("ca_cert: /config/bundle-ca.crt"))
+			for token, code := range map[string]int{"": http.StatusUnauthorized, "secret": http.StatusOK} {
+				req := httptest.NewRequest(http.MethodGet, bundle.Path("default", resourceName, ""), nil)
+				if token != "" {
+					req.Header.Set("Authorization", "Bearer "+token)
+				}
+				recorder := httptest.NewRecorder()
+				controllerReconciler.Bundles.ServeHTTP(recorder, req)
+				Expect(recorder.Code).To(Equal(code))
+			}
+
+			deployment := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deployment)).To(Succeed())
+			container := deployment.Spec.Template.Spec.Containers[0]
+			Expect(container.Args).To(ContainElements("--tls-cert-file", "--authentication", "token", "/config/authz.rego"))
+			Expect(container.ReadinessProbe.HTTPGet.Scheme).To(Equal(corev1.URISchemeHTTPS))
+			Expect(container.Env).To(ContainElement(HaveField("Name", "OPA_API_TOKEN")))
+			hash := deployment.Spec.Template.Annotations[apiHashAnnotation]
+
+			By("Rotating the token")
+			tokenSecret.Data["token"] = []byte("rotated")
+			Expect(k8sClient.Update(ctx, tokenSecret)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deployment)).To(Succeed())
+			Expect(deployment.Spec.Template.Annotations[apiHashAnnotation]).NotTo(Equal(hash))
+		})
+
 		It("should successfully add finalizer", func() {
 			By("Reconciling the OpaEngine")
 			controllerReconciler := &OpaEngineReconciler{
-				Client: k8sClient,
-				Scheme: k8sClient.Scheme(),
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Bundles: bundle.NewServer(""),
 			}
 			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
 				NamespacedName: typeNamespacedName,
@@ -155,8 +479,9 @@ var _ = Describe("OpaEngine Controller", func() {
 		It("should successfully delete resource", func() {
 			By("Reconciling the OpaEngine")
 			controllerReconciler := &OpaEngineReconciler{
-				Client: k8sClient,
-				Scheme: k8sClient.Scheme(),
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Bundles: bundle.NewServer(""),
 			}
 			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
 				NamespacedName: typeNamespacedName,
@@ -185,5 +510,644 @@ var _ = Describe("OpaEngine Controller", func() {
 			}).Should(HaveOccurred())
 		})
 
+		It("should serve the expected policies to the engine", func() {
+			By("Creating the policy")
+			policy := &opaspolimiitv1alpha1.Policy{
+				ObjectMeta: metav1.ObjectMeta{Name: "served-policy", Namespace: "default"},
+				Spec:       opaspolimiitv1alpha1.PolicySpec{Rego: "package test\n\ndefault allow := false\n"},
+			}
+			Expect(k8sClient.Create(ctx, policy)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, policy)).To(Succeed())
+			}()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			opaengine.Spec.Policies = []string{"served-policy"}
+			Expect(k8sClient.Update(ctx, opaengine)).To(Succeed())
+
+			opa := newFakeOpaClient()
+			controllerReconciler := &OpaEngineReconciler{
+				Client:       k8sClient,
+				Scheme:       k8sClient.Scheme(),
+				NewOpaClient: func(string) opamanager.API { return opa },
+				Bundles:      bundle.NewServer(""),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Checking the OPA configuration")
+			config := &corev1.ConfigMap{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: resourceName + "-config", Namespace: "default"}, config)).To(Succeed())
+			Expect(config.Data["config.yaml"]).To(ContainSubstring(bundle.Path("default", resourceName, "")))
+
+			By("Starting a replica of the engine")
+			pod := createReadyOpaPod(ctx, opaengine, "served-pod")
+			defer func() {
+				Expect(k8sClient.Delete(ctx, pod)).To(Succeed())
+			}()
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			revision, ok := controllerReconciler.Bundles.Revision("default", resourceName)
+			Expect(ok).To(BeTrue())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			Expect(opaengine.Status.Pods).To(HaveLen(1))
+			Expect(opaengine.Status.Pods[0].Synced).To(BeFalse())
+			Expect(opaengine.Status.Policies).To(BeEmpty())
+
+			By("Activating the bundle in OPA")
+			opa.activate(revision, map[string]string{"served-policy": policy.Spec.Rego})
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			Expect(opaengine.Status.Policies).To(ConsistOf("served-policy"))
+			Expect(opaengine.Status.PolicyHashes).To(HaveKey("served-policy"))
+			Expect(opaengine.Status.Pods[0].Name).To(Equal("served-pod"))
+			Expect(opaengine.Status.Pods[0].Synced).To(BeTrue())
+			Expect(opaengine.Status.Pods[0].Revision).To(Equal(revision))
+			Expect(opaengine.Status.Pods[0].Policies).To(ConsistOf("served-policy"))
+
+			By("Marking the pod with the policies loaded")
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: pod.Name, Namespace: pod.Namespace}, pod)).To(Succeed())
+			Expect(podConditionTrue(pod, PoliciesLoadedCondition)).To(BeTrue())
+		})
+
+		It("should report the replicas that lost the bundle", func() {
+			By("Creating the policy")
+			policy := &opaspolimiitv1alpha1.Policy{
+				ObjectMeta: metav1.ObjectMeta{Name: "lost-policy", Namespace: "default"},
+				Spec:       opaspolimiitv1alpha1.PolicySpec{Rego: "package test\n\ndefault allow := false\n"},
+			}
+			Expect(k8sClient.Create(ctx, policy)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, policy)).To(Succeed())
+			}()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			opaengine.Spec.Policies = []string{"lost-policy"}
+			Expect(k8sClient.Update(ctx, opaengine)).To(Succeed())
+
+			opa := newFakeOpaClient()
+			controllerReconciler := &OpaEngineReconciler{
+				Client:       k8sClient,
+				Scheme:       k8sClient.Scheme(),
+				NewOpaClient: func(string) opamanager.API { return opa },
+				Bundles:      bundle.NewServer(""),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			pod := createReadyOpaPod(ctx, opaengine, "lost-pod")
+			defer func() {
+				Expect(k8sClient.Delete(ctx, pod)).To(Succeed())
+			}()
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			revision, _ := controllerReconciler.Bundles.Revision("default", resourceName)
+			opa.activate(revision, map[string]string{"lost-policy": policy.Spec.Rego})
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Simulating a restart of OPA")
+			opa.activate("", nil)
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			drift := meta.FindStatusCondition(opaengine.Status.Conditions, "PolicyDrift")
+			Expect(drift).NotTo(BeNil())
+			Expect(drift.Status).To(Equal(metav1.ConditionTrue))
+			Expect(opaengine.Status.Policies).To(BeEmpty())
+
+			By("Reporting the engine in sync once the bundle is downloaded again")
+			opa.activate(revision, map[string]string{"lost-policy": policy.Spec.Rego})
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			drift = meta.FindStatusCondition(opaengine.Status.Conditions, "PolicyDrift")
+			Expect(drift.Status).To(Equal(metav1.ConditionFalse))
+			Expect(opaengine.Status.Policies).To(ConsistOf("lost-policy"))
+		})
+
+		It("should heal and report the modules changed through the REST API", func() {
+			policy := &opaspolimiitv1alpha1.Policy{
+				ObjectMeta: metav1.ObjectMeta{Name: "drifting-policy", Namespace: "default"},
+				Spec:       opaspolimiitv1alpha1.PolicySpec{Rego: "package drifting\n\ndefault allow := false\n"},
+			}
+			Expect(k8sClient.Create(ctx, policy)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, policy)).To(Succeed())
+			}()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			opaengine.Spec.Policies = []string{"drifting-policy"}
+			Expect(k8sClient.Update(ctx, opaengine)).To(Succeed())
+
+			opa := newFakeOpaClient()
+			controllerReconciler := &OpaEngineReconciler{
+				Client:       k8sClient,
+				Scheme:       k8sClient.Scheme(),
+				NewOpaClient: func(string) opamanager.API { return opa },
+				Bundles:      bundle.NewServer(""),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			pod := createReadyOpaPod(ctx, opaengine, "drifting-pod")
+			defer func() {
+				Expect(k8sClient.Delete(ctx, pod)).To(Succeed())
+			}()
+			revision, _ := controllerReconciler.Bundles.Revision("default", resourceName)
+			opa.activate(revision, map[string]string{"drifting-policy": policy.Spec.Rego})
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Pushing a module out of band")
+			opa.policies["out-of-band"] = "package oob\n\nallow := true\n"
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opa.policies).NotTo(HaveKey("out-of-band"))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			drift := meta.FindStatusCondition(opaengine.Status.Conditions, "PolicyDrift")
+			Expect(drift.Status).To(Equal(metav1.ConditionTrue))
+			Expect(opaengine.Status.Policies).To(ConsistOf("drifting-policy"))
+
+			By("Deleting a module of the bundle")
+			delete(opa.policies, "opa-scaler/drifting-policy.rego")
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			drift = meta.FindStatusCondition(opaengine.Status.Conditions, "PolicyDrift")
+			Expect(drift.Status).To(Equal(metav1.ConditionTrue))
+			Expect(opaengine.Status.Policies).To(BeEmpty())
+			Expect(opaengine.Status.Pods[0].Synced).To(BeFalse())
+			Expect(opaengine.Status.Pods[0].Message).To(ContainSubstring("opa-scaler/drifting-policy.rego"))
+
+			By("Reporting the engine in sync once OPA serves the bundle again")
+			opa.activate(revision, map[string]string{"drifting-policy": policy.Spec.Rego})
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			drift = meta.FindStatusCondition(opaengine.Status.Conditions, "PolicyDrift")
+			Expect(drift.Status).To(Equal(metav1.ConditionFalse))
+			Expect(opaengine.Status.Policies).To(ConsistOf("drifting-policy"))
+		})
+
+		It("should report the bundle activation errors", func() {
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			opa := newFakeOpaClient()
+			opa.code = "bundle_error"
+			controllerReconciler := &OpaEngineReconciler{
+				Client:       k8sClient,
+				Scheme:       k8sClient.Scheme(),
+				NewOpaClient: func(string) opamanager.API { return opa },
+				Bundles:      bundle.NewServer(""),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			pod := createReadyOpaPod(ctx, opaengine, "failing-pod")
+			defer func() {
+				Expect(k8sClient.Delete(ctx, pod)).To(Succeed())
+			}()
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).To(HaveOccurred())
+
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			degraded := meta.FindStatusCondition(opaengine.Status.Conditions, "Degraded")
+			Expect(degraded).NotTo(BeNil())
+			Expect(degraded.Reason).To(Equal("BundleActivationFailed"))
+			Expect(opaengine.Status.Pods[0].Message).To(ContainSubstring("bundle_error"))
+		})
+
+		It("should sign the bundles with the keys of the secret", func() {
+			By("Referencing a missing secret")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			opaengine.Spec.Signing = &opaspolimiitv1alpha1.BundleSigning{SecretName: "signing-keys", ActiveKey: "old"}
+			Expect(k8sClient.Update(ctx, opaengine)).To(Succeed())
+			controllerReconciler := &OpaEngineReconciler{
+				Client:       k8sClient,
+				Scheme:       k8sClient.Scheme(),
+				NewOpaClient: func(string) opamanager.API { return newFakeOpaClient() },
+				Bundles:      bundle.NewServer(""),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).To(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			degraded := meta.FindStatusCondition(opaengine.Status.Conditions, "Degraded")
+			Expect(degraded).NotTo(BeNil())
+			Expect(degraded.Reason).To(Equal("SigningKeyError"))
+
+			By("Creating the secret")
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "signing-keys", Namespace: "default"},
+				Data: map[string][]byte{
+					"old.hmac": []byte("0123456789abcdef0123456789abcdef"),
+					"new.hmac": []byte("fedcba9876543210fedcba9876543210"),
+				},
+			}
+			Expect(k8sClient.Create(ctx, secret)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, secret)).To(Succeed())
+			}()
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			config := &corev1.ConfigMap{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: resourceName + "-config", Namespace: "default"}, config)).To(Succeed())
+			Expect(config.Data["config.yaml"]).To(ContainSubstring(bundle.Path("default", resourceName, "old")))
+			Expect(config.Data["config.yaml"]).To(ContainSubstring("keyid: old"))
+			Expect(config.Data["config.yaml"]).NotTo(ContainSubstring("0123456789abcdef"))
+			deployment := &appsv1.Deployment{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deployment)).To(Succeed())
+			Expect(deployment.Spec.Template.Spec.Containers[0].Env).To(HaveLen(1))
+			Expect(deployment.Spec.Template.Spec.Containers[0].Env[0].ValueFrom.SecretKeyRef.Key).To(Equal("old.hmac"))
+			hash := deployment.Spec.Template.Annotations[configHashAnnotation]
+			Expect(hash).NotTo(BeEmpty())
+
+			By("Activating the new key")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			opaengine.Spec.Signing.ActiveKey = "new"
+			Expect(k8sClient.Update(ctx, opaengine)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, deployment)).To(Succeed())
+			Expect(deployment.Spec.Template.Annotations[configHashAnnotation]).NotTo(Equal(hash))
+			Expect(deployment.Spec.Template.Spec.Containers[0].Env[0].ValueFrom.SecretKeyRef.Key).To(Equal("new.hmac"))
+		})
+
+		It("should load the documents of the expected policies", func() {
+			By("Creating the policy and its documents")
+			policy := &opaspolimiitv1alpha1.Policy{
+				ObjectMeta: metav1.ObjectMeta{Name: "data-policy", Namespace: "default"},
+				Spec:       opaspolimiitv1alpha1.PolicySpec{Rego: "package authz\n\nallow if data.roles.admins[_] == input.user\n"},
+			}
+			Expect(k8sClient.Create(ctx, policy)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, policy)).To(Succeed())
+			}()
+			source := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "allowlist", Namespace: "default"},
+				Data:       map[string]string{"allowlist.yaml": "- 10.0.0.1\n- 10.0.0.2\n"},
+			}
+			Expect(k8sClient.Create(ctx, source)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, source)).To(Succeed())
+			}()
+			roles := &opaspolimiitv1alpha1.PolicyData{
+				ObjectMeta: metav1.ObjectMeta{Name: "roles", Namespace: "default"},
+				Spec: opaspolimiitv1alpha1.PolicyDataSpec{
+					PolicyName: "data-policy",
+					Path:       "roles",
+					Value:      &apiextensionsv1.JSON{Raw: []byte(`{"admins": ["alice"]}`)},
+				},
+			}
+			allowlist := &opaspolimiitv1alpha1.PolicyData{
+				ObjectMeta: metav1.ObjectMeta{Name: "allowlist", Namespace: "default"},
+				Spec: opaspolimiitv1alpha1.PolicyDataSpec{
+					PolicyName:   "data-policy",
+					Path:         "network/allowlist",
+					ConfigMapRef: &opaspolimiitv1alpha1.DataSourceRef{Name: "allowlist", Key: "allowlist.yaml"},
+				},
+			}
+			for _, data := range []*opaspolimiitv1alpha1.PolicyData{roles, allowlist} {
+				Expect(k8sClient.Create(ctx, data)).To(Succeed())
+			}
+			defer func() {
+				Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, roles))).To(Succeed())
+				Expect(k8sClient.Delete(ctx, allowlist)).To(Succeed())
+			}()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			opaengine.Spec.Policies = []string{"data-policy"}
+			Expect(k8sClient.Update(ctx, opaengine)).To(Succeed())
+
+			opa := newFakeOpaClient()
+			controllerReconciler := &OpaEngineReconciler{
+				Client:       k8sClient,
+				Scheme:       k8sClient.Scheme(),
+				NewOpaClient: func(string) opamanager.API { return opa },
+				Bundles:      bundle.NewServer(""),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			pod := createReadyOpaPod(ctx, opaengine, "data-pod")
+			defer func() {
+				Expect(k8sClient.Delete(ctx, pod)).To(Succeed())
+			}()
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Checking the documents in OPA")
+			Expect(opa.data).To(HaveKeyWithValue("roles", MatchJSON(`{"admins": ["alice"]}`)))
+			Expect(opa.data).To(HaveKeyWithValue("network/allowlist", MatchJSON(`["10.0.0.1", "10.0.0.2"]`)))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			Expect(opaengine.Status.Data).To(HaveLen(2))
+			for _, data := range opaengine.Status.Data {
+				Expect(data.Synced).To(BeTrue())
+				Expect(data.Hash).To(HavePrefix("sha256:"))
+			}
+
+			By("Updating a document")
+			Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(roles), roles)).To(Succeed())
+			roles.Spec.Value = &apiextensionsv1.JSON{Raw: []byte(`{"admins": ["alice", "bob"], "viewers": ["carol"]}`)}
+			Expect(k8sClient.Update(ctx, roles)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opa.data).To(HaveKeyWithValue("roles", MatchJSON(`{"admins": ["alice", "bob"], "viewers": ["carol"]}`)))
+			Expect(opa.patches).To(Equal(1))
+
+			By("Restoring the documents lost by a replica")
+			delete(opa.data, "network/allowlist")
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opa.data).To(HaveKey("network/allowlist"))
+
+			By("Removing a document")
+			Expect(k8sClient.Delete(ctx, roles)).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opa.data).NotTo(HaveKey("roles"))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			Expect(opaengine.Status.Data).To(HaveLen(1))
+			Expect(opaengine.Status.Data[0].Name).To(Equal("allowlist"))
+		})
+
+		It("should report the documents that cannot be loaded", func() {
+			policy := &opaspolimiitv1alpha1.Policy{
+				ObjectMeta: metav1.ObjectMeta{Name: "missing-data-policy", Namespace: "default"},
+				Spec:       opaspolimiitv1alpha1.PolicySpec{Rego: "package missing\n\nallow if data.missing.enabled\n"},
+			}
+			Expect(k8sClient.Create(ctx, policy)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, policy)).To(Succeed())
+			}()
+			data := &opaspolimiitv1alpha1.PolicyData{
+				ObjectMeta: metav1.ObjectMeta{Name: "missing-source", Namespace: "default"},
+				Spec: opaspolimiitv1alpha1.PolicyDataSpec{
+					PolicyName: "missing-data-policy",
+					Path:       "missing",
+					SecretRef:  &opaspolimiitv1alpha1.DataSourceRef{Name: "missing", Key: "data.json"},
+				},
+			}
+			Expect(k8sClient.Create(ctx, data)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, data)).To(Succeed())
+			}()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			opaengine.Spec.Policies = []string{"missing-data-policy"}
+			Expect(k8sClient.Update(ctx, opaengine)).To(Succeed())
+
+			controllerReconciler := &OpaEngineReconciler{
+				Client:       k8sClient,
+				Scheme:       k8sClient.Scheme(),
+				NewOpaClient: func(string) opamanager.API { return newFakeOpaClient() },
+				Bundles:      bundle.NewServer(""),
+			}
+			// The first reconciliation may only create the resources of the engine
+			_, _ = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).To(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			Expect(opaengine.Status.Data).To(HaveLen(1))
+			Expect(opaengine.Status.Data[0].Synced).To(BeFalse())
+			Expect(opaengine.Status.Data[0].Message).To(ContainSubstring("missing"))
+			degraded := meta.FindStatusCondition(opaengine.Status.Conditions, "Degraded")
+			Expect(degraded).NotTo(BeNil())
+			Expect(degraded.Reason).To(Equal("DataSyncFailed"))
+		})
+
+		It("should report the documents under the packages of the policies", func() {
+			policy := &opaspolimiitv1alpha1.Policy{
+				ObjectMeta: metav1.ObjectMeta{Name: "package-data-policy", Namespace: "default"},
+				Spec:       opaspolimiitv1alpha1.PolicySpec{Rego: "package authz\n\nallow if input.user in data.authz.roles.admins\n"},
+			}
+			Expect(k8sClient.Create(ctx, policy)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, policy)).To(Succeed())
+			}()
+			data := &opaspolimiitv1alpha1.PolicyData{
+				ObjectMeta: metav1.ObjectMeta{Name: "package-roles", Namespace: "default"},
+				Spec: opaspolimiitv1alpha1.PolicyDataSpec{
+					PolicyName: "package-data-policy",
+					Path:       "authz/roles",
+					Value:      &apiextensionsv1.JSON{Raw: []byte(`{"admins": ["alice"]}`)},
+				},
+			}
+			Expect(k8sClient.Create(ctx, data)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, data)).To(Succeed())
+			}()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			opaengine.Spec.Policies = []string{"package-data-policy"}
+			Expect(k8sClient.Update(ctx, opaengine)).To(Succeed())
+
+			opa := newFakeOpaClient()
+			controllerReconciler := &OpaEngineReconciler{
+				Client:       k8sClient,
+				Scheme:       k8sClient.Scheme(),
+				NewOpaClient: func(string) opamanager.API { return opa },
+				Bundles:      bundle.NewServer(""),
+			}
+			_, _ = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).To(HaveOccurred())
+			Expect(opa.data).NotTo(HaveKey("authz/roles"))
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			Expect(opaengine.Status.Data).To(HaveLen(1))
+			Expect(opaengine.Status.Data[0].Synced).To(BeFalse())
+			Expect(opaengine.Status.Data[0].Message).To(ContainSubstring("overlaps the package authz"))
+			degraded := meta.FindStatusCondition(opaengine.Status.Conditions, "Degraded")
+			Expect(degraded).NotTo(BeNil())
+			Expect(degraded.Reason).To(Equal("DataPathConflict"))
+		})
+
+		It("should load the dependencies of the expected policies", func() {
+			By("Creating a policy importing a library")
+			lib := &opaspolimiitv1alpha1.Policy{
+				ObjectMeta: metav1.ObjectMeta{Name: "served-lib", Namespace: "default"},
+				Spec:       opaspolimiitv1alpha1.PolicySpec{Rego: "package lib\n\nadmins := {\"alice\"}\n"},
+			}
+			policy := &opaspolimiitv1alpha1.Policy{
+				ObjectMeta: metav1.ObjectMeta{Name: "importing-policy", Namespace: "default"},
+				Spec: opaspolimiitv1alpha1.PolicySpec{
+					Rego:         "package test\n\nimport data.lib\n\nallow if lib.admins[input.user]\n",
+					Dependencies: []opaspolimiitv1alpha1.PolicyReference{{Name: "served-lib"}},
+				},
+			}
+			for _, p := range []*opaspolimiitv1alpha1.Policy{lib, policy} {
+				Expect(k8sClient.Create(ctx, p)).To(Succeed())
+			}
+			defer func() {
+				Expect(k8sClient.Delete(ctx, policy)).To(Succeed())
+				Expect(k8sClient.Delete(ctx, lib)).To(Succeed())
+			}()
+			libData := &opaspolimiitv1alpha1.PolicyData{
+				ObjectMeta: metav1.ObjectMeta{Name: "served-lib-data", Namespace: "default"},
+				Spec: opaspolimiitv1alpha1.PolicyDataSpec{
+					PolicyName: "served-lib",
+					Path:       "libdata/admins",
+					Value:      &apiextensionsv1.JSON{Raw: []byte(`["bob"]`)},
+				},
+			}
+			Expect(k8sClient.Create(ctx, libData)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, libData)).To(Succeed())
+			}()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			opaengine.Spec.Policies = []string{"importing-policy"}
+			Expect(k8sClient.Update(ctx, opaengine)).To(Succeed())
+
+			opa := newFakeOpaClient()
+			controllerReconciler := &OpaEngineReconciler{
+				Client:       k8sClient,
+				Scheme:       k8sClient.Scheme(),
+				NewOpaClient: func(string) opamanager.API { return opa },
+				Bundles:      bundle.NewServer(""),
+			}
+			Expect(controllerReconciler.enginesOfPolicy(ctx, lib)).To(ConsistOf(reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			}))
+			Expect(controllerReconciler.enginesOfPolicyData(ctx, libData)).To(ConsistOf(reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			}))
+			_, _ = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			pod := createReadyOpaPod(ctx, opaengine, "importing-pod")
+			defer func() {
+				Expect(k8sClient.Delete(ctx, pod)).To(Succeed())
+			}()
+
+			By("Activating the bundle with the library in OPA")
+			revision, ok := controllerReconciler.Bundles.Revision("default", resourceName)
+			Expect(ok).To(BeTrue())
+			Expect(revision).To(Equal(opamanager.HashModules(map[string]string{
+				"served-lib":       lib.Spec.Rego,
+				"importing-policy": policy.Spec.Rego,
+			})))
+			opa.activate(revision, map[string]string{
+				"served-lib":       lib.Spec.Rego,
+				"importing-policy": policy.Spec.Rego,
+			})
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			Expect(opaengine.Status.Policies).To(ConsistOf("served-lib", "importing-policy"))
+
+			By("Loading the documents of the library")
+			Expect(opa.data).To(HaveKeyWithValue("libdata/admins", MatchJSON(`["bob"]`)))
+			Expect(opaengine.Status.Data).To(HaveLen(1))
+			Expect(opaengine.Status.Data[0].Name).To(Equal("served-lib-data"))
+		})
+
+		It("should report a dependency cycle between the expected policies", func() {
+			policy := &opaspolimiitv1alpha1.Policy{
+				ObjectMeta: metav1.ObjectMeta{Name: "cyclic-policy", Namespace: "default"},
+				Spec: opaspolimiitv1alpha1.PolicySpec{
+					Rego:         "package cyclic\n\ndefault allow := false\n",
+					Dependencies: []opaspolimiitv1alpha1.PolicyReference{{Name: "cyclic-policy"}},
+				},
+			}
+			Expect(k8sClient.Create(ctx, policy)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, policy)).To(Succeed())
+			}()
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			opaengine.Spec.Policies = []string{"cyclic-policy"}
+			Expect(k8sClient.Update(ctx, opaengine)).To(Succeed())
+
+			controllerReconciler := &OpaEngineReconciler{
+				Client:       k8sClient,
+				Scheme:       k8sClient.Scheme(),
+				NewOpaClient: func(string) opamanager.API { return newFakeOpaClient() },
+				Bundles:      bundle.NewServer(""),
+			}
+			_, _ = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).To(HaveOccurred())
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			degraded := meta.FindStatusCondition(opaengine.Status.Conditions, "Degraded")
+			Expect(degraded).NotTo(BeNil())
+			Expect(degraded.Reason).To(Equal("DependencyCycle"))
+		})
+
+		It("should map a policy to the engines referencing it", func() {
+			By("Adding the policy to the OpaEngine")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			opaengine.Spec.Policies = []string{"referenced-policy"}
+			Expect(k8sClient.Update(ctx, opaengine)).To(Succeed())
+
+			controllerReconciler := &OpaEngineReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Bundles: bundle.NewServer(""),
+			}
+			policy := &opaspolimiitv1alpha1.Policy{
+				ObjectMeta: metav1.ObjectMeta{Name: "referenced-policy", Namespace: "default"},
+			}
+			Expect(controllerReconciler.enginesOfPolicy(ctx, policy)).To(ConsistOf(reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			}))
+
+			policy.Name = "other-policy"
+			Expect(controllerReconciler.enginesOfPolicy(ctx, policy)).To(BeEmpty())
+		})
+
+		It("should only map the Secrets read by the engines or their PolicyData", func() {
+			By("Referencing Secrets from the OpaEngine and a PolicyData")
+			Expect(k8sClient.Get(ctx, typeNamespacedName, opaengine)).To(Succeed())
+			opaengine.Spec.Signing = &opaspolimiitv1alpha1.BundleSigning{SecretName: "signing-keys", ActiveKey: "key"}
+			opaengine.Spec.API = &opaspolimiitv1alpha1.EngineAPISpec{TLSSecretName: "api-tls"}
+			Expect(k8sClient.Update(ctx, opaengine)).To(Succeed())
+			data := &opaspolimiitv1alpha1.PolicyData{
+				ObjectMeta: metav1.ObjectMeta{Name: "secret-data", Namespace: "default"},
+				Spec: opaspolimiitv1alpha1.PolicyDataSpec{
+					PolicyName: "some-policy",
+					Path:       "secret/data",
+					SecretRef:  &opaspolimiitv1alpha1.DataSourceRef{Name: "data-source", Key: "data.json"},
+				},
+			}
+			Expect(k8sClient.Create(ctx, data)).To(Succeed())
+			DeferCleanup(func() {
+				Expect(k8sClient.Delete(ctx, data)).To(Succeed())
+			})
+
+			controllerReconciler := &OpaEngineReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Bundles: bundle.NewServer(""),
+			}
+			referenced := referencedSecret(k8sClient)
+			secret := func(name string) *metav1.PartialObjectMetadata {
+				return &metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}}
+			}
+			for _, name := range []string{"signing-keys", "api-tls", "data-source"} {
+				Expect(referenced.Generic(event.GenericEvent{Object: secret(name)})).To(BeTrue(), name)
+			}
+			Expect(referenced.Generic(event.GenericEvent{Object: secret("unrelated")})).To(BeFalse())
+
+			By("Mapping the Secrets of the engine to it")
+			Expect(controllerReconciler.enginesOfSecret(ctx, secret("api-tls"))).To(ConsistOf(reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			}))
+			Expect(controllerReconciler.enginesOfSecret(ctx, secret("unrelated"))).To(BeEmpty())
+		})
+
 	})
 })
+
+// createReadyOpaPod creates a running and ready replica of the engine
+func createReadyOpaPod(ctx context.Context, engine *opaspolimiitv1alpha1.OpaEngine, name string) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: engine.Namespace,
+			Labels:    labelsForOpaEngine(engine),
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "opa", Image: engine.Spec.Image}},
+		},
+	}
+	Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+	pod.Status.Phase = corev1.PodRunning
+	pod.Status.PodIP = "10.0.0.1"
+	pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.ContainersReady, Status: corev1.ConditionTrue}}
+	Expect(k8sClient.Status().Update(ctx, pod)).To(Succeed())
+	return pod
+}
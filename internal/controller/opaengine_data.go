@@ -0,0 +1,318 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	"github.com/bramba2000/opa-scaler/internal/bundle"
+	opamanager "github.com/bramba2000/opa-scaler/internal/opa"
+)
+
+// dataDocument is a PolicyData document expected in the replicas of an engine
+type dataDocument struct {
+	name  string
+	path  string
+	value json.RawMessage
+	hash  string
+	// secret reports a document read from a Secret
+	secret bool
+	// err is the reason why the document cannot be loaded
+	err error
+}
+
+// dataPathConflictError reports a document whose path cannot be written
+// because another document or the bundle of the policies owns it
+type dataPathConflictError struct {
+	path string
+	// owner describes what owns the path
+	owner string
+}
+
+func (e *dataPathConflictError) Error() string {
+	return fmt.Sprintf("path %s overlaps %s", e.path, e.owner)
+}
+
+// expectedData returns the documents of the resolved policies, the expected
+// ones and their dependencies, sorted by name. A document whose value cannot
+// be read, or whose path overlaps the one of a previous document or a package
+// of the modules, is returned with the error.
+func (r *OpaEngineReconciler) expectedData(
+	ctx context.Context,
+	engine *opaspolimiitv1alpha1.OpaEngine,
+	policies []*opaspolimiitv1alpha1.Policy,
+	modules map[string]string,
+) ([]dataDocument, error) {
+	names := make([]string, 0, len(policies))
+	for _, policy := range policies {
+		names = append(names, policy.Name)
+	}
+	docs, err := policiesData(ctx, r.Client, engine.Namespace, names)
+	if err != nil {
+		return nil, err
+	}
+
+	// The packages are roots of the bundle, OPA refuses to write under them
+	// through the REST API
+	parsed, _ := opamanager.ParseModules(modules)
+	roots := bundle.Roots(parsed, nil)
+	for i := range docs {
+		if docs[i].err != nil {
+			continue
+		}
+		for _, root := range roots {
+			if pathsOverlap(docs[i].path, root) {
+				docs[i].err = &dataPathConflictError{
+					path:  docs[i].path,
+					owner: fmt.Sprintf("the package %s of the policies", strings.ReplaceAll(root, "/", ".")),
+				}
+				break
+			}
+		}
+	}
+	return docs, nil
+}
+
+// dataSyncReason returns the reason of the condition reporting the documents
+// that cannot be loaded
+func dataSyncReason(err error) string {
+	var conflict *dataPathConflictError
+	if errors.As(err, &conflict) {
+		return "DataPathConflict"
+	}
+	return "DataSyncFailed"
+}
+
+// policiesData returns the documents of the policies sorted by name, with the
+// error of the ones that cannot be loaded
+func policiesData(ctx context.Context, c client.Client, namespace string, policies []string) ([]dataDocument, error) {
+	list := &opaspolimiitv1alpha1.PolicyDataList{}
+	if err := c.List(ctx, list, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(list.Items, func(a, b opaspolimiitv1alpha1.PolicyData) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	docs := []dataDocument{}
+	for i := range list.Items {
+		data := &list.Items[i]
+		if !slices.Contains(policies, data.Spec.PolicyName) || !data.DeletionTimestamp.IsZero() {
+			continue
+		}
+		doc := dataDocument{name: data.Name, path: strings.Trim(data.Spec.Path, "/"), secret: data.Spec.SecretRef != nil}
+		doc.value, doc.err = loadPolicyData(ctx, c, data)
+		if doc.err == nil {
+			doc.hash, doc.err = opamanager.HashData(doc.value)
+		}
+		for _, other := range docs {
+			if other.err == nil && doc.err == nil && pathsOverlap(doc.path, other.path) {
+				doc.err = &dataPathConflictError{path: doc.path, owner: "the document of PolicyData " + other.name}
+			}
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// syncPodData loads the documents in the pod and removes the ones not
+// expected anymore. It returns the error of each failed document by name.
+func (r *OpaEngineReconciler) syncPodData(
+	ctx context.Context,
+	opa opamanager.API,
+	docs []dataDocument,
+	stale []opaspolimiitv1alpha1.DataDocumentStatus,
+) map[string]error {
+	errs := map[string]error{}
+	for _, data := range stale {
+		if err := opa.DeleteData(ctx, data.Path); err != nil && !opamanager.IsNotFound(err) {
+			errs[data.Name] = err
+		}
+	}
+	for _, doc := range docs {
+		if doc.err != nil {
+			continue
+		}
+		if err := syncDocument(ctx, opa, doc); err != nil {
+			errs[doc.name] = err
+		}
+	}
+	return errs
+}
+
+// syncDocument writes the document if its value in OPA differs, patching
+// only the members that changed when both values are objects
+func syncDocument(ctx context.Context, opa opamanager.API, doc dataDocument) error {
+	current, err := opa.GetData(ctx, doc.path)
+	if err != nil {
+		return err
+	}
+	if opamanager.EqualData(current, doc.value) {
+		return nil
+	}
+	log.FromContext(ctx).Info("Loading document", "PolicyData", doc.name, "Path", doc.path, "Hash", doc.hash)
+	if ops, ok := opamanager.DiffData(current, doc.value); ok {
+		return opa.PatchData(ctx, doc.path, ops)
+	}
+	return opa.PutData(ctx, doc.path, doc.value)
+}
+
+// staleData returns the documents loaded in the engine that are not expected
+// anymore, or that have been moved to another path
+func staleData(loaded []opaspolimiitv1alpha1.DataDocumentStatus, docs []dataDocument) []opaspolimiitv1alpha1.DataDocumentStatus {
+	stale := []opaspolimiitv1alpha1.DataDocumentStatus{}
+	for _, data := range loaded {
+		if !slices.ContainsFunc(docs, func(doc dataDocument) bool {
+			return doc.name == data.Name && doc.path == data.Path
+		}) {
+			stale = append(stale, data)
+		}
+	}
+	return stale
+}
+
+// dataStatuses returns the state of the documents given the errors of each
+// running pod, and the errors of the documents that are not synced. A stale
+// document is kept until it is removed from every pod.
+func dataStatuses(
+	previous []opaspolimiitv1alpha1.DataDocumentStatus,
+	docs []dataDocument,
+	stale []opaspolimiitv1alpha1.DataDocumentStatus,
+	podErrs map[string]map[string]error,
+) ([]opaspolimiitv1alpha1.DataDocumentStatus, error) {
+	pods := sortedKeys(podErrs)
+	firstError := func(name string) error {
+		for _, pod := range pods {
+			if err := podErrs[pod][name]; err != nil {
+				return fmt.Errorf("pod %s: %w", pod, err)
+			}
+		}
+		return nil
+	}
+
+	statuses := []opaspolimiitv1alpha1.DataDocumentStatus{}
+	var errs []error
+	for _, data := range stale {
+		if err := firstError(data.Name); err != nil {
+			data.Synced = false
+			data.Message = truncate("Unable to remove the document: "+err.Error(), maxConditionMessage)
+			statuses = append(statuses, data)
+			errs = append(errs, fmt.Errorf("policydata %s: %w", data.Name, err))
+		}
+	}
+	for _, doc := range docs {
+		status := opaspolimiitv1alpha1.DataDocumentStatus{
+			Name: doc.name,
+			Path: doc.path,
+			Hash: doc.hash,
+		}
+		i := slices.IndexFunc(previous, func(d opaspolimiitv1alpha1.DataDocumentStatus) bool {
+			return d.Name == doc.name && d.Path == doc.path
+		})
+		err := doc.err
+		if err == nil {
+			err = firstError(doc.name)
+		}
+		switch {
+		case err != nil:
+			status.Message = truncate(err.Error(), maxConditionMessage)
+			errs = append(errs, fmt.Errorf("policydata %s: %w", doc.name, err))
+		case len(pods) == 0:
+			status.Message = "Waiting for OPA to start"
+		default:
+			status.Synced = true
+			if i >= 0 && previous[i].Synced && previous[i].Hash == doc.hash {
+				status.LastSyncTime = previous[i].LastSyncTime
+			} else {
+				now := metav1.Now()
+				status.LastSyncTime = &now
+			}
+		}
+		if !status.Synced && i >= 0 {
+			status.LastSyncTime = previous[i].LastSyncTime
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, errors.Join(errs...)
+}
+
+// pathsOverlap reports if one of the slash separated paths contains the other
+func pathsOverlap(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// enginesOfPolicyData maps a PolicyData to the OpaEngines that expect or have loaded it
+func (r *OpaEngineReconciler) enginesOfPolicyData(ctx context.Context, obj client.Object) []reconcile.Request {
+	logger := log.FromContext(ctx)
+
+	data, ok := obj.(*opaspolimiitv1alpha1.PolicyData)
+	if !ok {
+		return nil
+	}
+	engines := &opaspolimiitv1alpha1.OpaEngineList{}
+	if err := r.List(ctx, engines, client.InNamespace(data.Namespace)); err != nil {
+		logger.Error(err, "unable to list OpaEngines", "PolicyData", data.Name)
+		return nil
+	}
+	// The engines serving the policy of the document, directly or as a
+	// dependency of their policies
+	requests := r.enginesOfPolicy(ctx, &opaspolimiitv1alpha1.Policy{
+		ObjectMeta: metav1.ObjectMeta{Name: data.Spec.PolicyName, Namespace: data.Namespace},
+	})
+	for _, engine := range engines.Items {
+		request := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&engine)}
+		if !slices.Contains(requests, request) &&
+			slices.ContainsFunc(engine.Status.Data, func(d opaspolimiitv1alpha1.DataDocumentStatus) bool {
+				return d.Name == data.Name
+			}) {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
+
+// enginesOfDataSource maps a ConfigMap or a Secret to the OpaEngines loading
+// a PolicyData read from it
+func (r *OpaEngineReconciler) enginesOfDataSource(ctx context.Context, obj client.Object) []reconcile.Request {
+	logger := log.FromContext(ctx)
+
+	items, err := policyDataReading(ctx, r.Client, obj)
+	if err != nil {
+		logger.Error(err, "unable to list PolicyData", "Source", obj.GetName())
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for i := range items {
+		for _, request := range r.enginesOfPolicyData(ctx, &items[i]) {
+			if !slices.Contains(requests, request) {
+				requests = append(requests, request)
+			}
+		}
+	}
+	return requests
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+)
+
+// Defaults of the Envoy external authorization plugin, applied when the
+// OpaEngine has not been defaulted by the API server
+const (
+	extAuthzPlugin      = "envoy_ext_authz_grpc"
+	defaultExtAuthzPort = 9191
+	defaultExtAuthzPath = "envoy/authz/allow"
+	extAuthzPortName    = "grpc"
+)
+
+// extAuthzPort returns the port of the gRPC server of the plugin
+func extAuthzPort(spec *opaspolimiitv1alpha1.ExtAuthzSpec) int32 {
+	if spec.Port == 0 {
+		return defaultExtAuthzPort
+	}
+	return spec.Port
+}
+
+// opaExtAuthzConfig adds the plugin to the OPA configuration. In dry-run the
+// decisions are logged on the console, as they are not enforced.
+func opaExtAuthzConfig(config map[string]any, spec *opaspolimiitv1alpha1.ExtAuthzSpec) {
+	path := spec.Path
+	if path == "" {
+		path = defaultExtAuthzPath
+	}
+	config["plugins"] = map[string]any{
+		extAuthzPlugin: map[string]any{
+			"addr":    fmt.Sprintf(":%d", extAuthzPort(spec)),
+			"path":    path,
+			"dry-run": spec.DryRun,
+		},
+	}
+	if spec.DryRun {
+		config["decision_logs"] = map[string]any{
+			"console": true,
+		}
+	}
+}
+
+// withExtAuthz exposes the gRPC port of the plugin on the OPA container. The
+// readiness probe also requires the plugin to be healthy, and the liveness
+// probe checks that its server accepts connections.
+func withExtAuthz(container *corev1.Container, spec *opaspolimiitv1alpha1.ExtAuthzSpec) {
+	port := extAuthzPort(spec)
+	container.Ports = append(container.Ports, corev1.ContainerPort{
+		Name:          extAuthzPortName,
+		ContainerPort: port,
+		Protocol:      corev1.ProtocolTCP,
+	})
+	container.ReadinessProbe.HTTPGet.Path = "/health?bundle=true&plugins"
+	container.LivenessProbe.ProbeHandler = corev1.ProbeHandler{
+		TCPSocket: &corev1.TCPSocketAction{
+			Port: intstr.FromInt32(port),
+		},
+	}
+}
+
+// servicePortsForOpaEngine returns the ports of the Service of the engine
+func servicePortsForOpaEngine(engine *opaspolimiitv1alpha1.OpaEngine) []corev1.ServicePort {
+	ports := []corev1.ServicePort{
+		{
+			Name: "http",
+			Port: opaPort,
+		},
+	}
+	if engine.Spec.ExtAuthz != nil {
+		ports = append(ports, corev1.ServicePort{
+			Name:       extAuthzPortName,
+			Port:       extAuthzPort(engine.Spec.ExtAuthz),
+			TargetPort: intstr.FromString(extAuthzPortName),
+		})
+	}
+	return ports
+}
+
+// servicePortsChanged returns true if the Service does not expose the ports,
+// ignoring the fields defaulted by the API server
+func servicePortsChanged(found, desired []corev1.ServicePort) bool {
+	if len(found) != len(desired) {
+		return true
+	}
+	for i := range desired {
+		if found[i].Name != desired[i].Name || found[i].Port != desired[i].Port {
+			return true
+		}
+	}
+	return false
+}
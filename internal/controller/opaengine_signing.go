@@ -0,0 +1,117 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	"github.com/bramba2000/opa-scaler/internal/bundle"
+)
+
+// configHashAnnotation is the annotation of the OPA pods with the hash of
+// their configuration, so that a new configuration restarts them
+const configHashAnnotation = "opas.polimi.it/config-hash"
+
+// signingKeys returns the keys signing the bundles of the engine and the
+// one trusted by its replicas, nil if the bundles are not signed. Every key
+// signs a variant of the bundle, so that the replicas still trusting the
+// previous key keep receiving the updates while the new one is rolled out.
+func (r *OpaEngineReconciler) signingKeys(ctx context.Context, engine *opaspolimiitv1alpha1.OpaEngine) ([]*bundle.Key, *bundle.Key, error) {
+	if engine.Spec.Signing == nil {
+		return nil, nil, nil
+	}
+	secret := &corev1.Secret{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: engine.Namespace, Name: engine.Spec.Signing.SecretName}, secret); err != nil {
+		return nil, nil, err
+	}
+	keys, err := bundle.KeysFromSecret(secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	active, err := bundle.ActiveKey(keys, engine.Spec.Signing.ActiveKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, active, nil
+}
+
+// opaKeysConfig returns the keys section of the OPA configuration. An HMAC
+// secret is read from the environment, so that it is not stored in the
+// ConfigMap.
+func opaKeysConfig(key *bundle.Key) map[string]any {
+	value := string(key.Public)
+	if key.IsHMAC() {
+		value = "${" + signingKeyEnvName(key) + "}"
+	}
+	return map[string]any{
+		key.ID: map[string]any{
+			"algorithm": key.Algorithm,
+			"key":       value,
+		},
+	}
+}
+
+// signingKeyEnv returns the environment variables of the OPA container with
+// the HMAC secret of the key
+func signingKeyEnv(engine *opaspolimiitv1alpha1.OpaEngine, key *bundle.Key) []corev1.EnvVar {
+	if key == nil || !key.IsHMAC() {
+		return nil
+	}
+	return []corev1.EnvVar{{
+		Name: signingKeyEnvName(key),
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: engine.Spec.Signing.SecretName},
+				Key:                  key.ID + bundle.HMACKeySuffix,
+			},
+		},
+	}}
+}
+
+// signingKeyEnvName returns the environment variable holding the HMAC secret
+func signingKeyEnvName(key *bundle.Key) string {
+	return "OPA_SIGNING_KEY_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, key.ID)
+}
+
+// configHash returns the hash of the OPA configuration, including the key
+// whose value may not be part of the ConfigMap
+func configHash(config *corev1.ConfigMap, key *bundle.Key) string {
+	hash := sha256.New()
+	for _, name := range sortedKeys(config.Data) {
+		hash.Write([]byte(name + "\x00" + config.Data[name] + "\x00"))
+	}
+	if key != nil {
+		hash.Write([]byte(key.ID + "\x00" + key.Fingerprint() + "\x00"))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
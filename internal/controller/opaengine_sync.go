@@ -0,0 +1,508 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	"github.com/bramba2000/opa-scaler/internal/bundle"
+	opamanager "github.com/bramba2000/opa-scaler/internal/opa"
+)
+
+// PoliciesLoadedCondition is the readiness gate of the OPA pods, true once
+// every expected policy has been loaded in the pod
+const PoliciesLoadedCondition corev1.PodConditionType = "opas.polimi.it/policies-loaded"
+
+// opaPort is the port of the OPA REST API
+const opaPort = 8181
+
+// bundleCheckInterval is the period between two checks of the replicas that
+// have not activated the last bundle yet
+const bundleCheckInterval = 5 * time.Second
+
+// recoverableDegradedReasons are the reasons of a Degraded condition
+// cleared once the bundle and the documents have been loaded
+var recoverableDegradedReasons = []string{
+	"PolicyNotFound",
+	"MissingDependency",
+	"DependencyCycle",
+	"BundleBuildFailed",
+	"BundleActivationFailed",
+	"DataSyncFailed",
+	"DataPathConflict",
+}
+
+// syncPolicies publishes the bundle of the expected policies, signed with
+// each key, and records which revision has been activated by every running
+// replica of the engine
+func (r *OpaEngineReconciler) syncPolicies(
+	ctx context.Context,
+	req ctrl.Request,
+	engine *opaspolimiitv1alpha1.OpaEngine,
+	keys []*bundle.Key,
+	api *engineAPI,
+) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	// Load the code of the expected policies and of their dependencies, in
+	// topological order so that a library is loaded before its importers
+	policies, err := resolvePolicies(ctx, r.Client, engine.Namespace, engine.Spec.Policies)
+	if reason := dependencyErrorReason(err); reason != "" {
+		logger.Error(err, "unable to resolve the dependencies of the policies")
+		if err := r.addCondition(ctx, req, metav1.Condition{
+			Type:    typeDegradedOpaEngine,
+			Status:  metav1.ConditionTrue,
+			Reason:  reason,
+			Message: truncate(err.Error(), maxConditionMessage),
+		}); err != nil {
+			logger.Error(err, "unable to add condition to OpaEngine")
+		}
+		return ctrl.Result{}, err
+	} else if err != nil {
+		logger.Error(err, "unable to fetch policies")
+		return ctrl.Result{}, err
+	}
+	codes := make(map[string]map[string]string)
+	desired := make(map[string]string)
+	for _, policy := range policies {
+		modules, err := loadPolicyModules(ctx, r.Client, r.Puller, policy)
+		if err != nil {
+			logger.Error(err, "unable to fetch policy code")
+			return ctrl.Result{}, err
+		}
+		codes[policy.Name] = modules
+		for id, code := range modules {
+			desired[id] = code
+		}
+	}
+	revision := opamanager.HashModules(desired)
+
+	if err := r.Bundles.Set(engine.Namespace, engine.Name, &bundle.Bundle{
+		Revision: revision,
+		Modules:  desired,
+		Keys:     keys,
+		Token:    api.token,
+	}); err != nil {
+		logger.Error(err, "unable to build the bundle of OpaEngine")
+		if err := r.addCondition(ctx, req, metav1.Condition{
+			Type:    typeDegradedOpaEngine,
+			Status:  metav1.ConditionTrue,
+			Reason:  "BundleBuildFailed",
+			Message: truncate(err.Error(), maxConditionMessage),
+		}); err != nil {
+			logger.Error(err, "unable to add condition to OpaEngine")
+		}
+		return ctrl.Result{}, err
+	}
+
+	// The modules listed by every replica once the bundle is activated
+	expected, err := expectedModules(engine, desired)
+	if err != nil {
+		logger.Error(err, "unable to list the modules of the bundle")
+		return ctrl.Result{}, err
+	}
+
+	// Load the documents of the expected policies and of their dependencies,
+	// they are written in each replica as they are not part of the bundle
+	docs, err := r.expectedData(ctx, engine, policies, desired)
+	if err != nil {
+		logger.Error(err, "unable to list PolicyData")
+		return ctrl.Result{}, err
+	}
+	stale := staleData(engine.Status.Data, docs)
+
+	pods := &corev1.PodList{}
+	if err := r.List(ctx, pods, client.InNamespace(engine.Namespace), client.MatchingLabels(labelsForOpaEngine(engine))); err != nil {
+		logger.Error(err, "unable to list OpaEngine pods")
+		return ctrl.Result{}, err
+	}
+	slices.SortFunc(pods.Items, func(a, b corev1.Pod) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	podStatuses := []opaspolimiitv1alpha1.PodPolicyStatus{}
+	drifted := []string{}
+	pending := false
+	var errs []error
+	// The documents that failed in every running pod, by pod name
+	dataErrs := map[string]map[string]error{}
+	// The policies loaded in every running pod, nil until a pod has been checked
+	var loaded []string
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.PodIP == "" || !pod.DeletionTimestamp.IsZero() || !podConditionTrue(pod, corev1.ContainersReady) {
+			podStatuses = append(podStatuses, opaspolimiitv1alpha1.PodPolicyStatus{
+				Name:    pod.Name,
+				IP:      pod.Status.PodIP,
+				Message: "Waiting for OPA to start",
+			})
+			pending = true
+			continue
+		}
+
+		opa := r.podClient(api, pod)
+		previous := findPodPolicyStatus(engine.Status.Pods, pod.Name)
+		status, drift, err := r.syncPod(ctx, opa, pod, previous, codes, revision, expected)
+		if err != nil {
+			logger.Error(err, "unable to check the bundle of pod", "Pod", pod.Name)
+			errs = append(errs, fmt.Errorf("pod %s: %w", pod.Name, err))
+		}
+		if drift {
+			drifted = append(drifted, pod.Name)
+		}
+		dataErrs[pod.Name] = r.syncPodData(ctx, opa, docs, stale)
+		if failed := sortedKeys(dataErrs[pod.Name]); len(failed) > 0 && status.Message == "" {
+			status.Message = fmt.Sprintf("Unable to load the documents of PolicyData %v", failed)
+		}
+		ready := status.Synced && len(dataErrs[pod.Name]) == 0
+		if !ready {
+			pending = true
+		}
+		if err := r.setPoliciesLoaded(ctx, pod, ready); err != nil {
+			logger.Error(err, "unable to update the readiness of pod", "Pod", pod.Name)
+			errs = append(errs, err)
+		}
+		podStatuses = append(podStatuses, status)
+
+		if loaded == nil {
+			loaded = slices.Clone(status.Policies)
+		} else {
+			loaded = slices.DeleteFunc(loaded, func(p string) bool {
+				return !slices.Contains(status.Policies, p)
+			})
+		}
+	}
+	if loaded == nil {
+		loaded = []string{}
+	}
+	logger.Info("Policy situation", "Spec", engine.Spec.Policies, "Loaded", loaded, "Revision", revision, "Pods", len(pods.Items), "Drifted", drifted)
+	data, dataErr := dataStatuses(engine.Status.Data, docs, stale, dataErrs)
+
+	if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if err := r.Get(ctx, req.NamespacedName, engine); err != nil {
+			return err
+		}
+		hashes := make(map[string]string, len(loaded))
+		for _, p := range loaded {
+			hashes[p] = opamanager.HashModules(codes[p])
+		}
+		status := engine.Status.DeepCopy()
+		status.Policies = loaded
+		status.PolicyHashes = hashes
+		status.Pods = podStatuses
+		status.Data = data
+		if equality.Semantic.DeepEqual(status, &engine.Status) {
+			return nil
+		}
+		engine.Status = *status
+		return r.Status().Update(ctx, engine)
+	}); err != nil {
+		logger.Error(err, "unable to update OpaEngine status")
+		return ctrl.Result{}, err
+	}
+
+	drift := metav1.Condition{
+		Type:    typePolicyDriftOpaEngine,
+		Status:  metav1.ConditionFalse,
+		Reason:  "InSync",
+		Message: "The loaded modules match the expected policies",
+	}
+	if len(drifted) > 0 {
+		logger.Info("Policy drift detected", "Pods", drifted)
+		drift.Status = metav1.ConditionTrue
+		drift.Reason = "DriftDetected"
+		drift.Message = fmt.Sprintf("The modules loaded in pods %v differ from the expected policies", drifted)
+	}
+	if err := r.addCondition(ctx, req, drift); err != nil {
+		logger.Error(err, "unable to add condition to OpaEngine")
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		if err := r.addCondition(ctx, req, metav1.Condition{
+			Type:    typeDegradedOpaEngine,
+			Status:  metav1.ConditionTrue,
+			Reason:  "BundleActivationFailed",
+			Message: truncate(err.Error(), maxConditionMessage),
+		}); err != nil {
+			logger.Error(err, "unable to add condition to OpaEngine")
+		}
+		return ctrl.Result{}, err
+	}
+	if dataErr != nil {
+		logger.Error(dataErr, "unable to load the documents of OpaEngine")
+		if err := r.addCondition(ctx, req, metav1.Condition{
+			Type:    typeDegradedOpaEngine,
+			Status:  metav1.ConditionTrue,
+			Reason:  dataSyncReason(dataErr),
+			Message: truncate(dataErr.Error(), maxConditionMessage),
+		}); err != nil {
+			logger.Error(err, "unable to add condition to OpaEngine")
+		}
+		return ctrl.Result{}, dataErr
+	}
+	if degraded := meta.FindStatusCondition(engine.Status.Conditions, typeDegradedOpaEngine); degraded != nil &&
+		slices.Contains(recoverableDegradedReasons, degraded.Reason) {
+		if err := r.addCondition(ctx, req, metav1.Condition{
+			Type:    typeDegradedOpaEngine,
+			Status:  metav1.ConditionFalse,
+			Reason:  "BundleActivated",
+			Message: "The bundle of the policies and their documents have been loaded",
+		}); err != nil {
+			logger.Error(err, "unable to add condition to OpaEngine")
+		}
+	}
+
+	// OPA polls the bundle server, check again soon the replicas lagging behind
+	if pending {
+		return ctrl.Result{RequeueAfter: bundleCheckInterval}, nil
+	}
+	// Check periodically that no pod lost its policies
+	return ctrl.Result{RequeueAfter: driftCheckInterval}, nil
+}
+
+// syncPod reads the bundle revision activated by the pod and compares the
+// modules it lists with the expected ones. It reports a drift when a pod that
+// activated the expected revision does not serve it anymore, e.g. because OPA
+// restarted in place, or when its modules changed through the REST API.
+func (r *OpaEngineReconciler) syncPod(
+	ctx context.Context,
+	opa opamanager.API,
+	pod *corev1.Pod,
+	previous *opaspolimiitv1alpha1.PodPolicyStatus,
+	codes map[string]map[string]string,
+	revision string,
+	expected map[string]string,
+) (opaspolimiitv1alpha1.PodPolicyStatus, bool, error) {
+	status := opaspolimiitv1alpha1.PodPolicyStatus{
+		Name:     pod.Name,
+		IP:       pod.Status.PodIP,
+		Policies: []string{},
+	}
+	samePod := previous != nil && previous.IP == status.IP
+	if samePod {
+		status.LastSyncTime = previous.LastSyncTime
+	}
+
+	opaStatus, err := opa.Status(ctx)
+	if err != nil {
+		status.Message = truncate(err.Error(), maxConditionMessage)
+		return status, false, err
+	}
+	active := opaStatus.Bundles[opaBundleName]
+	status.Revision = active.ActiveRevision
+	drift := samePod && previous.Synced && previous.Revision == revision && active.ActiveRevision != revision
+
+	switch {
+	case active.ActiveRevision == revision:
+		status.Synced = true
+		status.Policies = sortedKeys(codes)
+		if !samePod || previous.Revision != revision || status.LastSyncTime == nil {
+			now := metav1.Now()
+			status.LastSyncTime = &now
+		}
+	case samePod && previous.Revision == active.ActiveRevision:
+		// Still serving the policies of the previous revision
+		status.Policies = previous.Policies
+	}
+
+	if active.Code != "" {
+		err := fmt.Errorf("bundle %s: %s: %s", opaBundleName, active.Code, active.Message)
+		details := make([]string, 0, len(active.Errors))
+		for _, e := range active.Errors {
+			details = append(details, e.String())
+		}
+		if len(details) > 0 {
+			err = fmt.Errorf("%w: %s", err, strings.Join(details, "; "))
+		}
+		status.Message = truncate(err.Error(), maxConditionMessage)
+		return status, drift, err
+	}
+	if status.Synced {
+		changed, removed, err := syncModules(ctx, opa, expected)
+		if err != nil {
+			status.Message = truncate(err.Error(), maxConditionMessage)
+			return status, drift, err
+		}
+		if len(removed) > 0 {
+			log.FromContext(ctx).Info("Removed the modules pushed out of band", "Pod", pod.Name, "Modules", removed)
+			drift = true
+		}
+		if len(changed) > 0 {
+			// The policies with a missing or modified module are not served
+			// as expected until OPA activates the bundle again
+			status.Synced = false
+			status.Policies = slices.DeleteFunc(status.Policies, func(p string) bool {
+				return slices.ContainsFunc(changed, func(id string) bool {
+					return policyOfModule(codes[p], id)
+				})
+			})
+			status.Message = truncate(fmt.Sprintf("Modules %v differ from the bundle", changed), maxConditionMessage)
+			return status, true, nil
+		}
+	}
+	if !status.Synced {
+		status.Message = fmt.Sprintf("Waiting for the activation of revision %s", revision)
+	}
+	return status, drift, nil
+}
+
+// expectedModules returns the source of the modules loaded by the replicas of
+// the engine, indexed by their id in OPA: the modules of the bundle and the
+// authorization policy of the API
+func expectedModules(engine *opaspolimiitv1alpha1.OpaEngine, desired map[string]string) (map[string]string, error) {
+	expected, err := bundle.ActivatedModules(opaBundleName, desired)
+	if err != nil {
+		return nil, err
+	}
+	if engine.Spec.API != nil && engine.Spec.API.TokenSecretRef != nil {
+		// OPA strips the leading slash of the files loaded from the command line
+		expected[strings.TrimPrefix(opaConfigPath+"/"+opaAuthzFile, "/")] = opaAuthzPolicy
+	}
+	return expected, nil
+}
+
+// syncModules compares the modules listed by OPA with the expected ones. It
+// removes the modules pushed out of band, and returns the expected modules
+// that are missing or whose code differs, which cannot be pushed again as
+// they are owned by the bundle.
+func syncModules(ctx context.Context, opa opamanager.API, expected map[string]string) (changed, removed []string, err error) {
+	listed, err := opa.ListPolicies(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, id := range listed {
+		if _, ok := expected[id]; !ok {
+			removed = append(removed, id)
+		}
+	}
+	for _, id := range sortedKeys(expected) {
+		if !slices.Contains(listed, id) {
+			changed = append(changed, id)
+			continue
+		}
+		policy, err := opa.GetPolicy(ctx, id)
+		if err != nil {
+			return nil, nil, err
+		}
+		if policy.Raw != expected[id] {
+			changed = append(changed, id)
+		}
+	}
+	if len(removed) > 0 {
+		if err := opa.DeletePolicies(ctx, removed).Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return changed, removed, nil
+}
+
+// policyOfModule reports whether the module with the given id in OPA is one
+// of the modules of a policy
+func policyOfModule(modules map[string]string, id string) bool {
+	for module := range modules {
+		if opaBundleName+bundle.ModulePath(module) == id {
+			return true
+		}
+	}
+	return false
+}
+
+// setPoliciesLoaded updates the readiness gate of the pod
+func (r *OpaEngineReconciler) setPoliciesLoaded(ctx context.Context, pod *corev1.Pod, loaded bool) error {
+	condition := corev1.PodCondition{
+		Type:    PoliciesLoadedCondition,
+		Status:  corev1.ConditionFalse,
+		Reason:  "PoliciesNotLoaded",
+		Message: "Some policies have not been loaded yet",
+	}
+	if loaded {
+		condition.Status = corev1.ConditionTrue
+		condition.Reason = "PoliciesLoaded"
+		condition.Message = "Every policy has been loaded"
+	}
+
+	original := pod.DeepCopy()
+	i := slices.IndexFunc(pod.Status.Conditions, func(c corev1.PodCondition) bool {
+		return c.Type == PoliciesLoadedCondition
+	})
+	switch {
+	case i < 0:
+		condition.LastTransitionTime = metav1.Now()
+		pod.Status.Conditions = append(pod.Status.Conditions, condition)
+	case pod.Status.Conditions[i].Status == condition.Status:
+		return nil
+	default:
+		condition.LastTransitionTime = metav1.Now()
+		pod.Status.Conditions[i] = condition
+	}
+	return r.Status().Patch(ctx, pod, client.StrategicMergeFrom(original))
+}
+
+// engineOfPod maps an OPA pod to the OpaEngine owning it
+func engineOfPod(ctx context.Context, obj client.Object) []reconcile.Request {
+	labels := obj.GetLabels()
+	if labels["app.kubernetes.io/component"] != "opa-engine" || labels["app.kubernetes.io/managed-by"] != "opa-scaler-operator" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{
+		Namespace: obj.GetNamespace(),
+		Name:      labels["app.kubernetes.io/name"],
+	}}}
+}
+
+func podConditionTrue(pod *corev1.Pod, conditionType corev1.PodConditionType) bool {
+	for _, c := range pod.Status.Conditions {
+		if c.Type == conditionType {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func findPodPolicyStatus(pods []opaspolimiitv1alpha1.PodPolicyStatus, name string) *opaspolimiitv1alpha1.PodPolicyStatus {
+	for i := range pods {
+		if pods[i].Name == name {
+			return &pods[i]
+		}
+	}
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,421 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	"github.com/bramba2000/opa-scaler/internal/scheduler"
+)
+
+const (
+	// typeReadyOpaEngineSet is the type of the condition for an OpaEngineSet whose engines are all available
+	typeReadyOpaEngineSet = "Ready"
+	// typeDegradedOpaEngineSet is the type of the condition for an OpaEngineSet with policies that cannot be loaded
+	typeDegradedOpaEngineSet = "Degraded"
+)
+
+// engineSetLabel is the label of the OpaEngines of an OpaEngineSet, their
+// policies are managed by the set and not by the Dependencies
+const engineSetLabel = "opas.polimi.it/engine-set"
+
+// OpaEngineSetReconciler reconciles a OpaEngineSet object
+type OpaEngineSetReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// DefaultCapacity bounds the policies of the OpaEngines when the template
+	// of the set does not set their capacity
+	DefaultCapacity opaspolimiitv1alpha1.EngineCapacity
+}
+
+// engineShard is an OpaEngine of a set with the policies it should load
+type engineShard struct {
+	ordinal  int32
+	engine   *opaspolimiitv1alpha1.OpaEngine
+	policies []string
+}
+
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=opaenginesets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=opaenginesets/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=opaenginesets/finalizers,verbs=update
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=opaengines,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=policies,verbs=get;list;watch
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=policydata,verbs=get;list;watch
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=dependencies,verbs=get;list;watch
+
+// Reconcile distributes the policies of the OpaEngineSet among its OpaEngines,
+// creating a new engine when the policies do not fit in the existing ones and
+// deleting the engines left empty
+func (r *OpaEngineSetReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	// Fetch the OpaEngineSet instance
+	set := &opaspolimiitv1alpha1.OpaEngineSet{}
+	if err := r.Get(ctx, req.NamespacedName, set); err != nil {
+		err = client.IgnoreNotFound(err)
+		if err != nil {
+			logger.Error(err, "unable to fetch OpaEngineSet")
+		}
+		return ctrl.Result{}, err
+	}
+	if !set.DeletionTimestamp.IsZero() {
+		// The engines are deleted with the set by their owner reference
+		return ctrl.Result{}, nil
+	}
+
+	shards, err := r.shardsOfSet(ctx, set)
+	if err != nil {
+		logger.Error(err, "unable to list the OpaEngines of OpaEngineSet")
+		return ctrl.Result{}, err
+	}
+
+	// Each policy is scheduled together with its transitive dependencies
+	closures := map[string][]string{}
+	unresolved := []string{}
+	for _, policy := range set.Spec.Policies {
+		closure, err := resolvePolicyNames(ctx, r.Client, set.Namespace, []string{policy})
+		if dependencyErrorReason(err) != "" {
+			logger.Error(err, "unable to resolve the dependencies of Policy", "Policy", policy)
+			unresolved = append(unresolved, policy)
+			continue
+		} else if err != nil {
+			logger.Error(err, "unable to fetch the dependencies of Policy", "Policy", policy)
+			return ctrl.Result{}, err
+		}
+		closures[policy] = closure
+	}
+
+	unscheduled, err := r.assignPolicies(ctx, set, shards, closures)
+	if err != nil {
+		logger.Error(err, "unable to assign the policies of OpaEngineSet")
+		return ctrl.Result{}, err
+	}
+
+	// Delete the empty engines exceeding the minimum, starting from the last ones
+	minShards := 1
+	if set.Spec.MinShards != nil {
+		minShards = int(*set.Spec.MinShards)
+	}
+	for len(*shards) < minShards {
+		*shards = append(*shards, engineShard{ordinal: nextOrdinal(*shards)})
+	}
+	for i := len(*shards) - 1; i >= 0 && len(*shards) > minShards; i-- {
+		shard := (*shards)[i]
+		if len(shard.policies) > 0 {
+			continue
+		}
+		if shard.engine != nil {
+			if err := r.Delete(ctx, shard.engine); client.IgnoreNotFound(err) != nil {
+				logger.Error(err, "unable to delete empty OpaEngine", "OpaEngine", shard.engine.Name)
+				return ctrl.Result{}, err
+			}
+			logger.Info("Deleted empty OpaEngine", "OpaEngine", shard.engine.Name)
+		}
+		*shards = slices.Delete(*shards, i, i+1)
+	}
+
+	// Create or update the engines with their policies
+	for i := range *shards {
+		shard := &(*shards)[i]
+		engine, err := r.applyShard(ctx, set, shard)
+		if err != nil {
+			logger.Error(err, "unable to create or update OpaEngine", "Ordinal", shard.ordinal)
+			return ctrl.Result{}, err
+		}
+		shard.engine = engine
+	}
+
+	if err := r.updateStatus(ctx, req, *shards, append(unresolved, unscheduled...)); err != nil {
+		logger.Error(err, "unable to update OpaEngineSet status")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// shardsOfSet returns the OpaEngines of the set sorted by ordinal
+func (r *OpaEngineSetReconciler) shardsOfSet(ctx context.Context, set *opaspolimiitv1alpha1.OpaEngineSet) (*[]engineShard, error) {
+	engines := &opaspolimiitv1alpha1.OpaEngineList{}
+	if err := r.List(ctx, engines, client.InNamespace(set.Namespace), client.MatchingLabels{engineSetLabel: set.Name}); err != nil {
+		return nil, err
+	}
+	shards := []engineShard{}
+	for i := range engines.Items {
+		engine := &engines.Items[i]
+		ordinal, err := strconv.ParseInt(engine.Labels[shardOrdinalLabel], 10, 32)
+		if err != nil || !metav1.IsControlledBy(engine, set) {
+			continue
+		}
+		shards = append(shards, engineShard{ordinal: int32(ordinal), engine: engine})
+	}
+	slices.SortFunc(shards, func(a, b engineShard) int {
+		return int(a.ordinal - b.ordinal)
+	})
+	return &shards, nil
+}
+
+// assignPolicies sets the policies of the shards. A policy stays in the shard
+// already loading it, the new ones are placed in the first shard with room
+// for them or in a new shard. It returns the policies exceeding the maximum
+// number of shards.
+func (r *OpaEngineSetReconciler) assignPolicies(
+	ctx context.Context,
+	set *opaspolimiitv1alpha1.OpaEngineSet,
+	shards *[]engineShard,
+	closures map[string][]string,
+) ([]string, error) {
+	template := r.engineForShard(set, "", 0, nil)
+	state, err := placementState(ctx, r.Client, set.Namespace, nil, r.DefaultCapacity)
+	if err != nil {
+		return nil, err
+	}
+	limits := engineLimits(template, r.DefaultCapacity)
+
+	pending := []string{}
+	for _, policy := range set.Spec.Policies {
+		closure, ok := closures[policy]
+		if !ok {
+			continue
+		}
+		i := slices.IndexFunc(*shards, func(s engineShard) bool {
+			return s.engine != nil && slices.Contains(s.engine.Spec.Policies, policy)
+		})
+		if i < 0 {
+			pending = append(pending, policy)
+			continue
+		}
+		(*shards)[i].policies = append((*shards)[i].policies, missingPolicies((*shards)[i].policies, closure)...)
+	}
+
+	unscheduled := []string{}
+	strategy, _ := scheduler.New(scheduler.FirstFit, "")
+	for _, policy := range pending {
+		state.Engines = state.Engines[:0]
+		for _, shard := range *shards {
+			state.Engines = append(state.Engines, scheduler.Engine{
+				Name:     strconv.Itoa(int(shard.ordinal)),
+				Policies: shard.policies,
+				Limits:   limits,
+			})
+		}
+		req := scheduler.Request{Policies: closures[policy]}
+		if name, ok := scheduler.Place(strategy, req, state); ok {
+			i := slices.IndexFunc(state.Engines, func(e scheduler.Engine) bool { return e.Name == name })
+			(*shards)[i].policies = append((*shards)[i].policies, missingPolicies((*shards)[i].policies, req.Policies)...)
+			continue
+		}
+		if set.Spec.MaxShards != nil && len(*shards) >= int(*set.Spec.MaxShards) {
+			unscheduled = append(unscheduled, policy)
+			continue
+		}
+		*shards = append(*shards, engineShard{ordinal: nextOrdinal(*shards), policies: slices.Clone(req.Policies)})
+	}
+	return unscheduled, nil
+}
+
+// applyShard creates or updates the OpaEngine of the shard
+func (r *OpaEngineSetReconciler) applyShard(
+	ctx context.Context,
+	set *opaspolimiitv1alpha1.OpaEngineSet,
+	shard *engineShard,
+) (*opaspolimiitv1alpha1.OpaEngine, error) {
+	name := fmt.Sprintf("%s-%d", set.Name, shard.ordinal)
+	desired := r.engineForShard(set, name, shard.ordinal, shard.policies)
+	engine := &opaspolimiitv1alpha1.OpaEngine{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: set.Namespace},
+	}
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, engine, func() error {
+		if !engine.CreationTimestamp.IsZero() && !metav1.IsControlledBy(engine, set) {
+			return fmt.Errorf("OpaEngine %s already exists and is not part of the set", name)
+		}
+		if engine.Labels == nil {
+			engine.Labels = map[string]string{}
+		}
+		for k, v := range desired.Labels {
+			engine.Labels[k] = v
+		}
+		engine.Spec = desired.Spec
+		return ctrl.SetControllerReference(set, engine, r.Scheme)
+	})
+	return engine, err
+}
+
+// engineForShard returns the OpaEngine of the set with the given ordinal
+func (r *OpaEngineSetReconciler) engineForShard(
+	set *opaspolimiitv1alpha1.OpaEngineSet,
+	name string,
+	ordinal int32,
+	policies []string,
+) *opaspolimiitv1alpha1.OpaEngine {
+	template := set.Spec.Template.DeepCopy()
+	if policies == nil {
+		policies = []string{}
+	}
+	return &opaspolimiitv1alpha1.OpaEngine{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: set.Namespace,
+			Labels: map[string]string{
+				engineSetLabel:    set.Name,
+				shardOrdinalLabel: strconv.Itoa(int(ordinal)),
+			},
+		},
+		Spec: opaspolimiitv1alpha1.OpaEngineSpec{
+			Image:        template.Image,
+			Replicas:     template.Replicas,
+			Resources:    template.Resources,
+			InstanceName: set.Name,
+			Policies:     policies,
+			Signing:      template.Signing,
+			ExtAuthz:     template.ExtAuthz,
+			API:          template.API,
+			Capacity:     template.Capacity,
+		},
+	}
+}
+
+// updateStatus aggregates the state of the engines in the status of the set
+func (r *OpaEngineSetReconciler) updateStatus(ctx context.Context, req ctrl.Request, shards []engineShard, unscheduled []string) error {
+	status := opaspolimiitv1alpha1.OpaEngineSetStatus{
+		Shards:              int32(len(shards)),
+		UnscheduledPolicies: unscheduled,
+	}
+	for _, shard := range shards {
+		ready := meta.IsStatusConditionTrue(shard.engine.Status.Conditions, typeAvailableOpaEngine)
+		if ready {
+			status.ReadyShards++
+		}
+		status.Policies += int32(len(shard.policies))
+		for _, policy := range shard.policies {
+			if slices.Contains(shard.engine.Status.Policies, policy) {
+				status.LoadedPolicies++
+			}
+		}
+		status.Engines = append(status.Engines, opaspolimiitv1alpha1.EngineShardStatus{
+			Name:     shard.engine.Name,
+			Ordinal:  shard.ordinal,
+			Policies: shard.policies,
+			Ready:    ready,
+		})
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		set := &opaspolimiitv1alpha1.OpaEngineSet{}
+		if err := r.Get(ctx, req.NamespacedName, set); err != nil {
+			return err
+		}
+		readyCondition := metav1.Condition{
+			Type:               typeReadyOpaEngineSet,
+			Status:             metav1.ConditionTrue,
+			Reason:             "EnginesAvailable",
+			Message:            fmt.Sprintf("%d OpaEngines available", status.ReadyShards),
+			ObservedGeneration: set.Generation,
+		}
+		if status.ReadyShards < status.Shards {
+			readyCondition.Status = metav1.ConditionFalse
+			readyCondition.Reason = "EnginesUnavailable"
+			readyCondition.Message = fmt.Sprintf("%d of %d OpaEngines available", status.ReadyShards, status.Shards)
+		}
+		degraded := metav1.Condition{
+			Type:               typeDegradedOpaEngineSet,
+			Status:             metav1.ConditionFalse,
+			Reason:             "PoliciesScheduled",
+			Message:            fmt.Sprintf("%d policies scheduled in %d OpaEngines", status.Policies, status.Shards),
+			ObservedGeneration: set.Generation,
+		}
+		if len(unscheduled) > 0 {
+			degraded.Status = metav1.ConditionTrue
+			degraded.Reason = "PoliciesUnscheduled"
+			degraded.Message = truncate(fmt.Sprintf("Policies not loaded in any OpaEngine: %v", unscheduled), maxConditionMessage)
+		}
+
+		status.Conditions = set.Status.Conditions
+		changed := meta.SetStatusCondition(&status.Conditions, readyCondition)
+		changed = meta.SetStatusCondition(&status.Conditions, degraded) || changed
+		status.ObservedGeneration = set.Generation
+		if !changed && equality.Semantic.DeepEqual(set.Status, status) {
+			return nil
+		}
+		set.Status = status
+		return r.Status().Update(ctx, set)
+	})
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *OpaEngineSetReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&opaspolimiitv1alpha1.OpaEngineSet{}).
+		Owns(&opaspolimiitv1alpha1.OpaEngine{}).
+		Watches(
+			&opaspolimiitv1alpha1.Policy{},
+			handler.EnqueueRequestsFromMapFunc(r.setsOfPolicy),
+			builder.WithPredicates(policyGraphChanged),
+		).
+		Complete(r)
+}
+
+// setsOfPolicy maps a Policy to the OpaEngineSets loading it or a policy depending on it
+func (r *OpaEngineSetReconciler) setsOfPolicy(ctx context.Context, obj client.Object) []reconcile.Request {
+	logger := log.FromContext(ctx)
+
+	sets := &opaspolimiitv1alpha1.OpaEngineSetList{}
+	if err := r.List(ctx, sets, client.InNamespace(obj.GetNamespace())); err != nil {
+		logger.Error(err, "unable to list OpaEngineSets", "Policy", obj.GetName())
+		return nil
+	}
+	names := []string{obj.GetName()}
+	for _, dependent := range policiesDependingOn(ctx, r.Client, obj) {
+		names = append(names, dependent.Name)
+	}
+	requests := []reconcile.Request{}
+	for _, set := range sets.Items {
+		if slices.ContainsFunc(names, func(name string) bool {
+			return slices.Contains(set.Spec.Policies, name)
+		}) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&set)})
+		}
+	}
+	return requests
+}
+
+// nextOrdinal returns the ordinal following the ones of the shards
+func nextOrdinal(shards []engineShard) int32 {
+	next := int32(0)
+	for _, shard := range shards {
+		if shard.ordinal >= next {
+			next = shard.ordinal + 1
+		}
+	}
+	return next
+}
@@ -0,0 +1,195 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+)
+
+var _ = Describe("OpaEngineSet Controller", func() {
+	Context("When reconciling a resource", func() {
+		const resourceName = "test-set"
+
+		ctx := context.Background()
+
+		typeNamespacedName := types.NamespacedName{
+			Name:      resourceName,
+			Namespace: "default",
+		}
+		policies := []string{"set-policy-1", "set-policy-2", "set-policy-3"}
+
+		createSet := func(spec opaspolimiitv1alpha1.OpaEngineSetSpec) {
+			By("creating the custom resource for the Kind OpaEngineSet")
+			resource := &opaspolimiitv1alpha1.OpaEngineSet{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      resourceName,
+					Namespace: "default",
+				},
+				Spec: spec,
+			}
+			Expect(k8sClient.Create(ctx, resource)).To(Succeed())
+		}
+
+		reconcileSet := func() *opaspolimiitv1alpha1.OpaEngineSet {
+			By("Reconciling the OpaEngineSet")
+			controllerReconciler := &OpaEngineSetReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			set := &opaspolimiitv1alpha1.OpaEngineSet{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, set)).To(Succeed())
+			return set
+		}
+
+		enginePolicies := func(ordinal int) []string {
+			engine := &opaspolimiitv1alpha1.OpaEngine{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{
+				Name:      fmt.Sprintf("%s-%d", resourceName, ordinal),
+				Namespace: "default",
+			}, engine)).To(Succeed())
+			return engine.Spec.Policies
+		}
+
+		twoPolicies := &opaspolimiitv1alpha1.EngineCapacity{MaxPolicies: ptr.To[int32](2)}
+
+		BeforeEach(func() {
+			By("Creating the policies of the set")
+			for _, name := range policies {
+				Expect(k8sClient.Create(ctx, &opaspolimiitv1alpha1.Policy{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+					Spec:       opaspolimiitv1alpha1.PolicySpec{Rego: "package set"},
+				})).To(Succeed())
+			}
+		})
+
+		AfterEach(func() {
+			By("Cleanup the OpaEngineSet, its engines and its policies")
+			Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, &opaspolimiitv1alpha1.OpaEngineSet{
+				ObjectMeta: metav1.ObjectMeta{Name: resourceName, Namespace: "default"},
+			}))).To(Succeed())
+			Expect(k8sClient.DeleteAllOf(ctx, &opaspolimiitv1alpha1.OpaEngine{}, client.InNamespace("default"))).To(Succeed())
+			for _, name := range policies {
+				Expect(k8sClient.Delete(ctx, &opaspolimiitv1alpha1.Policy{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+				})).To(Succeed())
+			}
+		})
+
+		It("should distribute the policies among the engines within their capacity", func() {
+			createSet(opaspolimiitv1alpha1.OpaEngineSetSpec{
+				Template: opaspolimiitv1alpha1.OpaEngineTemplate{Replicas: 2, Capacity: twoPolicies},
+				Policies: policies,
+			})
+			set := reconcileSet()
+
+			Expect(enginePolicies(0)).To(Equal(policies[:2]))
+			Expect(enginePolicies(1)).To(Equal(policies[2:]))
+			engine := &opaspolimiitv1alpha1.OpaEngine{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: resourceName + "-1", Namespace: "default"}, engine)).To(Succeed())
+			Expect(metav1.IsControlledBy(engine, set)).To(BeTrue())
+			Expect(engine.Spec.InstanceName).To(Equal(resourceName))
+			Expect(engine.Spec.Replicas).To(BeEquivalentTo(2))
+
+			Expect(set.Status.Shards).To(BeEquivalentTo(2))
+			Expect(set.Status.Policies).To(BeEquivalentTo(3))
+			Expect(set.Status.Engines).To(HaveLen(2))
+			Expect(meta.IsStatusConditionFalse(set.Status.Conditions, "Degraded")).To(BeTrue())
+		})
+
+		It("should keep the policies in their engine and delete the empty ones", func() {
+			createSet(opaspolimiitv1alpha1.OpaEngineSetSpec{
+				Template: opaspolimiitv1alpha1.OpaEngineTemplate{Capacity: twoPolicies},
+				Policies: policies,
+			})
+			set := reconcileSet()
+
+			By("Removing the policies of the first engine")
+			set.Spec.Policies = policies[2:]
+			Expect(k8sClient.Update(ctx, set)).To(Succeed())
+			set = reconcileSet()
+			Expect(set.Status.Shards).To(BeEquivalentTo(1))
+			Expect(enginePolicies(1)).To(Equal(policies[2:]))
+			engine := &opaspolimiitv1alpha1.OpaEngine{}
+			err := k8sClient.Get(ctx, types.NamespacedName{Name: resourceName + "-0", Namespace: "default"}, engine)
+			Expect(client.IgnoreNotFound(err)).To(Succeed())
+			if err == nil {
+				Expect(engine.DeletionTimestamp).NotTo(BeNil())
+			}
+
+			By("Adding a policy back")
+			set.Spec.Policies = append(set.Spec.Policies, policies[0])
+			Expect(k8sClient.Update(ctx, set)).To(Succeed())
+			reconcileSet()
+			Expect(enginePolicies(1)).To(Equal([]string{policies[2], policies[0]}))
+		})
+
+		It("should report the policies exceeding the maximum number of engines", func() {
+			createSet(opaspolimiitv1alpha1.OpaEngineSetSpec{
+				Template:  opaspolimiitv1alpha1.OpaEngineTemplate{Capacity: twoPolicies},
+				Policies:  policies,
+				MaxShards: ptr.To[int32](1),
+			})
+			set := reconcileSet()
+
+			Expect(set.Status.Shards).To(BeEquivalentTo(1))
+			Expect(set.Status.UnscheduledPolicies).To(Equal(policies[2:]))
+			degraded := meta.FindStatusCondition(set.Status.Conditions, "Degraded")
+			Expect(degraded).NotTo(BeNil())
+			Expect(degraded.Status).To(Equal(metav1.ConditionTrue))
+			Expect(degraded.Reason).To(Equal("PoliciesUnscheduled"))
+		})
+
+		It("should aggregate the state of the engines", func() {
+			createSet(opaspolimiitv1alpha1.OpaEngineSetSpec{Policies: policies[:1]})
+			set := reconcileSet()
+			Expect(meta.IsStatusConditionTrue(set.Status.Conditions, "Ready")).To(BeFalse())
+
+			By("Simulating an available engine with the policy loaded")
+			engine := &opaspolimiitv1alpha1.OpaEngine{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: resourceName + "-0", Namespace: "default"}, engine)).To(Succeed())
+			engine.Status.Policies = policies[:1]
+			meta.SetStatusCondition(&engine.Status.Conditions, metav1.Condition{
+				Type: "Available", Status: metav1.ConditionTrue, Reason: "Reconciling", Message: "available",
+			})
+			Expect(k8sClient.Status().Update(ctx, engine)).To(Succeed())
+
+			set = reconcileSet()
+			Expect(set.Status.ReadyShards).To(BeEquivalentTo(1))
+			Expect(set.Status.LoadedPolicies).To(BeEquivalentTo(1))
+			Expect(set.Status.Engines[0].Ready).To(BeTrue())
+			Expect(meta.IsStatusConditionTrue(set.Status.Conditions, "Ready")).To(BeTrue())
+		})
+	})
+})
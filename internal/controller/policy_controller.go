@@ -0,0 +1,370 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/retry"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	"github.com/bramba2000/opa-scaler/internal/oci"
+	opamanager "github.com/bramba2000/opa-scaler/internal/opa"
+)
+
+const (
+	// typeCompiledPolicy is the type of the condition for a Policy whose Rego compiles
+	typeCompiledPolicy = "Compiled"
+	// typeReadyPolicy is the type of the condition for a Policy loaded in at least one OpaEngine
+	typeReadyPolicy = "Ready"
+)
+
+// maxConditionMessage is the maximum length of a condition message accepted by the API server
+const maxConditionMessage = 32768
+
+// defaultPuller is shared by reconcilers without a configured Puller
+var defaultPuller = oci.NewPuller()
+
+// PolicyReconciler reconciles a Policy object
+type PolicyReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// Puller fetches the policies distributed as OCI images
+	Puller *oci.Puller
+}
+
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=policies,verbs=get;list;watch
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=policies/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=opaengines,verbs=get;list;watch
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=policydata,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=secrets,verbs=get;list;watch
+
+// Reconcile checks that the Rego of the Policy compiles and reports the OpaEngines serving it
+func (r *PolicyReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	// Fetch the Policy instance
+	policy := &opaspolimiitv1alpha1.Policy{}
+	if err := r.Get(ctx, req.NamespacedName, policy); err != nil {
+		err = client.IgnoreNotFound(err)
+		if err != nil {
+			logger.Error(err, "unable to fetch Policy")
+		}
+		return ctrl.Result{}, err
+	}
+	if !policy.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	// Check the rego code
+	result := ctrl.Result{}
+	compiled := metav1.Condition{
+		Type:               typeCompiledPolicy,
+		ObservedGeneration: policy.Generation,
+	}
+	modules, err := loadPolicyModules(ctx, r.Client, r.Puller, policy)
+
+	// Infer the dependencies from the imports of the modules, the packages of
+	// the policy are kept in its status to resolve the imports of the others
+	refs := opamanager.ModuleRefs{Packages: policy.Status.Packages, Imports: policy.Status.Imports}
+	size := policy.Status.Size
+	imports := metav1.Condition{
+		Type:               typeImportsResolvedPolicy,
+		Status:             metav1.ConditionUnknown,
+		Reason:             "SourceUnavailable",
+		Message:            "The modules of the policy cannot be read",
+		ObservedGeneration: policy.Generation,
+	}
+	if err == nil {
+		refs = opamanager.AnalyzeModules(modules)
+		size = 0
+		for _, code := range modules {
+			size += int64(len(code))
+		}
+		resolution, err := r.resolvePolicyImports(ctx, policy, refs)
+		if err != nil {
+			logger.Error(err, "unable to resolve policy imports")
+			return ctrl.Result{}, err
+		}
+		imports = resolution.condition(policy.Generation)
+		policy.Status.Dependencies = resolution.dependencies
+	}
+
+	// The policy is compiled together with the modules it imports
+	dependencies := map[string]string{}
+	graph := directDependencies(policy)
+	if err == nil {
+		dependencies, graph, err = r.dependencyModules(ctx, policy)
+	}
+	if reason := dependencyErrorReason(err); reason != "" {
+		logger.Error(err, "unable to resolve policy dependencies")
+		compiled.Status = metav1.ConditionFalse
+		compiled.Reason = reason
+		compiled.Message = truncate(err.Error(), maxConditionMessage)
+	} else if err != nil {
+		logger.Error(err, "unable to load policy code")
+		compiled.Status = metav1.ConditionFalse
+		compiled.Reason = "SourceUnavailable"
+		compiled.Message = err.Error()
+		// The image or its pull secret may appear later
+		result.RequeueAfter = 30 * time.Second
+	} else if len(modules) == 0 {
+		compiled.Status = metav1.ConditionFalse
+		compiled.Reason = "Empty"
+		compiled.Message = "Policy does not contain any rego module"
+	} else if regoErrors := opamanager.CheckModules(mergeModules(dependencies, modules)); len(regoErrors) > 0 {
+		compiled.Status = metav1.ConditionFalse
+		compiled.Reason = "CompileError"
+		if regoErrors[0].IsParseError() {
+			compiled.Reason = "ParseError"
+		}
+		messages := make([]string, 0, len(regoErrors))
+		for _, e := range regoErrors {
+			messages = append(messages, e.String())
+		}
+		compiled.Message = truncate(strings.Join(messages, "\n"), maxConditionMessage)
+	} else {
+		compiled.Status = metav1.ConditionTrue
+		compiled.Reason = "Compiled"
+		compiled.Message = fmt.Sprintf("%d rego modules compiled", len(modules))
+		if len(dependencies) > 0 {
+			compiled.Message += fmt.Sprintf(" with %d modules of the dependencies", len(dependencies))
+		}
+	}
+
+	// Look for the engines where the policy is loaded
+	engines, err := r.enginesServingPolicy(ctx, policy)
+	if err != nil {
+		logger.Error(err, "unable to list OpaEngines")
+		return ctrl.Result{}, err
+	}
+
+	ready := metav1.Condition{
+		Type:               typeReadyPolicy,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: policy.Generation,
+	}
+	switch {
+	case compiled.Status != metav1.ConditionTrue:
+		ready.Reason = "NotCompiled"
+		ready.Message = "Policy does not compile"
+	case len(engines) == 0:
+		ready.Reason = "NotLoaded"
+		ready.Message = "Policy is not loaded in any OpaEngine"
+	default:
+		ready.Status = metav1.ConditionTrue
+		ready.Reason = "Loaded"
+		ready.Message = fmt.Sprintf("Policy loaded in %d OpaEngines", len(engines))
+	}
+
+	if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if err := r.Get(ctx, req.NamespacedName, policy); err != nil {
+			return err
+		}
+		changed := meta.SetStatusCondition(&policy.Status.Conditions, compiled)
+		changed = meta.SetStatusCondition(&policy.Status.Conditions, ready) || changed
+		changed = meta.SetStatusCondition(&policy.Status.Conditions, imports) || changed
+		if !changed && policy.Status.ObservedGeneration == policy.Generation && slices.Equal(policy.Status.Engines, engines) && policy.Status.Size == size &&
+			slices.Equal(policy.Status.Packages, refs.Packages) && slices.Equal(policy.Status.Imports, refs.Imports) &&
+			equality.Semantic.DeepEqual(policy.Status.Dependencies, graph) {
+			return nil
+		}
+		policy.Status.ObservedGeneration = policy.Generation
+		policy.Status.Engines = engines
+		policy.Status.Size = size
+		policy.Status.Packages = refs.Packages
+		policy.Status.Imports = refs.Imports
+		policy.Status.Dependencies = graph
+		return r.Status().Update(ctx, policy)
+	}); err != nil {
+		logger.Error(err, "unable to update Policy status")
+		return ctrl.Result{}, err
+	}
+
+	return result, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PolicyReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&opaspolimiitv1alpha1.Policy{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&opaspolimiitv1alpha1.OpaEngine{}, handler.EnqueueRequestsFromMapFunc(policiesOfEngine)).
+		Watches(
+			&opaspolimiitv1alpha1.Policy{},
+			handler.EnqueueRequestsFromMapFunc(r.policiesImporting),
+			builder.WithPredicates(policyGraphChanged),
+		).
+		Watches(
+			&opaspolimiitv1alpha1.PolicyData{},
+			handler.EnqueueRequestsFromMapFunc(r.policiesImporting),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{}),
+		).
+		Complete(r)
+}
+
+// dependencyModules returns the modules of the transitive dependencies of the
+// policy and the edges of its dependency graph. The direct dependencies of
+// the policy are the ones of its status, not the stored ones.
+func (r *PolicyReconciler) dependencyModules(
+	ctx context.Context,
+	policy *opaspolimiitv1alpha1.Policy,
+) (map[string]string, []opaspolimiitv1alpha1.PolicyDependencyStatus, error) {
+	policies, err := resolvePolicies(ctx, r.Client, policy.Namespace, []string{policy.Name}, policy)
+	if err != nil {
+		return nil, directDependencies(policy), err
+	}
+	// The policy itself comes after its dependencies
+	modules := map[string]string{}
+	for _, dependency := range policies[:len(policies)-1] {
+		code, err := loadPolicyModules(ctx, r.Client, r.Puller, dependency)
+		if err != nil {
+			return nil, dependencyGraph(policies), fmt.Errorf("dependency %s: %w", dependency.Name, err)
+		}
+		modules = mergeModules(modules, code)
+	}
+	return modules, dependencyGraph(policies), nil
+}
+
+// enginesServingPolicy returns the sorted names of the OpaEngines that have loaded the policy
+func (r *PolicyReconciler) enginesServingPolicy(ctx context.Context, policy *opaspolimiitv1alpha1.Policy) ([]string, error) {
+	engines := &opaspolimiitv1alpha1.OpaEngineList{}
+	if err := r.List(ctx, engines, client.InNamespace(policy.Namespace)); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, engine := range engines.Items {
+		if slices.Contains(engine.Status.Policies, policy.Name) {
+			names = append(names, engine.Name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// policiesOfEngine maps an OpaEngine to the policies it expects or has loaded
+func policiesOfEngine(ctx context.Context, obj client.Object) []reconcile.Request {
+	engine, ok := obj.(*opaspolimiitv1alpha1.OpaEngine)
+	if !ok {
+		return nil
+	}
+	names := append(slices.Clone(engine.Spec.Policies), engine.Status.Policies...)
+	slices.Sort(names)
+	names = slices.Compact(names)
+
+	requests := make([]reconcile.Request, 0, len(names))
+	for _, name := range names {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKey{
+			Namespace: engine.Namespace,
+			Name:      name,
+		}})
+	}
+	return requests
+}
+
+// loadPolicyModules returns the modules of the policy indexed by their OPA id.
+// Inline Rego is loaded under the policy name, while the files of an image
+// are loaded as <policy>/<path>.
+func loadPolicyModules(ctx context.Context, c client.Client, puller *oci.Puller, policy *opaspolimiitv1alpha1.Policy) (map[string]string, error) {
+	logger := log.FromContext(ctx)
+
+	modules := make(map[string]string)
+	if policy.Spec.Rego != "" {
+		modules[policy.Name] = policy.Spec.Rego
+	}
+	if policy.Spec.Image != "" {
+		cred, err := pullCredential(ctx, c, policy)
+		if err != nil {
+			logger.Error(err, "unable to read image pull secrets", "Policy", policy.Name)
+			return nil, err
+		}
+		if puller == nil {
+			puller = defaultPuller
+		}
+		artifact, err := puller.Pull(ctx, policy.Spec.Image, cred)
+		if err != nil {
+			logger.Error(err, "unable to pull policy image", "Policy", policy.Name, "Image", policy.Spec.Image)
+			return nil, err
+		}
+		logger.Info("Pulled policy image", "Policy", policy.Name, "Digest", artifact.Digest, "Modules", len(artifact.Modules))
+		for file, code := range artifact.Modules {
+			modules[opamanager.ModuleID(policy.Name, file)] = code
+		}
+	}
+	return modules, nil
+}
+
+// mergeModules returns the union of the modules indexed by their OPA id
+func mergeModules(a, b map[string]string) map[string]string {
+	merged := make(map[string]string, len(a)+len(b))
+	for id, code := range a {
+		merged[id] = code
+	}
+	for id, code := range b {
+		merged[id] = code
+	}
+	return merged
+}
+
+// pullCredential looks for the credential of the image registry among the policy pull secrets
+func pullCredential(ctx context.Context, c client.Client, policy *opaspolimiitv1alpha1.Policy) (auth.Credential, error) {
+	if len(policy.Spec.ImagePullSecrets) == 0 {
+		return auth.EmptyCredential, nil
+	}
+	ref, _, err := oci.ParseReference(policy.Spec.Image)
+	if err != nil {
+		return auth.EmptyCredential, err
+	}
+	for _, s := range policy.Spec.ImagePullSecrets {
+		secret := &corev1.Secret{}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: policy.Namespace, Name: s.Name}, secret); err != nil {
+			return auth.EmptyCredential, err
+		}
+		cred, found, err := oci.CredentialFromSecret(secret, ref.Registry)
+		if err != nil {
+			return auth.EmptyCredential, err
+		}
+		if found {
+			return cred, nil
+		}
+	}
+	return auth.EmptyCredential, nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-3] + "..."
+}
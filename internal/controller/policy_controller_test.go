@@ -0,0 +1,240 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+)
+
+var _ = Describe("Policy Controller", func() {
+	Context("When reconciling a resource", func() {
+		const resourceName = "test-policy"
+
+		ctx := context.Background()
+
+		typeNamespacedName := types.NamespacedName{
+			Name:      resourceName,
+			Namespace: "default",
+		}
+
+		createPolicy := func(rego string, dependencies ...string) {
+			By("creating the custom resource for the Kind Policy")
+			resource := &opaspolimiitv1alpha1.Policy{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      resourceName,
+					Namespace: "default",
+				},
+				Spec: opaspolimiitv1alpha1.PolicySpec{
+					Rego: rego,
+				},
+			}
+			for _, name := range dependencies {
+				resource.Spec.Dependencies = append(resource.Spec.Dependencies, opaspolimiitv1alpha1.PolicyReference{Name: name})
+			}
+			Expect(k8sClient.Create(ctx, resource)).To(Succeed())
+		}
+
+		reconcilePolicy := func() *opaspolimiitv1alpha1.Policy {
+			By("Reconciling the Policy")
+			controllerReconciler := &PolicyReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			policy := &opaspolimiitv1alpha1.Policy{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, policy)).To(Succeed())
+			return policy
+		}
+
+		AfterEach(func() {
+			resource := &opaspolimiitv1alpha1.Policy{}
+			err := k8sClient.Get(ctx, typeNamespacedName, resource)
+			if errors.IsNotFound(err) {
+				Skip("Resource already deleted")
+			}
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Cleanup the specific resource instance Policy")
+			Expect(k8sClient.Delete(ctx, resource)).To(Succeed())
+		})
+
+		It("should report a compiled policy not loaded anywhere", func() {
+			createPolicy("package test\n\ndefault allow := false\n")
+			policy := reconcilePolicy()
+
+			compiled := meta.FindStatusCondition(policy.Status.Conditions, typeCompiledPolicy)
+			Expect(compiled).NotTo(BeNil())
+			Expect(compiled.Status).To(Equal(metav1.ConditionTrue))
+			Expect(compiled.ObservedGeneration).To(Equal(policy.Generation))
+
+			ready := meta.FindStatusCondition(policy.Status.Conditions, typeReadyPolicy)
+			Expect(ready).NotTo(BeNil())
+			Expect(ready.Status).To(Equal(metav1.ConditionFalse))
+			Expect(ready.Reason).To(Equal("NotLoaded"))
+			Expect(policy.Status.ObservedGeneration).To(Equal(policy.Generation))
+			Expect(policy.Status.Engines).To(BeEmpty())
+		})
+
+		It("should report the position of syntax errors", func() {
+			createPolicy("package test\n\nallow if {\n")
+			policy := reconcilePolicy()
+
+			compiled := meta.FindStatusCondition(policy.Status.Conditions, typeCompiledPolicy)
+			Expect(compiled).NotTo(BeNil())
+			Expect(compiled.Status).To(Equal(metav1.ConditionFalse))
+			Expect(compiled.Reason).To(Equal("ParseError"))
+			Expect(compiled.Message).To(ContainSubstring(resourceName + ":"))
+
+			ready := meta.FindStatusCondition(policy.Status.Conditions, typeReadyPolicy)
+			Expect(ready).NotTo(BeNil())
+			Expect(ready.Reason).To(Equal("NotCompiled"))
+		})
+
+		It("should compile the policy with the modules of its dependencies", func() {
+			By("creating the library imported by the policy")
+			lib := &opaspolimiitv1alpha1.Policy{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-policy-lib", Namespace: "default"},
+				Spec: opaspolimiitv1alpha1.PolicySpec{
+					Rego: "package lib\n\nis_admin(user) if user == \"alice\"\n",
+				},
+			}
+			Expect(k8sClient.Create(ctx, lib)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, lib)).To(Succeed())
+			}()
+			createPolicy("package test\n\nimport data.lib\n\nallow if lib.is_admin(input.user)\n", "test-policy-lib")
+			policy := reconcilePolicy()
+
+			compiled := meta.FindStatusCondition(policy.Status.Conditions, typeCompiledPolicy)
+			Expect(compiled).NotTo(BeNil())
+			Expect(compiled.Status).To(Equal(metav1.ConditionTrue))
+			Expect(compiled.Message).To(ContainSubstring("dependencies"))
+		})
+
+		It("should infer the dependencies from the imports", func() {
+			By("creating and reconciling the library imported by the policy")
+			lib := &opaspolimiitv1alpha1.Policy{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-policy-inferred-lib", Namespace: "default"},
+				Spec: opaspolimiitv1alpha1.PolicySpec{
+					Rego: "package lib.users\n\nis_admin(user) if user == \"alice\"\n",
+				},
+			}
+			Expect(k8sClient.Create(ctx, lib)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, lib)).To(Succeed())
+			}()
+			controllerReconciler := &PolicyReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: types.NamespacedName{
+				Name:      lib.Name,
+				Namespace: lib.Namespace,
+			}})
+			Expect(err).NotTo(HaveOccurred())
+
+			createPolicy("package test\n\nimport data.lib.users\nimport data.unknown\n\nallow if users.is_admin(input.user)\n")
+			policy := reconcilePolicy()
+			Expect(policy.Status.Packages).To(Equal([]string{"data.test"}))
+			Expect(policy.Status.Imports).To(Equal([]string{"data.lib.users", "data.unknown"}))
+			Expect(policy.Status.Dependencies).To(Equal([]opaspolimiitv1alpha1.PolicyDependencyStatus{{
+				Policy:   resourceName,
+				Name:     lib.Name,
+				Inferred: true,
+				Imports:  []string{"data.lib.users"},
+			}}))
+
+			compiled := meta.FindStatusCondition(policy.Status.Conditions, typeCompiledPolicy)
+			Expect(compiled).NotTo(BeNil())
+			Expect(compiled.Status).To(Equal(metav1.ConditionTrue))
+			imports := meta.FindStatusCondition(policy.Status.Conditions, typeImportsResolvedPolicy)
+			Expect(imports).NotTo(BeNil())
+			Expect(imports.Status).To(Equal(metav1.ConditionFalse))
+			Expect(imports.Reason).To(Equal("UnresolvedImports"))
+			Expect(imports.Message).To(ContainSubstring("data.unknown"))
+
+			By("mapping the library to the policy importing it")
+			Expect(controllerReconciler.policiesImporting(ctx, lib)).To(ContainElement(reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			}))
+		})
+
+		It("should report a missing dependency", func() {
+			createPolicy("package test\n\nimport data.lib\n\nallow if lib.is_admin(input.user)\n", "missing-lib")
+			policy := reconcilePolicy()
+
+			compiled := meta.FindStatusCondition(policy.Status.Conditions, typeCompiledPolicy)
+			Expect(compiled).NotTo(BeNil())
+			Expect(compiled.Status).To(Equal(metav1.ConditionFalse))
+			Expect(compiled.Reason).To(Equal("MissingDependency"))
+			Expect(compiled.Message).To(ContainSubstring("missing-lib"))
+		})
+
+		It("should report a policy depending on itself", func() {
+			createPolicy("package test\n\ndefault allow := false\n", resourceName)
+			policy := reconcilePolicy()
+
+			compiled := meta.FindStatusCondition(policy.Status.Conditions, typeCompiledPolicy)
+			Expect(compiled).NotTo(BeNil())
+			Expect(compiled.Status).To(Equal(metav1.ConditionFalse))
+			Expect(compiled.Reason).To(Equal("DependencyCycle"))
+		})
+
+		It("should list the engines serving the policy", func() {
+			createPolicy("package test\n\ndefault allow := false\n")
+
+			By("creating an OpaEngine reporting the policy as loaded")
+			engine := &opaspolimiitv1alpha1.OpaEngine{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-policy-engine",
+					Namespace: "default",
+				},
+				Spec: opaspolimiitv1alpha1.OpaEngineSpec{
+					InstanceName: "default",
+					Policies:     []string{resourceName},
+				},
+			}
+			Expect(k8sClient.Create(ctx, engine)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, engine)).To(Succeed())
+			}()
+			engine.Status.Policies = []string{resourceName}
+			Expect(k8sClient.Status().Update(ctx, engine)).To(Succeed())
+
+			policy := reconcilePolicy()
+			Expect(policy.Status.Engines).To(Equal([]string{"test-policy-engine"}))
+			ready := meta.FindStatusCondition(policy.Status.Conditions, typeReadyPolicy)
+			Expect(ready).NotTo(BeNil())
+			Expect(ready.Status).To(Equal(metav1.ConditionTrue))
+		})
+	})
+})
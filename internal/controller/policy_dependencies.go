@@ -0,0 +1,262 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+)
+
+// missingPolicyError reports a Policy that does not exist
+type missingPolicyError struct {
+	name string
+	// requiredBy is the policy depending on the missing one, empty for a root
+	requiredBy string
+}
+
+func (e *missingPolicyError) Error() string {
+	if e.requiredBy == "" {
+		return fmt.Sprintf("policy %s not found", e.name)
+	}
+	return fmt.Sprintf("policy %s not found, required by %s", e.name, e.requiredBy)
+}
+
+// dependencyCycleError reports policies that depend on each other
+type dependencyCycleError struct {
+	// cycle starts and ends with the same policy
+	cycle []string
+}
+
+func (e *dependencyCycleError) Error() string {
+	return "dependency cycle between policies " + strings.Join(e.cycle, " -> ")
+}
+
+// dependencyErrorReason returns the reason of the condition reporting a
+// missing policy or a dependency error, empty for any other error
+func dependencyErrorReason(err error) string {
+	var missing *missingPolicyError
+	var cycle *dependencyCycleError
+	switch {
+	case errors.As(err, &missing) && missing.requiredBy == "":
+		return "PolicyNotFound"
+	case errors.As(err, &missing):
+		return "MissingDependency"
+	case errors.As(err, &cycle):
+		return "DependencyCycle"
+	default:
+		return ""
+	}
+}
+
+// policyClosure returns the roots and their transitive dependencies in
+// topological order, each policy after the ones it depends on. The order is
+// stable given the order of the roots and of the dependencies.
+func policyClosure(roots []string, dependencies func(name, requiredBy string) ([]string, error)) ([]string, error) {
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := map[string]int{}
+	order := []string{}
+	// path is the chain of policies being visited, used to report a cycle
+	path := []string{}
+
+	var visit func(name, requiredBy string) error
+	visit = func(name, requiredBy string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			cycle := slices.Clone(path[slices.Index(path, name):])
+			return &dependencyCycleError{cycle: append(cycle, name)}
+		}
+		state[name] = visiting
+		path = append(path, name)
+		deps, err := dependencies(name, requiredBy)
+		if err != nil {
+			return err
+		}
+		for _, dep := range deps {
+			if err := visit(dep, name); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+
+	for _, root := range roots {
+		if err := visit(root, ""); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// resolvePolicies fetches the policies and their transitive dependencies,
+// returned in topological order. The given policies are used in place of the
+// ones stored with the same name.
+func resolvePolicies(
+	ctx context.Context,
+	c client.Client,
+	namespace string,
+	roots []string,
+	overrides ...*opaspolimiitv1alpha1.Policy,
+) ([]*opaspolimiitv1alpha1.Policy, error) {
+	policies := map[string]*opaspolimiitv1alpha1.Policy{}
+	order, err := policyClosure(roots, func(name, requiredBy string) ([]string, error) {
+		if i := slices.IndexFunc(overrides, func(p *opaspolimiitv1alpha1.Policy) bool { return p.Name == name }); i >= 0 {
+			policies[name] = overrides[i]
+			return policyDependencies(overrides[i]), nil
+		}
+		policy := &opaspolimiitv1alpha1.Policy{}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: namespace, Name: name}, policy); err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil, &missingPolicyError{name: name, requiredBy: requiredBy}
+			}
+			return nil, err
+		}
+		policies[name] = policy
+		return policyDependencies(policy), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	resolved := make([]*opaspolimiitv1alpha1.Policy, 0, len(order))
+	for _, name := range order {
+		resolved = append(resolved, policies[name])
+	}
+	return resolved, nil
+}
+
+// resolvePolicyNames returns the names of the policies and of their
+// transitive dependencies in topological order
+func resolvePolicyNames(ctx context.Context, c client.Client, namespace string, roots []string) ([]string, error) {
+	policies, err := resolvePolicies(ctx, c, namespace, roots)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(policies))
+	for _, policy := range policies {
+		names = append(names, policy.Name)
+	}
+	return names, nil
+}
+
+// policyDependencies returns the names of the policies the policy depends on
+func policyDependencies(policy *opaspolimiitv1alpha1.Policy) []string {
+	edges := directDependencies(policy)
+	names := make([]string, 0, len(edges))
+	for _, edge := range edges {
+		names = append(names, edge.Name)
+	}
+	return names
+}
+
+// directDependencies returns the edges from the policy to the policies listed
+// in its spec, followed by the ones inferred from its imports
+func directDependencies(policy *opaspolimiitv1alpha1.Policy) []opaspolimiitv1alpha1.PolicyDependencyStatus {
+	edges := make([]opaspolimiitv1alpha1.PolicyDependencyStatus, 0, len(policy.Spec.Dependencies))
+	for _, dep := range policy.Spec.Dependencies {
+		edge := opaspolimiitv1alpha1.PolicyDependencyStatus{Policy: policy.Name, Name: dep.Name}
+		if i := slices.IndexFunc(policy.Status.Dependencies, func(e opaspolimiitv1alpha1.PolicyDependencyStatus) bool {
+			return e.Policy == policy.Name && e.Name == dep.Name
+		}); i >= 0 {
+			edge.Imports = policy.Status.Dependencies[i].Imports
+		}
+		edges = append(edges, edge)
+	}
+	for _, edge := range policy.Status.Dependencies {
+		if edge.Policy == policy.Name && edge.Inferred && !slices.ContainsFunc(edges, func(e opaspolimiitv1alpha1.PolicyDependencyStatus) bool {
+			return e.Name == edge.Name
+		}) {
+			edges = append(edges, edge)
+		}
+	}
+	return edges
+}
+
+// dependencyGraph returns the edges of the dependency graph of the policies
+func dependencyGraph(policies []*opaspolimiitv1alpha1.Policy) []opaspolimiitv1alpha1.PolicyDependencyStatus {
+	edges := []opaspolimiitv1alpha1.PolicyDependencyStatus{}
+	for _, policy := range policies {
+		edges = append(edges, directDependencies(policy)...)
+	}
+	return edges
+}
+
+// policyGraphChanged passes the events of the policies whose code or
+// dependencies may have changed, including the ones inferred by the controller
+var policyGraphChanged = predicate.Or[client.Object](
+	predicate.GenerationChangedPredicate{},
+	predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			oldPolicy, ok := e.ObjectOld.(*opaspolimiitv1alpha1.Policy)
+			if !ok {
+				return false
+			}
+			newPolicy, ok := e.ObjectNew.(*opaspolimiitv1alpha1.Policy)
+			if !ok {
+				return false
+			}
+			return !slices.Equal(oldPolicy.Status.Packages, newPolicy.Status.Packages) ||
+				!equality.Semantic.DeepEqual(oldPolicy.Status.Dependencies, newPolicy.Status.Dependencies)
+		},
+	},
+)
+
+// policiesDependingOn maps a Policy to the policies that depend on it,
+// directly or through other policies
+func policiesDependingOn(ctx context.Context, c client.Client, obj client.Object) []reconcile.Request {
+	logger := log.FromContext(ctx)
+
+	policies := &opaspolimiitv1alpha1.PolicyList{}
+	if err := c.List(ctx, policies, client.InNamespace(obj.GetNamespace())); err != nil {
+		logger.Error(err, "unable to list Policies", "Policy", obj.GetName())
+		return nil
+	}
+	requests := []reconcile.Request{}
+	queue := []string{obj.GetName()}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, policy := range policies.Items {
+			request := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&policy)}
+			if policy.Name != obj.GetName() && !slices.Contains(requests, request) &&
+				slices.Contains(policyDependencies(&policy), name) {
+				requests = append(requests, request)
+				queue = append(queue, policy.Name)
+			}
+		}
+	}
+	return requests
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Policy dependencies", func() {
+	// graph returns the lookup of the dependencies of the policies
+	graph := func(edges map[string][]string) func(name, requiredBy string) ([]string, error) {
+		return func(name, requiredBy string) ([]string, error) {
+			deps, ok := edges[name]
+			if !ok {
+				return nil, &missingPolicyError{name: name, requiredBy: requiredBy}
+			}
+			return deps, nil
+		}
+	}
+
+	It("should order the transitive dependencies before their importers", func() {
+		order, err := policyClosure([]string{"app", "other"}, graph(map[string][]string{
+			"app":   {"authz", "utils"},
+			"authz": {"utils"},
+			"utils": {},
+			"other": {"utils"},
+		}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(order).To(Equal([]string{"utils", "authz", "app", "other"}))
+	})
+
+	It("should report the policies of a cycle", func() {
+		_, err := policyClosure([]string{"app"}, graph(map[string][]string{
+			"app":   {"authz"},
+			"authz": {"utils"},
+			"utils": {"authz"},
+		}))
+		Expect(err).To(MatchError("dependency cycle between policies authz -> utils -> authz"))
+		Expect(dependencyErrorReason(err)).To(Equal("DependencyCycle"))
+	})
+
+	It("should report a missing dependency with the policy requiring it", func() {
+		_, err := policyClosure([]string{"app"}, graph(map[string][]string{
+			"app": {"authz"},
+		}))
+		Expect(err).To(MatchError("policy authz not found, required by app"))
+		Expect(dependencyErrorReason(err)).To(Equal("MissingDependency"))
+
+		_, err = policyClosure([]string{"missing"}, graph(nil))
+		Expect(dependencyErrorReason(err)).To(Equal("PolicyNotFound"))
+	})
+})
@@ -0,0 +1,237 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	opamanager "github.com/bramba2000/opa-scaler/internal/opa"
+)
+
+// typeImportsResolvedPolicy is the type of the condition for a Policy whose
+// imports are all defined by a single policy or by a PolicyData
+const typeImportsResolvedPolicy = "ImportsResolved"
+
+// importResolution is the result of the matching of the imports of a policy
+// with the packages of the other policies
+type importResolution struct {
+	// dependencies are the direct dependencies of the policy, the ones listed
+	// in the spec followed by the inferred ones
+	dependencies []opaspolimiitv1alpha1.PolicyDependencyStatus
+	// unresolved are the imports not defined by any policy or PolicyData
+	unresolved []string
+	// ambiguous are the imports defined by several policies, by import
+	ambiguous map[string][]string
+}
+
+// resolveImports matches the imports of the policy with the packages of the
+// other policies, whose modules are indexed by their status, and with the
+// paths of the documents of the PolicyData. A policy defining an imported
+// package, or a package under an imported document, becomes a dependency
+// unless the import is already matched by a dependency of the spec. An import
+// whose package is defined by several policies is not inferred.
+func resolveImports(
+	policy *opaspolimiitv1alpha1.Policy,
+	refs opamanager.ModuleRefs,
+	others []opaspolimiitv1alpha1.Policy,
+	documents []string,
+) importResolution {
+	resolution := importResolution{ambiguous: map[string][]string{}}
+	explicit := map[string]*opaspolimiitv1alpha1.PolicyDependencyStatus{}
+	for _, dep := range policy.Spec.Dependencies {
+		resolution.dependencies = append(resolution.dependencies, opaspolimiitv1alpha1.PolicyDependencyStatus{
+			Policy: policy.Name,
+			Name:   dep.Name,
+		})
+	}
+	for i := range resolution.dependencies {
+		explicit[resolution.dependencies[i].Name] = &resolution.dependencies[i]
+	}
+	inferred := map[string][]string{}
+
+	for _, imp := range refs.Imports {
+		if slices.ContainsFunc(refs.Packages, func(pkg string) bool {
+			return opamanager.RefHasPrefix(imp, pkg) || opamanager.RefHasPrefix(pkg, imp)
+		}) {
+			continue
+		}
+		// The policies defining the package of the import, and the ones
+		// defining packages under the imported document
+		containing, nested := []string{}, []string{}
+		for _, other := range others {
+			if other.Name == policy.Name {
+				continue
+			}
+			for _, pkg := range other.Status.Packages {
+				switch {
+				case opamanager.RefHasPrefix(imp, pkg):
+					containing = append(containing, other.Name)
+				case opamanager.RefHasPrefix(pkg, imp):
+					nested = append(nested, other.Name)
+				}
+			}
+		}
+		candidates := append(slices.Clone(containing), nested...)
+		slices.Sort(candidates)
+		candidates = slices.Compact(candidates)
+
+		matched := false
+		for _, name := range candidates {
+			if dep, ok := explicit[name]; ok {
+				dep.Imports = append(dep.Imports, imp)
+				matched = true
+			}
+		}
+		slices.Sort(containing)
+		containing = slices.Compact(containing)
+		switch {
+		case matched:
+		case len(containing) > 1:
+			resolution.ambiguous[imp] = containing
+		case len(candidates) > 0:
+			for _, name := range candidates {
+				inferred[name] = append(inferred[name], imp)
+			}
+		case slices.ContainsFunc(documents, func(doc string) bool {
+			return opamanager.RefHasPrefix(imp, doc) || opamanager.RefHasPrefix(doc, imp)
+		}):
+		default:
+			resolution.unresolved = append(resolution.unresolved, imp)
+		}
+	}
+
+	for _, name := range sortedKeys(inferred) {
+		resolution.dependencies = append(resolution.dependencies, opaspolimiitv1alpha1.PolicyDependencyStatus{
+			Policy:   policy.Name,
+			Name:     name,
+			Inferred: true,
+			Imports:  inferred[name],
+		})
+	}
+	return resolution
+}
+
+// condition returns the ImportsResolved condition of the policy
+func (res importResolution) condition(generation int64) metav1.Condition {
+	condition := metav1.Condition{
+		Type:               typeImportsResolvedPolicy,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Resolved",
+		Message:            "Every import is defined by a dependency or a PolicyData",
+		ObservedGeneration: generation,
+	}
+	messages := []string{}
+	if len(res.unresolved) > 0 {
+		messages = append(messages, fmt.Sprintf("No policy or PolicyData defines the imports %v", res.unresolved))
+	}
+	for _, imp := range sortedKeys(res.ambiguous) {
+		messages = append(messages, fmt.Sprintf("Import %s is defined by the policies %v, list one of them in the dependencies", imp, res.ambiguous[imp]))
+	}
+	switch {
+	case len(res.unresolved) > 0:
+		condition.Reason = "UnresolvedImports"
+	case len(res.ambiguous) > 0:
+		condition.Reason = "AmbiguousImports"
+	default:
+		return condition
+	}
+	condition.Status = metav1.ConditionFalse
+	condition.Message = truncate(strings.Join(messages, "; "), maxConditionMessage)
+	return condition
+}
+
+// resolvePolicyImports resolves the imports of the policy against the other
+// policies and the PolicyData of its namespace
+func (r *PolicyReconciler) resolvePolicyImports(
+	ctx context.Context,
+	policy *opaspolimiitv1alpha1.Policy,
+	refs opamanager.ModuleRefs,
+) (importResolution, error) {
+	policies := &opaspolimiitv1alpha1.PolicyList{}
+	if err := r.List(ctx, policies, client.InNamespace(policy.Namespace)); err != nil {
+		return importResolution{}, err
+	}
+	others := slices.DeleteFunc(policies.Items, func(p opaspolimiitv1alpha1.Policy) bool {
+		return p.Name == policy.Name || !p.DeletionTimestamp.IsZero()
+	})
+	slices.SortFunc(others, func(a, b opaspolimiitv1alpha1.Policy) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	data := &opaspolimiitv1alpha1.PolicyDataList{}
+	if err := r.List(ctx, data, client.InNamespace(policy.Namespace)); err != nil {
+		return importResolution{}, err
+	}
+	documents := make([]string, 0, len(data.Items))
+	for _, d := range data.Items {
+		documents = append(documents, opamanager.DataRef(d.Spec.Path))
+	}
+	return resolveImports(policy, refs, others, documents), nil
+}
+
+// policiesImporting maps a Policy or a PolicyData to the policies whose
+// imports may be resolved differently because of it: the policies depending
+// on it, importing its documents or with imports not resolved yet
+func (r *PolicyReconciler) policiesImporting(ctx context.Context, obj client.Object) []reconcile.Request {
+	logger := log.FromContext(ctx)
+
+	var defined []string
+	switch o := obj.(type) {
+	case *opaspolimiitv1alpha1.Policy:
+		defined = o.Status.Packages
+	case *opaspolimiitv1alpha1.PolicyData:
+		defined = []string{opamanager.DataRef(o.Spec.Path)}
+	default:
+		return nil
+	}
+
+	policies := &opaspolimiitv1alpha1.PolicyList{}
+	if err := r.List(ctx, policies, client.InNamespace(obj.GetNamespace())); err != nil {
+		logger.Error(err, "unable to list Policies", "Object", obj.GetName())
+		return nil
+	}
+	requests := []reconcile.Request{}
+	_, isPolicy := obj.(*opaspolimiitv1alpha1.Policy)
+	if isPolicy {
+		requests = policiesDependingOn(ctx, r.Client, obj)
+	}
+	for _, policy := range policies.Items {
+		request := reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&policy)}
+		if (isPolicy && policy.Name == obj.GetName()) || slices.Contains(requests, request) {
+			continue
+		}
+		if !meta.IsStatusConditionTrue(policy.Status.Conditions, typeImportsResolvedPolicy) ||
+			slices.ContainsFunc(policy.Status.Imports, func(imp string) bool {
+				return slices.ContainsFunc(defined, func(pkg string) bool {
+					return opamanager.RefHasPrefix(imp, pkg) || opamanager.RefHasPrefix(pkg, imp)
+				})
+			}) {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
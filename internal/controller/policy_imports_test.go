@@ -0,0 +1,88 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	opamanager "github.com/bramba2000/opa-scaler/internal/opa"
+)
+
+var _ = Describe("Policy imports", func() {
+	// library returns a policy defining the packages
+	library := func(name string, packages ...string) opaspolimiitv1alpha1.Policy {
+		return opaspolimiitv1alpha1.Policy{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status:     opaspolimiitv1alpha1.PolicyStatus{Packages: packages},
+		}
+	}
+	app := &opaspolimiitv1alpha1.Policy{ObjectMeta: metav1.ObjectMeta{Name: "app"}}
+
+	It("should infer the policy defining an imported package", func() {
+		resolution := resolveImports(app, opamanager.ModuleRefs{
+			Packages: []string{"data.app"},
+			Imports:  []string{"data.app.utils", "data.lib.authz.allow", "data.teams"},
+		}, []opaspolimiitv1alpha1.Policy{
+			library("authz", "data.lib.authz"),
+			library("alpha", "data.teams.alpha"),
+			library("beta", "data.teams.beta"),
+		}, nil)
+		Expect(resolution.dependencies).To(Equal([]opaspolimiitv1alpha1.PolicyDependencyStatus{
+			{Policy: "app", Name: "alpha", Inferred: true, Imports: []string{"data.teams"}},
+			{Policy: "app", Name: "authz", Inferred: true, Imports: []string{"data.lib.authz.allow"}},
+			{Policy: "app", Name: "beta", Inferred: true, Imports: []string{"data.teams"}},
+		}))
+		Expect(resolution.unresolved).To(BeEmpty())
+		Expect(resolution.condition(1).Status).To(Equal(metav1.ConditionTrue))
+	})
+
+	It("should prefer the dependencies listed in the spec", func() {
+		explicit := app.DeepCopy()
+		explicit.Spec.Dependencies = []opaspolimiitv1alpha1.PolicyReference{{Name: "authz-v2"}}
+		resolution := resolveImports(explicit, opamanager.ModuleRefs{
+			Imports: []string{"data.lib.authz"},
+		}, []opaspolimiitv1alpha1.Policy{
+			library("authz", "data.lib.authz"),
+			library("authz-v2", "data.lib.authz"),
+		}, nil)
+		Expect(resolution.dependencies).To(Equal([]opaspolimiitv1alpha1.PolicyDependencyStatus{
+			{Policy: "app", Name: "authz-v2", Imports: []string{"data.lib.authz"}},
+		}))
+		Expect(resolution.ambiguous).To(BeEmpty())
+	})
+
+	It("should warn about the ambiguous and unresolved imports", func() {
+		resolution := resolveImports(app, opamanager.ModuleRefs{
+			Imports: []string{"data.lib.authz", "data.missing", "data.roles.admins"},
+		}, []opaspolimiitv1alpha1.Policy{
+			library("authz", "data.lib.authz"),
+			library("authz-v2", "data.lib.authz"),
+		}, []string{opamanager.DataRef("roles")})
+		Expect(resolution.dependencies).To(BeEmpty())
+		Expect(resolution.ambiguous).To(HaveKeyWithValue("data.lib.authz", []string{"authz", "authz-v2"}))
+		Expect(resolution.unresolved).To(Equal([]string{"data.missing"}))
+
+		condition := resolution.condition(1)
+		Expect(condition.Status).To(Equal(metav1.ConditionFalse))
+		Expect(condition.Reason).To(Equal("UnresolvedImports"))
+		Expect(condition.Message).To(ContainSubstring("data.missing"))
+		Expect(condition.Message).To(ContainSubstring("data.lib.authz"))
+	})
+})
@@ -0,0 +1,277 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/yaml"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	opamanager "github.com/bramba2000/opa-scaler/internal/opa"
+)
+
+const (
+	// typeResolvedPolicyData is the type of the condition for a PolicyData whose value has been read
+	typeResolvedPolicyData = "Resolved"
+	// typeReadyPolicyData is the type of the condition for a PolicyData loaded in at least one OpaEngine
+	typeReadyPolicyData = "Ready"
+)
+
+// PolicyDataReconciler reconciles a PolicyData object
+type PolicyDataReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=policydata,verbs=get;list;watch
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=policydata/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=opaengines,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=configmaps;secrets,verbs=get;list;watch
+
+// Reconcile checks that the value of the PolicyData can be read and reports the OpaEngines serving it
+func (r *PolicyDataReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+
+	// Fetch the PolicyData instance
+	data := &opaspolimiitv1alpha1.PolicyData{}
+	if err := r.Get(ctx, req.NamespacedName, data); err != nil {
+		err = client.IgnoreNotFound(err)
+		if err != nil {
+			logger.Error(err, "unable to fetch PolicyData")
+		}
+		return ctrl.Result{}, err
+	}
+	if !data.DeletionTimestamp.IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	// Read the value of the document
+	result := ctrl.Result{}
+	resolved := metav1.Condition{
+		Type:               typeResolvedPolicyData,
+		ObservedGeneration: data.Generation,
+	}
+	hash := ""
+	value, err := loadPolicyData(ctx, r.Client, data)
+	size := int64(len(value))
+	if err == nil {
+		hash, err = opamanager.HashData(value)
+	}
+	if err != nil {
+		logger.Error(err, "unable to read the value of PolicyData")
+		resolved.Status = metav1.ConditionFalse
+		resolved.Reason = "SourceUnavailable"
+		resolved.Message = truncate(err.Error(), maxConditionMessage)
+		// The ConfigMap or the Secret may appear later
+		result.RequeueAfter = 30 * time.Second
+	} else {
+		resolved.Status = metav1.ConditionTrue
+		resolved.Reason = "Resolved"
+		resolved.Message = fmt.Sprintf("Document of %d bytes", len(value))
+	}
+
+	// Look for the engines where the current value is loaded
+	engines, err := r.enginesServingData(ctx, data, hash)
+	if err != nil {
+		logger.Error(err, "unable to list OpaEngines")
+		return ctrl.Result{}, err
+	}
+
+	ready := metav1.Condition{
+		Type:               typeReadyPolicyData,
+		Status:             metav1.ConditionFalse,
+		ObservedGeneration: data.Generation,
+	}
+	switch {
+	case resolved.Status != metav1.ConditionTrue:
+		ready.Reason = "NotResolved"
+		ready.Message = "The value of the document cannot be read"
+	case len(engines) == 0:
+		ready.Reason = "NotLoaded"
+		ready.Message = "Document is not loaded in any OpaEngine"
+	default:
+		ready.Status = metav1.ConditionTrue
+		ready.Reason = "Loaded"
+		ready.Message = fmt.Sprintf("Document loaded in %d OpaEngines", len(engines))
+	}
+
+	if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if err := r.Get(ctx, req.NamespacedName, data); err != nil {
+			return err
+		}
+		changed := meta.SetStatusCondition(&data.Status.Conditions, resolved)
+		changed = meta.SetStatusCondition(&data.Status.Conditions, ready) || changed
+		if !changed && data.Status.ObservedGeneration == data.Generation && data.Status.Hash == hash &&
+			data.Status.Size == size && slices.Equal(data.Status.Engines, engines) {
+			return nil
+		}
+		data.Status.ObservedGeneration = data.Generation
+		data.Status.Hash = hash
+		data.Status.Size = size
+		data.Status.Engines = engines
+		return r.Status().Update(ctx, data)
+	}); err != nil {
+		logger.Error(err, "unable to update PolicyData status")
+		return ctrl.Result{}, err
+	}
+
+	return result, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PolicyDataReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&opaspolimiitv1alpha1.PolicyData{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Watches(&opaspolimiitv1alpha1.OpaEngine{}, handler.EnqueueRequestsFromMapFunc(policyDataOfEngine)).
+		Watches(&corev1.ConfigMap{}, handler.EnqueueRequestsFromMapFunc(r.policyDataOfSource)).
+		WatchesMetadata(
+			&corev1.Secret{},
+			handler.EnqueueRequestsFromMapFunc(r.policyDataOfSource),
+			builder.WithPredicates(referencedSecret(r.Client)),
+		).
+		Complete(r)
+}
+
+// enginesServingData returns the sorted names of the OpaEngines that have
+// loaded the value of the document with the given hash
+func (r *PolicyDataReconciler) enginesServingData(ctx context.Context, data *opaspolimiitv1alpha1.PolicyData, hash string) ([]string, error) {
+	engines := &opaspolimiitv1alpha1.OpaEngineList{}
+	if err := r.List(ctx, engines, client.InNamespace(data.Namespace)); err != nil {
+		return nil, err
+	}
+	names := []string{}
+	if hash == "" {
+		return names, nil
+	}
+	for _, engine := range engines.Items {
+		if slices.ContainsFunc(engine.Status.Data, func(d opaspolimiitv1alpha1.DataDocumentStatus) bool {
+			return d.Name == data.Name && d.Path == data.Spec.Path && d.Hash == hash && d.Synced
+		}) {
+			names = append(names, engine.Name)
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// policyDataOfSource maps a ConfigMap or a Secret to the PolicyData reading it
+func (r *PolicyDataReconciler) policyDataOfSource(ctx context.Context, obj client.Object) []reconcile.Request {
+	logger := log.FromContext(ctx)
+
+	items, err := policyDataReading(ctx, r.Client, obj)
+	if err != nil {
+		logger.Error(err, "unable to list PolicyData", "Source", obj.GetName())
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(items))
+	for _, data := range items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&data)})
+	}
+	return requests
+}
+
+// policyDataOfEngine maps an OpaEngine to the documents it has loaded
+func policyDataOfEngine(ctx context.Context, obj client.Object) []reconcile.Request {
+	engine, ok := obj.(*opaspolimiitv1alpha1.OpaEngine)
+	if !ok {
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(engine.Status.Data))
+	for _, data := range engine.Status.Data {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKey{
+			Namespace: engine.Namespace,
+			Name:      data.Name,
+		}})
+	}
+	return requests
+}
+
+// policyDataReading returns the PolicyData whose value is read from the
+// ConfigMap or the Secret
+func policyDataReading(ctx context.Context, c client.Client, obj client.Object) ([]opaspolimiitv1alpha1.PolicyData, error) {
+	list := &opaspolimiitv1alpha1.PolicyDataList{}
+	if err := c.List(ctx, list, client.InNamespace(obj.GetNamespace())); err != nil {
+		return nil, err
+	}
+	items := []opaspolimiitv1alpha1.PolicyData{}
+	for _, data := range list.Items {
+		// The Secrets are watched through their metadata only
+		ref := data.Spec.SecretRef
+		if _, ok := obj.(*corev1.ConfigMap); ok {
+			ref = data.Spec.ConfigMapRef
+		}
+		if ref != nil && ref.Name == obj.GetName() {
+			items = append(items, data)
+		}
+	}
+	return items, nil
+}
+
+// loadPolicyData returns the value of the document encoded as normalized JSON.
+// The value read from a ConfigMap or a Secret can be written as JSON or YAML.
+func loadPolicyData(ctx context.Context, c client.Client, data *opaspolimiitv1alpha1.PolicyData) (json.RawMessage, error) {
+	var raw []byte
+	switch spec := data.Spec; {
+	case spec.Value != nil:
+		raw = spec.Value.Raw
+	case spec.ConfigMapRef != nil:
+		configMap := &corev1.ConfigMap{}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: data.Namespace, Name: spec.ConfigMapRef.Name}, configMap); err != nil {
+			return nil, err
+		}
+		value, ok := configMap.Data[spec.ConfigMapRef.Key]
+		if !ok {
+			return nil, fmt.Errorf("configmap %s has no key %s", spec.ConfigMapRef.Name, spec.ConfigMapRef.Key)
+		}
+		raw = []byte(value)
+	case spec.SecretRef != nil:
+		secret := &corev1.Secret{}
+		if err := c.Get(ctx, client.ObjectKey{Namespace: data.Namespace, Name: spec.SecretRef.Name}, secret); err != nil {
+			return nil, err
+		}
+		value, ok := secret.Data[spec.SecretRef.Key]
+		if !ok {
+			return nil, fmt.Errorf("secret %s has no key %s", spec.SecretRef.Name, spec.SecretRef.Key)
+		}
+		raw = value
+	default:
+		return nil, fmt.Errorf("policydata %s has no value", data.Name)
+	}
+
+	value, err := yaml.YAMLToJSON(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid document: %w", err)
+	}
+	return opamanager.NormalizeData(value)
+}
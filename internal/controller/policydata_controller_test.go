@@ -0,0 +1,170 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+)
+
+var _ = Describe("PolicyData Controller", func() {
+	Context("When reconciling a resource", func() {
+		const resourceName = "test-policydata"
+
+		ctx := context.Background()
+
+		typeNamespacedName := types.NamespacedName{
+			Name:      resourceName,
+			Namespace: "default",
+		}
+
+		createPolicyData := func(spec opaspolimiitv1alpha1.PolicyDataSpec) {
+			By("creating the custom resource for the Kind PolicyData")
+			resource := &opaspolimiitv1alpha1.PolicyData{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      resourceName,
+					Namespace: "default",
+				},
+				Spec: spec,
+			}
+			Expect(k8sClient.Create(ctx, resource)).To(Succeed())
+		}
+
+		reconcilePolicyData := func() *opaspolimiitv1alpha1.PolicyData {
+			By("Reconciling the PolicyData")
+			controllerReconciler := &PolicyDataReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: typeNamespacedName,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			data := &opaspolimiitv1alpha1.PolicyData{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, data)).To(Succeed())
+			return data
+		}
+
+		AfterEach(func() {
+			resource := &opaspolimiitv1alpha1.PolicyData{}
+			err := k8sClient.Get(ctx, typeNamespacedName, resource)
+			if errors.IsNotFound(err) {
+				Skip("Resource already deleted")
+			}
+			Expect(err).NotTo(HaveOccurred())
+
+			By("Cleanup the specific resource instance PolicyData")
+			Expect(k8sClient.Delete(ctx, resource)).To(Succeed())
+		})
+
+		It("should resolve an inline document not loaded anywhere", func() {
+			createPolicyData(opaspolimiitv1alpha1.PolicyDataSpec{
+				PolicyName: "test-policy",
+				Path:       "roles",
+				Value:      &apiextensionsv1.JSON{Raw: []byte(`{"admins": ["alice"]}`)},
+			})
+			data := reconcilePolicyData()
+
+			resolved := meta.FindStatusCondition(data.Status.Conditions, typeResolvedPolicyData)
+			Expect(resolved).NotTo(BeNil())
+			Expect(resolved.Status).To(Equal(metav1.ConditionTrue))
+			Expect(data.Status.Hash).To(HavePrefix("sha256:"))
+
+			ready := meta.FindStatusCondition(data.Status.Conditions, typeReadyPolicyData)
+			Expect(ready).NotTo(BeNil())
+			Expect(ready.Status).To(Equal(metav1.ConditionFalse))
+			Expect(ready.Reason).To(Equal("NotLoaded"))
+			Expect(data.Status.Engines).To(BeEmpty())
+		})
+
+		It("should read the document from a ConfigMap", func() {
+			createPolicyData(opaspolimiitv1alpha1.PolicyDataSpec{
+				PolicyName:   "test-policy",
+				Path:         "roles",
+				ConfigMapRef: &opaspolimiitv1alpha1.DataSourceRef{Name: "test-policydata-source", Key: "roles.yaml"},
+			})
+			data := reconcilePolicyData()
+			resolved := meta.FindStatusCondition(data.Status.Conditions, typeResolvedPolicyData)
+			Expect(resolved).NotTo(BeNil())
+			Expect(resolved.Reason).To(Equal("SourceUnavailable"))
+
+			By("creating the ConfigMap")
+			source := &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-policydata-source", Namespace: "default"},
+				Data:       map[string]string{"roles.yaml": "admins:\n- alice\n"},
+			}
+			Expect(k8sClient.Create(ctx, source)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, source)).To(Succeed())
+			}()
+			data = reconcilePolicyData()
+			resolved = meta.FindStatusCondition(data.Status.Conditions, typeResolvedPolicyData)
+			Expect(resolved.Status).To(Equal(metav1.ConditionTrue))
+			value, err := loadPolicyData(ctx, k8sClient, data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(value).To(MatchJSON(`{"admins": ["alice"]}`))
+		})
+
+		It("should list the engines serving the document", func() {
+			createPolicyData(opaspolimiitv1alpha1.PolicyDataSpec{
+				PolicyName: "test-policy",
+				Path:       "roles",
+				Value:      &apiextensionsv1.JSON{Raw: []byte(`{"admins": ["alice"]}`)},
+			})
+			data := reconcilePolicyData()
+
+			By("creating an OpaEngine reporting the document as loaded")
+			engine := &opaspolimiitv1alpha1.OpaEngine{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      "test-policydata-engine",
+					Namespace: "default",
+				},
+				Spec: opaspolimiitv1alpha1.OpaEngineSpec{
+					InstanceName: "default",
+					Policies:     []string{"test-policy"},
+				},
+			}
+			Expect(k8sClient.Create(ctx, engine)).To(Succeed())
+			defer func() {
+				Expect(k8sClient.Delete(ctx, engine)).To(Succeed())
+			}()
+			engine.Status.Data = []opaspolimiitv1alpha1.DataDocumentStatus{
+				{Name: resourceName, Path: "roles", Hash: data.Status.Hash, Synced: true},
+			}
+			Expect(k8sClient.Status().Update(ctx, engine)).To(Succeed())
+
+			data = reconcilePolicyData()
+			Expect(data.Status.Engines).To(Equal([]string{"test-policydata-engine"}))
+			ready := meta.FindStatusCondition(data.Status.Conditions, typeReadyPolicyData)
+			Expect(ready).NotTo(BeNil())
+			Expect(ready.Status).To(Equal(metav1.ConditionTrue))
+		})
+	})
+})
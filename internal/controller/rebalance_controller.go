@@ -0,0 +1,258 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	"github.com/bramba2000/opa-scaler/internal/scheduler"
+)
+
+// Annotations of a Dependency whose policies are migrating to another engine
+const (
+	migrateFromAnnotation = "opas.polimi.it/migrate-from"
+	migrateToAnnotation   = "opas.polimi.it/migrate-to"
+)
+
+// migrationCheckInterval is the period between two checks of the policies
+// loaded in the target of a migration
+const migrationCheckInterval = 5 * time.Second
+
+// RebalanceReconciler periodically consolidates the OpaEngines of a namespace,
+// moving the policies of the least loaded engines to the others and deleting
+// the engines left empty. A policy is moved by loading it in the target
+// engine, waiting for the engine to load it, pointing the Dependency to the
+// target and finally unloading it from the source engine.
+type RebalanceReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Interval is the period between two rebalancing of a namespace
+	Interval time.Duration
+
+	// DryRun only reports the planned moves as events of the Dependencies
+	DryRun bool
+
+	// DefaultCapacity bounds the policies of the OpaEngines that do not set
+	// their own capacity
+	DefaultCapacity opaspolimiitv1alpha1.EngineCapacity
+}
+
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=dependencies,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=dependencies/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=opaengines,verbs=get;list;watch;update;patch;delete
+
+// Reconcile completes the migrations in progress in the namespace, then plans
+// and starts the moves consolidating its OpaEngines
+func (r *RebalanceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	namespace := req.Name
+
+	dependencies := &opaspolimiitv1alpha1.DependencyList{}
+	if err := r.List(ctx, dependencies, client.InNamespace(namespace)); err != nil {
+		logger.Error(err, "unable to list Dependencies")
+		return ctrl.Result{}, err
+	}
+
+	// Complete the migrations in progress before planning new ones
+	inProgress := false
+	for i := range dependencies.Items {
+		dep := &dependencies.Items[i]
+		if dep.Annotations[migrateToAnnotation] == "" {
+			continue
+		}
+		done, err := r.migrate(ctx, dep)
+		if err != nil {
+			logger.Error(err, "unable to migrate the policies of Dependency", "Dependency", dep.Name)
+			return ctrl.Result{}, err
+		}
+		inProgress = inProgress || !done
+	}
+	if inProgress {
+		return ctrl.Result{RequeueAfter: migrationCheckInterval}, nil
+	}
+
+	engines := &opaspolimiitv1alpha1.OpaEngineList{}
+	if err := r.List(ctx, engines, client.InNamespace(namespace)); err != nil {
+		logger.Error(err, "unable to list OpaEngines")
+		return ctrl.Result{}, err
+	}
+	// The policies of the engines of an OpaEngineSet are managed by the set
+	engines.Items = slices.DeleteFunc(engines.Items, func(e opaspolimiitv1alpha1.OpaEngine) bool {
+		_, ok := e.Labels[engineSetLabel]
+		return ok
+	})
+	if len(engines.Items) < 2 {
+		return ctrl.Result{RequeueAfter: r.Interval}, nil
+	}
+	state, err := placementState(ctx, r.Client, namespace, engines.Items, r.DefaultCapacity)
+	if err != nil {
+		logger.Error(err, "unable to compute the placement state")
+		return ctrl.Result{}, err
+	}
+
+	assignments := []scheduler.Assignment{}
+	for _, dep := range dependencies.Items {
+		if !dep.DeletionTimestamp.IsZero() {
+			continue
+		}
+		policies, err := resolvePolicyNames(ctx, r.Client, namespace, []string{dep.Spec.PolicyName})
+		if err != nil {
+			// The Dependency controller reports the policies that cannot be resolved
+			continue
+		}
+		for _, engine := range dep.Status.EngineName {
+			assignments = append(assignments, scheduler.Assignment{
+				ID:      dep.Name,
+				Engine:  engine,
+				Request: scheduler.Request{ServiceName: dep.Spec.ServiceName, Policies: policies},
+			})
+		}
+	}
+
+	plan := scheduler.Consolidate(state, assignments)
+	if len(plan.Moves) == 0 {
+		return ctrl.Result{RequeueAfter: r.Interval}, nil
+	}
+	logger.Info("Rebalancing OpaEngines", "Moves", len(plan.Moves), "Emptied", plan.Emptied, "DryRun", r.DryRun)
+	for _, move := range plan.Moves {
+		dep := &dependencies.Items[slices.IndexFunc(dependencies.Items, func(d opaspolimiitv1alpha1.Dependency) bool {
+			return d.Name == move.ID
+		})]
+		if r.DryRun {
+			logger.Info("Planned move", "Dependency", dep.Name, "From", move.From, "To", move.To, "Policies", move.Policies)
+			r.Recorder.Eventf(dep, corev1.EventTypeNormal, "RebalancePlanned",
+				"Policies %v would move from OpaEngine %s to %s", move.Policies, move.From, move.To)
+			continue
+		}
+		if err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+			if err := r.Get(ctx, client.ObjectKeyFromObject(dep), dep); err != nil {
+				return err
+			}
+			if dep.Annotations == nil {
+				dep.Annotations = map[string]string{}
+			}
+			dep.Annotations[migrateFromAnnotation] = move.From
+			dep.Annotations[migrateToAnnotation] = move.To
+			return r.Update(ctx, dep)
+		}); err != nil {
+			logger.Error(err, "unable to start the migration of Dependency", "Dependency", dep.Name)
+			return ctrl.Result{}, err
+		}
+		r.Recorder.Eventf(dep, corev1.EventTypeNormal, "Rebalancing",
+			"Moving policies %v from OpaEngine %s to %s", move.Policies, move.From, move.To)
+	}
+	if r.DryRun {
+		return ctrl.Result{RequeueAfter: r.Interval}, nil
+	}
+	return ctrl.Result{RequeueAfter: migrationCheckInterval}, nil
+}
+
+// migrate advances the migration of the Dependency, returning true once
+// the policies are unloaded from the source engine or the migration is aborted
+func (r *RebalanceReconciler) migrate(ctx context.Context, dep *opaspolimiitv1alpha1.Dependency) (bool, error) {
+	from, to := dep.Annotations[migrateFromAnnotation], dep.Annotations[migrateToAnnotation]
+	logger := log.FromContext(ctx).WithValues("Dependency", dep.Name, "From", from, "To", to)
+
+	policies, err := resolvePolicyNames(ctx, r.Client, dep.Namespace, []string{dep.Spec.PolicyName})
+	if dependencyErrorReason(err) != "" {
+		logger.Info("Aborting the migration of Dependency", "Reason", err.Error())
+		return true, r.endMigration(ctx, dep)
+	} else if err != nil {
+		return false, err
+	}
+	target := &opaspolimiitv1alpha1.OpaEngine{}
+	if err := r.Get(ctx, client.ObjectKey{Namespace: dep.Namespace, Name: to}, target); errors.IsNotFound(err) {
+		logger.Info("Aborting the migration of Dependency, the target OpaEngine is gone")
+		return true, r.endMigration(ctx, dep)
+	} else if err != nil {
+		return false, err
+	}
+
+	// Load the policies in the target engine
+	if len(missingPolicies(target.Spec.Policies, policies)) > 0 {
+		if err := addPoliciesToEngine(ctx, r.Client, policies, target); err != nil {
+			return false, err
+		}
+		logger.Info("Policies added to the target OpaEngine", "Policies", policies)
+	}
+	// Wait for the target engine to load them
+	if len(missingPolicies(target.Status.Policies, policies)) > 0 {
+		logger.Info("Waiting for the target OpaEngine to load the policies")
+		return false, nil
+	}
+
+	// Point the Dependency to the target engine
+	if err := retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		if err := r.Get(ctx, client.ObjectKeyFromObject(dep), dep); err != nil {
+			return err
+		}
+		engines := slices.DeleteFunc(slices.Clone(dep.Status.EngineName), func(name string) bool {
+			return name == from || name == to
+		})
+		dep.Status.EngineName = append(engines, to)
+		return r.Status().Update(ctx, dep)
+	}); err != nil {
+		return false, err
+	}
+	if err := r.endMigration(ctx, dep); err != nil {
+		return false, err
+	}
+
+	// Unload the policies from the source engine
+	if err := unloadPolicies(ctx, r.Client, dep.Namespace, from, policies); err != nil {
+		return false, err
+	}
+	logger.Info("Migration of Dependency completed")
+	r.Recorder.Eventf(dep, corev1.EventTypeNormal, "Rebalanced", "Policies %v moved from OpaEngine %s to %s", policies, from, to)
+	return true, nil
+}
+
+// endMigration removes the migration annotations from the Dependency
+func (r *RebalanceReconciler) endMigration(ctx context.Context, dep *opaspolimiitv1alpha1.Dependency) error {
+	return retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		if err := r.Get(ctx, client.ObjectKeyFromObject(dep), dep); err != nil {
+			return err
+		}
+		delete(dep.Annotations, migrateFromAnnotation)
+		delete(dep.Annotations, migrateToAnnotation)
+		return r.Update(ctx, dep)
+	})
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *RebalanceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("rebalance").
+		For(&corev1.Namespace{}).
+		Complete(r)
+}
@@ -0,0 +1,151 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+)
+
+var _ = Describe("Rebalance Controller", func() {
+	Context("When reconciling a namespace", func() {
+		ctx := context.Background()
+
+		// Two half-empty engines, each loading the policy of a Dependency
+		placements := map[string]string{"rebalance-a": "rebalance-1", "rebalance-b": "rebalance-2"}
+
+		var recorder *record.FakeRecorder
+
+		reconcileNamespace := func(dryRun bool) reconcile.Result {
+			By("Reconciling the namespace")
+			controllerReconciler := &RebalanceReconciler{
+				Client:   k8sClient,
+				Scheme:   k8sClient.Scheme(),
+				Recorder: recorder,
+				Interval: time.Minute,
+				DryRun:   dryRun,
+			}
+			result, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: "default"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return result
+		}
+
+		getEngine := func(name string) *opaspolimiitv1alpha1.OpaEngine {
+			engine := &opaspolimiitv1alpha1.OpaEngine{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: name, Namespace: "default"}, engine)).To(Succeed())
+			return engine
+		}
+
+		getDependency := func(name string) *opaspolimiitv1alpha1.Dependency {
+			dep := &opaspolimiitv1alpha1.Dependency{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: name, Namespace: "default"}, dep)).To(Succeed())
+			return dep
+		}
+
+		BeforeEach(func() {
+			recorder = record.NewFakeRecorder(10)
+			By("Creating the policies, their engines and their Dependencies")
+			for policy, engine := range placements {
+				Expect(k8sClient.Create(ctx, &opaspolimiitv1alpha1.Policy{
+					ObjectMeta: metav1.ObjectMeta{Name: policy, Namespace: "default"},
+					Spec:       opaspolimiitv1alpha1.PolicySpec{Rego: "package rebalance"},
+				})).To(Succeed())
+				Expect(k8sClient.Create(ctx, &opaspolimiitv1alpha1.OpaEngine{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      engine,
+						Namespace: "default",
+						Labels:    map[string]string{scheduledEngineLabel: "true"},
+					},
+					Spec: opaspolimiitv1alpha1.OpaEngineSpec{InstanceName: engine, Policies: []string{policy}},
+				})).To(Succeed())
+				dep := &opaspolimiitv1alpha1.Dependency{
+					ObjectMeta: metav1.ObjectMeta{Name: policy, Namespace: "default"},
+					Spec:       opaspolimiitv1alpha1.DependencySpec{ServiceName: "rebalance", PolicyName: policy},
+				}
+				Expect(k8sClient.Create(ctx, dep)).To(Succeed())
+				dep.Status.EngineName = []string{engine}
+				dep.Status.Deployed = true
+				Expect(k8sClient.Status().Update(ctx, dep)).To(Succeed())
+			}
+		})
+
+		AfterEach(func() {
+			By("Cleanup the policies, the engines and the Dependencies")
+			for policy := range placements {
+				Expect(k8sClient.Delete(ctx, &opaspolimiitv1alpha1.Policy{
+					ObjectMeta: metav1.ObjectMeta{Name: policy, Namespace: "default"},
+				})).To(Succeed())
+			}
+			Expect(k8sClient.DeleteAllOf(ctx, &opaspolimiitv1alpha1.Dependency{}, client.InNamespace("default"))).To(Succeed())
+			Expect(k8sClient.DeleteAllOf(ctx, &opaspolimiitv1alpha1.OpaEngine{}, client.InNamespace("default"))).To(Succeed())
+		})
+
+		It("should only report the plan in dry-run mode", func() {
+			result := reconcileNamespace(true)
+			Expect(result.RequeueAfter).To(Equal(time.Minute))
+
+			Expect(recorder.Events).To(Receive(ContainSubstring("RebalancePlanned")))
+			Expect(getDependency("rebalance-a").Annotations).NotTo(HaveKey(migrateToAnnotation))
+			Expect(getEngine("rebalance-1").Spec.Policies).To(Equal([]string{"rebalance-a"}))
+			Expect(getEngine("rebalance-2").Spec.Policies).To(Equal([]string{"rebalance-b"}))
+		})
+
+		It("should move the policies before unloading them and delete the empty engine", func() {
+			By("Planning the move")
+			reconcileNamespace(false)
+			dep := getDependency("rebalance-a")
+			Expect(dep.Annotations).To(HaveKeyWithValue(migrateFromAnnotation, "rebalance-1"))
+			Expect(dep.Annotations).To(HaveKeyWithValue(migrateToAnnotation, "rebalance-2"))
+
+			By("Loading the policy in the target engine")
+			result := reconcileNamespace(false)
+			Expect(result.RequeueAfter).To(Equal(migrationCheckInterval))
+			target := getEngine("rebalance-2")
+			Expect(target.Spec.Policies).To(Equal([]string{"rebalance-b", "rebalance-a"}))
+			Expect(getEngine("rebalance-1").Spec.Policies).To(Equal([]string{"rebalance-a"}))
+			Expect(getDependency("rebalance-a").Status.EngineName).To(Equal([]string{"rebalance-1"}))
+
+			By("Simulating the target engine loading the policy")
+			target.Status.Policies = target.Spec.Policies
+			Expect(k8sClient.Status().Update(ctx, target)).To(Succeed())
+			reconcileNamespace(false)
+
+			dep = getDependency("rebalance-a")
+			Expect(dep.Status.EngineName).To(Equal([]string{"rebalance-2"}))
+			Expect(dep.Annotations).NotTo(HaveKey(migrateToAnnotation))
+			source := &opaspolimiitv1alpha1.OpaEngine{}
+			err := k8sClient.Get(ctx, types.NamespacedName{Name: "rebalance-1", Namespace: "default"}, source)
+			Expect(client.IgnoreNotFound(err)).To(Succeed())
+			if err == nil {
+				Expect(source.DeletionTimestamp).NotTo(BeNil())
+			}
+		})
+	})
+})
@@ -0,0 +1,228 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+)
+
+const (
+	// routeLabel marks the ConfigMaps holding the route of a service
+	routeLabel = "opas.polimi.it/route"
+	// routeServiceAnnotation is the ServiceName of the Dependencies routed by a ConfigMap
+	routeServiceAnnotation = "opas.polimi.it/service-name"
+	// routePrefix prefixes the name of the ConfigMap routing a service
+	routePrefix = "opa-route-"
+)
+
+// Keys of the data of a route ConfigMap
+const (
+	// RouteEnginesKey lists the OpaEngines serving the service, one per line
+	RouteEnginesKey = "engines"
+	// RouteEndpointsKey lists the endpoints of the OpaEngines, one per line
+	RouteEndpointsKey = "endpoints"
+	// RoutePoliciesKey maps each policy of the service to the endpoints loading it, as JSON
+	RoutePoliciesKey = "policies.json"
+)
+
+// RouteReconciler publishes, for each ServiceName of the Dependencies of a
+// namespace, a ConfigMap named after the service that tells it which
+// OpaEngines hold its policies. The ConfigMap is rewritten in a single update
+// whenever a Dependency is scheduled in or moved to another engine, so a
+// service never reads a partially updated route.
+type RouteReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=dependencies,verbs=get;list;watch
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=opaengines,verbs=get;list;watch
+
+// Reconcile publishes the routes of the services of the namespace and deletes
+// the ones of the services left without Dependencies
+func (r *RouteReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	namespace := req.Name
+
+	dependencies := &opaspolimiitv1alpha1.DependencyList{}
+	if err := r.List(ctx, dependencies, client.InNamespace(namespace)); err != nil {
+		logger.Error(err, "unable to list Dependencies")
+		return ctrl.Result{}, err
+	}
+
+	// The scheme of the API of each engine
+	engines := &opaspolimiitv1alpha1.OpaEngineList{}
+	if err := r.List(ctx, engines, client.InNamespace(namespace)); err != nil {
+		logger.Error(err, "unable to list OpaEngines")
+		return ctrl.Result{}, err
+	}
+	schemes := map[string]string{}
+	for _, engine := range engines.Items {
+		schemes[engine.Name] = apiScheme(&engine)
+	}
+
+	// The policies of each service, with the engines they are scheduled in
+	routes := map[string]map[string][]string{}
+	for _, dep := range dependencies.Items {
+		if !dep.DeletionTimestamp.IsZero() || len(dep.Status.EngineName) == 0 {
+			continue
+		}
+		if routes[dep.Spec.ServiceName] == nil {
+			routes[dep.Spec.ServiceName] = map[string][]string{}
+		}
+		policies := routes[dep.Spec.ServiceName]
+		for _, engine := range dep.Status.EngineName {
+			if !slices.Contains(policies[dep.Spec.PolicyName], engine) {
+				policies[dep.Spec.PolicyName] = append(policies[dep.Spec.PolicyName], engine)
+			}
+		}
+	}
+
+	for service, policies := range routes {
+		route := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      routeName(service),
+				Namespace: namespace,
+			},
+		}
+		res, err := controllerutil.CreateOrUpdate(ctx, r.Client, route, func() error {
+			if route.Labels == nil {
+				route.Labels = map[string]string{}
+			}
+			route.Labels[routeLabel] = "true"
+			if route.Annotations == nil {
+				route.Annotations = map[string]string{}
+			}
+			route.Annotations[routeServiceAnnotation] = service
+			data, err := routeData(namespace, policies, schemes)
+			route.Data = data
+			return err
+		})
+		if err != nil {
+			logger.Error(err, "unable to publish the route of service", "ServiceName", service)
+			return ctrl.Result{}, err
+		}
+		if res != controllerutil.OperationResultNone {
+			logger.Info("Route of service published", "ServiceName", service, "ConfigMap", route.Name)
+		}
+	}
+
+	// Delete the routes of the services without Dependencies
+	published := &corev1.ConfigMapList{}
+	if err := r.List(ctx, published, client.InNamespace(namespace), client.MatchingLabels{routeLabel: "true"}); err != nil {
+		logger.Error(err, "unable to list the routes")
+		return ctrl.Result{}, err
+	}
+	for _, route := range published.Items {
+		if _, ok := routes[route.Annotations[routeServiceAnnotation]]; ok {
+			continue
+		}
+		if err := r.Delete(ctx, &route); client.IgnoreNotFound(err) != nil {
+			logger.Error(err, "unable to delete the route", "ConfigMap", route.Name)
+			return ctrl.Result{}, err
+		}
+		logger.Info("Route of service deleted", "ServiceName", route.Annotations[routeServiceAnnotation])
+	}
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *RouteReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("route").
+		For(&corev1.Namespace{}).
+		Watches(
+			&opaspolimiitv1alpha1.Dependency{},
+			handler.EnqueueRequestsFromMapFunc(namespaceOf),
+		).
+		Watches(
+			&opaspolimiitv1alpha1.OpaEngine{},
+			handler.EnqueueRequestsFromMapFunc(namespaceOf),
+			builder.WithPredicates(predicate.GenerationChangedPredicate{}),
+		).
+		Complete(r)
+}
+
+// namespaceOf maps an object to its namespace
+func namespaceOf(_ context.Context, obj client.Object) []reconcile.Request {
+	return []reconcile.Request{{NamespacedName: client.ObjectKey{Name: obj.GetNamespace()}}}
+}
+
+// routeName returns the name of the ConfigMap routing the service
+func routeName(service string) string {
+	return routePrefix + service
+}
+
+// routeData returns the data of the route of the policies scheduled in the
+// engines, reached with the scheme of their API
+func routeData(namespace string, policies map[string][]string, schemes map[string]string) (map[string]string, error) {
+	engines := []string{}
+	endpoints := map[string][]string{}
+	for policy, scheduled := range policies {
+		for _, engine := range scheduled {
+			if !slices.Contains(engines, engine) {
+				engines = append(engines, engine)
+			}
+			endpoints[policy] = append(endpoints[policy], engineEndpoint(schemes[engine], namespace, engine))
+		}
+		slices.Sort(endpoints[policy])
+	}
+	slices.Sort(engines)
+	all := []string{}
+	for _, engine := range engines {
+		all = append(all, engineEndpoint(schemes[engine], namespace, engine))
+	}
+	// Maps are encoded with sorted keys, so the route only changes with the placement
+	encoded, err := json.Marshal(endpoints)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		RouteEnginesKey:   strings.Join(engines, "\n"),
+		RouteEndpointsKey: strings.Join(all, "\n"),
+		RoutePoliciesKey:  string(encoded),
+	}, nil
+}
+
+// engineEndpoint returns the URL of the OPA API of the engine, over plain
+// HTTP if the scheme is not known
+func engineEndpoint(scheme, namespace, engine string) string {
+	if scheme == "" {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s.%s.svc:%d", scheme, engine, namespace, opaPort)
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+)
+
+var _ = Describe("Route Controller", func() {
+	Context("When reconciling a namespace", func() {
+		ctx := context.Background()
+
+		// The Dependencies of the orders service, with the engine they are scheduled in
+		placements := map[string]string{"route-a": "route-engine-1", "route-b": "route-engine-2"}
+
+		routeKey := types.NamespacedName{Name: routeName("orders"), Namespace: "default"}
+
+		reconcileNamespace := func() {
+			By("Reconciling the namespace")
+			controllerReconciler := &RouteReconciler{
+				Client: k8sClient,
+				Scheme: k8sClient.Scheme(),
+			}
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{
+				NamespacedName: types.NamespacedName{Name: "default"},
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		BeforeEach(func() {
+			By("Creating the scheduled Dependencies")
+			for name, engine := range placements {
+				dep := &opaspolimiitv1alpha1.Dependency{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+					Spec:       opaspolimiitv1alpha1.DependencySpec{ServiceName: "orders", PolicyName: name},
+				}
+				Expect(k8sClient.Create(ctx, dep)).To(Succeed())
+				dep.Status.EngineName = []string{engine}
+				Expect(k8sClient.Status().Update(ctx, dep)).To(Succeed())
+			}
+		})
+
+		AfterEach(func() {
+			By("Cleanup the Dependencies and the routes")
+			for name := range placements {
+				dep := &opaspolimiitv1alpha1.Dependency{}
+				dep.Name, dep.Namespace = name, "default"
+				Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, dep))).To(Succeed())
+			}
+			Expect(client.IgnoreNotFound(k8sClient.DeleteAllOf(ctx, &corev1.ConfigMap{},
+				client.InNamespace("default"), client.MatchingLabels{routeLabel: "true"}))).To(Succeed())
+		})
+
+		It("should publish the engines of each service", func() {
+			reconcileNamespace()
+
+			route := &corev1.ConfigMap{}
+			Expect(k8sClient.Get(ctx, routeKey, route)).To(Succeed())
+			Expect(route.Annotations).To(HaveKeyWithValue(routeServiceAnnotation, "orders"))
+			Expect(route.Data).To(HaveKeyWithValue(RouteEnginesKey, "route-engine-1\nroute-engine-2"))
+			Expect(route.Data).To(HaveKeyWithValue(RoutePoliciesKey,
+				`{"route-a":["http://route-engine-1.default.svc:8181"],"route-b":["http://route-engine-2.default.svc:8181"]}`))
+		})
+
+		It("should follow the moves of the policies and delete the unused routes", func() {
+			reconcileNamespace()
+
+			By("Moving a policy to the other engine")
+			dep := &opaspolimiitv1alpha1.Dependency{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "route-b", Namespace: "default"}, dep)).To(Succeed())
+			dep.Status.EngineName = []string{"route-engine-1"}
+			Expect(k8sClient.Status().Update(ctx, dep)).To(Succeed())
+			reconcileNamespace()
+
+			route := &corev1.ConfigMap{}
+			Expect(k8sClient.Get(ctx, routeKey, route)).To(Succeed())
+			Expect(route.Data).To(HaveKeyWithValue(RouteEnginesKey, "route-engine-1"))
+			Expect(route.Data).To(HaveKeyWithValue(RouteEndpointsKey, "http://route-engine-1.default.svc:8181"))
+
+			By("Deleting the Dependencies of the service")
+			for name := range placements {
+				dep := &opaspolimiitv1alpha1.Dependency{}
+				dep.Name, dep.Namespace = name, "default"
+				Expect(k8sClient.Delete(ctx, dep)).To(Succeed())
+			}
+			reconcileNamespace()
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, routeKey, route))).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,92 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"slices"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+)
+
+// engineSecrets returns the names of the Secrets read by the OpaEngine for
+// its signing keys and its API, besides the ones of its PolicyData
+func engineSecrets(engine *opaspolimiitv1alpha1.OpaEngine) []string {
+	names := []string{}
+	if engine.Spec.Signing != nil {
+		names = append(names, engine.Spec.Signing.SecretName)
+	}
+	if api := engine.Spec.API; api != nil {
+		if api.TLSSecretName != "" {
+			names = append(names, api.TLSSecretName)
+		}
+		if api.TokenSecretRef != nil {
+			names = append(names, api.TokenSecretRef.Name)
+		}
+	}
+	return names
+}
+
+// referencedSecret passes the events of the Secrets read by an OpaEngine or a
+// PolicyData of their namespace, dropping the other Secrets of the cluster
+// before they are mapped
+func referencedSecret(c client.Client) predicate.Predicate {
+	return predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		ctx := context.Background()
+		engines := &opaspolimiitv1alpha1.OpaEngineList{}
+		if err := c.List(ctx, engines, client.InNamespace(obj.GetNamespace())); err != nil {
+			// Let the map functions report the error
+			return true
+		}
+		for i := range engines.Items {
+			if slices.Contains(engineSecrets(&engines.Items[i]), obj.GetName()) {
+				return true
+			}
+		}
+		items, err := policyDataReading(ctx, c, obj)
+		return err != nil || len(items) > 0
+	})
+}
+
+// enginesOfSecret maps a Secret to the OpaEngines reading it, directly or
+// through their PolicyData
+func (r *OpaEngineReconciler) enginesOfSecret(ctx context.Context, obj client.Object) []reconcile.Request {
+	logger := log.FromContext(ctx)
+
+	engines := &opaspolimiitv1alpha1.OpaEngineList{}
+	if err := r.List(ctx, engines, client.InNamespace(obj.GetNamespace())); err != nil {
+		logger.Error(err, "unable to list OpaEngines", "Secret", obj.GetName())
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, engine := range engines.Items {
+		if slices.Contains(engineSecrets(&engine), obj.GetName()) {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&engine)})
+		}
+	}
+	for _, request := range r.enginesOfDataSource(ctx, obj) {
+		if !slices.Contains(requests, request) {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	"github.com/bramba2000/opa-scaler/internal/bundle"
+	"github.com/bramba2000/opa-scaler/internal/oci"
+	opamanager "github.com/bramba2000/opa-scaler/internal/opa"
+)
+
+// ServiceBundleReconciler publishes, for each ServiceName of the Dependencies
+// of a namespace, a bundle with exactly the policies of the service, their
+// dependencies and their documents. The bundles are downloaded by the OPA
+// sidecars injected in the pods of the service.
+type ServiceBundleReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+
+	// Puller fetches the policies distributed as OCI images
+	Puller *oci.Puller
+
+	// Bundles serves the bundles of the services
+	Bundles *bundle.Server
+
+	// BundleCAFile is the CA of the certificate of the bundle server, copied
+	// in the namespaces of the services for their sidecars. Empty if the
+	// bundles are served over plain HTTP.
+	BundleCAFile string
+
+	mu sync.Mutex
+	// published are the services with a bundle, by namespace
+	published map[string][]string
+}
+
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=dependencies,verbs=get;list;watch
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=policies,verbs=get;list;watch
+// +kubebuilder:rbac:groups=opas.polimi.it,resources=policydata,verbs=get;list;watch
+
+// Reconcile publishes the bundles of the services of the namespace and stops
+// serving the ones of the services left without Dependencies
+func (r *ServiceBundleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	namespace := req.Name
+
+	dependencies := &opaspolimiitv1alpha1.DependencyList{}
+	if err := r.List(ctx, dependencies, client.InNamespace(namespace)); err != nil {
+		logger.Error(err, "unable to list Dependencies")
+		return ctrl.Result{}, err
+	}
+	roots := map[string][]string{}
+	for _, dep := range dependencies.Items {
+		if dep.DeletionTimestamp.IsZero() && !slices.Contains(roots[dep.Spec.ServiceName], dep.Spec.PolicyName) {
+			roots[dep.Spec.ServiceName] = append(roots[dep.Spec.ServiceName], dep.Spec.PolicyName)
+		}
+	}
+
+	services := sortedKeys(roots)
+	if err := r.syncCA(ctx, namespace, len(services) > 0); err != nil {
+		logger.Error(err, "unable to sync the CA of the bundle server")
+		return ctrl.Result{}, err
+	}
+	for _, service := range services {
+		b, err := r.serviceBundle(ctx, namespace, roots[service])
+		if reason := dependencyErrorReason(err); reason != "" {
+			// The sidecars keep the previous bundle until the policies are fixed
+			logger.Error(err, "unable to resolve the policies of service", "ServiceName", service)
+			continue
+		} else if err != nil {
+			logger.Error(err, "unable to load the policies of service", "ServiceName", service)
+			return ctrl.Result{}, err
+		}
+		if err := r.Bundles.SetService(namespace, service, b); err != nil {
+			logger.Error(err, "unable to build the bundle of service", "ServiceName", service)
+			continue
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.published == nil {
+		r.published = map[string][]string{}
+	}
+	for _, service := range r.published[namespace] {
+		if _, ok := roots[service]; !ok {
+			logger.Info("Bundle of service deleted", "ServiceName", service)
+			r.Bundles.DeleteService(namespace, service)
+		}
+	}
+	r.published[namespace] = services
+	return ctrl.Result{}, nil
+}
+
+// syncCA copies the CA of the bundle server in the namespace while it has
+// services, so that their sidecars can verify the bundle server
+func (r *ServiceBundleReconciler) syncCA(ctx context.Context, namespace string, needed bool) error {
+	if r.BundleCAFile == "" {
+		return nil
+	}
+	cm := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: bundle.CAConfigMap}}
+	if !needed {
+		return client.IgnoreNotFound(r.Delete(ctx, cm))
+	}
+	ca, err := os.ReadFile(r.BundleCAFile)
+	if err != nil {
+		return err
+	}
+	_, err = controllerutil.CreateOrUpdate(ctx, r.Client, cm, func() error {
+		cm.Data = map[string]string{bundle.CAKey: string(ca)}
+		return nil
+	})
+	return err
+}
+
+// serviceBundle returns the bundle of the policies with their dependencies and
+// the documents of their PolicyData. The documents that cannot be loaded are
+// left out, as they are reported by the OpaEngines. The documents read from a
+// Secret are left out as well, since the bundles are readable by every
+// service account of the namespace.
+func (r *ServiceBundleReconciler) serviceBundle(ctx context.Context, namespace string, roots []string) (*bundle.Bundle, error) {
+	policies, err := resolvePolicies(ctx, r.Client, namespace, roots)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	modules := map[string]string{}
+	for _, policy := range policies {
+		code, err := loadPolicyModules(ctx, r.Client, r.Puller, policy)
+		if err != nil {
+			return nil, err
+		}
+		for id, module := range code {
+			modules[id] = module
+		}
+		names = append(names, policy.Name)
+	}
+
+	docs, err := policiesData(ctx, r.Client, namespace, names)
+	if err != nil {
+		return nil, err
+	}
+	data := map[string]any{}
+	for _, doc := range docs {
+		var value any
+		if doc.err != nil || doc.secret || json.Unmarshal(doc.value, &value) != nil {
+			continue
+		}
+		setDocument(data, strings.Split(doc.path, "/"), value)
+	}
+	// The revision identifies the documents as well as the modules
+	revision := opamanager.HashModules(modules)
+	if len(data) > 0 {
+		encoded, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		hash, err := opamanager.HashData(encoded)
+		if err != nil {
+			return nil, err
+		}
+		revision += "-" + hash
+	}
+	return &bundle.Bundle{Revision: revision, Modules: modules, Data: data}, nil
+}
+
+// setDocument writes the value at the path of the data
+func setDocument(data map[string]any, path []string, value any) {
+	for _, key := range path[:len(path)-1] {
+		next, ok := data[key].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			data[key] = next
+		}
+		data = next
+	}
+	data[path[len(path)-1]] = value
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ServiceBundleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("servicebundle").
+		For(&corev1.Namespace{}).
+		Watches(
+			&opaspolimiitv1alpha1.Dependency{},
+			handler.EnqueueRequestsFromMapFunc(namespaceOf),
+		).
+		Watches(
+			&opaspolimiitv1alpha1.Policy{},
+			handler.EnqueueRequestsFromMapFunc(namespaceOf),
+			builder.WithPredicates(policyGraphChanged),
+		).
+		Watches(
+			&opaspolimiitv1alpha1.PolicyData{},
+			handler.EnqueueRequestsFromMapFunc(namespaceOf),
+		).
+		Complete(r)
+}
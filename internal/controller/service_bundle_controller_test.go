@@ -0,0 +1,149 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	"github.com/bramba2000/opa-scaler/internal/bundle"
+)
+
+var _ = Describe("ServiceBundle Controller", func() {
+	Context("When reconciling a namespace", func() {
+		ctx := context.Background()
+
+		policy := &opaspolimiitv1alpha1.Policy{
+			ObjectMeta: metav1.ObjectMeta{Name: "sidecar-policy", Namespace: "default"},
+			Spec:       opaspolimiitv1alpha1.PolicySpec{Rego: "package sidecar\n\nallow := true\n"},
+		}
+		dependency := &opaspolimiitv1alpha1.Dependency{
+			ObjectMeta: metav1.ObjectMeta{Name: "sidecar-dependency", Namespace: "default"},
+			Spec:       opaspolimiitv1alpha1.DependencySpec{ServiceName: "sidecar-service", PolicyName: "sidecar-policy"},
+		}
+
+		BeforeEach(func() {
+			By("Creating the policy and the Dependency of the service")
+			Expect(k8sClient.Create(ctx, policy.DeepCopy())).To(Succeed())
+			Expect(k8sClient.Create(ctx, dependency.DeepCopy())).To(Succeed())
+		})
+
+		AfterEach(func() {
+			By("Cleanup the policy and the Dependency")
+			Expect(client.IgnoreNotFound(k8sClient.Delete(ctx, dependency.DeepCopy()))).To(Succeed())
+			Expect(k8sClient.Delete(ctx, policy.DeepCopy())).To(Succeed())
+		})
+
+		It("should publish the bundle of each service until its Dependencies are deleted", func() {
+			controllerReconciler := &ServiceBundleReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Bundles: bundle.NewServer(""),
+			}
+			request := reconcile.Request{NamespacedName: types.NamespacedName{Name: "default"}}
+			_, err := controllerReconciler.Reconcile(ctx, request)
+			Expect(err).NotTo(HaveOccurred())
+			_, ok := controllerReconciler.Bundles.ServiceRevision("default", "sidecar-service")
+			Expect(ok).To(BeTrue())
+
+			By("Deleting the Dependency")
+			Expect(k8sClient.Delete(ctx, dependency.DeepCopy())).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, request)
+			Expect(err).NotTo(HaveOccurred())
+			_, ok = controllerReconciler.Bundles.ServiceRevision("default", "sidecar-service")
+			Expect(ok).To(BeFalse())
+		})
+
+		It("should copy the CA of the bundle server in the namespace while it has services", func() {
+			caFile := filepath.Join(GinkgoT().TempDir(), "ca.crt")
+			Expect(os.WriteFile(caFile, []byte("bundle ca"), 0o600)).To(Succeed())
+			controllerReconciler := &ServiceBundleReconciler{
+				Client:       k8sClient,
+				Scheme:       k8sClient.Scheme(),
+				Bundles:      bundle.NewServer(""),
+				BundleCAFile: caFile,
+			}
+			request := reconcile.Request{NamespacedName: types.NamespacedName{Name: "default"}}
+			_, err := controllerReconciler.Reconcile(ctx, request)
+			Expect(err).NotTo(HaveOccurred())
+			ca := &corev1.ConfigMap{}
+			key := types.NamespacedName{Name: bundle.CAConfigMap, Namespace: "default"}
+			Expect(k8sClient.Get(ctx, key, ca)).To(Succeed())
+			Expect(ca.Data).To(HaveKeyWithValue(bundle.CAKey, "bundle ca"))
+
+			By("Deleting the Dependency")
+			Expect(k8sClient.Delete(ctx, dependency.DeepCopy())).To(Succeed())
+			_, err = controllerReconciler.Reconcile(ctx, request)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(errors.IsNotFound(k8sClient.Get(ctx, key, ca))).To(BeTrue())
+		})
+
+		It("should leave the documents read from a Secret out of the bundle", func() {
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "sidecar-secret", Namespace: "default"},
+				Data:       map[string][]byte{"token.json": []byte(`"s3cr3t"`)},
+			}
+			public := &opaspolimiitv1alpha1.PolicyData{
+				ObjectMeta: metav1.ObjectMeta{Name: "sidecar-public", Namespace: "default"},
+				Spec: opaspolimiitv1alpha1.PolicyDataSpec{
+					PolicyName: "sidecar-policy",
+					Path:       "public",
+					Value:      &apiextensionsv1.JSON{Raw: []byte(`{"enabled": true}`)},
+				},
+			}
+			private := &opaspolimiitv1alpha1.PolicyData{
+				ObjectMeta: metav1.ObjectMeta{Name: "sidecar-private", Namespace: "default"},
+				Spec: opaspolimiitv1alpha1.PolicyDataSpec{
+					PolicyName: "sidecar-policy",
+					Path:       "private",
+					SecretRef:  &opaspolimiitv1alpha1.DataSourceRef{Name: "sidecar-secret", Key: "token.json"},
+				},
+			}
+			for _, obj := range []client.Object{secret, public, private} {
+				Expect(k8sClient.Create(ctx, obj)).To(Succeed())
+			}
+			defer func() {
+				for _, obj := range []client.Object{secret, public, private} {
+					Expect(k8sClient.Delete(ctx, obj)).To(Succeed())
+				}
+			}()
+
+			controllerReconciler := &ServiceBundleReconciler{
+				Client:  k8sClient,
+				Scheme:  k8sClient.Scheme(),
+				Bundles: bundle.NewServer(""),
+			}
+			b, err := controllerReconciler.serviceBundle(ctx, "default", []string{"sidecar-policy"})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b.Data).To(HaveKey("public"))
+			Expect(b.Data).NotTo(HaveKey("private"))
+		})
+	})
+})
@@ -0,0 +1,315 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	opamanager "github.com/bramba2000/opa-scaler/internal/opa"
+)
+
+// DataPath is the path of the Data API of OPA served by the gateway
+const DataPath = "/v1/data"
+
+// caCertKey is the key of the CA in the TLS Secrets of the engines
+const caCertKey = "ca.crt"
+
+// Gateway serves the Data API of OPA in front of the OpaEngines of a
+// namespace. Each query is forwarded to an engine that loaded the package of
+// the queried document, and its response is returned unchanged, so the
+// clients query a single endpoint wherever their policies are scheduled.
+type Gateway struct {
+	// Addr is the address the gateway listens on
+	Addr string
+	// Namespace is the namespace of the OpaEngines behind the gateway
+	Namespace string
+	// Reader reads the Policies, the OpaEngines and the Secrets of their
+	// API, usually from a cache
+	Reader client.Reader
+	// EngineURL returns the url of the OPA API of an engine
+	EngineURL func(engine *opaspolimiitv1alpha1.OpaEngine) string
+	// Transport forwards the queries, http.DefaultTransport when nil. When
+	// set, it also forwards the queries to the engines serving their API over
+	// TLS, which are otherwise verified with the CA of their Secret.
+	Transport http.RoundTripper
+
+	mu sync.Mutex
+	// transports are the transports of the engines serving their API over TLS
+	transports map[string]engineTransport
+}
+
+// engineTransport trusts the CA of a version of the TLS Secret of an engine
+type engineTransport struct {
+	version   string
+	transport *http.Transport
+}
+
+// New returns a gateway for the OpaEngines of the namespace
+func New(addr, namespace string, reader client.Reader) *Gateway {
+	return &Gateway{
+		Addr:      addr,
+		Namespace: namespace,
+		Reader:    reader,
+		EngineURL: func(engine *opaspolimiitv1alpha1.OpaEngine) string {
+			scheme := "http"
+			if servesTLS(engine) {
+				scheme = "https"
+			}
+			return fmt.Sprintf("%s://%s.%s.svc:8181", scheme, engine.Name, engine.Namespace)
+		},
+		transports: map[string]engineTransport{},
+	}
+}
+
+// servesTLS returns true if the engine serves its API over TLS
+func servesTLS(engine *opaspolimiitv1alpha1.OpaEngine) bool {
+	return engine.Spec.API != nil && engine.Spec.API.TLSSecretName != ""
+}
+
+// transportOf returns the transport forwarding the queries to the engine
+func (g *Gateway) transportOf(ctx context.Context, engine *opaspolimiitv1alpha1.OpaEngine) (http.RoundTripper, error) {
+	if g.Transport != nil || !servesTLS(engine) {
+		return g.Transport, nil
+	}
+	secret := &corev1.Secret{}
+	key := client.ObjectKey{Namespace: engine.Namespace, Name: engine.Spec.API.TLSSecretName}
+	if err := g.Reader.Get(ctx, key, secret); err != nil {
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if cached, ok := g.transports[engine.Name]; ok && cached.version == secret.ResourceVersion {
+		return cached.transport, nil
+	}
+	config, err := opamanager.NewTLSConfig(opamanager.TLSOptions{CA: secret.Data[caCertKey]})
+	if err != nil {
+		return nil, fmt.Errorf("invalid TLS Secret %s: %w", secret.Name, err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	if cached, ok := g.transports[engine.Name]; ok {
+		cached.transport.CloseIdleConnections()
+	}
+	if g.transports == nil {
+		g.transports = map[string]engineTransport{}
+	}
+	g.transports[engine.Name] = engineTransport{version: secret.ResourceVersion, transport: transport}
+	return transport, nil
+}
+
+// route is a package with the engines that loaded it
+type route struct {
+	path    []string
+	engines []string
+}
+
+// routes returns the packages of the Policies of the namespace with the
+// engines loading them. An engine that still has to load a policy is used
+// only when no other engine loaded it.
+func (g *Gateway) routes(ctx context.Context) ([]route, error) {
+	policies := &opaspolimiitv1alpha1.PolicyList{}
+	if err := g.Reader.List(ctx, policies, client.InNamespace(g.Namespace)); err != nil {
+		return nil, err
+	}
+	engines := &opaspolimiitv1alpha1.OpaEngineList{}
+	if err := g.Reader.List(ctx, engines, client.InNamespace(g.Namespace)); err != nil {
+		return nil, err
+	}
+	slices.SortFunc(engines.Items, func(a, b opaspolimiitv1alpha1.OpaEngine) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	routes := []route{}
+	for _, policy := range policies.Items {
+		loaded, expected := []string{}, []string{}
+		for _, engine := range engines.Items {
+			if slices.Contains(engine.Status.Policies, policy.Name) {
+				loaded = append(loaded, engine.Name)
+			} else if slices.Contains(engine.Spec.Policies, policy.Name) {
+				expected = append(expected, engine.Name)
+			}
+		}
+		if len(loaded) == 0 {
+			loaded = expected
+		}
+		if len(loaded) == 0 {
+			continue
+		}
+		for _, pkg := range policy.Status.Packages {
+			routes = append(routes, route{
+				path:    strings.Split(strings.TrimPrefix(pkg, "data."), "."),
+				engines: loaded,
+			})
+		}
+	}
+	return routes, nil
+}
+
+// engineOf returns the engine serving the document. A document inside a
+// package is served by an engine of the deepest package containing it, a
+// document containing packages by an engine loading all of them.
+func engineOf(routes []route, document []string) (string, bool) {
+	var best *route
+	for i, r := range routes {
+		if len(r.path) <= len(document) && slices.Equal(r.path, document[:len(r.path)]) &&
+			(best == nil || len(r.path) > len(best.path)) {
+			best = &routes[i]
+		}
+	}
+	if best != nil {
+		return best.engines[0], true
+	}
+
+	var candidates []string
+	for _, r := range routes {
+		if len(r.path) <= len(document) || !slices.Equal(r.path[:len(document)], document) {
+			continue
+		}
+		if candidates == nil {
+			candidates = slices.Clone(r.engines)
+		} else {
+			candidates = slices.DeleteFunc(candidates, func(e string) bool {
+				return !slices.Contains(r.engines, e)
+			})
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	return candidates[0], true
+}
+
+// ServeHTTP forwards the queries of the Data API to the engine serving the document
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	logger := log.FromContext(req.Context())
+
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "invalid_parameter", "the gateway only answers queries")
+		return
+	}
+	document := strings.Trim(strings.TrimPrefix(req.URL.Path, DataPath), "/")
+	if document == "" {
+		writeError(w, http.StatusBadRequest, "invalid_parameter", "the gateway cannot query the whole data document")
+		return
+	}
+
+	routes, err := g.routes(req.Context())
+	if err != nil {
+		logger.Error(err, "unable to read the routes")
+		writeError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+	engine, ok := engineOf(routes, strings.Split(document, "/"))
+	if !ok {
+		writeError(w, http.StatusNotFound, "resource_not_found",
+			fmt.Sprintf("no engine loads the package of data.%s", strings.ReplaceAll(document, "/", ".")))
+		return
+	}
+	opaEngine := &opaspolimiitv1alpha1.OpaEngine{}
+	if err := g.Reader.Get(req.Context(), client.ObjectKey{Namespace: g.Namespace, Name: engine}, opaEngine); err != nil {
+		logger.Error(err, "unable to read the engine", "OpaEngine", engine)
+		writeError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+	target, err := url.Parse(g.EngineURL(opaEngine))
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+	transport, err := g.transportOf(req.Context(), opaEngine)
+	if err != nil {
+		logger.Error(err, "unable to set up the connection to the engine", "OpaEngine", engine)
+		writeError(w, http.StatusInternalServerError, "internal_error", err.Error())
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(target)
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, _ *http.Request, err error) {
+			logger.Error(err, "unable to forward the query", "OpaEngine", engine)
+			writeError(w, http.StatusBadGateway, "internal_error", err.Error())
+		},
+	}
+	proxy.ServeHTTP(w, req)
+}
+
+// writeError writes an error in the format of the OPA API
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"code": code, "message": message})
+}
+
+// Start serves the queries until the context is done, it implements
+// manager.Runnable
+func (g *Gateway) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx).WithName("gateway")
+
+	listener, err := net.Listen("tcp", g.Addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(DataPath+"/", g)
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		BaseContext: func(net.Listener) context.Context {
+			return log.IntoContext(context.Background(), logger)
+		},
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Error(err, "unable to shut down the gateway")
+		}
+	}()
+
+	logger.Info("Serving queries", "Addr", listener.Addr().String(), "Namespace", g.Namespace)
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// NeedLeaderElection returns false, every replica of the gateway serves queries
+func (g *Gateway) NeedLeaderElection() bool {
+	return false
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gateway
+
+import (
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+)
+
+var _ = Describe("gateway", func() {
+	var engines map[string]*httptest.Server
+	var ts *httptest.Server
+
+	BeforeEach(func() {
+		// Each engine answers with its name and the path of the query
+		engines = map[string]*httptest.Server{}
+		for _, name := range []string{"default", "default-1", "secure"} {
+			handler := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				body, _ := io.ReadAll(req.Body)
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = io.WriteString(w, `{"result":"`+name+" "+req.Method+" "+req.URL.RequestURI()+" "+string(body)+`"}`)
+			})
+			if name == "secure" {
+				engines[name] = httptest.NewTLSServer(handler)
+			} else {
+				engines[name] = httptest.NewServer(handler)
+			}
+		}
+
+		scheme := runtime.NewScheme()
+		Expect(opaspolimiitv1alpha1.AddToScheme(scheme)).To(Succeed())
+		Expect(corev1.AddToScheme(scheme)).To(Succeed())
+		policy := func(name string, packages ...string) *opaspolimiitv1alpha1.Policy {
+			return &opaspolimiitv1alpha1.Policy{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+				Status:     opaspolimiitv1alpha1.PolicyStatus{Packages: packages},
+			}
+		}
+		engine := func(name string, expected, loaded []string) *opaspolimiitv1alpha1.OpaEngine {
+			return &opaspolimiitv1alpha1.OpaEngine{
+				ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+				Spec:       opaspolimiitv1alpha1.OpaEngineSpec{Policies: expected},
+				Status:     opaspolimiitv1alpha1.OpaEngineStatus{Policies: loaded},
+			}
+		}
+		reader := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			policy("authz", "data.orders.authz"),
+			policy("lib", "data.orders.lib"),
+			policy("payments", "data.payments"),
+			policy("pending", "data.pending"),
+			engine("default", []string{"authz", "lib"}, []string{"authz", "lib"}),
+			engine("default-1", []string{"lib", "payments", "pending"}, []string{"lib", "payments"}),
+			policy("secure", "data.secure"),
+			&opaspolimiitv1alpha1.OpaEngine{
+				ObjectMeta: metav1.ObjectMeta{Name: "secure", Namespace: "default"},
+				Spec: opaspolimiitv1alpha1.OpaEngineSpec{
+					Policies: []string{"secure"},
+					API:      &opaspolimiitv1alpha1.EngineAPISpec{TLSSecretName: "secure-tls"},
+				},
+				Status: opaspolimiitv1alpha1.OpaEngineStatus{Policies: []string{"secure"}},
+			},
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "secure-tls", Namespace: "default"},
+				Data: map[string][]byte{
+					"ca.crt": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: engines["secure"].Certificate().Raw}),
+				},
+			},
+		).Build()
+
+		gateway := New("", "default", reader)
+		gateway.EngineURL = func(engine *opaspolimiitv1alpha1.OpaEngine) string {
+			return engines[engine.Name].URL
+		}
+		ts = httptest.NewServer(gateway)
+	})
+
+	AfterEach(func() {
+		ts.Close()
+		for _, engine := range engines {
+			engine.Close()
+		}
+	})
+
+	query := func(method, path, body string) (int, string) {
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		Expect(err).NotTo(HaveOccurred())
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		out, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return resp.StatusCode, string(out)
+	}
+
+	It("should forward each query to the engine loading its package", func() {
+		status, body := query(http.MethodGet, "/v1/data/orders/authz/allow?pretty=true", "")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(Equal(`{"result":"default GET /v1/data/orders/authz/allow?pretty=true "}`))
+
+		status, body = query(http.MethodPost, "/v1/data/payments/allow", `{"input":{}}`)
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(Equal(`{"result":"default-1 POST /v1/data/payments/allow {"input":{}}"}`))
+	})
+
+	It("should forward a query on several packages to an engine loading all of them", func() {
+		_, body := query(http.MethodGet, "/v1/data/orders", "")
+		Expect(body).To(HavePrefix(`{"result":"default GET`))
+	})
+
+	It("should verify the engines serving their API over TLS with the CA of their Secret", func() {
+		status, body := query(http.MethodGet, "/v1/data/secure/allow", "")
+		Expect(status).To(Equal(http.StatusOK))
+		Expect(body).To(HavePrefix(`{"result":"secure GET`))
+	})
+
+	It("should use an engine still loading the policy only when no other loaded it", func() {
+		_, body := query(http.MethodGet, "/v1/data/pending", "")
+		Expect(body).To(HavePrefix(`{"result":"default-1 GET`))
+	})
+
+	It("should reject the documents without engine and the writes", func() {
+		status, body := query(http.MethodGet, "/v1/data/unknown/allow", "")
+		Expect(status).To(Equal(http.StatusNotFound))
+		Expect(body).To(ContainSubstring("data.unknown.allow"))
+
+		status, _ = query(http.MethodPut, "/v1/data/payments", "{}")
+		Expect(status).To(Equal(http.StatusMethodNotAllowed))
+	})
+})
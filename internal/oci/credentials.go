@@ -0,0 +1,89 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package oci
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+type dockerConfig struct {
+	Auths map[string]dockerConfigEntry `json:"auths"`
+}
+
+type dockerConfigEntry struct {
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	Auth     string `json:"auth,omitempty"`
+}
+
+// CredentialFromSecret extracts the credential for the registry host from an
+// image pull secret of type kubernetes.io/dockerconfigjson or kubernetes.io/dockercfg.
+// The returned boolean reports if the secret holds an entry for the registry.
+func CredentialFromSecret(secret *corev1.Secret, host string) (auth.Credential, bool, error) {
+	auths := map[string]dockerConfigEntry{}
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		config := dockerConfig{}
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+			return auth.EmptyCredential, false, fmt.Errorf("invalid secret %s: %w", secret.Name, err)
+		}
+		auths = config.Auths
+	case corev1.SecretTypeDockercfg:
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &auths); err != nil {
+			return auth.EmptyCredential, false, fmt.Errorf("invalid secret %s: %w", secret.Name, err)
+		}
+	default:
+		return auth.EmptyCredential, false, fmt.Errorf("secret %s has unsupported type %s", secret.Name, secret.Type)
+	}
+
+	for server, entry := range auths {
+		if normalizeHost(server) != normalizeHost(host) {
+			continue
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return auth.EmptyCredential, false, fmt.Errorf("invalid auth for %s in secret %s: %w", server, secret.Name, err)
+			}
+			username, password, ok := strings.Cut(string(decoded), ":")
+			if !ok {
+				return auth.EmptyCredential, false, fmt.Errorf("invalid auth for %s in secret %s", server, secret.Name)
+			}
+			return auth.Credential{Username: username, Password: password}, true, nil
+		}
+		return auth.Credential{Username: entry.Username, Password: entry.Password}, true, nil
+	}
+	return auth.EmptyCredential, false, nil
+}
+
+// normalizeHost reduces a docker config server entry to the bare registry host
+func normalizeHost(server string) string {
+	server = strings.TrimPrefix(server, "https://")
+	server = strings.TrimPrefix(server, "http://")
+	server, _, _ = strings.Cut(server, "/")
+	switch server {
+	case "docker.io", "index.docker.io", "registry-1.docker.io":
+		return "registry-1.docker.io"
+	}
+	return server
+}
@@ -0,0 +1,300 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package oci pulls Rego policies packaged as OCI artifacts, either OPA bundles
+// pushed with `opa build`/`oras push` or plain tar.gz image layers.
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/v2"
+	"oras.land/oras-go/v2/content"
+	"oras.land/oras-go/v2/registry"
+	"oras.land/oras-go/v2/registry/remote"
+	"oras.land/oras-go/v2/registry/remote/auth"
+	"oras.land/oras-go/v2/registry/remote/retry"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Layer media types understood by the puller
+const (
+	// MediaTypeOPABundleLayer is the layer of a bundle pushed with `opa build --push` or `oras push`
+	MediaTypeOPABundleLayer = "application/vnd.oci.image.layer.v1.tar+gzip"
+	// MediaTypeOPALegacyBundleLayer is the layer media type used by older OPA releases
+	MediaTypeOPALegacyBundleLayer = "application/vnd.openpolicyagent.layer.v1.tar+gzip"
+	// MediaTypeOPAPolicyLayer is a layer containing a single raw Rego module
+	MediaTypeOPAPolicyLayer = "application/vnd.openpolicyagent.policy.layer.v1+rego"
+	// MediaTypeDockerLayer is the layer of an image built by docker
+	MediaTypeDockerLayer = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+// MaxLayerSize is the maximum size, both compressed and uncompressed, of a single layer
+const MaxLayerSize = 16 << 20
+
+// ErrNoPolicies is returned when an artifact does not contain any Rego module
+var ErrNoPolicies = errors.New("artifact does not contain any rego module")
+
+// Artifact is the result of pulling an image
+type Artifact struct {
+	// Digest is the digest of the manifest that has been pulled
+	Digest string
+	// Modules maps the path of each Rego file inside the artifact to its source
+	Modules map[string]string
+}
+
+// TargetFunc returns the target from which the reference is pulled
+type TargetFunc func(ref registry.Reference, cred auth.Credential, plainHTTP bool) (oras.ReadOnlyTarget, error)
+
+// Puller fetches Rego modules from OCI registries. Artifacts are cached by
+// manifest digest, so an image pinned by digest is downloaded only once and a
+// tag costs a single manifest resolution when its content has not changed.
+type Puller struct {
+	// PlainHTTP forces plain HTTP for every registry, otherwise it is used
+	// only for localhost and http:// references
+	PlainHTTP bool
+
+	// NewTarget overrides the target used to pull images, by default a remote repository
+	NewTarget TargetFunc
+
+	mu    sync.Mutex
+	cache map[string]*Artifact
+}
+
+// NewPuller returns a puller accessing remote registries
+func NewPuller() *Puller {
+	return &Puller{}
+}
+
+// Pull fetches the image and extracts every Rego module it contains
+func (p *Puller) Pull(ctx context.Context, image string, cred auth.Credential) (*Artifact, error) {
+	logger := log.FromContext(ctx).WithValues("image", image)
+
+	ref, plainHTTP, err := ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+	plainHTTP = plainHTTP || p.PlainHTTP
+
+	// Pinned references never change, avoid contacting the registry at all
+	if dgst, err := ref.Digest(); err == nil {
+		if artifact := p.cached(dgst.String()); artifact != nil {
+			return artifact, nil
+		}
+	}
+
+	newTarget := p.NewTarget
+	if newTarget == nil {
+		newTarget = remoteTarget
+	}
+	target, err := newTarget(ref, cred, plainHTTP)
+	if err != nil {
+		return nil, err
+	}
+
+	desc, err := oras.Resolve(ctx, target, ref.ReferenceOrDefault(), oras.DefaultResolveOptions)
+	if err != nil {
+		return nil, fmt.Errorf("unable to resolve %s: %w", image, err)
+	}
+	if artifact := p.cached(desc.Digest.String()); artifact != nil {
+		return artifact, nil
+	}
+
+	logger.Info("Pulling policy image", "digest", desc.Digest)
+	modules, err := pullModules(ctx, target, desc)
+	if err != nil {
+		return nil, fmt.Errorf("unable to pull %s: %w", image, err)
+	}
+	if len(modules) == 0 {
+		return nil, fmt.Errorf("%s: %w", image, ErrNoPolicies)
+	}
+
+	artifact := &Artifact{Digest: desc.Digest.String(), Modules: modules}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cache == nil {
+		p.cache = make(map[string]*Artifact)
+	}
+	p.cache[artifact.Digest] = artifact
+	return artifact, nil
+}
+
+func (p *Puller) cached(dgst string) *Artifact {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cache[dgst]
+}
+
+// ParseReference normalizes an image reference, accepting the oci://, http://
+// and https:// prefixes and docker hub short names. The second value reports
+// if the registry has to be contacted over plain HTTP.
+func ParseReference(image string) (registry.Reference, bool, error) {
+	plainHTTP := false
+	switch {
+	case strings.HasPrefix(image, "oci://"):
+		image = strings.TrimPrefix(image, "oci://")
+	case strings.HasPrefix(image, "https://"):
+		image = strings.TrimPrefix(image, "https://")
+	case strings.HasPrefix(image, "http://"):
+		image = strings.TrimPrefix(image, "http://")
+		plainHTTP = true
+	}
+
+	// Images without a registry host are served by docker hub
+	host, _, found := strings.Cut(image, "/")
+	if !found || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		if !found {
+			image = "library/" + image
+		}
+		image = "docker.io/" + image
+	}
+
+	ref, err := registry.ParseReference(image)
+	if err != nil {
+		return registry.Reference{}, false, err
+	}
+	if ref.Registry == "docker.io" {
+		ref.Registry = "registry-1.docker.io"
+	}
+
+	hostname, _, _ := strings.Cut(ref.Registry, ":")
+	if hostname == "localhost" || hostname == "127.0.0.1" {
+		plainHTTP = true
+	}
+	return ref, plainHTTP, nil
+}
+
+func remoteTarget(ref registry.Reference, cred auth.Credential, plainHTTP bool) (oras.ReadOnlyTarget, error) {
+	repo, err := remote.NewRepository(ref.Registry + "/" + ref.Repository)
+	if err != nil {
+		return nil, err
+	}
+	repo.PlainHTTP = plainHTTP
+	repo.Client = &auth.Client{
+		Client:     retry.DefaultClient,
+		Cache:      auth.NewCache(),
+		Credential: auth.StaticCredential(ref.Registry, cred),
+	}
+	return repo, nil
+}
+
+// pullModules walks the manifest behind desc and collects the Rego modules of every layer
+func pullModules(ctx context.Context, target oras.ReadOnlyTarget, desc ocispec.Descriptor) (map[string]string, error) {
+	if desc.MediaType == ocispec.MediaTypeImageIndex || desc.MediaType == "application/vnd.docker.distribution.manifest.list.v2+json" {
+		// Policies are platform independent, any manifest of the index will do
+		index := ocispec.Index{}
+		if err := fetchJSON(ctx, target, desc, &index); err != nil {
+			return nil, err
+		}
+		if len(index.Manifests) == 0 {
+			return nil, fmt.Errorf("image index %s is empty", desc.Digest)
+		}
+		return pullModules(ctx, target, index.Manifests[0])
+	}
+
+	manifest := ocispec.Manifest{}
+	if err := fetchJSON(ctx, target, desc, &manifest); err != nil {
+		return nil, err
+	}
+
+	modules := make(map[string]string)
+	for _, layer := range manifest.Layers {
+		if layer.Size > MaxLayerSize {
+			return nil, fmt.Errorf("layer %s exceeds the maximum size of %d bytes", layer.Digest, MaxLayerSize)
+		}
+
+		switch layer.MediaType {
+		case MediaTypeOPAPolicyLayer:
+			data, err := content.FetchAll(ctx, target, layer)
+			if err != nil {
+				return nil, err
+			}
+			name := layer.Annotations[ocispec.AnnotationTitle]
+			if name == "" {
+				name = layer.Digest.Encoded() + ".rego"
+			}
+			modules[cleanPath(name)] = string(data)
+		case MediaTypeOPABundleLayer, MediaTypeOPALegacyBundleLayer, MediaTypeDockerLayer:
+			data, err := content.FetchAll(ctx, target, layer)
+			if err != nil {
+				return nil, err
+			}
+			if err := extractModules(data, modules); err != nil {
+				return nil, fmt.Errorf("layer %s: %w", layer.Digest, err)
+			}
+		default:
+			// Configuration, data and signature layers carry no Rego
+			continue
+		}
+	}
+	return modules, nil
+}
+
+func fetchJSON(ctx context.Context, target oras.ReadOnlyTarget, desc ocispec.Descriptor, v any) error {
+	data, err := content.FetchAll(ctx, target, desc)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// extractModules adds every .rego file of a tar.gz archive to modules, skipping tests
+func extractModules(data []byte, modules map[string]string) error {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	// Bound the uncompressed size as well
+	tr := tar.NewReader(io.LimitReader(gz, MaxLayerSize))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := cleanPath(header.Name)
+		if path.Ext(name) != ".rego" || strings.HasSuffix(name, "_test.rego") {
+			continue
+		}
+		code, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		modules[name] = string(code)
+	}
+}
+
+func cleanPath(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
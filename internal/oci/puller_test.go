@@ -0,0 +1,286 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package oci
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"oras.land/oras-go/v2/registry/remote/auth"
+)
+
+// testRegistry is a minimal stand-in for an OCI distribution registry
+type testRegistry struct {
+	server    *httptest.Server
+	manifests map[string][]byte
+	blobs     map[string][]byte
+	tags      map[string]string
+	username  string
+	password  string
+	requests  int
+}
+
+func newTestRegistry() *testRegistry {
+	r := &testRegistry{
+		manifests: map[string][]byte{},
+		blobs:     map[string][]byte{},
+		tags:      map[string]string{},
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+func (r *testRegistry) host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+func (r *testRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.requests++
+	if r.username != "" {
+		if user, pass, ok := req.BasicAuth(); !ok || user != r.username || pass != r.password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	if req.URL.Path == "/v2/" {
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/v2/"), "/")
+	if len(parts) < 3 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	kind, ref := parts[len(parts)-2], parts[len(parts)-1]
+	var data []byte
+	switch kind {
+	case "manifests":
+		if dgst, ok := r.tags[ref]; ok {
+			ref = dgst
+		}
+		data = r.manifests[ref]
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageManifest)
+	case "blobs":
+		data = r.blobs[ref]
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	if data == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Docker-Content-Digest", ref)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if req.Method != http.MethodHead {
+		_, _ = w.Write(data)
+	}
+}
+
+func (r *testRegistry) addBlob(mediaType string, data []byte, annotations map[string]string) ocispec.Descriptor {
+	desc := ocispec.Descriptor{
+		MediaType:   mediaType,
+		Digest:      digest.FromBytes(data),
+		Size:        int64(len(data)),
+		Annotations: annotations,
+	}
+	r.blobs[desc.Digest.String()] = data
+	return desc
+}
+
+// push stores an image made of the given layers and returns its manifest digest
+func (r *testRegistry) push(tag string, layers ...ocispec.Descriptor) string {
+	config := r.addBlob("application/vnd.oci.image.config.v1+json", []byte("{}"), nil)
+	manifest, err := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    layers,
+	})
+	Expect(err).NotTo(HaveOccurred())
+	dgst := digest.FromBytes(manifest).String()
+	r.manifests[dgst] = manifest
+	r.tags[tag] = dgst
+	return dgst
+}
+
+func tarGz(files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	for name, body := range files {
+		Expect(tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0o644,
+			Size:     int64(len(body)),
+			Typeflag: tar.TypeReg,
+		})).To(Succeed())
+		_, err := tw.Write([]byte(body))
+		Expect(err).NotTo(HaveOccurred())
+	}
+	Expect(tw.Close()).To(Succeed())
+	Expect(gz.Close()).To(Succeed())
+	return buf.Bytes()
+}
+
+var _ = Describe("OCI policy puller", func() {
+	const rule = `package test
+default allow = false`
+
+	var registry *testRegistry
+	var puller *Puller
+	ctx := context.Background()
+
+	BeforeEach(func() {
+		registry = newTestRegistry()
+		puller = NewPuller()
+	})
+
+	AfterEach(func() {
+		registry.server.Close()
+	})
+
+	It("should extract rego files from an OPA bundle layer", func() {
+		layer := registry.addBlob(MediaTypeOPABundleLayer, tarGz(map[string]string{
+			"/authz/policy.rego":      rule,
+			"/authz/policy_test.rego": "package test_test",
+			"/data.json":              "{}",
+			"/.manifest":              `{"revision": "1"}`,
+		}), nil)
+		dgst := registry.push("v1", layer)
+
+		artifact, err := puller.Pull(ctx, registry.host()+"/policies:v1", auth.EmptyCredential)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(artifact.Digest).To(Equal(dgst))
+		Expect(artifact.Modules).To(Equal(map[string]string{"authz/policy.rego": rule}))
+	})
+
+	It("should read raw rego layers", func() {
+		layer := registry.addBlob(MediaTypeOPAPolicyLayer, []byte(rule), map[string]string{
+			ocispec.AnnotationTitle: "test.rego",
+		})
+		registry.push("latest", layer)
+
+		artifact, err := puller.Pull(ctx, "oci://"+registry.host()+"/policies", auth.EmptyCredential)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(artifact.Modules).To(Equal(map[string]string{"test.rego": rule}))
+	})
+
+	It("should fail when the image has no rego", func() {
+		layer := registry.addBlob(MediaTypeOPABundleLayer, tarGz(map[string]string{"data.json": "{}"}), nil)
+		registry.push("v1", layer)
+
+		_, err := puller.Pull(ctx, registry.host()+"/policies:v1", auth.EmptyCredential)
+		Expect(err).To(MatchError(ErrNoPolicies))
+	})
+
+	It("should pull pinned images only once", func() {
+		layer := registry.addBlob(MediaTypeOPABundleLayer, tarGz(map[string]string{"policy.rego": rule}), nil)
+		dgst := registry.push("v1", layer)
+
+		artifact, err := puller.Pull(ctx, registry.host()+"/policies@"+dgst, auth.EmptyCredential)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(artifact.Digest).To(Equal(dgst))
+
+		requests := registry.requests
+		_, err = puller.Pull(ctx, registry.host()+"/policies:v1@"+dgst, auth.EmptyCredential)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(registry.requests).To(Equal(requests))
+	})
+
+	It("should reject content not matching the pinned digest", func() {
+		layer := registry.addBlob(MediaTypeOPABundleLayer, tarGz(map[string]string{"policy.rego": rule}), nil)
+		registry.push("v1", layer)
+		wrong := digest.FromString("something else").String()
+		registry.manifests[wrong] = registry.manifests[registry.tags["v1"]]
+
+		_, err := puller.Pull(ctx, registry.host()+"/policies@"+wrong, auth.EmptyCredential)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should authenticate with the given credential", func() {
+		registry.username, registry.password = "user", "secret"
+		layer := registry.addBlob(MediaTypeOPABundleLayer, tarGz(map[string]string{"policy.rego": rule}), nil)
+		registry.push("v1", layer)
+
+		_, err := puller.Pull(ctx, registry.host()+"/policies:v1", auth.EmptyCredential)
+		Expect(err).To(HaveOccurred())
+
+		artifact, err := puller.Pull(ctx, registry.host()+"/policies:v1", auth.Credential{
+			Username: "user",
+			Password: "secret",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(artifact.Modules).To(HaveKey("policy.rego"))
+	})
+
+	Context("references", func() {
+		It("should default to docker hub", func() {
+			ref, plainHTTP, err := ParseReference("openpolicyagent/policy:1.0")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ref.Registry).To(Equal("registry-1.docker.io"))
+			Expect(ref.Repository).To(Equal("openpolicyagent/policy"))
+			Expect(plainHTTP).To(BeFalse())
+		})
+
+		It("should strip url schemes", func() {
+			ref, plainHTTP, err := ParseReference("https://ghcr.io/example/example:latest")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ref.Registry).To(Equal("ghcr.io"))
+			Expect(ref.Reference).To(Equal("latest"))
+			Expect(plainHTTP).To(BeFalse())
+
+			_, plainHTTP, err = ParseReference("http://registry.local:5000/example")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(plainHTTP).To(BeTrue())
+		})
+	})
+
+	Context("pull secrets", func() {
+		It("should read credentials from a dockerconfigjson secret", func() {
+			encoded := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+			secret := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "pull-secret"},
+				Type:       corev1.SecretTypeDockerConfigJson,
+				Data: map[string][]byte{
+					corev1.DockerConfigJsonKey: []byte(`{"auths": {"https://index.docker.io/v1/": {"auth": "` + encoded + `"}}}`),
+				},
+			}
+
+			cred, found, err := CredentialFromSecret(secret, "registry-1.docker.io")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(BeTrue())
+			Expect(cred).To(Equal(auth.Credential{Username: "user", Password: "secret"}))
+
+			_, found, err = CredentialFromSecret(secret, "ghcr.io")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found).To(BeFalse())
+		})
+	})
+})
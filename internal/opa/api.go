@@ -0,0 +1,182 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Policy is a module loaded in OPA
+type Policy struct {
+	ID string `json:"id"`
+	// Raw is the source code of the module
+	Raw string `json:"raw"`
+}
+
+// HealthOptions selects the checks performed by the health endpoint
+type HealthOptions struct {
+	// Bundles requires every configured bundle to be activated
+	Bundles bool
+	// Plugins requires every plugin to be in the OK state
+	Plugins bool
+}
+
+// BundleStatus is the activation state of a bundle
+type BundleStatus struct {
+	Name                     string        `json:"name"`
+	ActiveRevision           string        `json:"active_revision,omitempty"`
+	LastSuccessfulActivation time.Time     `json:"last_successful_activation,omitempty"`
+	LastSuccessfulDownload   time.Time     `json:"last_successful_download,omitempty"`
+	Code                     string        `json:"code,omitempty"`
+	Message                  string        `json:"message,omitempty"`
+	Errors                   []ErrorDetail `json:"errors,omitempty"`
+}
+
+// PluginStatus is the state of a plugin, one of OK, NOT_READY or ERROR
+type PluginStatus struct {
+	State   string `json:"state"`
+	Message string `json:"message,omitempty"`
+}
+
+// Status is the report of the status plugin of OPA
+type Status struct {
+	Labels  map[string]string       `json:"labels,omitempty"`
+	Bundles map[string]BundleStatus `json:"bundles,omitempty"`
+	Plugins map[string]PluginStatus `json:"plugins,omitempty"`
+}
+
+// ListPolicies returns the ids of the modules loaded in the OPA instance
+func (c *Client) ListPolicies(ctx context.Context) ([]string, error) {
+	var list struct {
+		Result []Policy `json:"result"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/policies", "", "", &list); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(list.Result))
+	for _, p := range list.Result {
+		ids = append(ids, p.ID)
+	}
+	return ids, nil
+}
+
+// GetPolicy returns the module with the given id
+func (c *Client) GetPolicy(ctx context.Context, id string) (*Policy, error) {
+	var policy struct {
+		Result Policy `json:"result"`
+	}
+	if err := c.do(ctx, http.MethodGet, apiPath("/v1/policies", id), "", "", &policy); err != nil {
+		return nil, err
+	}
+	return &policy.Result, nil
+}
+
+// PutPolicy creates or updates a module
+func (c *Client) PutPolicy(ctx context.Context, id, code string) error {
+	return c.do(ctx, http.MethodPut, apiPath("/v1/policies", id), "text/plain", code, nil)
+}
+
+// DeletePolicy removes a module
+func (c *Client) DeletePolicy(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, apiPath("/v1/policies", id), "", "", nil)
+}
+
+// GetData returns the document at path, nil if it is undefined
+func (c *Client) GetData(ctx context.Context, path string) (json.RawMessage, error) {
+	var data struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := c.do(ctx, http.MethodGet, apiPath("/v1/data", path), "", "", &data); err != nil {
+		return nil, err
+	}
+	return data.Result, nil
+}
+
+// PutData creates or overwrites the document at path with value encoded as JSON
+func (c *Client) PutData(ctx context.Context, path string, value any) error {
+	body, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPut, apiPath("/v1/data", path), "application/json", string(body), nil)
+}
+
+// PatchData applies the JSON Patch operations to the document at path
+func (c *Client) PatchData(ctx context.Context, path string, ops []PatchOperation) error {
+	body, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPatch, apiPath("/v1/data", path), "application/json-patch+json", string(body), nil)
+}
+
+// DeleteData removes the document at path
+func (c *Client) DeleteData(ctx context.Context, path string) error {
+	return c.do(ctx, http.MethodDelete, apiPath("/v1/data", path), "", "", nil)
+}
+
+// Evaluate returns the decision at path for the given input, nil if it is undefined
+func (c *Client) Evaluate(ctx context.Context, path string, input any) (json.RawMessage, error) {
+	body, err := json.Marshal(map[string]any{"input": input})
+	if err != nil {
+		return nil, err
+	}
+	var decision struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := c.do(ctx, http.MethodPost, apiPath("/v1/data", path), "application/json", string(body), &decision); err != nil {
+		return nil, err
+	}
+	return decision.Result, nil
+}
+
+// Health returns an error if the OPA instance is not healthy. It is not
+// retried, so that the caller sees the current state.
+func (c *Client) Health(ctx context.Context, opts HealthOptions) error {
+	query := url.Values{}
+	if opts.Bundles {
+		query.Set("bundles", "true")
+	}
+	if opts.Plugins {
+		query.Set("plugins", "true")
+	}
+	path := "/health"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	return c.attempt(ctx, http.MethodGet, path, "", "", nil)
+}
+
+// Status returns the report of the status plugin
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	var status struct {
+		Result Status `json:"result"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/status", "", "", &status); err != nil {
+		return nil, err
+	}
+	return &status.Result, nil
+}
+
+// Config returns the active configuration of the OPA instance
+func (c *Client) Config(ctx context.Context) (map[string]any, error) {
+	var config struct {
+		Result map[string]any `json:"result"`
+	}
+	if err := c.do(ctx, http.MethodGet, "/v1/config", "", "", &config); err != nil {
+		return nil, err
+	}
+	return config.Result, nil
+}
+
+// apiPath joins the slash separated path to the prefix escaping each segment
+func apiPath(prefix, path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, s := range segments {
+		segments[i] = url.PathEscape(s)
+	}
+	return prefix + "/" + strings.Join(segments, "/")
+}
@@ -0,0 +1,198 @@
+package manager
+
+import (
+	"context"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("opa rest api", func() {
+	var server *httptest.Server
+	var requests []*http.Request
+	var bodies []string
+	var handler http.HandlerFunc
+	ctx := context.Background()
+
+	BeforeEach(func() {
+		requests, bodies = nil, nil
+		handler = func(w http.ResponseWriter, req *http.Request) {}
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			body, _ := io.ReadAll(req.Body)
+			requests = append(requests, req)
+			bodies = append(bodies, string(body))
+			handler(w, req)
+		}))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("should decode the OPA error envelope", func() {
+		handler = func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = io.WriteString(w, `{
+				"code": "invalid_parameter",
+				"message": "error(s) occurred while compiling module(s)",
+				"errors": [{
+					"code": "rego_unsafe_var_error",
+					"message": "var x is unsafe",
+					"location": {"file": "policy1", "row": 3, "col": 1}
+				}]
+			}`)
+		}
+		err := NewClient(server.URL).PutPolicy(ctx, "policy1", "package test")
+		Expect(IsInvalid(err)).To(BeTrue())
+		opaErr, ok := err.(*Error)
+		Expect(ok).To(BeTrue())
+		Expect(opaErr.Errors).To(HaveLen(1))
+		Expect(opaErr.Errors[0].Location).To(Equal(&Location{File: "policy1", Row: 3, Col: 1}))
+		Expect(err.Error()).To(ContainSubstring("policy1:3:1: rego_unsafe_var_error: var x is unsafe"))
+	})
+
+	It("should keep bodies that are not an error envelope", func() {
+		handler = func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = io.WriteString(w, "upstream unavailable")
+		}
+		client := NewClient(server.URL)
+		client.Retries = 0
+		_, err := client.ListPolicies(ctx)
+		Expect(err).To(MatchError(ContainSubstring("upstream unavailable")))
+	})
+
+	It("should send the bearer token", func() {
+		handler = func(w http.ResponseWriter, req *http.Request) {
+			_, _ = io.WriteString(w, `{"result": []}`)
+		}
+		client := NewClient(server.URL)
+		client.Token = "secret"
+		_, err := client.ListPolicies(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requests[0].Header.Get("Authorization")).To(Equal("Bearer secret"))
+	})
+
+	It("should read a policy", func() {
+		handler = func(w http.ResponseWriter, req *http.Request) {
+			_, _ = io.WriteString(w, `{"result": {"id": "policy1/a.rego", "raw": "package a"}}`)
+		}
+		policy, err := NewClient(server.URL).GetPolicy(ctx, "policy1/a.rego")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy).To(Equal(&Policy{ID: "policy1/a.rego", Raw: "package a"}))
+		Expect(requests[0].URL.Path).To(Equal("/v1/policies/policy1/a.rego"))
+	})
+
+	It("should write, read and delete documents", func() {
+		handler = func(w http.ResponseWriter, req *http.Request) {
+			switch req.Method {
+			case http.MethodGet:
+				_, _ = io.WriteString(w, `{"result": {"admins": ["alice"]}}`)
+			default:
+				w.WriteHeader(http.StatusNoContent)
+			}
+		}
+		client := NewClient(server.URL)
+		Expect(client.PutData(ctx, "/users/roles", map[string][]string{"admins": {"alice"}})).To(Succeed())
+		Expect(requests[0].Method).To(Equal(http.MethodPut))
+		Expect(requests[0].URL.Path).To(Equal("/v1/data/users/roles"))
+		Expect(bodies[0]).To(MatchJSON(`{"admins": ["alice"]}`))
+
+		data, err := client.GetData(ctx, "users/roles")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(MatchJSON(`{"admins": ["alice"]}`))
+
+		Expect(client.DeleteData(ctx, "users/roles")).To(Succeed())
+		Expect(requests[2].Method).To(Equal(http.MethodDelete))
+
+		Expect(client.PatchData(ctx, "users/roles", []PatchOperation{{Op: "remove", Path: "/admins"}})).To(Succeed())
+		Expect(requests[3].Method).To(Equal(http.MethodPatch))
+		Expect(requests[3].Header.Get("Content-Type")).To(Equal("application/json-patch+json"))
+		Expect(bodies[3]).To(MatchJSON(`[{"op": "remove", "path": "/admins"}]`))
+	})
+
+	It("should evaluate a decision", func() {
+		handler = func(w http.ResponseWriter, req *http.Request) {
+			_, _ = io.WriteString(w, `{"result": true}`)
+		}
+		decision, err := NewClient(server.URL).Evaluate(ctx, "authz/allow", map[string]string{"user": "alice"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(decision).To(MatchJSON(`true`))
+		Expect(requests[0].Method).To(Equal(http.MethodPost))
+		Expect(bodies[0]).To(MatchJSON(`{"input": {"user": "alice"}}`))
+	})
+
+	It("should check the health", func() {
+		healthy := true
+		handler = func(w http.ResponseWriter, req *http.Request) {
+			if !healthy {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			_, _ = io.WriteString(w, `{}`)
+		}
+		client := NewClient(server.URL)
+		Expect(client.Health(ctx, HealthOptions{Bundles: true})).To(Succeed())
+		Expect(requests[0].URL.RawQuery).To(Equal("bundles=true"))
+
+		healthy = false
+		Expect(client.Health(ctx, HealthOptions{})).NotTo(Succeed())
+		Expect(requests).To(HaveLen(2))
+	})
+
+	It("should read the status and the config", func() {
+		handler = func(w http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/v1/status":
+				_, _ = io.WriteString(w, `{"result": {
+					"labels": {"id": "opa-1"},
+					"bundles": {"authz": {"name": "authz", "active_revision": "r1"}},
+					"plugins": {"bundle": {"state": "OK"}}
+				}}`)
+			case "/v1/config":
+				_, _ = io.WriteString(w, `{"result": {"services": {"scaler": {"url": "http://scaler"}}}}`)
+			}
+		}
+		client := NewClient(server.URL)
+		status, err := client.Status(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(status.Labels).To(HaveKeyWithValue("id", "opa-1"))
+		Expect(status.Bundles["authz"].ActiveRevision).To(Equal("r1"))
+		Expect(status.Plugins["bundle"].State).To(Equal("OK"))
+
+		config, err := client.Config(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(config).To(HaveKey("services"))
+	})
+
+	It("should connect over TLS", func() {
+		tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = io.WriteString(w, `{"result": []}`)
+		}))
+		defer tlsServer.Close()
+
+		By("rejecting an unknown certificate")
+		client := NewClient(tlsServer.URL)
+		client.Retries = 0
+		_, err := client.ListPolicies(ctx)
+		Expect(err).To(HaveOccurred())
+
+		By("trusting the server CA")
+		ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+		config, err := NewTLSConfig(TLSOptions{CA: ca})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = client.WithTLS(config).ListPolicies(ctx)
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = NewTLSConfig(TLSOptions{CA: []byte("not a certificate")})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should escape the path segments", func() {
+		Expect(apiPath("/v1/data", "/a/b c/")).To(Equal("/v1/data/a/b%20c"))
+		Expect(apiPath("/v1/policies", "p/x.rego")).To(Equal("/v1/policies/p/x.rego"))
+	})
+})
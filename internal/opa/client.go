@@ -0,0 +1,262 @@
+package manager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// DefaultConcurrency is the default number of requests in flight towards an OPA instance
+	DefaultConcurrency = 8
+	// DefaultTimeout is the default timeout of a single request
+	DefaultTimeout = 10 * time.Second
+	// DefaultRetries is the default number of times a failed request is retried
+	DefaultRetries = 3
+	// DefaultBackoff is the default delay before the first retry, doubled at every attempt
+	DefaultBackoff = 200 * time.Millisecond
+
+	// maxBackoff caps the delay between two attempts
+	maxBackoff = 5 * time.Second
+	// maxErrorBody caps the bytes of an error response kept in a Result
+	maxErrorBody = 64 << 10
+)
+
+// API is the OPA REST API the controllers depend on
+type API interface {
+	// ListPolicies returns the ids of the loaded modules
+	ListPolicies(ctx context.Context) ([]string, error)
+	// GetPolicy returns a loaded module
+	GetPolicy(ctx context.Context, id string) (*Policy, error)
+	// PutPolicy creates or updates a module
+	PutPolicy(ctx context.Context, id, code string) error
+	// DeletePolicy removes a module
+	DeletePolicy(ctx context.Context, id string) error
+	// PushPolicies creates or updates the modules indexed by id
+	PushPolicies(ctx context.Context, policies map[string]string) Results
+	// DeletePolicies removes the modules
+	DeletePolicies(ctx context.Context, ids []string) Results
+
+	// GetData returns the document at path, nil if undefined
+	GetData(ctx context.Context, path string) (json.RawMessage, error)
+	// PutData creates or overwrites the document at path
+	PutData(ctx context.Context, path string, value any) error
+	// PatchData applies the JSON Patch operations to the document at path
+	PatchData(ctx context.Context, path string, ops []PatchOperation) error
+	// DeleteData removes the document at path
+	DeleteData(ctx context.Context, path string) error
+	// Evaluate returns the decision at path for the input, nil if undefined
+	Evaluate(ctx context.Context, path string, input any) (json.RawMessage, error)
+
+	// Health returns an error if the instance is not healthy
+	Health(ctx context.Context, opts HealthOptions) error
+	// Status returns the status reported by the status plugin
+	Status(ctx context.Context) (*Status, error)
+	// Config returns the active configuration of the instance
+	Config(ctx context.Context) (map[string]any, error)
+}
+
+var _ API = &Client{}
+
+// Client talks to the REST API of a single OPA instance
+type Client struct {
+	// URL of the OPA instance, e.g. http://opa:8181
+	URL string
+	// HTTPClient sends the requests, http.DefaultClient if nil
+	HTTPClient *http.Client
+	// Token is sent as bearer token when OPA runs with token authentication
+	Token string
+	// Concurrency bounds the number of requests in flight
+	Concurrency int
+	// Timeout bounds every single attempt of a request
+	Timeout time.Duration
+	// Retries is the number of times a request is retried on transient failures
+	Retries int
+	// Backoff is the delay before the first retry, doubled at every attempt
+	Backoff time.Duration
+}
+
+// NewClient returns a Client for the OPA instance at url with the default settings
+func NewClient(url string) *Client {
+	return &Client{
+		URL:         strings.TrimSuffix(url, "/"),
+		Concurrency: DefaultConcurrency,
+		Timeout:     DefaultTimeout,
+		Retries:     DefaultRetries,
+		Backoff:     DefaultBackoff,
+	}
+}
+
+// Result is the outcome of the request for a single module
+type Result struct {
+	ID string
+	// Err is set if the request failed after all the retries
+	Err error
+}
+
+// Results collects the outcome of a batch of requests, sorted by module id
+type Results []Result
+
+// Succeeded returns the ids of the modules processed successfully
+func (rs Results) Succeeded() []string {
+	ids := []string{}
+	for _, r := range rs {
+		if r.Err == nil {
+			ids = append(ids, r.ID)
+		}
+	}
+	return ids
+}
+
+// Failed returns the error of every module that could not be processed
+func (rs Results) Failed() map[string]error {
+	failed := make(map[string]error)
+	for _, r := range rs {
+		if r.Err != nil {
+			failed[r.ID] = r.Err
+		}
+	}
+	return failed
+}
+
+// Err joins the errors of the failed modules, nil if every request succeeded
+func (rs Results) Err() error {
+	errs := []error{}
+	for _, r := range rs {
+		if r.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.ID, r.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// PushPolicies creates or updates the modules, indexed by id, concurrently.
+// A failed module doesn't prevent the others from being pushed.
+func (c *Client) PushPolicies(ctx context.Context, policies map[string]string) Results {
+	log.FromContext(ctx).Info("Pushing policies", "Count", len(policies), "URL", c.URL)
+	return c.batch(ctx, sortedKeys(policies), func(ctx context.Context, id string) error {
+		return c.PutPolicy(ctx, id, policies[id])
+	})
+}
+
+// DeletePolicies removes the modules concurrently
+func (c *Client) DeletePolicies(ctx context.Context, ids []string) Results {
+	log.FromContext(ctx).Info("Deleting policies", "Count", len(ids), "URL", c.URL)
+	return c.batch(ctx, ids, func(ctx context.Context, id string) error {
+		return c.DeletePolicy(ctx, id)
+	})
+}
+
+// batch runs fn for every id with at most Concurrency calls in flight
+func (c *Client) batch(ctx context.Context, ids []string, fn func(context.Context, string) error) Results {
+	concurrency := c.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	results := make(Results, len(ids))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, id := range ids {
+		results[i].ID = id
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+				results[i].Err = fn(ctx, id)
+			case <-ctx.Done():
+				results[i].Err = ctx.Err()
+			}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// do sends the request, retrying on transient failures, and decodes the
+// response into out if not nil
+func (c *Client) do(ctx context.Context, method, path, contentType, body string, out any) error {
+	backoff := c.Backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = c.attempt(ctx, method, path, contentType, body, out); err == nil || !retriable(err) || attempt >= c.Retries {
+			return err
+		}
+		log.FromContext(ctx).V(1).Info("Retrying OPA request", "Method", method, "Path", path, "Attempt", attempt+1, "Error", err.Error())
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		}
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, path, contentType, body string, out any) error {
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.URL+path, reader)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+		return newError(method, path, resp.StatusCode, data)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode %s %s: %w", method, path, err)
+	}
+	return nil
+}
+
+// retriable reports if a failed request should be attempted again
+func retriable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var opaErr *Error
+	if errors.As(err, &opaErr) {
+		return opaErr.Temporary()
+	}
+	// Connection errors and timeouts of a single attempt
+	return true
+}
@@ -0,0 +1,178 @@
+package manager
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// fakeOpa mimics the policy API of OPA, failing on demand
+type fakeOpa struct {
+	server   *httptest.Server
+	mu       sync.Mutex
+	policies map[string]string
+	// failures is the number of 500 errors returned for a module before accepting it
+	failures map[string]int
+	// rejected are the modules answered with a 400 error
+	rejected map[string]bool
+	requests map[string]int
+	inFlight atomic.Int32
+	maxSeen  atomic.Int32
+	delay    time.Duration
+}
+
+func newFakeOpa() *fakeOpa {
+	f := &fakeOpa{
+		policies: map[string]string{},
+		failures: map[string]int{},
+		rejected: map[string]bool{},
+		requests: map[string]int{},
+	}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeOpa) serve(w http.ResponseWriter, req *http.Request) {
+	current := f.inFlight.Add(1)
+	defer f.inFlight.Add(-1)
+	for {
+		seen := f.maxSeen.Load()
+		if current <= seen || f.maxSeen.CompareAndSwap(seen, current) {
+			break
+		}
+	}
+	time.Sleep(f.delay)
+
+	id := strings.TrimPrefix(req.URL.Path, "/v1/policies/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests[id]++
+
+	if req.URL.Path == "/v1/policies" {
+		ids := []string{}
+		for id := range f.policies {
+			ids = append(ids, `{"id":"`+id+`"}`)
+		}
+		_, _ = io.WriteString(w, `{"result":[`+strings.Join(ids, ",")+`]}`)
+		return
+	}
+	if f.failures[id] > 0 {
+		f.failures[id]--
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = io.WriteString(w, `{"code":"internal_error","message":"try again"}`)
+		return
+	}
+	if f.rejected[id] {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, `{"code":"invalid_parameter","message":"error(s) occurred while compiling module(s)"}`)
+		return
+	}
+	switch req.Method {
+	case http.MethodPut:
+		body, _ := io.ReadAll(req.Body)
+		f.policies[id] = string(body)
+	case http.MethodDelete:
+		if _, ok := f.policies[id]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.policies, id)
+	}
+	_, _ = io.WriteString(w, "{}")
+}
+
+var _ = Describe("opa client", func() {
+	var opa *fakeOpa
+	var client *Client
+	ctx := context.Background()
+
+	BeforeEach(func() {
+		opa = newFakeOpa()
+		client = NewClient(opa.server.URL)
+		client.Backoff = time.Millisecond
+	})
+
+	AfterEach(func() {
+		opa.server.Close()
+	})
+
+	It("should push every module", func() {
+		results := client.PushPolicies(ctx, map[string]string{"b": "package b", "a": "package a"})
+		Expect(results.Err()).NotTo(HaveOccurred())
+		Expect(results.Succeeded()).To(Equal([]string{"a", "b"}))
+		Expect(opa.policies).To(Equal(map[string]string{"a": "package a", "b": "package b"}))
+	})
+
+	It("should bound the requests in flight", func() {
+		opa.delay = 20 * time.Millisecond
+		client.Concurrency = 2
+		policies := map[string]string{}
+		for _, id := range []string{"a", "b", "c", "d", "e", "f"} {
+			policies[id] = "package " + id
+		}
+		Expect(client.PushPolicies(ctx, policies).Err()).NotTo(HaveOccurred())
+		Expect(opa.maxSeen.Load()).To(BeNumerically("<=", 2))
+		Expect(opa.maxSeen.Load()).To(BeNumerically(">", 1))
+	})
+
+	It("should retry transient failures", func() {
+		opa.failures["a"] = 2
+		results := client.PushPolicies(ctx, map[string]string{"a": "package a"})
+		Expect(results.Err()).NotTo(HaveOccurred())
+		Expect(opa.requests["a"]).To(Equal(3))
+	})
+
+	It("should give up after the configured retries", func() {
+		opa.failures["a"] = 10
+		client.Retries = 1
+		results := client.PushPolicies(ctx, map[string]string{"a": "package a"})
+		Expect(results.Failed()).To(HaveKey("a"))
+		Expect(opa.requests["a"]).To(Equal(2))
+	})
+
+	It("should report the failed modules without blocking the others", func() {
+		opa.rejected["b"] = true
+		results := client.PushPolicies(ctx, map[string]string{"a": "package a", "b": "package b", "c": "package c"})
+		Expect(results.Succeeded()).To(Equal([]string{"a", "c"}))
+		failed := results.Failed()
+		Expect(failed).To(HaveLen(1))
+		var opaErr *Error
+		Expect(errors.As(failed["b"], &opaErr)).To(BeTrue())
+		Expect(opaErr.StatusCode).To(Equal(http.StatusBadRequest))
+		Expect(opaErr.Code).To(Equal(CodeInvalidParameter))
+		Expect(opaErr.Message).To(ContainSubstring("compiling module"))
+		Expect(IsInvalid(failed["b"])).To(BeTrue())
+		By("not retrying client errors")
+		Expect(opa.requests["b"]).To(Equal(1))
+	})
+
+	It("should time out slow requests", func() {
+		opa.delay = 100 * time.Millisecond
+		client.Timeout = 10 * time.Millisecond
+		client.Retries = 0
+		results := client.PushPolicies(ctx, map[string]string{"a": "package a"})
+		Expect(results.Failed()).To(HaveKey("a"))
+	})
+
+	It("should list and delete modules", func() {
+		Expect(client.PushPolicies(ctx, map[string]string{"a": "package a", "b": "package b"}).Err()).NotTo(HaveOccurred())
+		loaded, err := client.ListPolicies(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(loaded).To(ConsistOf("a", "b"))
+
+		results := client.DeletePolicies(ctx, []string{"a", "missing"})
+		Expect(results.Succeeded()).To(Equal([]string{"a"}))
+		Expect(results.Failed()).To(HaveKey("missing"))
+		Expect(IsNotFound(results.Failed()["missing"])).To(BeTrue())
+		Expect(opa.policies).To(HaveKey("b"))
+	})
+})
@@ -0,0 +1,91 @@
+package manager
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// PatchOperation is an operation of the JSON Patch applied by PatchData
+type PatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value,omitempty"`
+}
+
+// NormalizeData decodes a JSON document and encodes it again with sorted
+// keys and without insignificant spaces
+func NormalizeData(data []byte) (json.RawMessage, error) {
+	var value any
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// HashData returns a digest of a JSON document, stable across the order of
+// its keys
+func HashData(data []byte) (string, error) {
+	normalized, err := NormalizeData(data)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(normalized)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// DiffData returns the operations turning the current document into the
+// desired one. Only the members of two objects are compared, ok is false if
+// the whole document must be replaced.
+func DiffData(current, desired json.RawMessage) (ops []PatchOperation, ok bool) {
+	var from, to map[string]json.RawMessage
+	if len(current) == 0 || json.Unmarshal(current, &from) != nil || from == nil {
+		return nil, false
+	}
+	if json.Unmarshal(desired, &to) != nil || to == nil {
+		return nil, false
+	}
+
+	ops = []PatchOperation{}
+	for _, key := range sortedKeys(from) {
+		if _, found := to[key]; !found {
+			ops = append(ops, PatchOperation{Op: "remove", Path: pointer(key)})
+		}
+	}
+	for _, key := range sortedKeys(to) {
+		value, found := from[key]
+		switch {
+		case !found:
+			ops = append(ops, PatchOperation{Op: "add", Path: pointer(key), Value: to[key]})
+		case !equalJSON(value, to[key]):
+			ops = append(ops, PatchOperation{Op: "replace", Path: pointer(key), Value: to[key]})
+		}
+	}
+	return ops, true
+}
+
+// EqualData reports whether two JSON documents have the same value
+func EqualData(a, b json.RawMessage) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return len(a) == len(b)
+	}
+	return equalJSON(a, b)
+}
+
+func equalJSON(a, b json.RawMessage) bool {
+	var x, y any
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// pointer returns the JSON pointer of a member of the document
+func pointer(key string) string {
+	return "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
@@ -0,0 +1,49 @@
+package manager
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("opa data documents", func() {
+	It("should hash documents regardless of the order of their keys", func() {
+		hash, err := HashData([]byte(`{"b": [1, 2], "a": {"y": true, "x": "z"}}`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hash).To(HavePrefix("sha256:"))
+		Expect(HashData([]byte(`{"a": {"x": "z", "y": true}, "b": [1, 2]}`))).To(Equal(hash))
+		Expect(HashData([]byte(`{"a": {"x": "z", "y": true}, "b": [2, 1]}`))).NotTo(Equal(hash))
+		_, err = HashData([]byte(`{"a": `))
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should diff the members of two objects", func() {
+		ops, ok := DiffData(
+			json.RawMessage(`{"keep": 1, "change": [1], "drop": true, "a/b": 1}`),
+			json.RawMessage(`{"keep": 1, "change": [2], "add": {"x": 1}, "a/b": 2}`),
+		)
+		Expect(ok).To(BeTrue())
+		Expect(ops).To(Equal([]PatchOperation{
+			{Op: "remove", Path: "/drop"},
+			{Op: "replace", Path: "/a~1b", Value: json.RawMessage(`2`)},
+			{Op: "add", Path: "/add", Value: json.RawMessage(`{"x": 1}`)},
+			{Op: "replace", Path: "/change", Value: json.RawMessage(`[2]`)},
+		}))
+	})
+
+	It("should replace documents that are not objects", func() {
+		_, ok := DiffData(nil, json.RawMessage(`{"a": 1}`))
+		Expect(ok).To(BeFalse())
+		_, ok = DiffData(json.RawMessage(`[1]`), json.RawMessage(`{"a": 1}`))
+		Expect(ok).To(BeFalse())
+		_, ok = DiffData(json.RawMessage(`{"a": 1}`), json.RawMessage(`"a"`))
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should compare documents by value", func() {
+		Expect(EqualData(json.RawMessage(`{"a": [1, 2]}`), json.RawMessage(`{ "a":[1,2] }`))).To(BeTrue())
+		Expect(EqualData(json.RawMessage(`{"a": [1, 2]}`), json.RawMessage(`{"a": [2]}`))).To(BeFalse())
+		Expect(EqualData(nil, json.RawMessage(`null`))).To(BeFalse())
+	})
+})
@@ -0,0 +1,103 @@
+package manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Error codes returned by OPA in the error envelope
+const (
+	CodeInternal         = "internal_error"
+	CodeInvalidParameter = "invalid_parameter"
+	CodeInvalidOperation = "invalid_operation"
+	CodeResourceNotFound = "resource_not_found"
+	CodeResourceConflict = "resource_conflict"
+	CodeUnauthorized     = "unauthorized"
+)
+
+// Location is the position of an error in a Rego module
+type Location struct {
+	File string `json:"file"`
+	Row  int    `json:"row"`
+	Col  int    `json:"col"`
+}
+
+// ErrorDetail is one of the errors listed in the OPA error envelope,
+// e.g. a compile error of a module
+type ErrorDetail struct {
+	Code     string    `json:"code"`
+	Message  string    `json:"message"`
+	Location *Location `json:"location,omitempty"`
+}
+
+func (d ErrorDetail) String() string {
+	if d.Location == nil {
+		return fmt.Sprintf("%s: %s", d.Code, d.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s: %s", d.Location.File, d.Location.Row, d.Location.Col, d.Code, d.Message)
+}
+
+// Error is returned when OPA answers with an unexpected status code. The
+// fields are decoded from the OPA error envelope when the body contains one.
+type Error struct {
+	Method     string `json:"-"`
+	Path       string `json:"-"`
+	StatusCode int    `json:"-"`
+	// Body is the raw error document returned by OPA
+	Body string `json:"-"`
+
+	Code    string        `json:"code"`
+	Message string        `json:"message"`
+	Errors  []ErrorDetail `json:"errors,omitempty"`
+}
+
+// newError builds the Error of a response, decoding the OPA error envelope if possible
+func newError(method, path string, statusCode int, body []byte) *Error {
+	e := &Error{}
+	if err := json.Unmarshal(body, e); err != nil {
+		e = &Error{}
+	}
+	e.Method, e.Path, e.StatusCode, e.Body = method, path, statusCode, string(body)
+	return e
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = strings.TrimSpace(e.Body)
+	}
+	if e.Code != "" {
+		msg = e.Code + ": " + msg
+	}
+	s := fmt.Sprintf("%s %s: %d %s: %s", e.Method, e.Path, e.StatusCode, http.StatusText(e.StatusCode), msg)
+	for _, d := range e.Errors {
+		s += "\n" + d.String()
+	}
+	return s
+}
+
+// Temporary reports if the request may succeed when retried
+func (e *Error) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= http.StatusInternalServerError
+}
+
+// IsNotFound reports if err is an Error for a missing resource
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && (e.StatusCode == http.StatusNotFound || e.Code == CodeResourceNotFound)
+}
+
+// IsUnauthorized reports if err is an Error for a request without valid credentials
+func IsUnauthorized(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && (e.StatusCode == http.StatusUnauthorized || e.Code == CodeUnauthorized)
+}
+
+// IsInvalid reports if err is an Error for a rejected request, e.g. a module that doesn't compile
+func IsInvalid(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusBadRequest
+}
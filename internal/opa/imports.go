@@ -0,0 +1,60 @@
+package manager
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/open-policy-agent/opa/ast"
+)
+
+// ModuleRefs are the packages defined by a set of modules and the data
+// documents they import, as references like data.lib.authz
+type ModuleRefs struct {
+	Packages []string
+	Imports  []string
+}
+
+// AnalyzeModules returns the sorted packages and data imports of the modules.
+// The modules that cannot be parsed are ignored.
+func AnalyzeModules(modules map[string]string) ModuleRefs {
+	parsed, _ := ParseModules(modules)
+	refs := ModuleRefs{Packages: []string{}, Imports: []string{}}
+	for _, module := range parsed {
+		refs.Packages = append(refs.Packages, module.Package.Path.String())
+		for _, imp := range module.Imports {
+			ref, ok := imp.Path.Value.(ast.Ref)
+			if !ok || !ref.HasPrefix(ast.DefaultRootRef) || len(ref) < 2 {
+				continue
+			}
+			refs.Imports = append(refs.Imports, ref.String())
+		}
+	}
+	slices.Sort(refs.Packages)
+	refs.Packages = slices.Compact(refs.Packages)
+	slices.Sort(refs.Imports)
+	refs.Imports = slices.Compact(refs.Imports)
+	return refs
+}
+
+// RefHasPrefix reports if the reference is prefix or is under prefix, i.e.
+// the documents of ref are defined by the package prefix
+func RefHasPrefix(ref, prefix string) bool {
+	parsedRef, err := ast.ParseRef(ref)
+	if err != nil {
+		return false
+	}
+	parsedPrefix, err := ast.ParseRef(prefix)
+	if err != nil {
+		return false
+	}
+	return parsedRef.HasPrefix(parsedPrefix)
+}
+
+// DataRef returns the reference of the document at the slash separated path
+func DataRef(path string) string {
+	ref := ast.DefaultRootRef.Copy()
+	for _, segment := range strings.Split(strings.Trim(path, "/"), "/") {
+		ref = ref.Append(ast.StringTerm(segment))
+	}
+	return ref.String()
+}
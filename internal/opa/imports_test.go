@@ -0,0 +1,33 @@
+package manager
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("rego imports", func() {
+	It("should list the packages and the data imports of the modules", func() {
+		refs := AnalyzeModules(map[string]string{
+			"app":    "package app\n\nimport data.lib.authz\nimport data.roles as r\nimport input.user\nimport rego.v1\n\nallow if authz.allow\n",
+			"app/v2": "package app.v2\n\nimport data.lib.authz\n\nallow := true\n",
+			"broken": "package broken\n\nimport data.other\n\nallow if {\n",
+		})
+		Expect(refs.Packages).To(Equal([]string{"data.app", "data.app.v2"}))
+		Expect(refs.Imports).To(Equal([]string{"data.lib.authz", "data.roles"}))
+	})
+
+	It("should match an import with the package defining its documents", func() {
+		Expect(RefHasPrefix("data.lib.authz", "data.lib")).To(BeTrue())
+		Expect(RefHasPrefix("data.lib", "data.lib")).To(BeTrue())
+		Expect(RefHasPrefix("data.lib", "data.lib.authz")).To(BeFalse())
+		Expect(RefHasPrefix("data.library", "data.lib")).To(BeFalse())
+		Expect(RefHasPrefix("data.lib.authz", "data.lib.users")).To(BeFalse())
+	})
+
+	It("should return the reference of a document path", func() {
+		Expect(DataRef("network/allowlist")).To(Equal("data.network.allowlist"))
+		Expect(DataRef("/roles/")).To(Equal("data.roles"))
+		Expect(DataRef("teams/on-call")).To(Equal(`data.teams["on-call"]`))
+		Expect(RefHasPrefix(`data.teams["on-call"].members`, DataRef("teams/on-call"))).To(BeTrue())
+	})
+})
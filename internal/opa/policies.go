@@ -1,13 +1,9 @@
 package manager
 
 import (
-	"context"
-	"fmt"
-	"io"
-	"net/http"
+	"crypto/sha256"
+	"encoding/hex"
 	"strings"
-
-	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 func MergePolicies(expected, actual []string) (toBeAdded, toBeRemove []string) {
@@ -43,58 +39,31 @@ func MergePolicies(expected, actual []string) (toBeAdded, toBeRemove []string) {
 	return toBeAdded, toBeRemove
 }
 
-func PushPolicies(ctx context.Context, opaUrl string, policies map[string]string) ([]string, error) {
-	logger := log.FromContext(ctx)
-	added := make([]string, 0, len(policies))
-	logger.Info("Pushing policies", "count", len(policies))
-	for name, policy := range policies {
-		req, err := http.NewRequestWithContext(ctx, http.MethodPut, opaUrl+"/v1/policies/"+name, nil)
-		if err != nil {
-			return added, err
-		}
-		logger.Info("Request prepared", "Request", req)
-		req.Header.Set("Content-Type", "text/plain")
-		req.Body = io.NopCloser(strings.NewReader(policy))
-		logger.Info("Context set", "Context", ctx, "Context error", ctx.Err(), "Request", req)
-		resp, err := http.DefaultClient.Do(req)
-		logger.Info("Request sent", "Request", req)
-		if err != nil {
-			return added, err
-		}
-		defer resp.Body.Close()
-		logger.Info("Pushing policy", "name", name, "status", resp.Status)
-		if resp.StatusCode != http.StatusOK {
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				return added, fmt.Errorf("failed to push policy %s: %s", name, err)
-			}
-			return added, fmt.Errorf("failed to push policy %s: %s\n%s", name, resp.Status, string(body))
+// ModuleID returns the id of a module of a policy made of several files
+func ModuleID(policy, file string) string {
+	return policy + "/" + file
+}
+
+// PolicyModules selects the modules belonging to the policy among the loaded ones
+func PolicyModules(loaded []string, policy string) []string {
+	modules := []string{}
+	for _, id := range loaded {
+		if id == policy || strings.HasPrefix(id, policy+"/") {
+			modules = append(modules, id)
 		}
-		added = append(added, name)
 	}
-	return added, nil
+	return modules
 }
 
-func DeletePolicies(ctx context.Context, opaUrl string, policies []string) ([]string, error) {
-	removed := make([]string, 0, len(policies))
-	for _, name := range policies {
-		req, err := http.NewRequestWithContext(ctx, http.MethodDelete, opaUrl+"/v1/policies/"+name, nil)
-		if err != nil {
-			return removed, err
-		}
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			return removed, err
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusOK {
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				return removed, fmt.Errorf("failed to delete policy %s: %s", name, err)
-			}
-			return removed, fmt.Errorf("failed to delete policy %s: %s\n%s", name, resp.Status, string(body))
-		}
-		removed = append(removed, name)
+// HashModules returns a digest of the code of a policy, stable across the
+// order of its modules
+func HashModules(modules map[string]string) string {
+	h := sha256.New()
+	for _, id := range sortedKeys(modules) {
+		h.Write([]byte(id))
+		h.Write([]byte{0})
+		h.Write([]byte(modules[id]))
+		h.Write([]byte{0})
 	}
-	return removed, nil
+	return "sha256:" + hex.EncodeToString(h.Sum(nil))
 }
@@ -2,6 +2,7 @@ package manager
 
 import (
 	"context"
+	"encoding/json"
 	"io"
 	"net/http"
 	"os/exec"
@@ -44,6 +45,21 @@ var _ = Describe("opa policy manager", Ordered, func() {
 			Expect(toBeAdded).To(Equal([]string{"policy1"}))
 			Expect(toBeRemove).To(Equal([]string{"policy3"}))
 		})
+
+		It("should select the modules of a policy", func() {
+			loaded := []string{"policy1", "policy10", ModuleID("policy1", "a.rego"), ModuleID("policy2", "b.rego")}
+			Expect(PolicyModules(loaded, "policy1")).To(Equal([]string{"policy1", "policy1/a.rego"}))
+			Expect(PolicyModules(loaded, "policy2")).To(Equal([]string{"policy2/b.rego"}))
+			Expect(PolicyModules(loaded, "policy3")).To(BeEmpty())
+		})
+
+		It("should hash the policy code", func() {
+			modules := map[string]string{"policy1/a.rego": "package a", "policy1/b.rego": "package b"}
+			hash := HashModules(modules)
+			Expect(hash).To(HavePrefix("sha256:"))
+			Expect(HashModules(map[string]string{"policy1/b.rego": "package b", "policy1/a.rego": "package a"})).To(Equal(hash))
+			Expect(HashModules(map[string]string{"policy1/a.rego": "package a", "policy1/b.rego": "package c"})).NotTo(Equal(hash))
+		})
 	})
 
 	Context("opa integration", func() {
@@ -61,8 +77,8 @@ var _ = Describe("opa policy manager", Ordered, func() {
 			By("pushing a policy")
 			rule := `package test
 default allow = false`
-			_, err := PushPolicies(context.TODO(), url, map[string]string{"policy1": rule})
-			Expect(err).To(BeNil())
+			results := NewClient(url).PushPolicies(context.TODO(), map[string]string{"policy1": rule})
+			Expect(results.Err()).To(BeNil())
 			By("checking the policy is available in OPA")
 			resp, err := http.Get(url + "/v1/policies/policy1")
 			Expect(err).To(BeNil())
@@ -82,17 +98,32 @@ default allow = false`
 			By("pushing a policy")
 			rule := `package test
 default allow = false`
-			_, err := PushPolicies(context.TODO(), url, map[string]string{"policy1": rule})
-			Expect(err).To(BeNil())
+			client := NewClient(url)
+			results := client.PushPolicies(context.TODO(), map[string]string{"policy1": rule})
+			Expect(results.Err()).To(BeNil())
 			By("deleting the policy")
-			_, err = DeletePolicies(context.TODO(), url, []string{"policy1"})
-			Expect(err).To(BeNil())
+			results = client.DeletePolicies(context.TODO(), []string{"policy1"})
+			Expect(results.Err()).To(BeNil())
 			By("checking the policy is not available in OPA")
 			resp, err := http.Get(url + "/v1/policies/policy1")
 			Expect(err).To(BeNil())
 			Expect(resp.StatusCode).To(Equal(http.StatusNotFound))
 		})
 
+		It("should patch a document", func() {
+			client := NewClient(url)
+			current := json.RawMessage(`{"admins": ["alice"], "a/b": 1, "old": true}`)
+			desired := json.RawMessage(`{"admins": ["alice", "bob"], "a/b": 1, "new": {"x": 1}}`)
+			Expect(client.PutData(context.TODO(), "roles", current)).To(Succeed())
+
+			ops, ok := DiffData(current, desired)
+			Expect(ok).To(BeTrue())
+			Expect(client.PatchData(context.TODO(), "roles", ops)).To(Succeed())
+			data, err := client.GetData(context.TODO(), "roles")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data).To(MatchJSON(desired))
+		})
+
 		AfterEach(func() {
 			cmd.Process.Kill()
 		})
@@ -0,0 +1,94 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/open-policy-agent/opa/ast"
+)
+
+// RegoError is a problem found in a Rego module, with its location
+type RegoError struct {
+	Module  string
+	Row     int
+	Col     int
+	Code    string
+	Message string
+}
+
+func (e RegoError) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s: %s", e.Module, e.Row, e.Col, e.Code, e.Message)
+}
+
+// IsParseError reports if the module could not be parsed at all
+func (e RegoError) IsParseError() bool {
+	return e.Code == ast.ParseErr
+}
+
+// ParseModules parses the modules, indexed by name, accepting both the Rego v1
+// syntax of OPA 1.0 and the original v0 one. Errors are those of the v1 parser.
+func ParseModules(modules map[string]string) (map[string]*ast.Module, []RegoError) {
+	parsed := make(map[string]*ast.Module, len(modules))
+	regoErrors := []RegoError{}
+	for _, name := range sortedKeys(modules) {
+		module, err := ast.ParseModuleWithOpts(name, modules[name], ast.ParserOptions{RegoVersion: ast.RegoV1})
+		if err != nil {
+			var errV0 error
+			if module, errV0 = ast.ParseModuleWithOpts(name, modules[name], ast.ParserOptions{RegoVersion: ast.RegoV0}); errV0 != nil {
+				regoErrors = append(regoErrors, toRegoErrors(name, err)...)
+				continue
+			}
+		}
+		if module == nil {
+			regoErrors = append(regoErrors, RegoError{Module: name, Code: ast.ParseErr, Message: "empty module"})
+			continue
+		}
+		parsed[name] = module
+	}
+	return parsed, regoErrors
+}
+
+// CheckModules parses and compiles the modules together, returning every
+// error found. Parse errors prevent the compilation.
+func CheckModules(modules map[string]string) []RegoError {
+	parsed, regoErrors := ParseModules(modules)
+	if len(regoErrors) > 0 {
+		return regoErrors
+	}
+
+	compiler := ast.NewCompiler()
+	compiler.Compile(parsed)
+	if compiler.Failed() {
+		return toRegoErrors("", compiler.Errors)
+	}
+	return nil
+}
+
+func toRegoErrors(module string, err error) []RegoError {
+	var astErrors ast.Errors
+	if !errors.As(err, &astErrors) {
+		return []RegoError{{Module: module, Code: ast.ParseErr, Message: err.Error()}}
+	}
+	regoErrors := make([]RegoError, 0, len(astErrors))
+	for _, e := range astErrors {
+		regoError := RegoError{Module: module, Code: e.Code, Message: e.Message}
+		if e.Location != nil {
+			regoError.Row, regoError.Col = e.Location.Row, e.Location.Col
+			if e.Location.File != "" {
+				regoError.Module = e.Location.File
+			}
+		}
+		regoErrors = append(regoErrors, regoError)
+	}
+	return regoErrors
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
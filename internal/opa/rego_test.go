@@ -0,0 +1,41 @@
+package manager
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("rego checks", func() {
+	It("should accept valid modules", func() {
+		Expect(CheckModules(map[string]string{
+			"policy1": "package test\n\ndefault allow := false\n",
+			"policy2": "package other\n\nimport data.test\n\nallow if test.allow\n",
+		})).To(BeEmpty())
+	})
+
+	It("should accept the rego v0 syntax", func() {
+		Expect(CheckModules(map[string]string{
+			"policy1": "package test\n\ndefault allow = false\n\nallow { input.admin }\n",
+		})).To(BeEmpty())
+	})
+
+	It("should report the location of parse errors", func() {
+		regoErrors := CheckModules(map[string]string{
+			"policy1": "package test\n\nallow if {\n",
+		})
+		Expect(regoErrors).NotTo(BeEmpty())
+		Expect(regoErrors[0].IsParseError()).To(BeTrue())
+		Expect(regoErrors[0].Module).To(Equal("policy1"))
+		Expect(regoErrors[0].Row).To(BeNumerically(">", 0))
+	})
+
+	It("should report compile errors", func() {
+		regoErrors := CheckModules(map[string]string{
+			"policy1": "package test\n\nallow if undefined_function(input)\n",
+		})
+		Expect(regoErrors).NotTo(BeEmpty())
+		Expect(regoErrors[0].IsParseError()).To(BeFalse())
+		Expect(regoErrors[0].Module).To(Equal("policy1"))
+		Expect(regoErrors[0].String()).To(HavePrefix("policy1:3:"))
+	})
+})
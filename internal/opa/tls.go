@@ -0,0 +1,53 @@
+package manager
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+)
+
+// TLSOptions configures the connection to an OPA instance served over HTTPS
+type TLSOptions struct {
+	// CA is the PEM bundle used to verify the server certificate, the system pool if empty
+	CA []byte
+	// Cert and Key are the PEM client certificate for mutual TLS
+	Cert []byte
+	Key  []byte
+	// ServerName overrides the name checked in the server certificate
+	ServerName string
+	// InsecureSkipVerify disables the verification of the server certificate
+	InsecureSkipVerify bool
+}
+
+// NewTLSConfig builds the tls.Config described by the options
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         opts.ServerName,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+	if len(opts.CA) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(opts.CA) {
+			return nil, errors.New("no valid certificate in the CA bundle")
+		}
+		config.RootCAs = pool
+	}
+	if len(opts.Cert) > 0 || len(opts.Key) > 0 {
+		cert, err := tls.X509KeyPair(opts.Cert, opts.Key)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// WithTLS makes the client send its requests with the given TLS configuration
+func (c *Client) WithTLS(config *tls.Config) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	c.HTTPClient = &http.Client{Transport: transport}
+	return c
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scheduler
+
+import (
+	"cmp"
+	"slices"
+)
+
+// Assignment is a request loaded in an engine
+type Assignment struct {
+	// ID identifies the request, e.g. the name of a Dependency
+	ID      string
+	Engine  string
+	Request Request
+}
+
+// Move migrates the policies of an assignment to another engine
+type Move struct {
+	ID       string
+	From     string
+	To       string
+	Policies []string
+}
+
+// Plan is a sequence of moves emptying some engines
+type Plan struct {
+	Moves []Move
+	// Emptied are the engines left without policies once the moves are done
+	Emptied []string
+}
+
+// Consolidate plans the moves emptying the least loaded engines into the
+// others. An engine is emptied only when it has assignments, each of its
+// policies belongs to one of them and all of them fit in the remaining
+// engines, which are filled by bin-packing. A request is moved at most once
+// per plan, an engine sharing a request with an emptied one is kept.
+func Consolidate(state State, assignments []Assignment) Plan {
+	plan := Plan{}
+	moved := map[string]bool{}
+	assignments = slices.Clone(assignments)
+	engines := slices.Clone(state.Engines)
+
+	sources := slices.Clone(engines)
+	slices.SortStableFunc(sources, func(a, b Engine) int {
+		return cmp.Compare(len(a.Policies), len(b.Policies))
+	})
+	for _, candidate := range sources {
+		// The engine may have received the policies of another one
+		i := slices.IndexFunc(engines, func(e Engine) bool { return e.Name == candidate.Name })
+		source := engines[i]
+		own := []int{}
+		covered := []string{}
+		for i, a := range assignments {
+			if a.Engine == source.Name {
+				own = append(own, i)
+				covered = append(covered, a.Request.Policies...)
+			}
+		}
+		if len(own) == 0 || len(missing(covered, source.Policies)) > 0 {
+			// Some policies are not loaded on behalf of an assignment
+			continue
+		}
+		if slices.ContainsFunc(own, func(i int) bool { return moved[assignments[i].ID] }) {
+			// A request cannot be migrated twice at the same time
+			continue
+		}
+
+		trial := State{Sizes: state.Sizes, DataSizes: state.DataSizes}
+		for _, engine := range engines {
+			if engine.Name != source.Name {
+				trial.Engines = append(trial.Engines, engine)
+			}
+		}
+		moves := []Move{}
+		for _, i := range own {
+			req := assignments[i].Request
+			name, ok := Place(binPacking{}, req, trial)
+			if !ok {
+				break
+			}
+			target := &trial.Engines[slices.IndexFunc(trial.Engines, func(e Engine) bool { return e.Name == name })]
+			target.Policies = append(slices.Clone(target.Policies), missing(target.Policies, req.Policies)...)
+			if req.ServiceName != "" && !slices.Contains(target.Services, req.ServiceName) {
+				target.Services = append(slices.Clone(target.Services), req.ServiceName)
+			}
+			moves = append(moves, Move{ID: assignments[i].ID, From: source.Name, To: name, Policies: req.Policies})
+		}
+		if len(moves) < len(own) {
+			continue
+		}
+
+		engines = trial.Engines
+		for k, i := range own {
+			assignments[i].Engine = moves[k].To
+			moved[assignments[i].ID] = true
+		}
+		plan.Moves = append(plan.Moves, moves...)
+		plan.Emptied = append(plan.Emptied, source.Name)
+	}
+	return plan
+}
@@ -0,0 +1,82 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scheduler
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Consolidation", func() {
+	var state State
+	var assignments []Assignment
+
+	BeforeEach(func() {
+		limits := Limits{MaxPolicies: 4}
+		state = State{
+			Engines: []Engine{
+				{Name: "a", Policies: []string{"lib", "p1", "p2"}, Limits: limits},
+				{Name: "b", Policies: []string{"p3"}, Limits: limits},
+				{Name: "c", Policies: []string{"lib", "p4"}, Limits: limits},
+			},
+		}
+		assignments = []Assignment{
+			{ID: "d1", Engine: "a", Request: Request{Policies: []string{"lib", "p1"}}},
+			{ID: "d2", Engine: "a", Request: Request{Policies: []string{"p2"}}},
+			{ID: "d3", Engine: "b", Request: Request{Policies: []string{"p3"}}},
+			{ID: "d4", Engine: "c", Request: Request{Policies: []string{"lib", "p4"}}},
+		}
+	})
+
+	It("should empty the least loaded engines into the fullest ones", func() {
+		plan := Consolidate(state, assignments)
+		Expect(plan.Moves).To(Equal([]Move{
+			{ID: "d3", From: "b", To: "a", Policies: []string{"p3"}},
+		}))
+		Expect(plan.Emptied).To(Equal([]string{"b"}))
+	})
+
+	It("should move the shared dependencies with the policies", func() {
+		state.Engines[0].Limits.MaxPolicies = 5
+		plan := Consolidate(state, assignments)
+		Expect(plan.Moves).To(ContainElement(Move{ID: "d4", From: "c", To: "a", Policies: []string{"lib", "p4"}}))
+		Expect(plan.Emptied).To(ConsistOf("b", "c"))
+	})
+
+	It("should move a request at most once", func() {
+		state.Engines[0].Limits.MaxPolicies = 5
+		state.Engines[2].Policies = append(state.Engines[2].Policies, "p3")
+		assignments = append(assignments, Assignment{ID: "d3", Engine: "c", Request: Request{Policies: []string{"p3"}}})
+		plan := Consolidate(state, assignments)
+		Expect(plan.Moves).To(HaveLen(1))
+		Expect(plan.Moves[0].ID).To(Equal("d3"))
+		Expect(plan.Emptied).To(Equal([]string{"b"}))
+	})
+
+	It("should not empty an engine with policies of no assignment", func() {
+		state.Engines[1].Policies = append(state.Engines[1].Policies, "manual")
+		plan := Consolidate(state, assignments)
+		Expect(plan.Emptied).NotTo(ContainElement("b"))
+	})
+
+	It("should not move anything when the engines are full", func() {
+		for i := range state.Engines {
+			state.Engines[i].Limits.MaxPolicies = len(state.Engines[i].Policies)
+		}
+		Expect(Consolidate(state, assignments).Moves).To(BeEmpty())
+	})
+})
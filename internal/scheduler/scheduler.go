@@ -0,0 +1,203 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scheduler
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Names of the built-in placement strategies
+const (
+	FirstFit    = "FirstFit"
+	LeastLoaded = "LeastLoaded"
+	BinPacking  = "BinPacking"
+	Affinity    = "Affinity"
+)
+
+// Metrics measuring the load of an engine
+const (
+	// PolicyCount is the number of policies of the engine
+	PolicyCount = "Policies"
+	// RegoSize is the size in bytes of the code of the policies of the engine
+	RegoSize = "RegoSize"
+)
+
+// DefaultMemoryCapacity is the memory available to the policies of an engine
+// without a memory limit
+const DefaultMemoryCapacity int64 = 256 << 20
+
+// Limits bound the load of an engine, a zero value is not limited
+type Limits struct {
+	MaxPolicies int
+	MaxRegoSize int64
+	MaxDataSize int64
+	MaxMemory   int64
+}
+
+// Engine is an OpaEngine as seen by the placement strategies
+type Engine struct {
+	Name string
+	// Policies are the policies expected in the engine
+	Policies []string
+	// Services are the ServiceNames of the Dependencies scheduled in the engine
+	Services []string
+	Limits   Limits
+}
+
+// Request is a policy to place together with its transitive dependencies
+type Request struct {
+	ServiceName string
+	Policies    []string
+}
+
+// State is the placement state of the engines of a namespace
+type State struct {
+	Engines []Engine
+	// Sizes are the sizes in bytes of the code of the policies, the ones not
+	// listed are considered empty
+	Sizes map[string]int64
+	// DataSizes are the sizes in bytes of the documents read by the policies
+	DataSizes map[string]int64
+}
+
+// Strategy chooses the engine receiving the policies of a request
+type Strategy interface {
+	// Select returns the name of the engine among the candidates, which all
+	// have room for the request, or false if no candidate is suitable
+	Select(req Request, candidates []Engine, state State) (string, bool)
+}
+
+// New returns the built-in strategy with the given name. The metric is the
+// load minimized by LeastLoaded and Affinity, the number of policies if empty.
+func New(name, metric string) (Strategy, error) {
+	switch metric {
+	case "", PolicyCount, RegoSize:
+	default:
+		return nil, fmt.Errorf("unknown load metric %q", metric)
+	}
+	switch name {
+	case "", FirstFit:
+		return firstFit{}, nil
+	case LeastLoaded:
+		return leastLoaded{metric: metric}, nil
+	case BinPacking:
+		return binPacking{}, nil
+	case Affinity:
+		return affinity{fallback: leastLoaded{metric: metric}}, nil
+	default:
+		return nil, fmt.Errorf("unknown placement strategy %q", name)
+	}
+}
+
+// Place returns the engine receiving the request, or false if none has room
+// for it. An engine already expecting every policy of the request is
+// preferred, as the placement does not add any load.
+func Place(strategy Strategy, req Request, state State) (string, bool) {
+	hosting := []Engine{}
+	candidates := []Engine{}
+	for _, engine := range state.Engines {
+		if !state.Fits(engine, req) {
+			continue
+		}
+		if len(missing(engine.Policies, req.Policies)) == 0 {
+			hosting = append(hosting, engine)
+		}
+		candidates = append(candidates, engine)
+	}
+	if len(hosting) > 0 {
+		if name, ok := strategy.Select(req, hosting, state); ok {
+			return name, true
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	return strategy.Select(req, candidates, state)
+}
+
+// Fits reports if the engine stays within its limits once it receives the request
+func (s State) Fits(engine Engine, req Request) bool {
+	return s.Within(engine.Limits, s.after(engine, req))
+}
+
+// Within reports if an engine with the given limits can load the policies
+func (s State) Within(limits Limits, policies []string) bool {
+	return (limits.MaxPolicies == 0 || len(policies) <= limits.MaxPolicies) &&
+		(limits.MaxRegoSize == 0 || s.RegoSize(policies) <= limits.MaxRegoSize) &&
+		(limits.MaxDataSize == 0 || s.DataSize(policies) <= limits.MaxDataSize) &&
+		(limits.MaxMemory == 0 || s.Memory(policies) <= limits.MaxMemory)
+}
+
+// RegoSize returns the size of the code of the policies
+func (s State) RegoSize(policies []string) int64 {
+	var size int64
+	for _, p := range policies {
+		size += s.Sizes[p]
+	}
+	return size
+}
+
+// DataSize returns the size of the documents read by the policies
+func (s State) DataSize(policies []string) int64 {
+	var size int64
+	for _, p := range policies {
+		size += s.DataSizes[p]
+	}
+	return size
+}
+
+// Memory returns the estimated memory used by the policies and their documents
+func (s State) Memory(policies []string) int64 {
+	var memory int64
+	for _, p := range policies {
+		memory += EstimateMemory(s.Sizes[p]) + s.DataSizes[p]
+	}
+	return memory
+}
+
+// Load returns the load of the engine measured by the metric
+func (s State) Load(engine Engine, metric string) int64 {
+	if metric == RegoSize {
+		return s.RegoSize(engine.Policies)
+	}
+	return int64(len(engine.Policies))
+}
+
+// after returns the policies of the engine once it receives the request
+func (s State) after(engine Engine, req Request) []string {
+	return append(slices.Clone(engine.Policies), missing(engine.Policies, req.Policies)...)
+}
+
+// EstimateMemory returns a rough estimation of the memory used by OPA for a
+// policy of the given size: the compiled rules take about ten times the size
+// of their source, plus a fixed overhead for each module
+func EstimateMemory(regoSize int64) int64 {
+	const overhead = 64 << 10
+	return overhead + 10*regoSize
+}
+
+// missing returns the policies that are not in the current ones
+func missing(current, policies []string) []string {
+	result := []string{}
+	for _, p := range policies {
+		if !slices.Contains(current, p) {
+			result = append(result, p)
+		}
+	}
+	return result
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scheduler
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Placement", func() {
+	var state State
+
+	BeforeEach(func() {
+		state = State{
+			Engines: []Engine{
+				{Name: "a", Policies: []string{"p1", "p2", "p3"}, Services: []string{"orders"}},
+				{Name: "b", Policies: []string{"p4"}, Services: []string{"payments"}},
+				{Name: "c", Policies: []string{"p5", "p6"}},
+			},
+			Sizes: map[string]int64{
+				"p1": 100, "p2": 100, "p3": 100,
+				"p4": 10 << 20,
+				"p5": 1000, "p6": 1000,
+				"new": 500,
+			},
+		}
+	})
+
+	place := func(name, metric string, req Request) string {
+		strategy, err := New(name, metric)
+		Expect(err).NotTo(HaveOccurred())
+		engine, ok := Place(strategy, req, state)
+		Expect(ok).To(BeTrue())
+		return engine
+	}
+
+	It("should place in the first engine with room with first-fit", func() {
+		Expect(place(FirstFit, "", Request{Policies: []string{"new"}})).To(Equal("a"))
+		state.Engines[0].Limits.MaxPolicies = 3
+		Expect(place(FirstFit, "", Request{Policies: []string{"new"}})).To(Equal("b"))
+	})
+
+	It("should place in the least loaded engine", func() {
+		Expect(place(LeastLoaded, PolicyCount, Request{Policies: []string{"new"}})).To(Equal("b"))
+		Expect(place(LeastLoaded, RegoSize, Request{Policies: []string{"new"}})).To(Equal("a"))
+	})
+
+	It("should fill the engine with the least memory left with bin-packing", func() {
+		Expect(place(BinPacking, "", Request{Policies: []string{"new"}})).To(Equal("b"))
+		// a has more modules than c, so it uses more memory
+		state.Engines[1].Limits.MaxMemory = state.Memory([]string{"p4"})
+		Expect(place(BinPacking, "", Request{Policies: []string{"new"}})).To(Equal("a"))
+	})
+
+	It("should place with the dependencies of the same service with affinity", func() {
+		Expect(place(Affinity, "", Request{ServiceName: "orders", Policies: []string{"new"}})).To(Equal("a"))
+		Expect(place(Affinity, "", Request{ServiceName: "shipping", Policies: []string{"new"}})).To(Equal("b"))
+	})
+
+	It("should prefer an engine already expecting the policies", func() {
+		Expect(place(LeastLoaded, "", Request{Policies: []string{"p5", "p6"}})).To(Equal("c"))
+	})
+
+	It("should respect the limits on the code and the documents of the policies", func() {
+		state.DataSizes = map[string]int64{"p5": 4096, "new": 1024}
+		state.Engines[0].Limits.MaxRegoSize = 500
+		state.Engines[1].Limits.MaxDataSize = 512
+		state.Engines[2].Limits.MaxDataSize = 8192
+		Expect(place(FirstFit, "", Request{Policies: []string{"new"}})).To(Equal("c"))
+		Expect(state.Within(Limits{MaxDataSize: 4096}, []string{"p5", "p6"})).To(BeTrue())
+		Expect(state.Within(Limits{MaxDataSize: 4096}, []string{"p5", "new"})).To(BeFalse())
+	})
+
+	It("should fail when no engine has room for the request", func() {
+		for i := range state.Engines {
+			state.Engines[i].Limits.MaxPolicies = 2
+		}
+		strategy, err := New(FirstFit, "")
+		Expect(err).NotTo(HaveOccurred())
+		_, ok := Place(strategy, Request{Policies: []string{"new", "p1"}}, state)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should reject unknown strategies and metrics", func() {
+		_, err := New("Random", "")
+		Expect(err).To(HaveOccurred())
+		_, err = New(LeastLoaded, "Requests")
+		Expect(err).To(HaveOccurred())
+	})
+})
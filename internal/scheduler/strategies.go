@@ -0,0 +1,89 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scheduler
+
+import "slices"
+
+// firstFit places the request in the first engine with room for it
+type firstFit struct{}
+
+func (firstFit) Select(_ Request, candidates []Engine, _ State) (string, bool) {
+	if len(candidates) == 0 {
+		return "", false
+	}
+	return candidates[0].Name, true
+}
+
+// leastLoaded places the request in the engine with the lowest load
+type leastLoaded struct {
+	metric string
+}
+
+func (s leastLoaded) Select(_ Request, candidates []Engine, state State) (string, bool) {
+	return minimize(candidates, func(e Engine) int64 {
+		return state.Load(e, s.metric)
+	})
+}
+
+// binPacking places the request in the engine with the least memory left once
+// the request is placed, so that the engines are filled before new ones are created
+type binPacking struct{}
+
+func (binPacking) Select(req Request, candidates []Engine, state State) (string, bool) {
+	return minimize(candidates, func(e Engine) int64 {
+		capacity := e.Limits.MaxMemory
+		if capacity == 0 {
+			capacity = DefaultMemoryCapacity
+		}
+		return capacity - state.Memory(state.after(e, req))
+	})
+}
+
+// affinity places the request with the Dependencies of the same service, so
+// that a service queries as few engines as possible. The fallback strategy
+// chooses among the engines of the service, or among every engine if none
+// serves it yet.
+type affinity struct {
+	fallback Strategy
+}
+
+func (s affinity) Select(req Request, candidates []Engine, state State) (string, bool) {
+	same := []Engine{}
+	for _, engine := range candidates {
+		if slices.Contains(engine.Services, req.ServiceName) {
+			same = append(same, engine)
+		}
+	}
+	if len(same) > 0 {
+		return s.fallback.Select(req, same, state)
+	}
+	return s.fallback.Select(req, candidates, state)
+}
+
+// minimize returns the first engine with the lowest cost
+func minimize(candidates []Engine, cost func(Engine) int64) (string, bool) {
+	if len(candidates) == 0 {
+		return "", false
+	}
+	best, bestCost := candidates[0], cost(candidates[0])
+	for _, engine := range candidates[1:] {
+		if c := cost(engine); c < bestCost {
+			best, bestCost = engine, c
+		}
+	}
+	return best.Name, true
+}
@@ -0,0 +1,191 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/bramba2000/opa-scaler/internal/bundle"
+)
+
+// log is for logging in this package.
+var podlog = logf.Log.WithName("pod-resource")
+
+const (
+	// InjectLabel is the label of the pods receiving an OPA sidecar, set to
+	// "true". The webhook only receives the pods matching it.
+	InjectLabel = "opas.polimi.it/inject"
+	// InjectServiceAnnotation is the annotation of the pods receiving an OPA
+	// sidecar, set to the ServiceName of the Dependencies whose policies are
+	// loaded in the sidecar
+	InjectServiceAnnotation = "opas.polimi.it/inject-service"
+
+	// SidecarName is the name of the injected OPA container
+	SidecarName = "opa-sidecar"
+
+	// sidecarPort is the port of the OPA API, only reachable from the pod
+	sidecarPort = 8181
+	// sidecarDiagnosticPort serves the health endpoints probed by the kubelet
+	sidecarDiagnosticPort = 8282
+	// sidecarBundle is the name of the bundle service and of the bundle in
+	// the OPA configuration
+	sidecarBundle = "opa-scaler"
+	// sidecarVolume is the volume with the token of the service account and
+	// the CA with which the sidecar downloads its bundle
+	sidecarVolume = "opa-scaler-bundle"
+	// sidecarVolumePath is the path at which the sidecarVolume is mounted
+	sidecarVolumePath = "/var/run/opa-scaler"
+	// sidecarTokenFile is the file of the token in the sidecarVolume
+	sidecarTokenFile = "token"
+)
+
+// SetupPodWebhookWithManager registers the webhook injecting the OPA sidecars in the manager.
+func SetupPodWebhookWithManager(mgr ctrl.Manager, defaulter *PodCustomDefaulter) error {
+	return ctrl.NewWebhookManagedBy(mgr).For(&corev1.Pod{}).
+		WithDefaulter(defaulter).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/mutate--v1-pod,mutating=true,failurePolicy=ignore,sideEffects=None,groups=core,resources=pods,verbs=create,versions=v1,name=mpod-v1.opas.polimi.it,admissionReviewVersions=v1
+
+// The webhook is restricted to the pods with the InjectLabel, outside of the
+// system namespaces and of the one of the operator, by the selectors patched
+// in config/webhook.
+
+// PodCustomDefaulter injects an OPA sidecar in the pods labeled for the
+// injection and annotated with a ServiceName. The sidecar downloads from the bundle server the bundle with
+// exactly the policies of the Dependencies of the service, and serves the
+// OPA API on localhost only.
+type PodCustomDefaulter struct {
+	// Image of the OPA sidecar
+	Image string
+
+	// BundleServiceURL is the url at which the sidecars download their bundles
+	BundleServiceURL string
+
+	// BundleCA makes the sidecars verify the bundle server with the CA copied
+	// in their namespace in the bundle.CAConfigMap. False if the bundles are
+	// served over plain HTTP.
+	BundleCA bool
+}
+
+var _ webhook.CustomDefaulter = &PodCustomDefaulter{}
+
+// Default implements webhook.CustomDefaulter so a webhook will be registered for the Kind Pod.
+func (d *PodCustomDefaulter) Default(ctx context.Context, obj runtime.Object) error {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return fmt.Errorf("expected a Pod object but got %T", obj)
+	}
+	service := pod.Annotations[InjectServiceAnnotation]
+	if pod.Labels[InjectLabel] != "true" || service == "" || slices.ContainsFunc(pod.Spec.Containers, func(c corev1.Container) bool {
+		return c.Name == SidecarName
+	}) {
+		return nil
+	}
+
+	// The namespace of a pod created by a controller is only in the request
+	namespace := pod.Namespace
+	if req, err := admission.RequestFromContext(ctx); err == nil && req.Namespace != "" {
+		namespace = req.Namespace
+	}
+	podlog.Info("Injecting OPA sidecar", "Pod", pod.GenerateName+pod.Name, "Namespace", namespace, "ServiceName", service)
+	pod.Spec.Containers = append(pod.Spec.Containers, d.sidecar(namespace, service))
+	pod.Spec.Volumes = append(pod.Spec.Volumes, d.sidecarVolume())
+	return nil
+}
+
+// sidecarVolume returns the volume with the token of the service account of
+// the pod, which is only served the bundles of its namespace, and with the CA
+// of the bundle server
+func (d *PodCustomDefaulter) sidecarVolume() corev1.Volume {
+	sources := []corev1.VolumeProjection{{
+		ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+			Path:              sidecarTokenFile,
+			ExpirationSeconds: ptr.To(int64(3600)),
+		},
+	}}
+	if d.BundleCA {
+		sources = append(sources, corev1.VolumeProjection{
+			ConfigMap: &corev1.ConfigMapProjection{
+				LocalObjectReference: corev1.LocalObjectReference{Name: bundle.CAConfigMap},
+				Items:                []corev1.KeyToPath{{Key: bundle.CAKey, Path: bundle.CAKey}},
+			},
+		})
+	}
+	return corev1.Volume{
+		Name: sidecarVolume,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{Sources: sources},
+		},
+	}
+}
+
+// sidecar returns the OPA container loading the bundle of the service
+func (d *PodCustomDefaulter) sidecar(namespace, service string) corev1.Container {
+	health := func(path string) *corev1.Probe {
+		return &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				HTTPGet: &corev1.HTTPGetAction{
+					Path:   path,
+					Port:   intstr.FromInt(sidecarDiagnosticPort),
+					Scheme: corev1.URISchemeHTTP,
+				}},
+			InitialDelaySeconds: 5,
+			PeriodSeconds:       3,
+		}
+	}
+	args := []string{
+		"run", "--server",
+		fmt.Sprintf("--addr=localhost:%d", sidecarPort),
+		fmt.Sprintf("--diagnostic-addr=:%d", sidecarDiagnosticPort),
+		"--set=services." + sidecarBundle + ".url=" + d.BundleServiceURL,
+		"--set=services." + sidecarBundle + ".credentials.bearer.token_path=" + sidecarVolumePath + "/" + sidecarTokenFile,
+		"--set=bundles." + sidecarBundle + ".service=" + sidecarBundle,
+		"--set=bundles." + sidecarBundle + ".resource=" + bundle.ServicePath(namespace, service, ""),
+		"--set=bundles." + sidecarBundle + ".polling.min_delay_seconds=5",
+		"--set=bundles." + sidecarBundle + ".polling.max_delay_seconds=15",
+	}
+	if d.BundleCA {
+		args = append(args, "--set=services."+sidecarBundle+".tls.ca_cert="+sidecarVolumePath+"/"+bundle.CAKey)
+	}
+	return corev1.Container{
+		Name:  SidecarName,
+		Image: d.Image,
+		Args:  args,
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: sidecarVolume, MountPath: sidecarVolumePath, ReadOnly: true},
+		},
+		Ports: []corev1.ContainerPort{
+			{Name: "opa-diagnostic", ContainerPort: sidecarDiagnosticPort, Protocol: corev1.ProtocolTCP},
+		},
+		// The pod is ready once the policies of the service have been loaded
+		LivenessProbe:  health("/health"),
+		ReadinessProbe: health("/health?bundle=true"),
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	"github.com/bramba2000/opa-scaler/internal/bundle"
+)
+
+var _ = Describe("Pod Webhook", func() {
+	var (
+		pod       *corev1.Pod
+		defaulter *PodCustomDefaulter
+	)
+
+	BeforeEach(func() {
+		pod = &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{GenerateName: "orders-"},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "orders:latest"}},
+			},
+		}
+		defaulter = &PodCustomDefaulter{
+			Image:            "openpolicyagent/opa:latest",
+			BundleServiceURL: "http://bundles:8082",
+		}
+	})
+
+	// The namespace of the pod is only in the admission request
+	admissionContext := func(namespace string) context.Context {
+		return admission.NewContextWithRequest(context.Background(), admission.Request{
+			AdmissionRequest: admissionv1.AdmissionRequest{Namespace: namespace},
+		})
+	}
+
+	It("should not inject a sidecar in the pods without a ServiceName", func() {
+		Expect(defaulter.Default(admissionContext("default"), pod)).To(Succeed())
+		Expect(pod.Spec.Containers).To(HaveLen(1))
+	})
+
+	It("should not inject a sidecar in the pods without the injection label", func() {
+		pod.Annotations = map[string]string{InjectServiceAnnotation: "orders"}
+		Expect(defaulter.Default(admissionContext("default"), pod)).To(Succeed())
+		Expect(pod.Spec.Containers).To(HaveLen(1))
+	})
+
+	It("should inject a sidecar loading the bundle of the service", func() {
+		pod.Labels = map[string]string{InjectLabel: "true"}
+		pod.Annotations = map[string]string{InjectServiceAnnotation: "orders"}
+		Expect(defaulter.Default(admissionContext("shop"), pod)).To(Succeed())
+		Expect(pod.Spec.Containers).To(HaveLen(2))
+
+		sidecar := pod.Spec.Containers[1]
+		Expect(sidecar.Name).To(Equal(SidecarName))
+		Expect(sidecar.Image).To(Equal("openpolicyagent/opa:latest"))
+		Expect(sidecar.Args).To(ContainElements(
+			"--addr=localhost:8181",
+			"--set=services.opa-scaler.url=http://bundles:8082",
+			"--set=bundles.opa-scaler.resource="+bundle.ServicePath("shop", "orders", ""),
+		))
+		Expect(sidecar.ReadinessProbe.HTTPGet.Path).To(Equal("/health?bundle=true"))
+
+		By("Defaulting the pod again")
+		Expect(defaulter.Default(admissionContext("shop"), pod)).To(Succeed())
+		Expect(pod.Spec.Containers).To(HaveLen(2))
+		Expect(pod.Spec.Volumes).To(HaveLen(1))
+	})
+
+	It("should download the bundle with the token of the pod and the CA of the bundle server", func() {
+		defaulter.BundleServiceURL = "https://bundles:8082"
+		defaulter.BundleCA = true
+		pod.Labels = map[string]string{InjectLabel: "true"}
+		pod.Annotations = map[string]string{InjectServiceAnnotation: "orders"}
+		Expect(defaulter.Default(admissionContext("shop"), pod)).To(Succeed())
+
+		sidecar := pod.Spec.Containers[1]
+		Expect(sidecar.Args).To(ContainElements(
+			"--set=services.opa-scaler.credentials.bearer.token_path=/var/run/opa-scaler/token",
+			"--set=services.opa-scaler.tls.ca_cert=/var/run/opa-scaler/ca.crt",
+		))
+		Expect(sidecar.VolumeMounts).To(ConsistOf(corev1.VolumeMount{
+			Name: "opa-scaler-bundle", MountPath: "/var/run/opa-scaler", ReadOnly: true,
+		}))
+
+		Expect(pod.Spec.Volumes).To(HaveLen(1))
+		sources := pod.Spec.Volumes[0].Projected.Sources
+		Expect(sources).To(HaveLen(2))
+		Expect(sources[0].ServiceAccountToken.Path).To(Equal("token"))
+		Expect(sources[1].ConfigMap.Name).To(Equal(bundle.CAConfigMap))
+	})
+})
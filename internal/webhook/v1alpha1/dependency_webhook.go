@@ -0,0 +1,122 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+)
+
+// log is for logging in this package.
+var dependencylog = logf.Log.WithName("dependency-resource")
+
+const (
+	// MissingPolicyWarn admits the Dependencies naming a Policy that does not
+	// exist yet, returning a warning
+	MissingPolicyWarn = "Warn"
+	// MissingPolicyDeny rejects the Dependencies naming a Policy that does not exist
+	MissingPolicyDeny = "Deny"
+)
+
+// SetupDependencyWebhookWithManager registers the webhook for Dependency in the manager.
+func SetupDependencyWebhookWithManager(mgr ctrl.Manager, validator *DependencyCustomValidator) error {
+	return ctrl.NewWebhookManagedBy(mgr).For(&opaspolimiitv1alpha1.Dependency{}).
+		WithValidator(validator).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/validate-opas-polimi-it-v1alpha1-dependency,mutating=false,failurePolicy=fail,sideEffects=None,groups=opas.polimi.it,resources=dependencies,verbs=create;update,versions=v1alpha1,name=vdependency-v1alpha1.opas.polimi.it,admissionReviewVersions=v1
+
+// DependencyCustomValidator checks that the Policy of a Dependency exists in
+// its namespace. A missing Policy is either a warning or an error, since the
+// Policy may be legitimately created after the Dependencies on it.
+type DependencyCustomValidator struct {
+	// Reader gets the Policies of the Dependencies
+	Reader client.Reader
+
+	// MissingPolicy is MissingPolicyWarn or MissingPolicyDeny
+	MissingPolicy string
+}
+
+var _ webhook.CustomValidator = &DependencyCustomValidator{}
+
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type Dependency.
+func (v *DependencyCustomValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	dependency, ok := obj.(*opaspolimiitv1alpha1.Dependency)
+	if !ok {
+		return nil, fmt.Errorf("expected a Dependency object but got %T", obj)
+	}
+	dependencylog.Info("Validation for Dependency upon creation", "name", dependency.GetName())
+	return v.validatePolicy(ctx, dependency)
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type Dependency.
+func (v *DependencyCustomValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	dependency, ok := newObj.(*opaspolimiitv1alpha1.Dependency)
+	if !ok {
+		return nil, fmt.Errorf("expected a Dependency object for the newObj but got %T", newObj)
+	}
+	old, ok := oldObj.(*opaspolimiitv1alpha1.Dependency)
+	if !ok {
+		return nil, fmt.Errorf("expected a Dependency object for the oldObj but got %T", oldObj)
+	}
+	dependencylog.Info("Validation for Dependency upon update", "name", dependency.GetName())
+	// The Policy is only checked when it changes, so that the Dependencies of
+	// a deleted Policy can still be updated and their finalizers removed
+	if old.Spec.PolicyName == dependency.Spec.PolicyName || !dependency.DeletionTimestamp.IsZero() {
+		return nil, nil
+	}
+	return v.validatePolicy(ctx, dependency)
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type Dependency.
+func (v *DependencyCustomValidator) ValidateDelete(_ context.Context, _ runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// validatePolicy looks for the Policy of the dependency
+func (v *DependencyCustomValidator) validatePolicy(ctx context.Context, dependency *opaspolimiitv1alpha1.Dependency) (admission.Warnings, error) {
+	policy := &opaspolimiitv1alpha1.Policy{}
+	key := types.NamespacedName{Namespace: dependency.Namespace, Name: dependency.Spec.PolicyName}
+	err := v.Reader.Get(ctx, key, policy)
+	if err == nil {
+		return nil, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	if v.MissingPolicy == MissingPolicyDeny {
+		return nil, apierrors.NewInvalid(opaspolimiitv1alpha1.GroupVersion.WithKind("Dependency").GroupKind(), dependency.Name,
+			field.ErrorList{field.NotFound(field.NewPath("spec", "policyName"), dependency.Spec.PolicyName)})
+	}
+	return admission.Warnings{fmt.Sprintf(
+		"the Policy %s does not exist in namespace %s, the Dependency is not scheduled until it is created",
+		dependency.Spec.PolicyName, dependency.Namespace)}, nil
+}
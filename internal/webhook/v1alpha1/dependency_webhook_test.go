@@ -0,0 +1,92 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+)
+
+var _ = Describe("Dependency Webhook", func() {
+	var (
+		dependency *opaspolimiitv1alpha1.Dependency
+		validator  *DependencyCustomValidator
+	)
+
+	BeforeEach(func() {
+		scheme := runtime.NewScheme()
+		Expect(opaspolimiitv1alpha1.AddToScheme(scheme)).To(Succeed())
+		reader := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			&opaspolimiitv1alpha1.Policy{ObjectMeta: metav1.ObjectMeta{Name: "authz", Namespace: "default"}},
+		).Build()
+
+		dependency = &opaspolimiitv1alpha1.Dependency{
+			ObjectMeta: metav1.ObjectMeta{Name: "orders-authz", Namespace: "default"},
+			Spec:       opaspolimiitv1alpha1.DependencySpec{ServiceName: "orders", PolicyName: "authz"},
+		}
+		validator = &DependencyCustomValidator{Reader: reader, MissingPolicy: MissingPolicyWarn}
+	})
+
+	It("should admit a dependency on an existing policy", func() {
+		warnings, err := validator.ValidateCreate(context.Background(), dependency)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(warnings).To(BeEmpty())
+	})
+
+	It("should warn about a missing policy", func() {
+		dependency.Spec.PolicyName = "missing"
+		warnings, err := validator.ValidateCreate(context.Background(), dependency)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(warnings).To(ConsistOf(ContainSubstring("missing")))
+
+		By("Checking the other namespaces are not looked up")
+		dependency.Spec.PolicyName = "authz"
+		dependency.Namespace = "other"
+		warnings, err = validator.ValidateCreate(context.Background(), dependency)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(warnings).To(HaveLen(1))
+	})
+
+	It("should reject a missing policy when configured to deny", func() {
+		validator.MissingPolicy = MissingPolicyDeny
+		dependency.Spec.PolicyName = "missing"
+		_, err := validator.ValidateCreate(context.Background(), dependency)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.policyName"))
+	})
+
+	It("should only check the policy when it changes", func() {
+		validator.MissingPolicy = MissingPolicyDeny
+		old := dependency.DeepCopy()
+		old.Spec.PolicyName = "missing"
+		dependency.Spec.PolicyName = "missing"
+		_, err := validator.ValidateUpdate(context.Background(), old, dependency)
+		Expect(err).NotTo(HaveOccurred())
+
+		old.Spec.PolicyName = "authz"
+		_, err = validator.ValidateUpdate(context.Background(), old, dependency)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+	})
+})
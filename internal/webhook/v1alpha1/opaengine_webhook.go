@@ -0,0 +1,194 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	"github.com/bramba2000/opa-scaler/internal/oci"
+	"github.com/bramba2000/opa-scaler/internal/scheduler"
+)
+
+// log is for logging in this package.
+var opaenginelog = logf.Log.WithName("opaengine-resource")
+
+// SetupOpaEngineWebhookWithManager registers the webhook for OpaEngine in the manager.
+func SetupOpaEngineWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).For(&opaspolimiitv1alpha1.OpaEngine{}).
+		WithValidator(&OpaEngineCustomValidator{}).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/validate-opas-polimi-it-v1alpha1-opaengine,mutating=false,failurePolicy=fail,sideEffects=None,groups=opas.polimi.it,resources=opaengines,verbs=create;update,versions=v1alpha1,name=vopaengine-v1alpha1.opas.polimi.it,admissionReviewVersions=v1
+
+// OpaEngineCustomValidator rejects the OpaEngines with an invalid image,
+// resources or list of policies, and warns about the combinations of
+// replicas, resources and capacity that the engine is unlikely to honour.
+type OpaEngineCustomValidator struct{}
+
+var _ webhook.CustomValidator = &OpaEngineCustomValidator{}
+
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type OpaEngine.
+func (v *OpaEngineCustomValidator) ValidateCreate(_ context.Context, obj runtime.Object) (admission.Warnings, error) {
+	engine, ok := obj.(*opaspolimiitv1alpha1.OpaEngine)
+	if !ok {
+		return nil, fmt.Errorf("expected a OpaEngine object but got %T", obj)
+	}
+	opaenginelog.Info("Validation for OpaEngine upon creation", "name", engine.GetName())
+	return validateOpaEngine(engine, nil)
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type OpaEngine.
+func (v *OpaEngineCustomValidator) ValidateUpdate(_ context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	engine, ok := newObj.(*opaspolimiitv1alpha1.OpaEngine)
+	if !ok {
+		return nil, fmt.Errorf("expected a OpaEngine object for the newObj but got %T", newObj)
+	}
+	old, ok := oldObj.(*opaspolimiitv1alpha1.OpaEngine)
+	if !ok {
+		return nil, fmt.Errorf("expected a OpaEngine object for the oldObj but got %T", oldObj)
+	}
+	opaenginelog.Info("Validation for OpaEngine upon update", "name", engine.GetName())
+	// An OpaEngine being deleted is not validated, so that its finalizers can be removed
+	if !engine.DeletionTimestamp.IsZero() {
+		return nil, nil
+	}
+	return validateOpaEngine(engine, old)
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type OpaEngine.
+func (v *OpaEngineCustomValidator) ValidateDelete(_ context.Context, _ runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// validateOpaEngine checks the spec of the engine, returning the warnings
+// about the settings that are valid but probably not intended. On update, the
+// old engine is given so that the duplicate policies it already lists are
+// only reported, as rejecting them would block the updates of the operator.
+func validateOpaEngine(engine, old *opaspolimiitv1alpha1.OpaEngine) (admission.Warnings, error) {
+	var warnings admission.Warnings
+	var allErrs field.ErrorList
+	spec := field.NewPath("spec")
+
+	if engine.Spec.Image != "" {
+		imagePath := spec.Child("image")
+		if strings.Contains(engine.Spec.Image, "://") {
+			allErrs = append(allErrs, field.Invalid(imagePath, engine.Spec.Image, "a container image cannot have a scheme"))
+		} else if _, _, err := oci.ParseReference(engine.Spec.Image); err != nil {
+			allErrs = append(allErrs, field.Invalid(imagePath, engine.Spec.Image, err.Error()))
+		} else if engine.Spec.ExtAuthz != nil && !strings.Contains(engine.Spec.Image, "envoy") {
+			warnings = append(warnings, fmt.Sprintf(
+				"the image %s does not look like an opa-envoy image, which is required by spec.extAuthz", engine.Spec.Image))
+		}
+	}
+
+	allErrs = append(allErrs, validateResources(engine.Spec.Resources, spec.Child("resources"))...)
+	resources := engine.Spec.Resources
+	memory, hasMemory := resources.Limits[corev1.ResourceMemory]
+	if !hasMemory {
+		warnings = append(warnings, fmt.Sprintf(
+			"spec.resources.limits.memory is not set, the policies are placed assuming %s of memory",
+			resourceBytes(scheduler.DefaultMemoryCapacity)))
+	}
+	if engine.Spec.Replicas > 1 && len(resources.Requests) == 0 {
+		warnings = append(warnings, fmt.Sprintf(
+			"each of the %d replicas loads every policy, set spec.resources.requests so that they are scheduled on nodes with room for them",
+			engine.Spec.Replicas))
+	}
+
+	if capacity := engine.Spec.Capacity; capacity != nil {
+		if capacity.MaxPolicies != nil && len(engine.Spec.Policies) > int(*capacity.MaxPolicies) {
+			warnings = append(warnings, fmt.Sprintf(
+				"spec.policies lists %d policies, more than the %d allowed by spec.capacity.maxPolicies",
+				len(engine.Spec.Policies), *capacity.MaxPolicies))
+		}
+		if hasMemory && capacity.MaxRegoBytes != nil {
+			estimated := scheduler.EstimateMemory(capacity.MaxRegoBytes.Value())
+			if capacity.MaxDataBytes != nil {
+				estimated += capacity.MaxDataBytes.Value()
+			}
+			if estimated > memory.Value() {
+				warnings = append(warnings, fmt.Sprintf(
+					"the policies allowed by spec.capacity may use about %s, more than the memory limit %s",
+					resourceBytes(estimated), memory.String()))
+			}
+		}
+	}
+
+	existing := map[string]int{}
+	if old != nil {
+		for _, name := range old.Spec.Policies {
+			existing[name]++
+		}
+	}
+	seen := map[string]int{}
+	for i, name := range engine.Spec.Policies {
+		seen[name]++
+		switch {
+		case seen[name] == 1:
+		case seen[name] <= existing[name]:
+			warnings = append(warnings, fmt.Sprintf("spec.policies[%d]: policy %s is listed more than once", i, name))
+		default:
+			allErrs = append(allErrs, field.Duplicate(spec.Child("policies").Index(i), name))
+		}
+	}
+
+	if len(allErrs) == 0 {
+		return warnings, nil
+	}
+	return warnings, apierrors.NewInvalid(opaspolimiitv1alpha1.GroupVersion.WithKind("OpaEngine").GroupKind(), engine.Name, allErrs)
+}
+
+// validateResources rejects the negative quantities and the requests above
+// their limits
+func validateResources(resources corev1.ResourceRequirements, path *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+	for name, quantity := range resources.Limits {
+		if quantity.Sign() < 0 {
+			allErrs = append(allErrs, field.Invalid(path.Child("limits").Key(string(name)), quantity.String(), "must be greater than or equal to 0"))
+		}
+	}
+	for name, quantity := range resources.Requests {
+		requestPath := path.Child("requests").Key(string(name))
+		if quantity.Sign() < 0 {
+			allErrs = append(allErrs, field.Invalid(requestPath, quantity.String(), "must be greater than or equal to 0"))
+		}
+		if limit, ok := resources.Limits[name]; ok && quantity.Cmp(limit) > 0 {
+			allErrs = append(allErrs, field.Invalid(requestPath, quantity.String(),
+				fmt.Sprintf("must be less than or equal to the %s limit %s", name, limit.String())))
+		}
+	}
+	return allErrs
+}
+
+// resourceBytes formats an amount of bytes as a binary quantity
+func resourceBytes(bytes int64) string {
+	return resource.NewQuantity(bytes, resource.BinarySI).String()
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+)
+
+var _ = Describe("OpaEngine Webhook", func() {
+	var (
+		engine    *opaspolimiitv1alpha1.OpaEngine
+		validator *OpaEngineCustomValidator
+	)
+
+	BeforeEach(func() {
+		engine = &opaspolimiitv1alpha1.OpaEngine{
+			ObjectMeta: metav1.ObjectMeta{Name: "engine", Namespace: "default"},
+			Spec: opaspolimiitv1alpha1.OpaEngineSpec{
+				Image:        "openpolicyagent/opa:latest-envoy",
+				Replicas:     1,
+				InstanceName: "engine",
+				Policies:     []string{"authz", "common"},
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("128Mi")},
+					Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("256Mi")},
+				},
+			},
+		}
+		validator = &OpaEngineCustomValidator{}
+	})
+
+	It("should admit a valid engine without warnings", func() {
+		warnings, err := validator.ValidateCreate(context.Background(), engine)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(warnings).To(BeEmpty())
+	})
+
+	It("should reject invalid images", func() {
+		engine.Spec.Image = "oci://ghcr.io/acme/opa:latest"
+		_, err := validator.ValidateCreate(context.Background(), engine)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+
+		engine.Spec.Image = "OpenPolicyAgent/opa"
+		_, err = validator.ValidateCreate(context.Background(), engine)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.image"))
+	})
+
+	It("should warn when the ext-authz mode runs without an opa-envoy image", func() {
+		engine.Spec.Image = "openpolicyagent/opa:latest"
+		engine.Spec.ExtAuthz = &opaspolimiitv1alpha1.ExtAuthzSpec{Port: 9191}
+		warnings, err := validator.ValidateCreate(context.Background(), engine)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(warnings).To(ConsistOf(ContainSubstring("opa-envoy")))
+	})
+
+	It("should reject requests above their limits", func() {
+		engine.Spec.Resources.Requests[corev1.ResourceMemory] = resource.MustParse("512Mi")
+		_, err := validator.ValidateCreate(context.Background(), engine)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.resources.requests[memory]"))
+	})
+
+	It("should warn about replicas and capacity not matching the resources", func() {
+		engine.Spec.Replicas = 3
+		engine.Spec.Resources = corev1.ResourceRequirements{}
+		warnings, err := validator.ValidateCreate(context.Background(), engine)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(warnings).To(ConsistOf(ContainSubstring("limits.memory"), ContainSubstring("3 replicas")))
+
+		engine.Spec.Resources.Limits = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("64Mi")}
+		engine.Spec.Resources.Requests = engine.Spec.Resources.Limits
+		maxRego := resource.MustParse("8Mi")
+		maxPolicies := int32(1)
+		engine.Spec.Capacity = &opaspolimiitv1alpha1.EngineCapacity{MaxRegoBytes: &maxRego, MaxPolicies: &maxPolicies}
+		warnings, err = validator.ValidateCreate(context.Background(), engine)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(warnings).To(ConsistOf(ContainSubstring("memory limit 64Mi"), ContainSubstring("maxPolicies")))
+	})
+
+	It("should reject duplicate policies", func() {
+		engine.Spec.Policies = []string{"authz", "common", "authz"}
+		_, err := validator.ValidateCreate(context.Background(), engine)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.policies[2]"))
+	})
+
+	It("should only reject the duplicate policies introduced by an update", func() {
+		old := engine.DeepCopy()
+		old.Spec.Policies = []string{"authz", "authz"}
+
+		By("Keeping the existing duplicates")
+		engine.Spec.Policies = []string{"authz", "authz", "common"}
+		warnings, err := validator.ValidateUpdate(context.Background(), old, engine)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(warnings).To(ConsistOf(ContainSubstring("policy authz is listed more than once")))
+
+		By("Adding a new duplicate")
+		engine.Spec.Policies = []string{"authz", "authz", "authz"}
+		_, err = validator.ValidateUpdate(context.Background(), old, engine)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.policies[2]"))
+	})
+})
@@ -0,0 +1,111 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+	"github.com/bramba2000/opa-scaler/internal/oci"
+	opamanager "github.com/bramba2000/opa-scaler/internal/opa"
+)
+
+// log is for logging in this package.
+var policylog = logf.Log.WithName("policy-resource")
+
+// SetupPolicyWebhookWithManager registers the webhook for Policy in the manager.
+func SetupPolicyWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).For(&opaspolimiitv1alpha1.Policy{}).
+		WithValidator(&PolicyCustomValidator{}).
+		Complete()
+}
+
+// +kubebuilder:webhook:path=/validate-opas-polimi-it-v1alpha1-policy,mutating=false,failurePolicy=fail,sideEffects=None,groups=opas.polimi.it,resources=policies,verbs=create;update,versions=v1alpha1,name=vpolicy-v1alpha1.opas.polimi.it,admissionReviewVersions=v1
+
+// PolicyCustomValidator rejects the Policies whose Rego code does not parse
+// or whose image is not a valid reference. The code is only parsed, as its
+// imports are resolved once the dependencies are loaded with it.
+type PolicyCustomValidator struct{}
+
+var _ webhook.CustomValidator = &PolicyCustomValidator{}
+
+// ValidateCreate implements webhook.CustomValidator so a webhook will be registered for the type Policy.
+func (v *PolicyCustomValidator) ValidateCreate(_ context.Context, obj runtime.Object) (admission.Warnings, error) {
+	policy, ok := obj.(*opaspolimiitv1alpha1.Policy)
+	if !ok {
+		return nil, fmt.Errorf("expected a Policy object but got %T", obj)
+	}
+	policylog.Info("Validation for Policy upon creation", "name", policy.GetName())
+	return nil, validatePolicy(policy)
+}
+
+// ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type Policy.
+func (v *PolicyCustomValidator) ValidateUpdate(_ context.Context, _, newObj runtime.Object) (admission.Warnings, error) {
+	policy, ok := newObj.(*opaspolimiitv1alpha1.Policy)
+	if !ok {
+		return nil, fmt.Errorf("expected a Policy object for the newObj but got %T", newObj)
+	}
+	policylog.Info("Validation for Policy upon update", "name", policy.GetName())
+	// A Policy being deleted is not validated, so that its finalizers can be removed
+	if !policy.DeletionTimestamp.IsZero() {
+		return nil, nil
+	}
+	return nil, validatePolicy(policy)
+}
+
+// ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type Policy.
+func (v *PolicyCustomValidator) ValidateDelete(_ context.Context, _ runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// validatePolicy checks the code and the image of the policy
+func validatePolicy(policy *opaspolimiitv1alpha1.Policy) error {
+	var allErrs field.ErrorList
+	if policy.Spec.Rego != "" {
+		_, regoErrors := opamanager.ParseModules(map[string]string{policy.Name: policy.Spec.Rego})
+		for _, e := range regoErrors {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "rego"), truncate(policy.Spec.Rego), e.String()))
+		}
+	}
+	if policy.Spec.Image != "" {
+		if _, _, err := oci.ParseReference(policy.Spec.Image); err != nil {
+			allErrs = append(allErrs, field.Invalid(field.NewPath("spec", "image"), policy.Spec.Image, err.Error()))
+		}
+	}
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(opaspolimiitv1alpha1.GroupVersion.WithKind("Policy").GroupKind(), policy.Name, allErrs)
+}
+
+// truncate shortens a value reported in an error
+func truncate(value string) string {
+	const maxValue = 64
+	if len(value) <= maxValue {
+		return value
+	}
+	return value[:maxValue] + "..."
+}
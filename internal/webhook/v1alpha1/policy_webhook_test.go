@@ -0,0 +1,80 @@
+/*
+Copyright 2025 Matteo Brambilla <matteo15.brambilla@polimi.it>.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	opaspolimiitv1alpha1 "github.com/bramba2000/opa-scaler/api/v1alpha1"
+)
+
+var _ = Describe("Policy Webhook", func() {
+	var (
+		policy    *opaspolimiitv1alpha1.Policy
+		validator *PolicyCustomValidator
+	)
+
+	BeforeEach(func() {
+		policy = &opaspolimiitv1alpha1.Policy{
+			ObjectMeta: metav1.ObjectMeta{Name: "authz", Namespace: "default"},
+			Spec: opaspolimiitv1alpha1.PolicySpec{
+				Rego: "package authz\n\nimport data.common\n\nallow if common.admin\n",
+			},
+		}
+		validator = &PolicyCustomValidator{}
+	})
+
+	It("should admit a policy whose code parses", func() {
+		warnings, err := validator.ValidateCreate(context.Background(), policy)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(warnings).To(BeEmpty())
+	})
+
+	It("should reject a policy whose code does not parse", func() {
+		policy.Spec.Rego = "package authz\n\nallow if {\n"
+		_, err := validator.ValidateCreate(context.Background(), policy)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.rego"))
+
+		By("Updating a valid policy with the invalid code")
+		old := policy.DeepCopy()
+		old.Spec.Rego = "package authz\n"
+		_, err = validator.ValidateUpdate(context.Background(), old, policy)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+	})
+
+	It("should reject an invalid image", func() {
+		policy.Spec.Rego = ""
+		policy.Spec.Image = "ghcr.io/acme/Policies:v1"
+		_, err := validator.ValidateCreate(context.Background(), policy)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		Expect(err.Error()).To(ContainSubstring("spec.image"))
+	})
+
+	It("should not validate a policy being deleted", func() {
+		policy.Spec.Rego = "package"
+		now := metav1.Now()
+		policy.DeletionTimestamp = &now
+		_, err := validator.ValidateUpdate(context.Background(), policy, policy)
+		Expect(err).NotTo(HaveOccurred())
+	})
+})